@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditGenesis is the previous hash of the first entry in a new audit log
+const auditGenesis = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// AuditEntry is one line of the oper audit log. Each entry carries the hash
+// of the entry before it, so editing or removing a line breaks the chain.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Oper    string    `json:"oper"`             // Oper block name
+	Class   string    `json:"class,omitempty"`  // Oper class at the time
+	Nick    string    `json:"nick"`             // Nick the action came from
+	Source  string    `json:"source"`           // user@host of the connection
+	Command string    `json:"command"`          // e.g. KILL, REHASH, OVERRIDE
+	Target  string    `json:"target,omitempty"` // Nick, mask, channel or server acted on
+	Outcome string    `json:"outcome"`          // ok, denied, failed or recovered
+	Detail  string    `json:"detail,omitempty"` // Reason, error or extra context
+	Prev    string    `json:"prev"`             // Hash of the previous entry
+	Hash    string    `json:"hash"`             // Hash of this entry, covering Prev
+}
+
+// computeHash hashes an entry's contents together with the previous hash
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditFilter selects entries for Search. Empty fields match everything.
+type AuditFilter struct {
+	Oper   string    // Oper name or wildcard
+	Target string    // Target wildcard
+	Since  time.Time // Only entries at or after this time
+	Limit  int       // Most recent entries to return; 0 for all
+}
+
+func (f AuditFilter) match(e *AuditEntry) bool {
+	if f.Oper != "" && !matchWildcard(strings.ToLower(f.Oper), strings.ToLower(e.Oper)) {
+		return false
+	}
+	if f.Target != "" && !matchWildcard(strings.ToLower(f.Target), strings.ToLower(e.Target)) {
+		return false
+	}
+	return f.Since.IsZero() || !e.Time.Before(f.Since)
+}
+
+// AuditLog is an append-only JSON lines file of oper actions. When the file
+// grows past MaxSize it is rotated to file.1, file.2 and so on; the hash
+// chain carries on across rotated files.
+type AuditLog struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	last       string // Hash of the newest entry
+	mu         sync.Mutex
+}
+
+// OpenAuditLog opens or creates an audit log and picks up its hash chain
+func OpenAuditLog(filename string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	al := &AuditLog{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		last:       auditGenesis,
+	}
+
+	// A crash in the middle of a write leaves part of a line at the end
+	torn, err := trimTornTail(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// The chain continues from the newest entry in the newest file that has one
+	for _, name := range al.files() {
+		entries, err := readAuditFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			al.last = entries[len(entries)-1].Hash
+		}
+	}
+
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	if torn > 0 {
+		entry := AuditEntry{
+			Time:    time.Now().UTC(),
+			Command: "AUDIT",
+			Outcome: "recovered",
+			Detail:  fmt.Sprintf("Discarded %d bytes of an incomplete entry at the end of the log", torn),
+		}
+		if err := al.Append(entry); err != nil {
+			al.Close()
+			return nil, err
+		}
+		log.Printf("Audit: discarded %d bytes of an incomplete entry at the end of %s", torn, filename)
+	}
+	return al, nil
+}
+
+// trimTornTail cuts an unterminated last line off an audit log file and
+// returns how many bytes were removed. Every complete entry ends in a
+// newline, so anything after the last one is a write that never finished.
+func trimTornTail(name string) (int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	keep := int64(bytes.LastIndexByte(data, '\n') + 1)
+	torn := int64(len(data)) - keep
+	if torn == 0 {
+		return 0, nil
+	}
+	if err := os.Truncate(name, keep); err != nil {
+		return 0, fmt.Errorf("failed to repair audit log: %v", err)
+	}
+	return torn, nil
+}
+
+// files returns the log's files, oldest first
+func (al *AuditLog) files() []string {
+	var files []string
+	for i := al.maxBackups; i >= 1; i-- {
+		name := fmt.Sprintf("%s.%d", al.filename, i)
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		}
+	}
+	if _, err := os.Stat(al.filename); err == nil {
+		files = append(files, al.filename)
+	}
+	return files
+}
+
+func (al *AuditLog) open() error {
+	if dir := filepath.Dir(al.filename); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create audit log directory: %v", err)
+		}
+	}
+	file, err := os.OpenFile(al.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	al.file = file
+	al.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file to file.1, shifting older files up and
+// dropping the oldest; the caller must hold al.mu
+func (al *AuditLog) rotate() error {
+	al.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", al.filename, al.maxBackups))
+	for i := al.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.filename, i), fmt.Sprintf("%s.%d", al.filename, i+1))
+	}
+	if al.maxBackups > 0 {
+		if err := os.Rename(al.filename, al.filename+".1"); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	} else {
+		os.Remove(al.filename)
+	}
+	return al.open()
+}
+
+// Append chains an entry to the log and writes it
+func (al *AuditLog) Append(entry AuditEntry) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	entry.Prev = al.last
+	entry.Hash = entry.computeHash()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %v", err)
+	}
+	data = append(data, '\n')
+
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(len(data)) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := al.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	al.size += int64(len(data))
+	al.last = entry.Hash
+	return nil
+}
+
+// Search returns matching entries, oldest first
+func (al *AuditLog) Search(filter AuditFilter) ([]AuditEntry, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	var matches []AuditEntry
+	for _, name := range al.files() {
+		entries, err := readAuditFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			if filter.match(&entries[i]) {
+				matches = append(matches, entries[i])
+			}
+		}
+	}
+	if filter.Limit > 0 && len(matches) > filter.Limit {
+		matches = matches[len(matches)-filter.Limit:]
+	}
+	return matches, nil
+}
+
+// Verify walks the hash chain through every file and returns the number of
+// entries checked, or an error naming the first entry that does not fit.
+// The oldest kept entry is trusted as the start of the chain, since older
+// files may have been rotated away.
+func (al *AuditLog) Verify() (int, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	checked := 0
+	prev := ""
+	for _, name := range al.files() {
+		entries, err := readAuditFile(name)
+		if err != nil {
+			return checked, err
+		}
+		for i, entry := range entries {
+			if prev != "" && entry.Prev != prev {
+				return checked, fmt.Errorf("%s line %d does not follow the previous entry", name, i+1)
+			}
+			if entry.computeHash() != entry.Hash {
+				return checked, fmt.Errorf("%s line %d has been modified", name, i+1)
+			}
+			prev = entry.Hash
+			checked++
+		}
+	}
+	if prev != "" && prev != al.last {
+		return checked, fmt.Errorf("the newest entries are missing")
+	}
+	return checked, nil
+}
+
+// Close closes the log file
+func (al *AuditLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.file.Close()
+}
+
+// readAuditFile reads every entry in one audit log file
+func readAuditFile(name string) ([]AuditEntry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", name, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	return entries, nil
+}
+
+// audit records an action by an oper when settings.log_oper_actions is on
+func (c *Client) audit(command, target, outcome, detail string) {
+	s := c.server
+	if s == nil || s.audit == nil || !s.OperConfig().Settings.LogOperActions {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:    time.Now().UTC(),
+		Oper:    c.OperName(),
+		Class:   c.OperClass(),
+		Nick:    c.Nick(),
+		Source:  c.User() + "@" + c.Host(),
+		Command: command,
+		Target:  target,
+		Outcome: outcome,
+		Detail:  detail,
+	}
+	if err := s.audit.Append(entry); err != nil {
+		log.Printf("Audit: %v", err)
+	}
+}
+
+// handleAudit handles AUDIT [VERIFY | oper <name> | target <mask> | since <duration> | limit <n> ...]
+func (c *Client) handleAudit(msg *Message) {
+	serverName := c.server.config.Server.Name
+	notice := func(format string, args ...interface{}) {
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** %s", serverName, c.Nick(), fmt.Sprintf(format, args...)))
+	}
+
+	if c.server.audit == nil {
+		notice("The audit log is not available")
+		return
+	}
+
+	if len(msg.Params) == 1 && strings.EqualFold(msg.Params[0], "VERIFY") {
+		checked, err := c.server.audit.Verify()
+		if err != nil {
+			notice("Audit log verification FAILED after %d entries: %v", checked, err)
+			c.sendSnomask('o', fmt.Sprintf("Audit log verification by %s failed: %v", c.Nick(), err))
+		} else {
+			notice("Audit log verified: %d entries, hash chain intact", checked)
+		}
+		c.audit("AUDIT", "", "ok", "verify")
+		return
+	}
+
+	usage := "Usage: AUDIT VERIFY | AUDIT [oper <name>] [target <mask>] [since <duration>] [limit <n>]"
+	if len(msg.Params)%2 == 1 {
+		notice(usage)
+		return
+	}
+
+	filter := AuditFilter{Limit: 20}
+	for i := 0; i < len(msg.Params); i += 2 {
+		value := msg.Params[i+1]
+		switch strings.ToLower(msg.Params[i]) {
+		case "oper":
+			filter.Oper = value
+		case "target":
+			filter.Target = value
+		case "since":
+			duration, ok := parseBanDuration(value)
+			if !ok || duration == 0 {
+				notice("Invalid duration %s (use e.g. 30m, 2h or 1d)", value)
+				return
+			}
+			filter.Since = time.Now().Add(-duration)
+		case "limit":
+			var limit int
+			if _, err := fmt.Sscanf(value, "%d", &limit); err != nil || limit < 1 || limit > 500 {
+				notice("Invalid limit %s (1-500)", value)
+				return
+			}
+			filter.Limit = limit
+		default:
+			notice(usage)
+			return
+		}
+	}
+
+	entries, err := c.server.audit.Search(filter)
+	if err != nil {
+		notice("Audit search failed: %v", err)
+		return
+	}
+	for _, e := range entries {
+		who := "-"
+		if e.Oper != "" {
+			who = fmt.Sprintf("%s (%s)", e.Oper, e.Class)
+		}
+		line := fmt.Sprintf("%s %s as %s [%s] %s", e.Time.Format(time.RFC3339), who, e.Nick, e.Source, e.Command)
+		if e.Target != "" {
+			line += " " + e.Target
+		}
+		line += ": " + e.Outcome
+		if e.Detail != "" {
+			line += " (" + e.Detail + ")"
+		}
+		notice("%s", line)
+	}
+	notice("End of audit log (%d entries)", len(entries))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogChainAndRotation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	al, err := OpenAuditLog(filename, 600, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC()
+	for i, target := range []string{"bob", "carol", "dave", "bob", "erin"} {
+		entry := AuditEntry{Time: start.Add(time.Duration(i) * time.Minute), Oper: "admin", Command: "KILL", Target: target, Outcome: "ok"}
+		if err := al.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filename + ".1"); err != nil {
+		t.Fatal("audit log was not rotated")
+	}
+	if checked, err := al.Verify(); err != nil || checked == 0 {
+		t.Fatalf("intact log failed verification after %d entries: %v", checked, err)
+	}
+
+	entries, err := al.Search(AuditFilter{Target: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[len(entries)-1].Target != "bob" {
+		t.Errorf("search by target returned %v", entries)
+	}
+	recent, _ := al.Search(AuditFilter{Since: start.Add(4 * time.Minute)})
+	if len(recent) != 1 || recent[0].Target != "erin" {
+		t.Errorf("search by time returned %v", recent)
+	}
+	al.Close()
+
+	// Reopening continues the chain
+	al, err = OpenAuditLog(filename, 600, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	if err := al.Append(AuditEntry{Time: time.Now().UTC(), Oper: "admin", Command: "REHASH", Outcome: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := al.Verify(); err != nil {
+		t.Fatalf("chain broken across reopen: %v", err)
+	}
+
+	// Editing an entry is detected
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(strings.Replace(string(data), `"outcome":"ok"`, `"outcome":"denied"`, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := al.Verify(); err == nil {
+		t.Error("tampered entry passed verification")
+	}
+}
+
+func TestAuditLogTornTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	al, err := OpenAuditLog(filename, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"bob", "carol"} {
+		al.Append(AuditEntry{Time: time.Now().UTC(), Oper: "admin", Command: "KILL", Target: target, Outcome: "ok"})
+	}
+	al.Close()
+
+	// A write cut short by a crash
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"time":"2024-01-01T00:00:00Z","oper":"adm`)
+	file.Close()
+
+	al, err = OpenAuditLog(filename, 0, 0)
+	if err != nil {
+		t.Fatalf("torn last line: %v", err)
+	}
+	defer al.Close()
+	entries, err := al.Search(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Target != "carol" || entries[2].Outcome != "recovered" || !strings.Contains(entries[2].Detail, "42 bytes") {
+		t.Errorf("entries after recovery: %+v", entries)
+	}
+	if checked, err := al.Verify(); err != nil || checked != 3 {
+		t.Errorf("chain after recovery: %d entries, %v", checked, err)
+	}
+
+	// Damage before the last line is not repaired
+	data, _ := os.ReadFile(filename)
+	os.WriteFile(filename, append([]byte("garbage\n"), data...), 0600)
+	if _, err := OpenAuditLog(filename, 0, 0); err == nil {
+		t.Error("corrupt audit log opened")
+	}
+}
+
+func TestServerRefusesToRunUnaudited(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.Bans.DatabaseFile = filepath.Join(dir, "bans.json")
+	config.Audit.File = filepath.Join(dir, "audit.log")
+	config.History.DatabaseFile = filepath.Join(dir, "history.db")
+	config.Services.DatabaseFile = filepath.Join(dir, "services.json")
+	if err := os.WriteFile(config.Audit.File, []byte("garbage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewServer(config); err == nil {
+		t.Fatal("server started without its audit log")
+	}
+
+	// Without auditing the log is not needed
+	config.OperConfig.Enable = true
+	config.OperConfig.ConfigFile = filepath.Join(dir, "opers.conf")
+	operConfig := DefaultOperConfig()
+	operConfig.Settings.LogOperActions = false
+	if err := SaveOperConfig(operConfig, config.OperConfig.ConfigFile); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer with auditing off: %v", err)
+	}
+	if s.audit != nil {
+		t.Error("corrupt audit log was opened")
+	}
+}
+
+func TestAuditMaxBackupsConfig(t *testing.T) {
+	dir := t.TempDir()
+	load := func(audit string) (*Config, error) {
+		// The default config with its audit section replaced
+		var sections map[string]json.RawMessage
+		data, _ := json.Marshal(DefaultConfig())
+		json.Unmarshal(data, &sections)
+		sections["audit"] = json.RawMessage(`{` + audit + `}`)
+		data, _ = json.Marshal(sections)
+
+		filename := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config, config.Validate()
+	}
+
+	for _, test := range []struct {
+		audit string
+		want  int
+	}{
+		{`"file": "audit.log"`, 5},
+		{`"max_backups": 0`, 0},
+		{`"max_backups": 2`, 2},
+	} {
+		config, err := load(test.audit)
+		if err != nil {
+			t.Errorf("%s: %v", test.audit, err)
+		} else if got := config.AuditMaxBackups(); got != test.want {
+			t.Errorf("%s: AuditMaxBackups() = %d, want %d", test.audit, got, test.want)
+		}
+	}
+	if _, err := load(`"max_backups": -1`); err == nil {
+		t.Error("negative max_backups was accepted")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// withTag returns a copy of a message with one more tag; the original is
+// left alone since it is usually being sent to many clients
+func withTag(msg *Message, name, value string) *Message {
+	tagged := *msg
+	tagged.Tags = make(map[string]string, len(msg.Tags)+1)
+	for k, v := range msg.Tags {
+		tagged.Tags[k] = v
+	}
+	tagged.Tags[name] = value
+	return &tagged
+}
+
+// inBatch returns a message tagged as part of a batch; with no batch
+// reference the message is sent on its own
+func inBatch(msg *Message, ref string) *Message {
+	if ref == "" {
+		return msg
+	}
+	return withTag(msg, "batch", ref)
+}
+
+// startBatch opens a batch for the client and returns its reference, or ""
+// if the client did not negotiate batch and should get the lines unbatched
+func (c *Client) startBatch(batchType string, params ...string) string {
+	if !c.HasCapability("batch") {
+		return ""
+	}
+	ref := newMsgID()
+	c.Send(NewMessage(c.server.config.Server.Name, "BATCH", append([]string{"+" + ref, batchType}, params...)...))
+	return ref
+}
+
+// endBatch closes a batch opened with startBatch
+func (c *Client) endBatch(ref string) {
+	if ref == "" {
+		return
+	}
+	c.Send(NewMessage(c.server.config.Server.Name, "BATCH", "-"+ref))
+}
+
+// batchGroup is one event, such as a netsplit, delivered to many clients.
+// Each client's batch is opened with its first line and all are closed by
+// end. A nil group sends lines unbatched.
+type batchGroup struct {
+	batchType string
+	params    []string
+	refs      map[*Client]string
+	mu        sync.Mutex
+}
+
+func newBatchGroup(batchType string, params ...string) *batchGroup {
+	return &batchGroup{
+		batchType: batchType,
+		params:    params,
+		refs:      make(map[*Client]string),
+	}
+}
+
+// send delivers a line to a client inside the group's batch
+func (g *batchGroup) send(c *Client, msg *Message) {
+	if g == nil || c.IsRemote() {
+		c.Send(msg)
+		return
+	}
+
+	g.mu.Lock()
+	ref, open := g.refs[c]
+	if !open {
+		ref = c.startBatch(g.batchType, g.params...)
+		g.refs[c] = ref
+	}
+	g.mu.Unlock()
+	c.Send(inBatch(msg, ref))
+}
+
+// end closes the batch of every client that got a line
+func (g *batchGroup) end() {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	refs := g.refs
+	g.refs = make(map[*Client]string)
+	g.mu.Unlock()
+
+	for c, ref := range refs {
+		c.endBatch(ref)
+	}
+}
+
+// goroutineID returns the ID of the calling goroutine, read from the header
+// of its stack trace ("goroutine 42 [running]:")
+func goroutineID() uint64 {
+	var buf [64]byte
+	fields := bytes.Fields(buf[:runtime.Stack(buf[:], false)])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+// startLabel starts holding back the replies to a command sent with a
+// label, so they can be sent together once the command finishes. Only lines
+// sent by the calling goroutine, which runs the command, are replies.
+func (c *Client) startLabel(label string) {
+	id := goroutineID()
+
+	c.labelMu.Lock()
+	defer c.labelMu.Unlock()
+	c.label = label
+	c.labeling = true
+	c.labelOwner = id
+	c.labelReplies = nil
+	c.labelBytes = 0
+}
+
+// holdReply keeps a reply back while a labeled command runs and returns
+// whether it did. Lines from other goroutines, such as messages from other
+// clients, are not replies and go out at once. Held replies count against
+// the SendQ: past it they are released to the queue, which disconnects the
+// client as it would for any other flood of output.
+func (c *Client) holdReply(msg *Message) bool {
+	c.labelMu.Lock()
+	if !c.labeling || goroutineID() != c.labelOwner {
+		c.labelMu.Unlock()
+		return false
+	}
+
+	c.labelBytes += len(msg.Line()) + 2
+	if c.sendq == nil || c.labelBytes <= c.sendq.Limit() {
+		c.labelReplies = append(c.labelReplies, msg)
+		c.labelMu.Unlock()
+		return true
+	}
+	held := c.labelReplies
+	c.label, c.labeling, c.labelReplies, c.labelBytes = "", false, nil, 0
+	c.labelMu.Unlock()
+
+	for _, reply := range held {
+		c.writeLine(reply.Line())
+	}
+	return false
+}
+
+// endLabel sends the replies to a labeled command: an ACK if there were
+// none, the one reply with the label, or all of them in a labeled-response
+// batch.
+func (c *Client) endLabel() {
+	c.labelMu.Lock()
+	if !c.labeling {
+		c.labelMu.Unlock()
+		return
+	}
+	label, replies := c.label, c.labelReplies
+	c.label, c.labeling, c.labelReplies, c.labelBytes = "", false, nil, 0
+	c.labelMu.Unlock()
+
+	serverName := c.server.config.Server.Name
+	switch {
+	case len(replies) == 0:
+		c.Send(withTag(NewMessage(serverName, "ACK"), "label", label))
+	case len(replies) == 1:
+		c.Send(withTag(replies[0], "label", label))
+	case !c.HasCapability("batch"):
+		for _, reply := range replies {
+			c.Send(reply)
+		}
+	default:
+		ref := newMsgID()
+		c.Send(withTag(NewMessage(serverName, "BATCH", "+"+ref, "labeled-response"), "label", label))
+		for _, reply := range replies {
+			// Lines of a nested batch stay in it; its BATCH lines join ours
+			if _, nested := reply.Tag("batch"); !nested {
+				reply = withTag(reply, "batch", ref)
+			}
+			c.Send(reply)
+		}
+		c.Send(NewMessage(serverName, "BATCH", "-"+ref))
+	}
+}
+
+// echo sends a client its own PRIVMSG, NOTICE or TAGMSG back, with the
+// server's msgid and time, if it negotiated echo-message
+func (c *Client) echo(msg *Message) {
+	if c.HasCapability("echo-message") {
+		c.Send(msg)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// labelClient returns a client with the given capabilities whose output can
+// be read from the returned reader
+func labelClient(t *testing.T, caps ...string) (*Client, *bufio.Reader) {
+	server, conn := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+
+	s := &Server{config: &Config{}}
+	s.config.Server.Name = "irc.test"
+	c := &Client{server: s, capabilities: make(map[string]bool), sendq: newSendQueue(server, 65536)}
+	for _, name := range caps {
+		c.capabilities[name] = true
+	}
+	return c, bufio.NewReader(conn)
+}
+
+func readLines(t *testing.T, r *bufio.Reader, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading line %d: %v", i+1, err)
+		}
+		lines[i] = strings.TrimRight(line, "\r\n")
+	}
+	return lines
+}
+
+func TestLabeledResponse(t *testing.T) {
+	c, r := labelClient(t, "labeled-response", "batch")
+
+	c.startLabel("a1")
+	c.endLabel()
+	if got := readLines(t, r, 1)[0]; got != "@label=a1 :irc.test ACK" {
+		t.Errorf("no replies: got %q", got)
+	}
+
+	c.startLabel("a2")
+	c.SendMessage(":irc.test PONG irc.test :x")
+	c.endLabel()
+	if got := readLines(t, r, 1)[0]; got != "@label=a2 :irc.test PONG irc.test :x" {
+		t.Errorf("one reply: got %q", got)
+	}
+
+	c.startLabel("a3")
+	c.SendMessage(":irc.test NOTICE me :one")
+	c.SendMessage(":irc.test NOTICE me :two")
+	c.endLabel()
+	lines := readLines(t, r, 4)
+	ref := strings.TrimPrefix(strings.Fields(lines[0])[3], "+")
+	want := []string{
+		"@label=a3 :irc.test BATCH +" + ref + " labeled-response",
+		"@batch=" + ref + " :irc.test NOTICE me :one",
+		"@batch=" + ref + " :irc.test NOTICE me :two",
+		":irc.test BATCH -" + ref,
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("batched reply line %d: got %q, want %q", i+1, lines[i], want[i])
+		}
+	}
+}
+
+func TestBatchGroup(t *testing.T) {
+	withBatch, r1 := labelClient(t, "batch")
+	without, r2 := labelClient(t)
+
+	g := newBatchGroup("netsplit", "hub.test", "leaf.test")
+	quit := NewMessage("bob!b@h", "QUIT", "hub.test leaf.test")
+	g.send(withBatch, quit)
+	g.send(without, quit)
+	g.end()
+
+	lines := readLines(t, r1, 3)
+	ref := strings.TrimPrefix(strings.Fields(lines[0])[2], "+")
+	if lines[0] != ":irc.test BATCH +"+ref+" netsplit hub.test leaf.test" ||
+		lines[1] != "@batch="+ref+" :bob!b@h QUIT :hub.test leaf.test" ||
+		lines[2] != ":irc.test BATCH -"+ref {
+		t.Errorf("batch client got %q", lines)
+	}
+	if got := readLines(t, r2, 1)[0]; got != ":bob!b@h QUIT :hub.test leaf.test" {
+		t.Errorf("client without batch got %q", got)
+	}
+}
+
+func TestLabelHoldsOnlyOwnReplies(t *testing.T) {
+	c, r := labelClient(t, "labeled-response", "batch")
+
+	c.startLabel("b1")
+	c.SendMessage(":irc.test NOTICE me :reply")
+
+	// A message from another client arrives while the command runs
+	done := make(chan bool)
+	go func() {
+		c.SendMessage(":bob!b@h PRIVMSG me :hello")
+		done <- true
+	}()
+	if got := readLines(t, r, 1)[0]; got != ":bob!b@h PRIVMSG me :hello" {
+		t.Errorf("other traffic: got %q", got)
+	}
+	<-done
+
+	c.endLabel()
+	if got := readLines(t, r, 1)[0]; got != "@label=b1 :irc.test NOTICE me :reply" {
+		t.Errorf("reply: got %q", got)
+	}
+}
+
+func TestLabelRepliesCountAgainstSendQ(t *testing.T) {
+	c, r := labelClient(t, "labeled-response", "batch")
+	c.class = &ConnectionClass{Name: "default", SendQ: 1024}
+	c.sendq.SetLimit(1024)
+
+	c.startLabel("c1")
+	line := ":irc.test NOTICE me :" + strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		c.SendMessage(line)
+	}
+	c.endLabel()
+
+	if reason := c.QuitReason(); reason != "Max SendQ exceeded" {
+		t.Errorf("quit reason = %q", reason)
+	}
+	if c.labeling || len(c.labelReplies) != 0 {
+		t.Errorf("%d replies still held", len(c.labelReplies))
+	}
+
+	// The queue was discarded and the connection closed
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Errorf("read %q after the overflow", line)
+	}
+}
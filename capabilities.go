@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IRCv3 capability negotiation numerics
+const (
+	ERR_INVALIDCAPCMD = 410
+)
+
+// maxCapLineLength is the budget for the capability list on a single CAP reply line
+const maxCapLineLength = 400
+
+// Capability describes an IRCv3 capability advertised by the server
+type Capability struct {
+	Name  string
+	Value string // Optional value shown to CAP LS 302 clients (e.g. "PLAIN,EXTERNAL")
+}
+
+// Token returns the capability as it appears in CAP LS for the given version
+func (cp *Capability) Token(version int) string {
+	if version >= 302 && cp.Value != "" {
+		return cp.Name + "=" + cp.Value
+	}
+	return cp.Name
+}
+
+// CapabilityRegistry holds every capability the server currently offers
+type CapabilityRegistry struct {
+	caps map[string]*Capability
+	mu   sync.RWMutex
+}
+
+func NewCapabilityRegistry() *CapabilityRegistry {
+	return &CapabilityRegistry{
+		caps: make(map[string]*Capability),
+	}
+}
+
+// Get returns the named capability, or nil if it is not offered
+func (r *CapabilityRegistry) Get(name string) *Capability {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.caps[name]
+}
+
+// List returns all offered capabilities sorted by name
+func (r *CapabilityRegistry) List() []*Capability {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	caps := make([]*Capability, 0, len(r.caps))
+	for _, cp := range r.caps {
+		caps = append(caps, cp)
+	}
+	sort.Slice(caps, func(i, j int) bool { return caps[i].Name < caps[j].Name })
+	return caps
+}
+
+// RegisterCapability offers a capability to clients. Features call this for the
+// capability they gate; clients that negotiated cap-notify are told about it.
+func (s *Server) RegisterCapability(name, value string) {
+	s.capabilities.mu.Lock()
+	existing, exists := s.capabilities.caps[name]
+	if exists && existing.Value == value {
+		s.capabilities.mu.Unlock()
+		return
+	}
+	cp := &Capability{Name: name, Value: value}
+	s.capabilities.caps[name] = cp
+	s.capabilities.mu.Unlock()
+
+	for _, client := range s.GetClients() {
+		if !client.HasCapability("cap-notify") {
+			continue
+		}
+		// A changed value is announced as DEL + NEW so clients re-evaluate it
+		if exists && client.HasCapability(name) {
+			client.SetCapability(name, false)
+			client.sendCap("DEL", name)
+		}
+		client.sendCap("NEW", cp.Token(client.CapVersion()))
+	}
+}
+
+// UnregisterCapability withdraws a capability and disables it on every client
+func (s *Server) UnregisterCapability(name string) {
+	s.capabilities.mu.Lock()
+	if _, exists := s.capabilities.caps[name]; !exists {
+		s.capabilities.mu.Unlock()
+		return
+	}
+	delete(s.capabilities.caps, name)
+	s.capabilities.mu.Unlock()
+
+	for _, client := range s.GetClients() {
+		client.SetCapability(name, false)
+		if client.HasCapability("cap-notify") {
+			client.sendCap("DEL", name)
+		}
+	}
+}
+
+// CapVersion returns the CAP LS version the client negotiated (0 if none)
+func (c *Client) CapVersion() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capVersion
+}
+
+// IsCapNegotiating returns true while registration is suspended by CAP
+func (c *Client) IsCapNegotiating() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capNegotiating
+}
+
+func (c *Client) setCapNegotiating(negotiating bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capNegotiating = negotiating
+}
+
+// EnabledCapabilities returns the names of all capabilities enabled on the client
+func (c *Client) EnabledCapabilities() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	caps := make([]string, 0, len(c.capabilities))
+	for name := range c.capabilities {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// sendCap sends a CAP reply to the client
+func (c *Client) sendCap(subcommand, params string) {
+	c.SendFrom(c.server.config.Server.Name, fmt.Sprintf("CAP %s %s :%s", c.displayNick(), subcommand, params))
+}
+
+// sendCapList sends a (possibly multi-line) CAP LS or LIST reply
+func (c *Client) sendCapList(subcommand string, tokens []string) {
+	multiline := c.CapVersion() >= 302
+
+	var line []string
+	length := 0
+	for _, token := range tokens {
+		if multiline && length > 0 && length+len(token)+1 > maxCapLineLength {
+			c.SendFrom(c.server.config.Server.Name, fmt.Sprintf("CAP %s %s * :%s",
+				c.displayNick(), subcommand, strings.Join(line, " ")))
+			line = nil
+			length = 0
+		}
+		line = append(line, token)
+		length += len(token) + 1
+	}
+	c.sendCap(subcommand, strings.Join(line, " "))
+}
+
+// handleCap handles CAP command (IRCv3 capability negotiation)
+func (c *Client) handleCap(msg *Message) {
+	subcommand := strings.ToUpper(msg.Params[0])
+	args := msg.Param(1)
+
+	switch subcommand {
+	case "LS":
+		if !c.IsRegistered() {
+			c.setCapNegotiating(true)
+		}
+
+		version := 301
+		if args != "" {
+			if v, err := strconv.Atoi(args); err == nil && v > version {
+				version = v
+			}
+		}
+		c.mu.Lock()
+		if version > c.capVersion {
+			c.capVersion = version
+		}
+		c.mu.Unlock()
+
+		// cap-notify is implicitly enabled for CAP 302 clients
+		if version >= 302 && c.server.capabilities.Get("cap-notify") != nil {
+			c.SetCapability("cap-notify", true)
+		}
+
+		var tokens []string
+		for _, cp := range c.server.capabilities.List() {
+			tokens = append(tokens, cp.Token(version))
+		}
+		c.sendCapList("LS", tokens)
+
+	case "LIST":
+		c.sendCapList("LIST", c.EnabledCapabilities())
+
+	case "REQ":
+		if !c.IsRegistered() {
+			c.setCapNegotiating(true)
+		}
+
+		requested := strings.Fields(args)
+		if len(requested) == 0 {
+			c.sendCap("NAK", args)
+			return
+		}
+
+		// A request is applied atomically: any unknown capability rejects it all
+		for _, req := range requested {
+			name := strings.TrimPrefix(req, "-")
+			if c.server.capabilities.Get(name) == nil {
+				c.sendCap("NAK", args)
+				return
+			}
+			if name == "cap-notify" && strings.HasPrefix(req, "-") && c.CapVersion() >= 302 {
+				c.sendCap("NAK", args)
+				return
+			}
+		}
+
+		for _, req := range requested {
+			if strings.HasPrefix(req, "-") {
+				c.SetCapability(req[1:], false)
+			} else {
+				c.SetCapability(req, true)
+			}
+		}
+		c.sendCap("ACK", args)
+
+	case "END":
+		if !c.IsRegistered() && c.IsCapNegotiating() {
+			c.setCapNegotiating(false)
+			c.checkRegistration()
+		}
+
+	default:
+		c.SendNumeric(ERR_INVALIDCAPCMD, subcommand+" :Invalid CAP command")
+	}
+}
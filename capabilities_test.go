@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCapLS302(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterCapability("sasl", "PLAIN,EXTERNAL")
+	for i := 0; i < 20; i++ {
+		s.RegisterCapability(fmt.Sprintf("example.org/cap-%02d", i), strings.Repeat("v", 20))
+	}
+
+	tc := dialTest(t, s)
+	tc.send("CAP LS 302")
+	lines := tc.readUntil(" LS :")
+	for _, line := range lines[:len(lines)-1] {
+		if !strings.Contains(line, "CAP * LS * :") {
+			t.Errorf("continuation line without '*': %q", line)
+		}
+	}
+	if len(lines) < 2 {
+		t.Errorf("expected a multiline reply, got %q", lines)
+	}
+
+	all := strings.Join(lines, " ")
+	if !strings.Contains(all, "sasl=PLAIN,EXTERNAL") {
+		t.Errorf("302 reply lacks capability values: %q", all)
+	}
+	for _, line := range lines {
+		if i := strings.Index(line, " :"); len(line[i+2:]) > maxCapLineLength {
+			t.Errorf("capability list of %d bytes on one line", len(line[i+2:]))
+		}
+	}
+
+	tc.send("CAP LIST")
+	if line := tc.expect(" LIST "); !strings.Contains(line, "cap-notify") {
+		t.Errorf("cap-notify is not implied by CAP LS 302: %q", line)
+	}
+}
+
+func TestCapLSWithoutVersion(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterCapability("sasl", "PLAIN")
+
+	tc := dialTest(t, s)
+	tc.send("CAP LS")
+	line := tc.expect(" LS ")
+	if strings.Contains(line, "sasl=") || !strings.Contains(line, "sasl") {
+		t.Errorf("CAP LS without 302 should list names only: %q", line)
+	}
+}
+
+func TestCapReq(t *testing.T) {
+	s := newTestServer(t)
+	tc := dialTest(t, s)
+	tc.send("CAP LS 302")
+	tc.expect(" LS ")
+
+	tc.send("CAP REQ :server-time echo-message")
+	if line := tc.expect("CAP"); !strings.HasSuffix(line, "ACK :server-time echo-message") {
+		t.Errorf("REQ: got %q", line)
+	}
+
+	// Any unknown capability rejects the whole request
+	tc.send("CAP REQ :batch no-such-cap")
+	if line := tc.expect("CAP"); !strings.HasSuffix(line, "NAK :batch no-such-cap") {
+		t.Errorf("invalid REQ: got %q", line)
+	}
+
+	tc.send("CAP REQ :-echo-message")
+	if line := tc.expect("CAP"); !strings.HasSuffix(line, "ACK :-echo-message") {
+		t.Errorf("-cap REQ: got %q", line)
+	}
+
+	// cap-notify cannot be disabled by a 302 client
+	tc.send("CAP REQ :-cap-notify")
+	if line := tc.expect("CAP"); !strings.Contains(line, "NAK") {
+		t.Errorf("-cap-notify REQ: got %q", line)
+	}
+
+	tc.send("CAP LIST")
+	line := tc.expect(" LIST ")
+	if !strings.Contains(line, "server-time") || strings.Contains(line, "echo-message") || strings.Contains(line, "batch") {
+		t.Errorf("enabled capabilities: %q", line)
+	}
+}
+
+func TestCapSuspendsRegistration(t *testing.T) {
+	s := newTestServer(t)
+	tc := dialTest(t, s)
+	tc.send("CAP LS 302", "NICK capper", "USER capper 0 * :Capper")
+	if welcome := containing(tc.sync(), " 001 "); len(welcome) != 0 {
+		t.Fatalf("registered before CAP END: %q", welcome)
+	}
+
+	tc.send("CAP END")
+	tc.expect(" 001 capper ")
+}
+
+func TestCapNotify(t *testing.T) {
+	s := newTestServer(t)
+	notified := registerTest(t, s, "notified")
+	notified.send("CAP REQ :cap-notify")
+	notified.expect("ACK")
+	plain := registerTest(t, s, "plain")
+
+	s.RegisterCapability("example.org/new", "v1")
+	if line := notified.expect(" NEW "); !strings.HasSuffix(line, "NEW :example.org/new") {
+		t.Errorf("NEW: got %q", line)
+	}
+
+	notified.send("CAP REQ :example.org/new")
+	notified.expect("ACK")
+
+	// A changed value is sent as DEL and NEW, disabling the capability
+	s.RegisterCapability("example.org/new", "v2")
+	notified.expect(" DEL :example.org/new")
+	notified.expect(" NEW :example.org/new")
+
+	notified.send("CAP REQ :example.org/new")
+	notified.expect("ACK")
+	s.UnregisterCapability("example.org/new")
+	notified.expect(" DEL :example.org/new")
+	notified.send("CAP LIST")
+	if line := notified.expect(" LIST "); strings.Contains(line, "example.org/new") {
+		t.Errorf("withdrawn capability still enabled: %q", line)
+	}
+
+	if lines := containing(plain.sync(), "CAP"); len(lines) != 0 {
+		t.Errorf("client without cap-notify was notified: %q", lines)
+	}
+}
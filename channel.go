@@ -8,16 +8,65 @@ import (
 	"time"
 )
 
+// statusModes are the channel status modes, highest first, with their NAMES prefixes
+var statusModes = []struct {
+	mode   rune
+	prefix string
+}{{'q', "~"}, {'o', "@"}, {'h', "%"}, {'v', "+"}}
+
+// Membership is a client's presence in a channel. It is keyed by the client
+// itself, so it follows the client across nick changes.
+type Membership struct {
+	Client    *Client
+	Modes     map[rune]bool // Status modes held: q, o, h and v
+	Joined    time.Time
+	LastSpoke time.Time
+	Ghost     bool // Joined with SPY GHOST: hidden from the channel and the network
+}
+
+// HasMode returns true if the member holds a status mode
+func (m *Membership) HasMode(mode rune) bool {
+	return m.Modes[mode]
+}
+
+// Prefixes returns every status prefix the member holds, highest first
+func (m *Membership) Prefixes() string {
+	prefixes := ""
+	for _, status := range statusModes {
+		if m.Modes[status.mode] {
+			prefixes += status.prefix
+		}
+	}
+	return prefixes
+}
+
+// HighestPrefix returns the prefix of the member's highest status, or ""
+func (m *Membership) HighestPrefix() string {
+	for _, status := range statusModes {
+		if m.Modes[status.mode] {
+			return status.prefix
+		}
+	}
+	return ""
+}
+
+// isChanop returns true if the member is a halfop or above
+func (m *Membership) isChanop() bool {
+	return m.Modes['q'] || m.Modes['o'] || m.Modes['h']
+}
+
+// canSpeakModerated returns true if the member may speak in a moderated
+// channel or while quieted
+func (m *Membership) canSpeakModerated() bool {
+	return m.Modes['q'] || m.Modes['o'] || m.Modes['h'] || m.Modes['v']
+}
+
 type Channel struct {
 	name       string
 	topic      string
 	topicBy    string
 	topicTime  time.Time
-	clients    map[string]*Client
-	operators  map[string]*Client
-	halfops    map[string]*Client
-	voices     map[string]*Client
-	owners     map[string]*Client
+	members    map[*Client]*Membership
 	modes      map[rune]bool
 	key        string
 	limit      int
@@ -32,11 +81,7 @@ type Channel struct {
 func NewChannel(name string) *Channel {
 	return &Channel{
 		name:       name,
-		clients:    make(map[string]*Client),
-		operators:  make(map[string]*Client),
-		halfops:    make(map[string]*Client),
-		voices:     make(map[string]*Client),
-		owners:     make(map[string]*Client),
+		members:    make(map[*Client]*Membership),
 		modes:      make(map[rune]bool),
 		banList:    make([]string, 0),
 		quietList:  make([]string, 0),
@@ -82,61 +127,156 @@ func (ch *Channel) AddClient(client *Client) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
-	ch.clients[strings.ToLower(client.Nick())] = client
-	client.AddChannel(ch)
+	member := ch.addMemberLocked(client)
 
 	// First user becomes operator (not owner - owner is for special designation)
-	if len(ch.clients) == 1 {
-		ch.operators[strings.ToLower(client.Nick())] = client
+	if ch.visibleCountLocked() == 1 {
+		member.Modes['o'] = true
 	}
 }
 
+// AddGhost adds an oper as a hidden member that receives the channel's
+// traffic but does not appear in NAMES, WHO or the member count
+func (ch *Channel) AddGhost(client *Client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.addMemberLocked(client).Ghost = true
+}
+
+// IsGhost returns true if the client is a hidden member of the channel
+func (ch *Channel) IsGhost(client *Client) bool {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	member, exists := ch.members[client]
+	return exists && member.Ghost
+}
+
+// visibleCountLocked counts the members that are not ghosts; the caller must
+// hold ch.mu
+func (ch *Channel) visibleCountLocked() int {
+	count := 0
+	for _, member := range ch.members {
+		if !member.Ghost {
+			count++
+		}
+	}
+	return count
+}
+
+// VisibleCount returns the number of members other users can see
+func (ch *Channel) VisibleCount() int {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.visibleCountLocked()
+}
+
+// AddMember adds a client without the operator status AddClient gives the
+// first user; used for users joining through a server link
+func (ch *Channel) AddMember(client *Client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.addMemberLocked(client)
+}
+
+// addMemberLocked creates the membership of a joining client; the caller
+// must hold ch.mu
+func (ch *Channel) addMemberLocked(client *Client) *Membership {
+	member, exists := ch.members[client]
+	if !exists {
+		member = &Membership{Client: client, Modes: make(map[rune]bool), Joined: time.Now()}
+		ch.members[client] = member
+	}
+	client.AddChannel(ch)
+	return member
+}
+
 func (ch *Channel) RemoveClient(client *Client) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
-	nick := strings.ToLower(client.Nick())
-	delete(ch.clients, nick)
-	delete(ch.operators, nick)
-	delete(ch.halfops, nick)
-	delete(ch.voices, nick)
-	delete(ch.owners, nick)
+	delete(ch.members, client)
 	client.RemoveChannel(ch.name)
 }
 
 func (ch *Channel) HasClient(client *Client) bool {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
-	_, exists := ch.clients[strings.ToLower(client.Nick())]
+	_, exists := ch.members[client]
 	return exists
 }
 
-func (ch *Channel) IsOperator(client *Client) bool {
+// Member returns a copy of a client's membership
+func (ch *Channel) Member(client *Client) (Membership, bool) {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
-	_, exists := ch.operators[strings.ToLower(client.Nick())]
-	return exists
+
+	member, exists := ch.members[client]
+	if !exists {
+		return Membership{}, false
+	}
+	copied := *member
+	copied.Modes = make(map[rune]bool, len(member.Modes))
+	for mode, set := range member.Modes {
+		copied.Modes[mode] = set
+	}
+	return copied, true
 }
 
-func (ch *Channel) IsVoice(client *Client) bool {
+// hasStatus returns true if a member holds a status mode
+func (ch *Channel) hasStatus(client *Client, mode rune) bool {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
-	_, exists := ch.voices[strings.ToLower(client.Nick())]
-	return exists
+	member, exists := ch.members[client]
+	return exists && member.Modes[mode]
+}
+
+// setStatus gives or takes a member's status mode
+func (ch *Channel) setStatus(client *Client, mode rune, set bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	member, exists := ch.members[client]
+	if !exists {
+		return
+	}
+	if set {
+		member.Modes[mode] = true
+	} else {
+		delete(member.Modes, mode)
+	}
+}
+
+// MarkSpoke records that a member spoke in the channel
+func (ch *Channel) MarkSpoke(client *Client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if member, exists := ch.members[client]; exists {
+		member.LastSpoke = time.Now()
+	}
+}
+
+func (ch *Channel) IsOperator(client *Client) bool {
+	return ch.hasStatus(client, 'o')
+}
+
+func (ch *Channel) IsVoice(client *Client) bool {
+	return ch.hasStatus(client, 'v')
 }
 
 func (ch *Channel) IsHalfop(client *Client) bool {
-	ch.mu.RLock()
-	defer ch.mu.RUnlock()
-	_, exists := ch.halfops[strings.ToLower(client.Nick())]
-	return exists
+	return ch.hasStatus(client, 'h')
 }
 
 func (ch *Channel) IsOwner(client *Client) bool {
+	return ch.hasStatus(client, 'q')
+}
+
+// IsChanop returns true if a member is a halfop or above
+func (ch *Channel) IsChanop(client *Client) bool {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
-	_, exists := ch.owners[strings.ToLower(client.Nick())]
-	return exists
+	member, exists := ch.members[client]
+	return exists && member.isChanop()
 }
 
 func (ch *Channel) IsQuieted(client *Client) bool {
@@ -147,7 +287,7 @@ func (ch *Channel) IsQuieted(client *Client) bool {
 
 func (ch *Channel) isQuietedUnsafe(client *Client) bool {
 	nick := strings.ToLower(client.Nick())
-	hostmask := fmt.Sprintf("%s!%s@%s", client.Nick(), client.user, client.host)
+	hostmask := fmt.Sprintf("%s!%s@%s", client.Nick(), client.User(), client.Host())
 
 	for _, quiet := range ch.quietList {
 		if matched, _ := filepath.Match(quiet, nick); matched {
@@ -161,59 +301,27 @@ func (ch *Channel) isQuietedUnsafe(client *Client) bool {
 }
 
 func (ch *Channel) SetOperator(client *Client, isOp bool) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	nick := strings.ToLower(client.Nick())
-	if isOp {
-		ch.operators[nick] = client
-	} else {
-		delete(ch.operators, nick)
-	}
+	ch.setStatus(client, 'o', isOp)
 }
 
 func (ch *Channel) SetVoice(client *Client, hasVoice bool) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	nick := strings.ToLower(client.Nick())
-	if hasVoice {
-		ch.voices[nick] = client
-	} else {
-		delete(ch.voices, nick)
-	}
+	ch.setStatus(client, 'v', hasVoice)
 }
 
 func (ch *Channel) SetHalfop(client *Client, isHalfop bool) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	nick := strings.ToLower(client.Nick())
-	if isHalfop {
-		ch.halfops[nick] = client
-	} else {
-		delete(ch.halfops, nick)
-	}
+	ch.setStatus(client, 'h', isHalfop)
 }
 
 func (ch *Channel) SetOwner(client *Client, isOwner bool) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	nick := strings.ToLower(client.Nick())
-	if isOwner {
-		ch.owners[nick] = client
-	} else {
-		delete(ch.owners, nick)
-	}
+	ch.setStatus(client, 'q', isOwner)
 }
 
 func (ch *Channel) GetClients() []*Client {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
 
-	clients := make([]*Client, 0, len(ch.clients))
-	for _, client := range ch.clients {
+	clients := make([]*Client, 0, len(ch.members))
+	for client := range ch.members {
 		clients = append(clients, client)
 	}
 	return clients
@@ -222,7 +330,7 @@ func (ch *Channel) GetClients() []*Client {
 func (ch *Channel) GetClientCount() int {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
-	return len(ch.clients)
+	return len(ch.members)
 }
 
 func (ch *Channel) UserCount() int {
@@ -233,20 +341,34 @@ func (ch *Channel) Broadcast(message string, exclude *Client) {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
 
-	for _, client := range ch.clients {
-		if exclude != nil && client.Nick() == exclude.Nick() {
+	for client := range ch.members {
+		if client == exclude {
 			continue
 		}
 		client.SendMessage(message)
 	}
 }
 
+// BroadcastMessage sends a message to every member; each gets only the tags
+// it negotiated
+func (ch *Channel) BroadcastMessage(msg *Message, exclude *Client) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	for client := range ch.members {
+		if client == exclude {
+			continue
+		}
+		client.Send(msg)
+	}
+}
+
 func (ch *Channel) BroadcastFrom(source, message string, exclude *Client) {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
 
-	for _, client := range ch.clients {
-		if exclude != nil && client.Nick() == exclude.Nick() {
+	for client := range ch.members {
+		if client == exclude {
 			continue
 		}
 		client.SendFrom(source, message)
@@ -290,15 +412,20 @@ func (ch *Channel) CanSendMessage(client *Client) bool {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
 
+	member, exists := ch.members[client]
+	if !exists {
+		member = &Membership{}
+	}
+
+	// Speaking would give a ghost away
+	if member.Ghost {
+		return false
+	}
+
 	// Check if user is quieted first
 	if ch.isQuietedUnsafe(client) {
 		// Only owners, operators, and halfops can speak when quieted
-		nick := strings.ToLower(client.Nick())
-		_, isOwner := ch.owners[nick]
-		_, isOp := ch.operators[nick]
-		_, isHalfop := ch.halfops[nick]
-
-		if !isOwner && !isOp && !isHalfop {
+		if !member.isChanop() {
 			return false
 		}
 	}
@@ -309,13 +436,7 @@ func (ch *Channel) CanSendMessage(client *Client) bool {
 	}
 
 	// In moderated channels, only owners, operators, halfops and voiced users can send messages
-	nick := strings.ToLower(client.Nick())
-	_, isOwner := ch.owners[nick]
-	_, isOp := ch.operators[nick]
-	_, isHalfop := ch.halfops[nick]
-	_, hasVoice := ch.voices[nick]
-
-	return isOwner || isOp || isHalfop || hasVoice
+	return member.canSpeakModerated()
 }
 
 func (ch *Channel) Key() string {
@@ -347,18 +468,8 @@ func (ch *Channel) GetNamesReply() string {
 	defer ch.mu.RUnlock()
 
 	var names []string
-	for _, client := range ch.clients {
-		prefix := ""
-		if ch.IsOwner(client) {
-			prefix = "~"
-		} else if ch.IsOperator(client) {
-			prefix = "@"
-		} else if ch.IsHalfop(client) {
-			prefix = "%"
-		} else if ch.IsVoice(client) {
-			prefix = "+"
-		}
-		names = append(names, prefix+client.Nick())
+	for client, member := range ch.members {
+		names = append(names, member.HighestPrefix()+client.Nick())
 	}
 
 	return strings.Join(names, " ")
@@ -373,8 +484,9 @@ func (ch *Channel) CanSpeak(client *Client) bool {
 		return true
 	}
 
-	// Operators and voiced users can always speak
-	return ch.IsOperator(client) || ch.IsVoice(client)
+	// Members with a status mode can always speak
+	member, exists := ch.members[client]
+	return exists && member.canSpeakModerated()
 }
 
 func (ch *Channel) CanJoin(client *Client, key string) bool {
@@ -398,7 +510,7 @@ func (ch *Channel) CanJoin(client *Client, key string) bool {
 	}
 
 	// Check limit
-	if ch.modes['l'] && len(ch.clients) >= ch.limit {
+	if ch.modes['l'] && len(ch.members) >= ch.limit {
 		return false
 	}
 
@@ -456,16 +568,69 @@ func (ch *Channel) Created() time.Time {
 	return ch.created
 }
 
+// TS returns the channel timestamp servers use to resolve conflicts
+func (ch *Channel) TS() int64 {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.created.Unix()
+}
+
+// SetTS replaces the channel timestamp
+func (ch *Channel) SetTS(ts int64) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.created = time.Unix(ts, 0)
+}
+
+// StatusPrefixes returns every status prefix a member holds, highest first
+func (ch *Channel) StatusPrefixes(client *Client) string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	if member, exists := ch.members[client]; exists {
+		return member.Prefixes()
+	}
+	return ""
+}
+
+// ModeParams returns the channel modes together with the key and limit
+// parameters, as sent in a netburst
+func (ch *Channel) ModeParams() (string, []string) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	modes := "+"
+	var params []string
+	for mode := range ch.modes {
+		switch mode {
+		case 'k':
+			if ch.key == "" {
+				continue
+			}
+			params = append(params, ch.key)
+		case 'l':
+			if ch.limit <= 0 {
+				continue
+			}
+			params = append(params, fmt.Sprintf("%d", ch.limit))
+		}
+		modes += string(mode)
+	}
+	return modes, params
+}
+
 // IsBanned checks if a client matches any ban mask in the channel
 func (ch *Channel) IsBanned(client *Client) bool {
+	// Bans may name the real host, the cloak or the vhost
+	masks := client.hostmasks()
+
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
-	
-	hostmask := fmt.Sprintf("%s!%s@%s", client.Nick(), client.User(), client.Host())
-	
 	for _, ban := range ch.banList {
-		if matchWildcard(ban, hostmask) {
-			return true
+		for _, mask := range masks {
+			if matchWildcard(ban, mask) {
+				return true
+			}
 		}
 	}
 	return false
@@ -473,14 +638,15 @@ func (ch *Channel) IsBanned(client *Client) bool {
 
 // IsInvited checks if a client is on the invite list for the channel
 func (ch *Channel) IsInvited(client *Client) bool {
+	masks := client.hostmasks()
+
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
-	
-	hostmask := fmt.Sprintf("%s!%s@%s", client.Nick(), client.User(), client.Host())
-	
 	for _, invite := range ch.inviteList {
-		if matchWildcard(invite, hostmask) {
-			return true
+		for _, mask := range masks {
+			if matchWildcard(invite, mask) {
+				return true
+			}
 		}
 	}
 	return false
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMembershipFollowsNickChange(t *testing.T) {
+	s := newTestServer(t)
+	alice := registerTest(t, s, "alice")
+	bob := registerTest(t, s, "bob")
+	alice.send("JOIN #members")
+	alice.expect(" 366 ")
+	bob.send("JOIN #members")
+	bob.expect(" 366 ")
+
+	alice.send("MODE #members +v bob", "MODE #members +o bob")
+	alice.expect("MODE #members +o bob")
+	bob.send("NICK robert")
+	alice.expect("NICK :robert")
+
+	channel := s.GetChannel("#members")
+	robert := s.GetClient("robert")
+	if robert == nil || s.GetClient("bob") != nil {
+		t.Fatal("nick change not applied")
+	}
+	if !channel.HasClient(robert) || !channel.IsOperator(robert) || !channel.IsVoice(robert) {
+		t.Errorf("after the rename: member %v, op %v, voice %v", channel.HasClient(robert), channel.IsOperator(robert), channel.IsVoice(robert))
+	}
+	if prefixes := channel.StatusPrefixes(robert); prefixes != "@+" {
+		t.Errorf("StatusPrefixes = %q", prefixes)
+	}
+
+	// NAMES and WHO show only the highest status
+	alice.send("NAMES #members")
+	names := alice.expect(" 353 ")
+	if !strings.Contains(names, "@robert") || strings.Contains(names, "bob") || strings.Contains(names, "+robert") {
+		t.Errorf("NAMES: %q", names)
+	}
+	alice.send("WHO #members")
+	lines := alice.readUntil(" 315 ")
+	if who := containing(lines, " robert H"); len(who) != 1 || !strings.Contains(who[0], " robert H@ :") {
+		t.Errorf("WHO: %q", lines)
+	}
+
+	// The renamed member can use its status
+	bob.send("MODE #members +m")
+	alice.expect("MODE #members +m")
+
+	channel.RemoveClient(robert)
+	if channel.HasClient(robert) || channel.IsOperator(robert) || channel.StatusPrefixes(robert) != "" {
+		t.Error("membership survived RemoveClient")
+	}
+	if channel.UserCount() != 1 {
+		t.Errorf("UserCount = %d", channel.UserCount())
+	}
+}
+
+func TestBanAndInviteMatchDisplayedHosts(t *testing.T) {
+	c := &Client{nick: "alice", user: "alice", host: "192.0.2.1", cloak: "abcd1234.users.test", modes: make(map[rune]bool)}
+	ch := NewChannel("#masks")
+
+	ch.AddBan("*!*@staff.example")
+	ch.inviteList = append(ch.inviteList, "*!*@staff.example")
+	if ch.IsBanned(c) || ch.IsInvited(c) {
+		t.Fatal("vhost mask matched a client without the vhost")
+	}
+
+	c.vhost = "staff.example"
+	if !ch.IsBanned(c) {
+		t.Error("ban on the vhost did not match")
+	}
+	if !ch.IsInvited(c) {
+		t.Error("invite on the vhost did not match")
+	}
+
+	ch.RemoveBan("*!*@staff.example")
+	ch.AddBan("*!*@*.users.test")
+	if !ch.IsBanned(c) {
+		t.Error("ban on the cloak did not match")
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ERR_MLOCKRESTRICTED is sent when a mode change conflicts with a channel's mode lock
+const ERR_MLOCKRESTRICTED = 742
+
+// lockableModes are the channel modes that can be locked with SET MLOCK
+const lockableModes = "imnpstkl"
+
+// accessRanks orders the channel access levels from lowest to highest
+var accessRanks = map[string]int{
+	"voice":   1,
+	"halfop":  2,
+	"op":      3,
+	"founder": 4,
+}
+
+// accessModes maps channel access levels to the status mode they grant
+var accessModes = map[string]rune{
+	"voice":   'v',
+	"halfop":  'h',
+	"op":      'o',
+	"founder": 'q',
+}
+
+// handleChanServ handles commands sent to ChanServ
+func (sv *Services) handleChanServ(c *Client, text string) {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		sv.reply(c, "ChanServ", "Type /msg ChanServ HELP for a list of commands.")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "REGISTER":
+		sv.csRegister(c, args[1:])
+	case "ACCESS":
+		sv.csAccess(c, args[1:])
+	case "SET":
+		sv.csSet(c, args[1:])
+	case "DROP":
+		sv.csDrop(c, args[1:])
+	case "INFO":
+		sv.csInfo(c, args[1:])
+	case "HELP":
+		sv.csHelp(c)
+	default:
+		sv.reply(c, "ChanServ", "Unknown command %s. Type /msg ChanServ HELP for a list of commands.", strings.ToUpper(args[0]))
+	}
+}
+
+// csRegister - REGISTER <#channel>
+func (sv *Services) csRegister(c *Client, args []string) {
+	if len(args) < 1 || !isChannelName(args[0]) {
+		sv.reply(c, "ChanServ", "Syntax: REGISTER <#channel>")
+		return
+	}
+
+	account := c.Account()
+	if account == "" {
+		sv.reply(c, "ChanServ", "You must be identified to register a channel.")
+		return
+	}
+
+	channel := sv.server.GetChannel(args[0])
+	if channel == nil || !channel.HasClient(c) {
+		sv.reply(c, "ChanServ", "You must be on %s to register it.", args[0])
+		return
+	}
+	if !channel.IsOperator(c) && !channel.IsOwner(c) {
+		sv.reply(c, "ChanServ", "You must be a channel operator on %s to register it.", channel.Name())
+		return
+	}
+
+	reg := &RegisteredChannel{
+		Name:       channel.Name(),
+		Founder:    account,
+		Registered: time.Now(),
+		Topic:      channel.Topic(),
+		TopicBy:    channel.TopicBy(),
+		TopicTime:  channel.TopicTime(),
+		Bans:       channel.GetBans(),
+		Access:     []ChannelAccess{},
+	}
+	if err := sv.db.RegisterChannel(reg); err != nil {
+		if err == errChannelExists {
+			sv.reply(c, "ChanServ", "%s is already registered.", channel.Name())
+		} else {
+			sv.reply(c, "ChanServ", "Registration failed, please try again later.")
+			sv.server.sendSnomask('d', fmt.Sprintf("ChanServ: failed to register %s: %v", channel.Name(), err))
+		}
+		return
+	}
+
+	sv.reply(c, "ChanServ", "%s is now registered to %s.", channel.Name(), account)
+	sv.grantStatus(channel, c, accessModes["founder"])
+	sv.server.sendSnomask('n', fmt.Sprintf("ChanServ: %s (%s) registered %s", c.Nick(), account, channel.Name()))
+}
+
+// csAccess - ACCESS <#channel> LIST | ADD <account> <level> | DEL <account>
+func (sv *Services) csAccess(c *Client, args []string) {
+	if len(args) < 2 {
+		sv.reply(c, "ChanServ", "Syntax: ACCESS <#channel> LIST | ADD <account> <op|halfop|voice> | DEL <account>")
+		return
+	}
+
+	reg, ok := sv.db.GetChannel(args[0])
+	if !ok {
+		sv.reply(c, "ChanServ", "%s is not registered.", args[0])
+		return
+	}
+	level := reg.accessLevel(c.Account())
+
+	switch strings.ToUpper(args[1]) {
+	case "LIST":
+		if level == "" && !c.IsOper() {
+			sv.reply(c, "ChanServ", "You do not have access to %s.", reg.Name)
+			return
+		}
+		sv.reply(c, "ChanServ", "Access list for %s:", reg.Name)
+		sv.reply(c, "ChanServ", "  %-20s %s", reg.Founder, "founder")
+		for _, entry := range reg.Access {
+			sv.reply(c, "ChanServ", "  %-20s %-8s (added by %s)", entry.Account, entry.Level, entry.AddedBy)
+		}
+		sv.reply(c, "ChanServ", "End of access list (%d entries).", len(reg.Access)+1)
+
+	case "ADD":
+		if len(args) < 4 {
+			sv.reply(c, "ChanServ", "Syntax: ACCESS <#channel> ADD <account> <op|halfop|voice>")
+			return
+		}
+		if level != "founder" {
+			sv.reply(c, "ChanServ", "Only the founder of %s can change its access list.", reg.Name)
+			return
+		}
+		newLevel := strings.ToLower(args[3])
+		if _, valid := accessRanks[newLevel]; !valid || newLevel == "founder" {
+			sv.reply(c, "ChanServ", "Invalid access level %s. Valid levels are op, halfop and voice.", args[3])
+			return
+		}
+		target, exists := sv.db.GetAccount(args[2])
+		if !exists {
+			sv.reply(c, "ChanServ", "%s is not a registered account.", args[2])
+			return
+		}
+		if strings.EqualFold(target.Name, reg.Founder) {
+			sv.reply(c, "ChanServ", "%s is the founder of %s.", target.Name, reg.Name)
+			return
+		}
+
+		err := sv.db.UpdateChannel(reg.Name, func(rc *RegisteredChannel) {
+			rc.setAccess(ChannelAccess{Account: target.Name, Level: newLevel, AddedBy: c.Account(), Added: time.Now()})
+		})
+		if err != nil {
+			sv.reply(c, "ChanServ", "Could not update the access list: %v", err)
+			return
+		}
+		sv.reply(c, "ChanServ", "%s has been given %s access on %s.", target.Name, newLevel, reg.Name)
+
+	case "DEL":
+		if len(args) < 3 {
+			sv.reply(c, "ChanServ", "Syntax: ACCESS <#channel> DEL <account>")
+			return
+		}
+		if level != "founder" {
+			sv.reply(c, "ChanServ", "Only the founder of %s can change its access list.", reg.Name)
+			return
+		}
+
+		removed := false
+		err := sv.db.UpdateChannel(reg.Name, func(rc *RegisteredChannel) {
+			removed = rc.removeAccess(args[2])
+		})
+		if err != nil {
+			sv.reply(c, "ChanServ", "Could not update the access list: %v", err)
+			return
+		}
+		if !removed {
+			sv.reply(c, "ChanServ", "%s is not on the access list of %s.", args[2], reg.Name)
+			return
+		}
+		sv.reply(c, "ChanServ", "%s has been removed from the access list of %s.", args[2], reg.Name)
+
+	default:
+		sv.reply(c, "ChanServ", "Syntax: ACCESS <#channel> LIST | ADD <account> <op|halfop|voice> | DEL <account>")
+	}
+}
+
+// csSet - SET <#channel> MLOCK <modes> [key] [limit]
+func (sv *Services) csSet(c *Client, args []string) {
+	if len(args) < 3 || strings.ToUpper(args[1]) != "MLOCK" {
+		sv.reply(c, "ChanServ", "Syntax: SET <#channel> MLOCK <modes> [key] [limit]")
+		return
+	}
+
+	reg, ok := sv.db.GetChannel(args[0])
+	if !ok {
+		sv.reply(c, "ChanServ", "%s is not registered.", args[0])
+		return
+	}
+	if reg.accessLevel(c.Account()) != "founder" {
+		sv.reply(c, "ChanServ", "Only the founder of %s can change its settings.", reg.Name)
+		return
+	}
+
+	on, off, key, limit, err := parseModeLock(args[2], args[3:])
+	if err != nil {
+		sv.reply(c, "ChanServ", "Invalid mode lock: %v", err)
+		return
+	}
+
+	err = sv.db.UpdateChannel(reg.Name, func(rc *RegisteredChannel) {
+		rc.MLockOn, rc.MLockOff, rc.MLockKey, rc.MLockLimit = on, off, key, limit
+	})
+	if err != nil {
+		sv.reply(c, "ChanServ", "Could not set the mode lock: %v", err)
+		return
+	}
+
+	reg.MLockOn, reg.MLockOff, reg.MLockKey, reg.MLockLimit = on, off, key, limit
+	if channel := sv.server.GetChannel(reg.Name); channel != nil {
+		sv.applyModeLock(channel, &reg)
+	}
+
+	if mlock := reg.modeLockString(); mlock != "" {
+		sv.reply(c, "ChanServ", "Mode lock on %s is now %s.", reg.Name, mlock)
+	} else {
+		sv.reply(c, "ChanServ", "Mode lock on %s has been cleared.", reg.Name)
+	}
+}
+
+// csDrop - DROP <#channel>
+func (sv *Services) csDrop(c *Client, args []string) {
+	if len(args) < 1 {
+		sv.reply(c, "ChanServ", "Syntax: DROP <#channel>")
+		return
+	}
+
+	reg, ok := sv.db.GetChannel(args[0])
+	if !ok {
+		sv.reply(c, "ChanServ", "%s is not registered.", args[0])
+		return
+	}
+	if reg.accessLevel(c.Account()) != "founder" {
+		sv.reply(c, "ChanServ", "Only the founder of %s can drop it.", reg.Name)
+		return
+	}
+
+	if err := sv.db.DropChannel(reg.Name); err != nil {
+		sv.reply(c, "ChanServ", "Could not drop %s: %v", reg.Name, err)
+		return
+	}
+
+	sv.reply(c, "ChanServ", "%s has been dropped.", reg.Name)
+	sv.server.sendSnomask('n', fmt.Sprintf("ChanServ: %s (%s) dropped %s", c.Nick(), c.Account(), reg.Name))
+}
+
+// csInfo - INFO <#channel>
+func (sv *Services) csInfo(c *Client, args []string) {
+	if len(args) < 1 {
+		sv.reply(c, "ChanServ", "Syntax: INFO <#channel>")
+		return
+	}
+
+	reg, ok := sv.db.GetChannel(args[0])
+	if !ok {
+		sv.reply(c, "ChanServ", "%s is not registered.", args[0])
+		return
+	}
+
+	sv.reply(c, "ChanServ", "Information on %s:", reg.Name)
+	sv.reply(c, "ChanServ", "  Founder    : %s", reg.Founder)
+	sv.reply(c, "ChanServ", "  Registered : %s", reg.Registered.Format(time.RFC1123))
+	if reg.Topic != "" {
+		sv.reply(c, "ChanServ", "  Topic      : %s", reg.Topic)
+	}
+	if mlock := reg.modeLockString(); mlock != "" {
+		sv.reply(c, "ChanServ", "  Mode lock  : %s", mlock)
+	}
+}
+
+func (sv *Services) csHelp(c *Client) {
+	sv.reply(c, "ChanServ", "ChanServ lets you register channels and keep their settings.")
+	sv.reply(c, "ChanServ", "  REGISTER <#channel>                     - Register a channel you operate")
+	sv.reply(c, "ChanServ", "  ACCESS <#channel> LIST                  - Show the access list")
+	sv.reply(c, "ChanServ", "  ACCESS <#channel> ADD <account> <level> - Grant op, halfop or voice")
+	sv.reply(c, "ChanServ", "  ACCESS <#channel> DEL <account>         - Remove an access entry")
+	sv.reply(c, "ChanServ", "  SET <#channel> MLOCK <modes> [params]   - Lock channel modes (e.g. +nt-s)")
+	sv.reply(c, "ChanServ", "  INFO <#channel>                         - Show channel information")
+	sv.reply(c, "ChanServ", "  DROP <#channel>                         - Unregister a channel")
+}
+
+// parseModeLock parses a mode lock such as "+ntk-s key"
+func parseModeLock(modes string, params []string) (on, off, key string, limit int, err error) {
+	adding := true
+	for _, mode := range modes {
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case !strings.ContainsRune(lockableModes, mode):
+			return "", "", "", 0, fmt.Errorf("mode %c cannot be locked", mode)
+		case adding:
+			if mode == 'k' || mode == 'l' {
+				if len(params) == 0 {
+					return "", "", "", 0, fmt.Errorf("mode %c needs a parameter", mode)
+				}
+				if mode == 'k' {
+					key = params[0]
+				} else if limit, err = strconv.Atoi(params[0]); err != nil || limit <= 0 {
+					return "", "", "", 0, fmt.Errorf("invalid limit %s", params[0])
+				}
+				params = params[1:]
+			}
+			off = strings.ReplaceAll(off, string(mode), "")
+			if !strings.ContainsRune(on, mode) {
+				on += string(mode)
+			}
+		default:
+			on = strings.ReplaceAll(on, string(mode), "")
+			if !strings.ContainsRune(off, mode) {
+				off += string(mode)
+			}
+		}
+	}
+
+	if !strings.ContainsRune(on, 'k') {
+		key = ""
+	}
+	if !strings.ContainsRune(on, 'l') {
+		limit = 0
+	}
+	return on, off, key, limit, nil
+}
+
+// modeLockString formats the mode lock for display, e.g. "+nt-s"
+func (rc *RegisteredChannel) modeLockString() string {
+	var mlock string
+	if rc.MLockOn != "" {
+		mlock += "+" + rc.MLockOn
+	}
+	if rc.MLockOff != "" {
+		mlock += "-" + rc.MLockOff
+	}
+	return mlock
+}
+
+// ModeLocked reports whether a channel mode change conflicts with the
+// channel's mode lock, returning the lock for the error reply
+func (sv *Services) ModeLocked(channelName string, mode rune, adding bool) (string, bool) {
+	reg, ok := sv.db.GetChannel(channelName)
+	if !ok {
+		return "", false
+	}
+
+	// Parameter modes locked on cannot be changed at all
+	lockedOn := strings.ContainsRune(reg.MLockOn, mode)
+	if lockedOn && (!adding || mode == 'k' || mode == 'l') {
+		return reg.modeLockString(), true
+	}
+	if adding && strings.ContainsRune(reg.MLockOff, mode) {
+		return reg.modeLockString(), true
+	}
+	return "", false
+}
+
+// ChannelCreated re-applies the stored topic, mode lock and bans of a
+// registered channel when it is created again
+func (sv *Services) ChannelCreated(channel *Channel) {
+	reg, ok := sv.db.GetChannel(channel.name)
+	if !ok {
+		return
+	}
+
+	channel.mu.Lock()
+	channel.topic = reg.Topic
+	channel.topicBy = reg.TopicBy
+	channel.topicTime = reg.TopicTime
+	channel.banList = append(channel.banList[:0], reg.Bans...)
+	modeLockChannelLocked(channel, &reg)
+	channel.mu.Unlock()
+}
+
+// applyModeLock enforces a changed mode lock on a live channel and tells its members
+func (sv *Services) applyModeLock(channel *Channel, reg *RegisteredChannel) {
+	channel.mu.Lock()
+	modeLockChannelLocked(channel, reg)
+	channel.mu.Unlock()
+
+	mlock := reg.modeLockString()
+	if mlock == "" {
+		return
+	}
+	params := []string{}
+	if reg.MLockKey != "" {
+		params = append(params, reg.MLockKey)
+	}
+	if reg.MLockLimit > 0 {
+		params = append(params, strconv.Itoa(reg.MLockLimit))
+	}
+
+	line := fmt.Sprintf(":%s MODE %s %s", sv.botPrefix("ChanServ"), channel.Name(), mlock)
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	channel.Broadcast(line, nil)
+}
+
+// modeLockChannelLocked sets the channel's modes to match the mode lock; the
+// caller must hold channel.mu
+func modeLockChannelLocked(channel *Channel, reg *RegisteredChannel) {
+	for _, mode := range reg.MLockOn {
+		channel.modes[mode] = true
+		switch mode {
+		case 'k':
+			channel.key = reg.MLockKey
+		case 'l':
+			channel.limit = reg.MLockLimit
+		}
+	}
+	for _, mode := range reg.MLockOff {
+		delete(channel.modes, mode)
+		switch mode {
+		case 'k':
+			channel.key = ""
+		case 'l':
+			channel.limit = 0
+		}
+	}
+}
+
+// ChannelJoin gives a client joining a registered channel the status its
+// account has on the access list. Users without op access do not keep the
+// operator status handed to whoever recreates an empty channel.
+func (sv *Services) ChannelJoin(c *Client, channel *Channel) {
+	reg, ok := sv.db.GetChannel(channel.Name())
+	if !ok {
+		return
+	}
+
+	level := reg.accessLevel(c.Account())
+	if accessRanks[level] < accessRanks["op"] && channel.IsOperator(c) {
+		channel.SetOperator(c, false)
+		channel.Broadcast(fmt.Sprintf(":%s MODE %s -o %s", sv.botPrefix("ChanServ"), channel.Name(), c.Nick()), nil)
+	}
+
+	if mode, exists := accessModes[level]; exists {
+		sv.grantStatus(channel, c, mode)
+	}
+}
+
+// grantStatus gives a channel member a status mode and announces it
+func (sv *Services) grantStatus(channel *Channel, c *Client, mode rune) {
+	switch mode {
+	case 'q':
+		channel.SetOwner(c, true)
+	case 'o':
+		channel.SetOperator(c, true)
+	case 'h':
+		channel.SetHalfop(c, true)
+	case 'v':
+		channel.SetVoice(c, true)
+	}
+	channel.Broadcast(fmt.Sprintf(":%s MODE %s +%c %s", sv.botPrefix("ChanServ"), channel.Name(), mode, c.Nick()), nil)
+}
+
+// ChannelTopicChanged stores the topic of a registered channel
+func (sv *Services) ChannelTopicChanged(channel *Channel) {
+	topic, by, at := channel.Topic(), channel.TopicBy(), channel.TopicTime()
+	err := sv.db.UpdateChannel(channel.Name(), func(rc *RegisteredChannel) {
+		rc.Topic, rc.TopicBy, rc.TopicTime = topic, by, at
+	})
+	if err != nil && err != errNoSuchChannel {
+		log.Printf("ChanServ: %v", err)
+	}
+}
+
+// ChannelBansChanged stores the ban list of a registered channel
+func (sv *Services) ChannelBansChanged(channel *Channel) {
+	bans := channel.GetBans()
+	err := sv.db.UpdateChannel(channel.Name(), func(rc *RegisteredChannel) {
+		rc.Bans = bans
+	})
+	if err != nil && err != errNoSuchChannel {
+		log.Printf("ChanServ: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// servicesTest returns a server running services with the given accounts
+// registered, all with the password "secret"
+func servicesTest(t *testing.T, accounts ...string) *Server {
+	t.Helper()
+	s := newTestServer(t, func(config *Config) {
+		config.Features.EnableServices = true
+	})
+	if s.services == nil {
+		t.Fatal("services did not start")
+	}
+	for _, account := range accounts {
+		if err := s.services.db.Register(account, "secret", ""); err != nil {
+			t.Fatalf("Register %s: %v", account, err)
+		}
+	}
+	return s
+}
+
+// identifiedTest registers a client with a nick and identifies it to the
+// account of the same name
+func identifiedTest(t *testing.T, s *Server, nick string) *testConn {
+	t.Helper()
+	tc := registerTest(t, s, nick)
+	tc.send("PRIVMSG NickServ :IDENTIFY secret")
+	tc.expect("You are now identified for")
+	return tc
+}
+
+func TestChanServRegisterAndAccess(t *testing.T) {
+	s := servicesTest(t, "founder", "helper")
+	founder := identifiedTest(t, s, "founder")
+	helper := identifiedTest(t, s, "helper")
+
+	founder.send("JOIN #reg")
+	founder.expect(" 366 ")
+	founder.send("PRIVMSG ChanServ :REGISTER #reg")
+	founder.expect("#reg is now registered to founder")
+	founder.expect("MODE #reg +q founder")
+
+	helper.send("JOIN #reg")
+	helper.expect(" 366 ")
+	helper.send("PRIVMSG ChanServ :ACCESS #reg ADD helper op")
+	helper.expect("Only the founder of #reg can change its access list")
+	helper.send("PRIVMSG ChanServ :ACCESS #reg LIST")
+	helper.expect("You do not have access to #reg")
+
+	founder.send("PRIVMSG ChanServ :ACCESS #reg ADD helper founder")
+	founder.expect("Invalid access level founder")
+	founder.send("PRIVMSG ChanServ :ACCESS #reg ADD nobody op")
+	founder.expect("nobody is not a registered account")
+	founder.send("PRIVMSG ChanServ :ACCESS #reg ADD helper op")
+	founder.expect("helper has been given op access on #reg")
+
+	founder.send("PRIVMSG ChanServ :ACCESS #reg LIST")
+	lines := founder.readUntil("End of access list (2 entries)")
+	if len(containing(lines, "founder ")) == 0 || len(containing(lines, "helper")) == 0 {
+		t.Errorf("access list: %q", lines)
+	}
+
+	// Auto-status on join
+	helper.send("PART #reg", "JOIN #reg")
+	helper.expect("MODE #reg +o helper")
+
+	founder.send("PRIVMSG ChanServ :ACCESS #reg DEL helper")
+	founder.expect("helper has been removed from the access list of #reg")
+	founder.send("PRIVMSG ChanServ :ACCESS #reg DEL helper")
+	founder.expect("helper is not on the access list of #reg")
+
+	reg, _ := s.services.db.GetChannel("#reg")
+	if level := reg.accessLevel("helper"); level != "" {
+		t.Errorf("helper still has %q access", level)
+	}
+	if level := reg.accessLevel("FOUNDER"); level != "founder" {
+		t.Errorf("founder access = %q", level)
+	}
+}
+
+func TestChanServModeLock(t *testing.T) {
+	s := servicesTest(t, "founder")
+	founder := identifiedTest(t, s, "founder")
+
+	founder.send("JOIN #lock", "TOPIC #lock :kept topic")
+	founder.expect("TOPIC #lock")
+	founder.send("PRIVMSG ChanServ :REGISTER #lock")
+	founder.expect("is now registered")
+
+	founder.send("PRIVMSG ChanServ :SET #lock MLOCK +ntl-s 50")
+	founder.expect("MODE #lock +ntl-s 50")
+	founder.expect("Mode lock on #lock is now +ntl-s")
+
+	for _, change := range []string{"+s", "-n", "+l 10"} {
+		founder.send("MODE #lock " + change)
+		if line := founder.expect(" 742 "); !strings.Contains(line, "+ntl-s") {
+			t.Errorf("MODE %s: %q", change, line)
+		}
+	}
+	founder.send("MODE #lock +m")
+	founder.expect("MODE #lock +m")
+
+	// The channel is recreated with its topic and locked modes, and a user
+	// without access does not keep the creator's operator status
+	founder.send("PART #lock")
+	founder.sync()
+	if s.GetChannel("#lock") != nil {
+		t.Fatal("empty channel was not removed")
+	}
+
+	rando := registerTest(t, s, "rando")
+	rando.send("JOIN #lock")
+	lines := rando.readUntil(" 366 ")
+	if len(containing(lines, "kept topic")) == 0 {
+		t.Errorf("topic not restored: %q", lines)
+	}
+	if len(containing(lines, "MODE #lock -o rando")) == 0 {
+		t.Errorf("creator's operator status not removed: %q", lines)
+	}
+
+	channel := s.GetChannel("#lock")
+	for _, mode := range "ntl" {
+		if !channel.HasMode(mode) {
+			t.Errorf("locked mode %c not set on the recreated channel", mode)
+		}
+	}
+	if channel.HasMode('m') || channel.Limit() != 50 {
+		t.Errorf("recreated channel: +m %v, limit %d", channel.HasMode('m'), channel.Limit())
+	}
+	if channel.IsOperator(s.GetClient("rando")) {
+		t.Error("user without access kept operator status")
+	}
+}
+
+func TestParseModeLock(t *testing.T) {
+	on, off, key, limit, err := parseModeLock("+ntkl-s+s-k", []string{"key", "20"})
+	if err != nil || on != "ntls" || off != "k" || key != "" || limit != 20 {
+		t.Errorf("parseModeLock = %q %q %q %d %v", on, off, key, limit, err)
+	}
+	if _, _, _, _, err := parseModeLock("+o", nil); err == nil {
+		t.Error("status mode was accepted in a mode lock")
+	}
+	if _, _, _, _, err := parseModeLock("+l", []string{"x"}); err == nil {
+		t.Error("invalid limit was accepted")
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Numerics for STATS I and Y
+const (
+	RPL_STATSILINE = 215
+	RPL_STATSYLINE = 218
+)
+
+// classDNSTimeout bounds the reverse lookup made for hostname class masks
+const classDNSTimeout = 2 * time.Second
+
+// isHostnameMask returns true if a class host mask names hosts rather than
+// addresses. Only an address, a CIDR block or a wildcard made of address
+// characters is an address mask; hex digits count only with a colon, so
+// *.de and *.cafe are hostnames.
+func isHostnameMask(mask string) bool {
+	if net.ParseIP(mask) != nil {
+		return false
+	}
+	if _, _, err := net.ParseCIDR(mask); err == nil {
+		return false
+	}
+	allowed := "0123456789.*?/"
+	if strings.Contains(mask, ":") {
+		allowed += ":abcdef"
+	}
+	return strings.Trim(strings.ToLower(mask), allowed) != ""
+}
+
+// resolveHostname returns the forward-confirmed reverse DNS name of an
+// address, or "" if it has none
+func resolveHostname(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), classDNSTimeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if matchIPMask(addr, ip) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// classCandidate is what a connection is matched against the classes with
+type classCandidate struct {
+	ip       string
+	hostname func() string // Resolved on first use
+	tls      bool
+	port     int
+	account  string
+	password string
+}
+
+// matches returns true if every criterion the class sets matches the connection
+func (cl *ConnectionClass) matches(cand *classCandidate) bool {
+	if cl.TLS && !cand.tls {
+		return false
+	}
+	if len(cl.Ports) > 0 {
+		found := false
+		for _, port := range cl.Ports {
+			if port == cand.port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(cl.Accounts) > 0 {
+		if cand.account == "" {
+			return false
+		}
+		found := false
+		for _, mask := range cl.Accounts {
+			if matchWildcard(strings.ToLower(mask), strings.ToLower(cand.account)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(cl.Hosts) > 0 {
+		found := false
+		for _, mask := range cl.Hosts {
+			if isHostnameMask(mask) {
+				hostname := cand.hostname()
+				found = hostname != "" && matchWildcard(strings.ToLower(mask), strings.ToLower(hostname))
+			} else {
+				found = matchIPMask(mask, cand.ip)
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	// A class with a password only takes clients that send it, so everyone
+	// else falls through to the next class
+	return cl.Password == "" || checkOperPassword(cl.Password, cand.password)
+}
+
+// MatchClass returns the first class, in config order, that a connection
+// matches; the default class if none do
+func (c *Config) MatchClass(cand *classCandidate) *ConnectionClass {
+	for i := range c.Classes {
+		if c.Classes[i].matches(cand) {
+			return &c.Classes[i]
+		}
+	}
+	return c.Class("default")
+}
+
+// Class returns the connection class the client was placed in
+func (c *Client) Class() *ConnectionClass {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.class
+}
+
+// acceptLimit returns the most connections a class could allow from one
+// address, judged on what is known when the connection is accepted, or 0 if
+// a class that may match has no limit. Classes that need an account,
+// password or hostname are assumed to match.
+func (c *Config) acceptLimit(ip string, tls bool, port int) int {
+	limit := 0
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		if class.TLS && !tls {
+			continue
+		}
+		if len(class.Ports) > 0 {
+			found := false
+			for _, p := range class.Ports {
+				found = found || p == port
+			}
+			if !found {
+				continue
+			}
+		}
+		if len(class.Hosts) > 0 {
+			found := false
+			for _, mask := range class.Hosts {
+				found = found || isHostnameMask(mask) || matchIPMask(mask, ip)
+			}
+			if !found {
+				continue
+			}
+		}
+		if class.MaxPerIP == 0 {
+			return 0
+		}
+		if class.MaxPerIP > limit {
+			limit = class.MaxPerIP
+		}
+	}
+
+	// Connections no class matches end up in the default class
+	fallback := c.Class("default").MaxPerIP
+	if fallback == 0 {
+		return 0
+	}
+	if fallback > limit {
+		limit = fallback
+	}
+	return limit
+}
+
+// classCounts returns how many local clients have been admitted to a class,
+// in total and from one address
+func (s *Server) classCounts(name, ip string) (total, fromIP int) {
+	for _, client := range s.GetClients() {
+		client.mu.RLock()
+		admitted, class, host := client.admitted, client.class, client.host
+		client.mu.RUnlock()
+		if !admitted || class == nil || class.Name != name {
+			continue
+		}
+		total++
+		if host == ip {
+			fromIP++
+		}
+	}
+	return total, fromIP
+}
+
+// assignClass places a client that is completing registration in its
+// connection class and applies the class limits. It returns false, after
+// disconnecting the client, if the class is full.
+func (c *Client) assignClass() bool {
+	s := c.server
+
+	c.mu.RLock()
+	cand := &classCandidate{
+		ip:       c.host,
+		tls:      c.ssl,
+		port:     c.port,
+		account:  c.account,
+		password: c.password,
+	}
+	c.mu.RUnlock()
+
+	resolved := false
+	hostname := ""
+	cand.hostname = func() string {
+		if !resolved {
+			hostname = resolveHostname(cand.ip)
+			resolved = true
+		}
+		return hostname
+	}
+
+	class := s.config.MatchClass(cand)
+
+	// Counting and admitting under one lock keeps simultaneous
+	// registrations from all passing the same limit
+	s.classMu.Lock()
+	total, fromIP := s.classCounts(class.Name, cand.ip)
+	full := class.MaxClients > 0 && total >= class.MaxClients
+	tooMany := class.MaxPerIP > 0 && fromIP >= class.MaxPerIP
+	if !full && !tooMany {
+		c.mu.Lock()
+		c.class = class
+		c.admitted = true
+		c.mu.Unlock()
+	}
+	s.classMu.Unlock()
+
+	switch {
+	case full:
+		log.Printf("Class %s is full, refusing %s", class.Name, cand.ip)
+		c.Quit(fmt.Sprintf("Too many connections in class %s", class.Name))
+		return false
+	case tooMany:
+		c.Quit("Too many connections from your host")
+		return false
+	}
+	c.sendq.SetLimit(class.SendQ)
+	return true
+}
+
+// pingFrequencyLocked returns how long a connection may be silent before it
+// is PINGed; the caller must hold c.mu
+func (c *Client) pingFrequencyLocked() time.Duration {
+	if c.class != nil && c.class.PingFrequency > 0 {
+		return time.Duration(c.class.PingFrequency) * time.Second
+	}
+	return c.server.config.PingFrequencyDuration()
+}
+
+// floodLimits returns the class flood limits, falling back to the global ones;
+// the caller must hold c.mu
+func (c *Client) floodLimits() (lines int, window time.Duration, recvq int) {
+	lines, seconds := c.server.config.Limits.FloodLines, c.server.config.Limits.FloodSeconds
+	if c.class != nil {
+		if c.class.FloodLines > 0 {
+			lines = c.class.FloodLines
+		}
+		if c.class.FloodSeconds > 0 {
+			seconds = c.class.FloodSeconds
+		}
+		recvq = c.class.RecvQ
+	}
+	return lines, time.Duration(seconds) * time.Second, recvq
+}
+
+// sendClassStats answers STATS Y with each class's limits and STATS I with
+// what connections each class matches
+func (c *Client) sendClassStats(query string) {
+	s := c.server
+	for i := range s.config.Classes {
+		class := &s.config.Classes[i]
+		if query == "Y" {
+			ping := class.PingFrequency
+			if ping == 0 {
+				ping = s.config.Limits.PingFrequency
+			}
+			users, _ := s.classCounts(class.Name, "")
+			c.SendNumeric(RPL_STATSYLINE, fmt.Sprintf("Y %s %d 0 %d %d %d %d :%d users",
+				class.Name, ping, class.MaxClients, class.SendQ, class.RecvQ, class.MaxPerIP, users))
+			continue
+		}
+
+		hosts, accounts, ports := "*", "*", "*"
+		if len(class.Hosts) > 0 {
+			hosts = strings.Join(class.Hosts, ",")
+		}
+		if len(class.Accounts) > 0 {
+			accounts = strings.Join(class.Accounts, ",")
+		}
+		if len(class.Ports) > 0 {
+			var list []string
+			for _, port := range class.Ports {
+				list = append(list, strconv.Itoa(port))
+			}
+			ports = strings.Join(list, ",")
+		}
+		var flags []string
+		if class.TLS {
+			flags = append(flags, "tls")
+		}
+		if class.Password != "" {
+			flags = append(flags, "password")
+		}
+		c.SendNumeric(RPL_STATSILINE, fmt.Sprintf("I %s * %s %s %s :%s",
+			hosts, accounts, ports, class.Name, strings.Join(flags, ",")))
+	}
+}
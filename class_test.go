@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchClass(t *testing.T) {
+	config := &Config{Classes: []ConnectionClass{
+		{Name: "bots", Hosts: []string{"10.0.0.0/8"}, Password: "botpass"},
+		{Name: "secure", TLS: true, Ports: []int{6697}},
+		{Name: "staff", Accounts: []string{"staff-*"}},
+		{Name: "internal", Hosts: []string{"*.example.net"}},
+		{Name: "default"},
+	}}
+	hostname := func(name string) func() string {
+		return func() string { return name }
+	}
+
+	tests := []struct {
+		cand classCandidate
+		want string
+	}{
+		{classCandidate{ip: "10.1.2.3", password: "botpass", hostname: hostname("")}, "bots"},
+		{classCandidate{ip: "10.1.2.3", password: "wrong", hostname: hostname("")}, "default"},
+		{classCandidate{ip: "192.0.2.1", password: "botpass", hostname: hostname("")}, "default"},
+		{classCandidate{ip: "192.0.2.1", tls: true, port: 6697, hostname: hostname("")}, "secure"},
+		{classCandidate{ip: "192.0.2.1", tls: false, port: 6697, hostname: hostname("")}, "default"},
+		{classCandidate{ip: "192.0.2.1", account: "Staff-Bob", hostname: hostname("")}, "staff"},
+		{classCandidate{ip: "192.0.2.1", hostname: hostname("shell.example.net")}, "internal"},
+		{classCandidate{ip: "192.0.2.1", hostname: hostname("example.org")}, "default"},
+	}
+	for _, tt := range tests {
+		if got := config.MatchClass(&tt.cand).Name; got != tt.want {
+			t.Errorf("MatchClass(%+v) = %s, want %s", tt.cand, got, tt.want)
+		}
+	}
+}
+
+func TestIsHostnameMask(t *testing.T) {
+	for mask, want := range map[string]bool{
+		"10.0.0.0/8":    false,
+		"2001:db8::/32": false,
+		"192.0.2.*":     false,
+		"*.example.net": true,
+		"localhost":     true,
+		"2001:db8:*":    false,
+		"::ffff:*":      false,
+		"*.de":          true,
+		"*.be":          true,
+		"*.ca":          true,
+		"*.cafe.ad":     true,
+		"bad.cafe":      true,
+		"*":             false,
+	} {
+		if got := isHostnameMask(mask); got != want {
+			t.Errorf("isHostnameMask(%q) = %v, want %v", mask, got, want)
+		}
+	}
+}
+
+func TestAcceptLimit(t *testing.T) {
+	config := &Config{Classes: []ConnectionClass{
+		{Name: "bots", Hosts: []string{"10.0.0.0/8"}, Password: "botpass", MaxPerIP: 50},
+		{Name: "secure", TLS: true, MaxPerIP: 10},
+		{Name: "shells", Hosts: []string{"*.example.net"}, MaxPerIP: 5},
+		{Name: "default", MaxPerIP: 3},
+	}}
+
+	tests := []struct {
+		ip   string
+		tls  bool
+		want int
+	}{
+		{"10.1.2.3", false, 50},
+		{"192.0.2.1", false, 5},
+		{"192.0.2.1", true, 10},
+	}
+	for _, tt := range tests {
+		if got := config.acceptLimit(tt.ip, tt.tls, 6667); got != tt.want {
+			t.Errorf("acceptLimit(%s, %v) = %d, want %d", tt.ip, tt.tls, got, tt.want)
+		}
+	}
+
+	config.Classes = append(config.Classes[:3], ConnectionClass{Name: "default"})
+	if got := config.acceptLimit("192.0.2.1", false, 6667); got != 0 {
+		t.Errorf("unlimited default class: acceptLimit = %d", got)
+	}
+}
+
+func TestClassLimits(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Classes = []ConnectionClass{{Name: "default", MaxPerIP: 2}}
+	})
+
+	// Unregistered connections count from the moment they are accepted
+	first, second := dialTest(t, s), dialTest(t, s)
+	third := dialTest(t, s)
+	if line := third.expect("ERROR"); !strings.Contains(line, "Too many connections from your host") {
+		t.Errorf("third connection: %q", line)
+	}
+	first.send("NICK first", "USER first 0 * :First")
+	first.expect(" 001 ")
+	second.send("NICK second", "USER second 0 * :Second")
+	second.expect(" 001 ")
+}
+
+func TestClassAdmissionIsAtomic(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Classes = []ConnectionClass{{Name: "default", MaxClients: 1}}
+	})
+
+	// Every connection finishes registration at once; only one may get in
+	const clients = 8
+	var conns []*testConn
+	for i := 0; i < clients; i++ {
+		tc := dialTest(t, s)
+		tc.send(fmt.Sprintf("NICK racer%d", i))
+		conns = append(conns, tc)
+	}
+	for i, tc := range conns {
+		tc.send(fmt.Sprintf("USER racer%d 0 * :Racer", i))
+	}
+
+	admitted := 0
+	for _, tc := range conns {
+		tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			line, err := tc.r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("no welcome or refusal: %v", err)
+			}
+			if strings.Contains(line, " 001 ") {
+				admitted++
+				break
+			}
+			if strings.HasPrefix(line, "ERROR") {
+				if !strings.Contains(line, "Too many connections in class default") {
+					t.Errorf("refused with %q", line)
+				}
+				break
+			}
+		}
+	}
+	if admitted != 1 {
+		t.Errorf("%d clients admitted to a class of one", admitted)
+	}
+}
@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"math/rand"
 )
 
 type Client struct {
@@ -18,13 +18,19 @@ type Client struct {
 	user       string
 	realname   string
 	host       string
+	cloak      string // Host shown while +x is set
+	vhost      string // Host set by an oper with CHGHOST, shown instead of the host or cloak
 	server     *Server
 	channels   map[string]*Channel
 	modes      map[rune]bool
 	away       string
 	oper       bool
 	operClass  string // Operator class name
+	operName   string // Oper block the client opered up with
+	pendingOper   *Oper     // Oper block waiting for a two-factor code
+	pendingOperAt time.Time // When the password for pendingOper was accepted
 	ssl        bool
+	port       int // Local port the client connected to
 	registered bool
 	account    string // Services account name
 	connectTime time.Time // When the client connected
@@ -36,26 +42,58 @@ type Client struct {
 	// Flood protection
 	lastMessage  time.Time
 	messageCount int
+	messageBytes int // Bytes received in the current flood window
 
 	// SASL authentication
 	saslMech string
 	saslData string
+	certfp   string // SHA-256 fingerprint of the TLS client certificate
 
 	// IRCv3 capabilities
-	capabilities map[string]bool
+	capabilities   map[string]bool
+	capVersion     int  // CAP LS version requested by the client
+	capNegotiating bool // Registration is suspended until CAP END
+
+	// labeled-response: replies held back while a labeled command runs
+	label        string
+	labeling     bool
+	labelOwner   uint64 // Goroutine running the labeled command
+	labelReplies []*Message
+	labelBytes   int        // Size of labelReplies on the wire
+	labelMu      sync.Mutex // Separate from mu, since every Send checks it
 
 	// Server Notice Masks (snomasks) for operators
 	snomasks map[rune]bool
 
 	// Ping timeout tracking
-	lastPong       time.Time
+	lastPong       time.Time // Last time anything was received from the client
 	waitingForPong bool
+	pingSent       time.Time
+	unwatched      bool // Handle has finished, so no more deadlines are set
+
+	// Reason broadcast to channels when the connection ends
+	quitReason string
+
+	// Outgoing data is queued and written by a separate goroutine
+	class    *ConnectionClass
+	admitted bool // Counted against its class limits, from assignClass on
+	sendq    *sendQueue
+
+	// Server linking
+	nickTS    int64         // When the nick was last set, for collision resolution
+	remote    *RemoteServer // Server a remote client is on; nil for local clients
+	link      *Link         // Set when this connection is a link to another server
+	linkBlock *LinkBlock    // Link block of an outgoing link still being negotiated
+	password  string        // Password sent with PASS
+	passSID   string        // SID sent with a TS6 PASS
 
 	mu sync.RWMutex
 }
 
 func NewClient(conn net.Conn, server *Server) *Client {
 	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	_, localPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+	port, _ := strconv.Atoi(localPort)
 
 	// Check if connection is SSL
 	isSSL := false
@@ -63,24 +101,30 @@ func NewClient(conn net.Conn, server *Server) *Client {
 		isSSL = true
 	}
 
-	// Generate unique client ID
-	clientID := fmt.Sprintf("%s_%d_%d", host, time.Now().Unix(), rand.Intn(10000))
+	// The client ID is the TS6 UID other servers know the client by
+	clientID := server.nextUID()
+
+	class := server.config.Class("default")
 
 	client := &Client{
 		clientID:       clientID,
 		conn:           conn,
 		host:           host,
+		cloak:          cloakHost(server.config.Privacy.CloakKey, server.config.Privacy.MaskedHostSuffix, host),
 		server:         server,
 		channels:       make(map[string]*Channel),
 		modes:          make(map[rune]bool),
 		capabilities:   make(map[string]bool),
 		snomasks:       make(map[rune]bool),
 		ssl:            isSSL,
+		port:           port,
 		connectTime:    time.Now(),
 		lastActivity:   time.Now(),
 		lastMessage:    time.Now(),
 		lastPong:       time.Now(),
 		waitingForPong: false,
+		class:          class,
+		sendq:          newSendQueue(conn, class.SendQ),
 	}
 
 	// Set SSL user mode if connected via SSL
@@ -91,30 +135,45 @@ func NewClient(conn net.Conn, server *Server) *Client {
 	return client
 }
 
+// SendMessage sends a raw protocol line to the client. The line is parsed
+// and re-serialized so it is subject to the same limits as Send.
 func (c *Client) SendMessage(message string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	msg, err := ParseMessage(message)
+	if err != nil {
+		return
+	}
+	c.Send(msg)
+}
 
-	// Add connection health check
-	if c.conn == nil {
+// Send serializes a message and writes it to the client, keeping only the
+// tags the client negotiated. A TAGMSG is nothing without its tags, so
+// clients without message-tags do not get it at all.
+func (c *Client) Send(msg *Message) {
+	if msg.Command == "TAGMSG" && !c.HasCapability("message-tags") {
 		return
 	}
+	msg = c.tagsFor(msg)
+	if c.holdReply(msg) {
+		return
+	}
+	c.writeLine(msg.Line())
+}
 
-	// Set write deadline to prevent hanging
-	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
-	defer c.conn.SetWriteDeadline(time.Time{}) // Clear deadline
+func (c *Client) writeLine(line string) {
+	if c.sendq == nil {
+		return
+	}
 
-	_, err := fmt.Fprintf(c.conn, "%s\r\n", message)
-	if err != nil {
-		// Log the error but don't panic - connection will be cleaned up
-		if c.server != nil {
-			log.Printf("Error sending message to %s: %v", c.Nick(), err)
-		}
-	} else {
-		// Log successful PONG sends for debugging
-		if strings.HasPrefix(message, "PONG") {
-			log.Printf("Successfully sent to client %s: %s", c.Nick(), message)
+	// A client that cannot keep up is disconnected rather than allowed to
+	// hold up everyone sending to it
+	if err := c.sendq.Enqueue(line); err == errSendQExceeded {
+		c.mu.Lock()
+		if c.quitReason == "" {
+			c.quitReason = "Max SendQ exceeded"
 		}
+		nick := c.nick
+		c.mu.Unlock()
+		log.Printf("Max SendQ exceeded for %s (%s), limit %d bytes", nick, c.Host(), c.Class().SendQ)
 	}
 }
 
@@ -126,7 +185,29 @@ func (c *Client) SendNumeric(code int, message string) {
 	if c.server == nil || c.server.config == nil {
 		return
 	}
-	c.SendFrom(c.server.config.Server.Name, fmt.Sprintf("%03d %s %s", code, c.Nick(), message))
+	params, trailing := splitParams(message)
+	msg := NewMessage(c.server.config.Server.Name, fmt.Sprintf("%03d", code), append([]string{c.displayNick()}, params...)...)
+	msg.ForceTrailing = trailing
+	c.Send(msg)
+}
+
+// sendFail sends an IRCv3 standard FAIL reply: the command, a machine
+// readable code, optional context and a description
+func (c *Client) sendFail(command, code string, context ...string) {
+	params := append([]string{command, code}, context...)
+	msg := NewMessage(c.server.config.Server.Name, "FAIL", params...)
+	msg.ForceTrailing = true
+	c.Send(msg)
+}
+
+// displayNick returns the nick to address the client by in replies, or "*"
+// if the client has not chosen one yet
+func (c *Client) displayNick() string {
+	nick := c.Nick()
+	if nick == "" {
+		return "*"
+	}
+	return nick
 }
 
 func (c *Client) Nick() string {
@@ -139,6 +220,39 @@ func (c *Client) SetNick(nick string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.nick = nick
+	c.nickTS = time.Now().Unix()
+}
+
+// UID returns the TS6 unique ID of the client
+func (c *Client) UID() string {
+	return c.clientID
+}
+
+// NickTS returns when the client's nick was last set
+func (c *Client) NickTS() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nickTS
+}
+
+// IsRemote returns true if the client is connected to another server
+func (c *Client) IsRemote() bool {
+	return c.remote != nil
+}
+
+// ServerName returns the name of the server the client is connected to
+func (c *Client) ServerName() string {
+	if c.remote != nil {
+		return c.remote.Name
+	}
+	return c.server.config.Server.Name
+}
+
+// Link returns the server link carried by this connection, or nil
+func (c *Client) Link() *Link {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.link
 }
 
 func (c *Client) User() string {
@@ -171,35 +285,49 @@ func (c *Client) Host() string {
 	return c.host
 }
 
-// HostForUser returns the appropriate hostname to show to a requesting user
-// based on privacy settings and the requester's privileges
-func (c *Client) HostForUser(requester *Client) string {
+// DisplayHost returns the host shown in the client's prefix: the cloak while
+// +x is set, otherwise the real host
+func (c *Client) DisplayHost() string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	
-	// If host hiding is disabled, always show real host
-	if !c.server.config.Privacy.HideHostsFromUsers {
-		return c.host
+	if c.vhost != "" {
+		return c.vhost
 	}
-	
-	// If requester is an operator and bypass is enabled, show real host
-	if requester != nil && requester.IsOper() && c.server.config.Privacy.OperBypassHostHide {
-		return c.host
+	if c.modes['x'] {
+		return c.cloak
 	}
-	
-	// If requester is viewing themselves, show real host
-	if requester != nil && requester.Nick() == c.Nick() {
-		return c.host
+	return c.host
+}
+
+// hostmasks returns the nick!user@host masks that bans and invites are
+// matched against: one for the real host, and one each for the cloak and
+// the vhost when the client has them, since either may be what others see
+func (c *Client) hostmasks() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	masks := []string{fmt.Sprintf("%s!%s@%s", c.nick, c.user, c.host)}
+	for _, host := range []string{c.cloak, c.vhost} {
+		if host != "" && host != c.host {
+			masks = append(masks, fmt.Sprintf("%s!%s@%s", c.nick, c.user, host))
+		}
 	}
-	
-	// Check if user has +x mode set (host masking)
-	if c.HasMode('x') {
-		// Return masked hostname
-		return c.nick + "." + c.server.config.Privacy.MaskedHostSuffix
+	return masks
+}
+
+// HostForUser returns the appropriate hostname to show to a requesting user:
+// the real host for the client itself and, when configured, for operators;
+// the displayed host for everyone else
+func (c *Client) HostForUser(requester *Client) string {
+	if requester == c {
+		return c.Host()
 	}
-	
-	// Default behavior: show masked host when privacy is enabled
-	return c.nick + "." + c.server.config.Privacy.MaskedHostSuffix
+
+	// If requester is an operator and bypass is enabled, show real host
+	if requester != nil && requester.IsOper() && c.server.config.Privacy.OperBypassHostHide {
+		return c.Host()
+	}
+
+	return c.DisplayHost()
 }
 
 // canSeeWhoisInfo checks if the requester can see specific WHOIS information about the target
@@ -217,6 +345,10 @@ func (c *Client) canSeeWhoisInfo(target *Client, infoType string) bool {
 		toEveryone = config.ShowSSLStatus.ToEveryone
 		toOpers = config.ShowSSLStatus.ToOpers
 		toSelf = config.ShowSSLStatus.ToSelf
+	case "certfp":
+		toEveryone = config.ShowCertFP.ToEveryone
+		toOpers = config.ShowCertFP.ToOpers
+		toSelf = config.ShowCertFP.ToSelf
 	case "idle_time":
 		toEveryone = config.ShowIdleTime.ToEveryone
 		toOpers = config.ShowIdleTime.ToOpers
@@ -334,20 +466,26 @@ func (c *Client) OperClass() string {
 	return c.operClass
 }
 
+// SetOperName records the oper block the client opered up with
+func (c *Client) SetOperName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operName = name
+}
+
+// OperName returns the oper block the client opered up with
+func (c *Client) OperName() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.operName
+}
+
 // HasOperPermission checks if the client has a specific operator permission
 func (c *Client) HasOperPermission(permission string) bool {
 	if !c.IsOper() {
 		return false
 	}
-	
-	// Load oper config and check permissions
-	operConfig, err := LoadOperConfig(c.server.config.OperConfig.ConfigFile)
-	if err != nil || !c.server.config.OperConfig.Enable {
-		// Fallback to legacy system
-		return true // Basic oper permissions
-	}
-	
-	return operConfig.HasPermission(c.Nick(), permission)
+	return c.server.OperConfig().HasPermission(c.OperName(), permission)
 }
 
 // GetOperRank returns the operator rank (higher number = higher authority)
@@ -355,13 +493,7 @@ func (c *Client) GetOperRank() int {
 	if !c.IsOper() {
 		return 0
 	}
-	
-	operConfig, err := LoadOperConfig(c.server.config.OperConfig.ConfigFile)
-	if err != nil || !c.server.config.OperConfig.Enable {
-		return 1 // Basic rank for legacy
-	}
-	
-	return operConfig.GetOperRank(c.Nick())
+	return c.server.OperConfig().GetOperRank(c.OperName())
 }
 
 // CanOperateOn checks if this operator can perform actions on another operator
@@ -369,17 +501,12 @@ func (c *Client) CanOperateOn(target *Client) bool {
 	if !c.IsOper() {
 		return false
 	}
-	
+
 	if !target.IsOper() {
 		return true // Opers can operate on regular users
 	}
-	
-	operConfig, err := LoadOperConfig(c.server.config.OperConfig.ConfigFile)
-	if err != nil || !c.server.config.OperConfig.Enable {
-		return true // Legacy behavior
-	}
-	
-	return operConfig.CanOperateOn(c.Nick(), target.Nick())
+
+	return c.server.OperConfig().CanOperateOn(c.OperName(), target.OperName())
 }
 
 // GetOperSymbol returns the symbol for this operator class
@@ -387,17 +514,12 @@ func (c *Client) GetOperSymbol() string {
 	if !c.IsOper() {
 		return ""
 	}
-	
-	operConfig, err := LoadOperConfig(c.server.config.OperConfig.ConfigFile)
-	if err != nil || !c.server.config.OperConfig.Enable {
-		return "*" // Default symbol
-	}
-	
-	class := operConfig.GetOperClass(c.OperClass())
+
+	class := c.server.OperConfig().GetOperClass(c.OperClass())
 	if class == nil {
 		return "*"
 	}
-	
+
 	return class.Symbol
 }
 
@@ -524,8 +646,8 @@ func (c *Client) IsVisibleTo(target *Client) bool {
 		return true
 	}
 	
-	// If target is an operator, stealth users are visible
-	if target.IsOper() {
+	// Operators with who_override see stealth users
+	if target.HasOperPermission("who_override") {
 		return true
 	}
 	
@@ -538,6 +660,17 @@ func (c *Client) IsVisibleTo(target *Client) bool {
 	return false
 }
 
+// operOverride checks whether an oper may act in a channel without channel
+// status using the named permission, and announces it on the 'o' snomask
+func (c *Client) operOverride(permission, target, action string) bool {
+	if !c.HasOperPermission(permission) {
+		return false
+	}
+	c.sendSnomask('o', fmt.Sprintf("OVERRIDE: %s %s (%s)", c.Nick(), action, permission))
+	c.audit("OVERRIDE", target, "ok", action)
+	return true
+}
+
 // CanBypassChannelRestrictions returns true if the client can bypass channel restrictions
 func (c *Client) CanBypassChannelRestrictions() bool {
 	return c.HasGodMode()
@@ -573,8 +706,61 @@ func (c *Client) GetChannels() map[string]*Channel {
 	return channels
 }
 
+// Quit disconnects the client. The reason is broadcast to common channels
+// when the connection handler cleans up.
+func (c *Client) Quit(reason string) {
+	c.mu.Lock()
+	if c.quitReason == "" {
+		c.quitReason = reason
+	}
+	c.mu.Unlock()
+
+	c.SendMessage(fmt.Sprintf("ERROR :Closing Link: %s (%s)", c.Host(), reason))
+	c.closeConn()
+}
+
+// closeConn closes the connection once everything queued has been written
+func (c *Client) closeConn() {
+	c.endLabel()
+	if c.sendq != nil {
+		c.sendq.Close()
+	} else if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// QuitReason returns the reason the client is disconnecting
+func (c *Client) QuitReason() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.quitReason == "" {
+		return "Client closed connection"
+	}
+	return c.quitReason
+}
+
+// commonChannelPeers returns every other client sharing a channel with c
+func (c *Client) commonChannelPeers() []*Client {
+	seen := make(map[*Client]bool)
+	var peers []*Client
+	for _, channel := range c.GetChannels() {
+		// A ghost's nick changes and quits are not shown to the channel
+		if channel.IsGhost(c) {
+			continue
+		}
+		for _, client := range channel.GetClients() {
+			if client == c || seen[client] {
+				continue
+			}
+			seen[client] = true
+			peers = append(peers, client)
+		}
+	}
+	return peers
+}
+
 func (c *Client) Prefix() string {
-	return fmt.Sprintf("%s!%s@%s", c.Nick(), c.User(), c.Host())
+	return fmt.Sprintf("%s!%s@%s", c.Nick(), c.User(), c.DisplayHost())
 }
 
 // sendSnomask sends a server notice to all operators with the specified snomask
@@ -611,16 +797,9 @@ func (c *Client) getServerConfig() *Config {
 	return c.server.config
 }
 
-// getRegistrationTimeout safely gets the registration timeout duration
-func (c *Client) getRegistrationTimeout() time.Duration {
-	config := c.getServerConfig()
-	if config == nil {
-		return 60 * time.Second // default 60 seconds
-	}
-	return config.RegistrationTimeoutDuration()
-}
-
-func (c *Client) CheckFlood() bool {
+// CheckFlood counts a received line of size bytes against the client's
+// flood limits and returns true if they are exceeded
+func (c *Client) CheckFlood(size int) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -647,21 +826,36 @@ func (c *Client) CheckFlood() bool {
 		return c.messageCount > 100
 	}
 
-	// For registered clients, use the configured limits but make them more reasonable
+	// For registered clients, use the class limits but make them more reasonable
+	floodLines, floodWindow, recvq := c.floodLimits()
 	now := time.Now()
-	floodWindow := time.Duration(c.server.config.Limits.FloodSeconds) * time.Second
 	if now.Sub(c.lastMessage) > floodWindow {
 		c.messageCount = 0
+		c.messageBytes = 0
 	}
 
 	c.messageCount++
+	c.messageBytes += size
 	c.lastMessage = now
 
+	if recvq > 0 && c.messageBytes > recvq {
+		return true
+	}
+
 	// Use higher limits than configured for better user experience
-	maxLines := c.server.config.Limits.FloodLines * 3 // Triple the configured limit
+	maxLines := floodLines * 3 // Triple the configured limit
 	return c.messageCount > maxLines
 }
 
+// addFloodPenalty charges a costly command against the flood limit
+func (c *Client) addFloodPenalty(lines int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.oper {
+		c.messageCount += lines
+	}
+}
+
 func (c *Client) HasCapability(cap string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -686,14 +880,32 @@ func (c *Client) Handle() {
 		}
 
 		// Cleanup
-		if c.conn != nil {
-			c.conn.Close()
+		c.closeConn()
+		if c.server != nil {
+			c.server.unwatchLiveness(c)
+		}
+		if link := c.Link(); link != nil {
+			c.server.linkClosed(link, c.QuitReason())
+			return
 		}
 		if c.server != nil {
 			c.server.RemoveClient(c)
 		}
 
-		// Part all channels
+		// Tell everyone sharing a channel and the rest of the network, then part all channels
+		if c.IsRegistered() {
+			quitMsg := c.taggedMessage("QUIT", c.QuitReason())
+			for _, peer := range c.commonChannelPeers() {
+				peer.Send(quitMsg)
+			}
+			if c.server != nil {
+				c.server.propagateQuit(c, c.QuitReason())
+				c.server.spyEvent(c, "", "quit ("+c.QuitReason()+")")
+			}
+		}
+		if c.server != nil {
+			c.server.spyRemove(c)
+		}
 		for _, channel := range c.GetChannels() {
 			channel.RemoveClient(c)
 			if len(channel.GetClients()) == 0 && c.server != nil {
@@ -710,102 +922,60 @@ func (c *Client) Handle() {
 
 	scanner := bufio.NewScanner(c.conn)
 
-	// Set maximum line length to prevent memory exhaustion
-	const maxLineLength = 4096
+	// Set maximum line length to prevent memory exhaustion (tags + body)
+	const maxLineLength = maxClientTagsLength + maxMessageLength
 	scanner.Buffer(make([]byte, maxLineLength), maxLineLength)
 
-	// Set read deadline for scanner
-	c.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-
-	// Set registration timeout
-	registrationTimer := time.NewTimer(c.getRegistrationTimeout())
-	defer registrationTimer.Stop()
-	registrationActive := true
-
-	// Set up ping timeout mechanism
-	pingInterval := 90 * time.Second // Send ping every 90 seconds
-	// Note: We don't enforce ping timeouts, let clients handle their own LAG detection
-
-	pingTicker := time.NewTicker(pingInterval)
-	defer pingTicker.Stop()
-
-	// Initialize ping state
-	c.mu.Lock()
-	c.lastPong = time.Now()
-	c.waitingForPong = false
-	c.mu.Unlock()
+	// Liveness (registration and ping timeouts) is tracked by the server's timer wheel
+	c.server.watchLiveness(c)
 
 	for {
-		select {
-		case <-registrationTimer.C:
-			if registrationActive && !c.IsRegistered() {
-				log.Printf("Registration timeout for client from %s", c.Host())
-				c.SendMessage("ERROR :Registration timeout")
-				return
-			}
-		case <-pingTicker.C:
-			if c.IsRegistered() {
-				c.mu.RLock()
-				lastActivity := c.lastActivity
-				c.mu.RUnlock()
-
-				// Only send server ping if client has been inactive for a while
-				// Don't worry about ping timeouts - let the client handle LAG detection
-				timeSinceActivity := time.Since(lastActivity)
-				
-				if timeSinceActivity > 60*time.Second {
-					// Send a gentle server ping, but don't enforce timeouts
-					c.SendMessage(fmt.Sprintf("PING :%s", c.server.config.Server.Name))
-					log.Printf("Sent keepalive PING to %s (inactive for %v)", c.Nick(), timeSinceActivity)
-				}
-			}
-		default:
-			// Reset read deadline for each message
-			c.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-
-			if !scanner.Scan() {
-				// Check for scanner error
-				if err := scanner.Err(); err != nil {
-					log.Printf("Scanner error for client %s: %v", c.Nick(), err)
-				}
-				return
+		if !scanner.Scan() {
+			// Check for scanner error
+			if err := scanner.Err(); err != nil {
+				log.Printf("Scanner error for client %s: %v", c.Nick(), err)
 			}
+			return
+		}
 
-			// Enhanced flood checking
-			if c.CheckFlood() {
-				c.SendMessage("ERROR :Excess Flood")
-				return
-			}
+		c.markAlive()
 
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" {
-				continue
+		// Server links carry the whole network's traffic and are not flood limited
+		if link := c.Link(); link != nil {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				link.handleLine(line)
 			}
+			continue
+		}
 
-			// Additional input validation
-			if len(line) > 4096 {
-				c.SendMessage("ERROR :Line too long")
-				continue
-			}
+		// Enhanced flood checking
+		if c.CheckFlood(len(scanner.Bytes())) {
+			c.SendMessage("ERROR :Excess Flood")
+			return
+		}
 
-			// Handle the message through the server command router
-			if c.server != nil {
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							log.Printf("Panic handling message from %s: %v", c.Nick(), r)
-							c.SendMessage("ERROR :Internal server error")
-						}
-					}()
-					c.server.HandleMessage(c, line)
-				}()
-			}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
-			// Stop registration timer once registered
-			if c.IsRegistered() && registrationActive {
-				registrationTimer.Stop()
-				registrationActive = false
-			}
+		// Additional input validation
+		if lineTooLong(line) {
+			c.SendNumeric(ERR_INPUTTOOLONG, ":Input line was too long")
+			continue
+		}
+
+		// Handle the message through the server command router
+		if c.server != nil {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("Panic handling message from %s: %v", c.Nick(), r)
+						c.SendMessage("ERROR :Internal server error")
+					}
+				}()
+				c.server.HandleMessage(c, line)
+			}()
 		}
 	}
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuit(t *testing.T) {
+	s := newTestServer(t)
+	alice := registerTest(t, s, "alice")
+	bob := registerTest(t, s, "bob")
+	alice.send("JOIN #quit")
+	alice.expect(" 366 ")
+	bob.send("JOIN #quit")
+	bob.expect(" 366 ")
+	alice.expect("JOIN")
+
+	bob.send("QUIT :gone fishing")
+	if line := bob.expect("ERROR"); !strings.Contains(line, "(Quit: gone fishing)") {
+		t.Errorf("closing link: %q", line)
+	}
+	if line := alice.expect("QUIT"); !strings.HasPrefix(line, ":bob!") || !strings.HasSuffix(line, "QUIT :Quit: gone fishing") {
+		t.Errorf("peer saw %q", line)
+	}
+	if lines := alice.sync(); len(containing(lines, "QUIT")) != 0 {
+		t.Errorf("QUIT sent more than once: %q", lines)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// RPL_HOSTHIDDEN tells a client its displayed host changed
+const RPL_HOSTHIDDEN = 396
+
+// cloakSegment hashes one part of a host with the cloak key
+func cloakSegment(key, data string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)[:4]))
+}
+
+// cloakHost derives the cloaked form of a real IP address or hostname.
+//
+// Each cloak carries a hash of the whole address followed by hashes of its
+// wider networks, so bans on the trailing parts still cover a range:
+//
+//	IPv4 a.b.c.d   ->  H(a.b.c.d).H(a.b.c).H(a.b).IP     (*.H(a.b.c).H(a.b).IP is the /24)
+//	IPv6           ->  H(/128):H(/64):H(/48):IP
+//	host.isp.net   ->  H(host.isp.net).isp.net
+//
+// Hostnames with fewer than three labels get the configured suffix instead
+// of their domain.
+func cloakHost(key, suffix, host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			return fmt.Sprintf("%s.%s.%s.IP",
+				cloakSegment(key, v4.String()),
+				cloakSegment(key, fmt.Sprintf("%d.%d.%d", v4[0], v4[1], v4[2])),
+				cloakSegment(key, fmt.Sprintf("%d.%d", v4[0], v4[1])))
+		}
+
+		v6 := ip.To16()
+		groups := make([]string, 8)
+		for i := range groups {
+			groups[i] = fmt.Sprintf("%x", uint16(v6[i*2])<<8|uint16(v6[i*2+1]))
+		}
+		return fmt.Sprintf("%s:%s:%s:IP",
+			cloakSegment(key, strings.Join(groups, ":")),
+			cloakSegment(key, strings.Join(groups[:4], ":")),
+			cloakSegment(key, strings.Join(groups[:3], ":")))
+	}
+
+	host = strings.ToLower(host)
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 {
+		return cloakSegment(key, host) + "." + suffix
+	}
+	return cloakSegment(key, host) + "." + strings.Join(labels[1:], ".")
+}
+
+// setCloaked turns the cloak (+x) on or off and tells the client and those
+// sharing a channel with it about the new host. It returns false if the mode
+// was already in that state.
+func (c *Client) setCloaked(cloaked bool) bool {
+	if c.HasMode('x') == cloaked {
+		return false
+	}
+
+	oldPrefix := c.Prefix()
+	c.SetMode('x', cloaked)
+	if !c.IsRemote() {
+		c.SendNumeric(RPL_HOSTHIDDEN, c.DisplayHost()+" :is now your displayed host")
+	}
+	c.sendChghost(oldPrefix)
+	return true
+}
+
+// sendChghost announces a changed visible host to the client itself and to
+// the clients sharing a channel with it that support chghost. Nothing is
+// sent if the displayed host did not actually change, e.g. +x under a vhost.
+func (c *Client) sendChghost(oldPrefix string) {
+	if oldPrefix == c.Prefix() {
+		return
+	}
+	msg := NewMessage(oldPrefix, "CHGHOST", c.User(), c.DisplayHost())
+	stampTags(msg, time.Now(), newMsgID(), c.Account())
+	c.notifyPeers("chghost", msg, true)
+}
+
+// validVhost checks a host given to CHGHOST: a hostname or address of at
+// most 63 characters that cannot be mistaken for a parameter or a mask
+func validVhost(host string) bool {
+	if host == "" || len(host) > 63 || host[0] == ':' || host[0] == '-' {
+		return false
+	}
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.' || r == '-' || r == ':' || r == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setVhost sets the host the client is shown with, or removes it with "",
+// and tells the client and those sharing a channel with it
+func (c *Client) setVhost(host string) {
+	oldPrefix := c.Prefix()
+	c.mu.Lock()
+	c.vhost = host
+	c.mu.Unlock()
+
+	if !c.IsRemote() {
+		c.SendNumeric(RPL_HOSTHIDDEN, c.DisplayHost()+" :is now your displayed host")
+	}
+	c.sendChghost(oldPrefix)
+}
+
+// handleChghost handles CHGHOST <nick> <host>; a host of - removes the vhost
+func (c *Client) handleChghost(msg *Message) {
+	target := c.server.GetClient(msg.Params[0])
+	if target == nil {
+		c.SendNumeric(ERR_NOSUCHNICK, msg.Params[0]+" :No such nick/channel")
+		return
+	}
+
+	host := msg.Params[1]
+	if host == "-" {
+		host = ""
+	} else if !validVhost(host) {
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Invalid host %s", c.server.config.Server.Name, c.Nick(), host))
+		return
+	}
+
+	target.setVhost(host)
+	c.server.propagateChghost(c, target, msg.Params[1])
+	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** %s is now shown as %s", c.server.config.Server.Name, c.Nick(), target.Nick(), target.Prefix()))
+	c.sendSnomask('o', fmt.Sprintf("%s changed the host of %s to %s", c.Nick(), target.Nick(), target.DisplayHost()))
+	c.audit("CHGHOST", target.Nick(), "ok", msg.Params[1])
+}
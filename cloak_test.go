@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCloakHostKeepsNetworks(t *testing.T) {
+	const key = "0123456789abcdef"
+
+	tail := func(cloak string) string { return cloak[strings.Index(cloak, "."):] }
+
+	a := cloakHost(key, "users.test", "192.0.2.10")
+	b := cloakHost(key, "users.test", "192.0.2.99")
+	c := cloakHost(key, "users.test", "192.0.3.10")
+
+	if a != cloakHost(key, "users.test", "192.0.2.10") {
+		t.Fatalf("cloak is not deterministic")
+	}
+	if strings.Contains(a, "192") {
+		t.Errorf("cloak %q leaks the address", a)
+	}
+	if a == b || tail(a) != tail(b) {
+		t.Errorf("addresses in one /24 should share the cloak tail: %q %q", a, b)
+	}
+	if tail(a) == tail(c) {
+		t.Errorf("addresses in different /24s share the cloak tail: %q %q", a, c)
+	}
+	if cloakHost("another-key-0000", "users.test", "192.0.2.10") == a {
+		t.Errorf("cloak does not depend on the key")
+	}
+
+	if got := cloakHost(key, "users.test", "host.isp.example"); !strings.HasSuffix(got, ".isp.example") {
+		t.Errorf("hostname cloak %q should keep the domain", got)
+	}
+	if got := cloakHost(key, "users.test", "2001:db8::1"); !strings.HasSuffix(got, ":IP") {
+		t.Errorf("IPv6 cloak %q has the wrong form", got)
+	}
+}
+
+func TestValidVhost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"staff.example.net":     true,
+		"2001:db8::1":           true,
+		"users/alice":           true,
+		"":                      false,
+		"-leading.dash":         false,
+		":colon":                false,
+		"has space":             false,
+		"bad!host":              false,
+		"*.example.net":         false,
+		strings.Repeat("a", 64): false,
+	} {
+		if got := validVhost(host); got != want {
+			t.Errorf("validVhost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestCloakKeyValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Privacy.CloakKey = ""
+	if err := config.Validate(); err != nil || len(config.Privacy.CloakKey) != 64 {
+		t.Errorf("missing key: %v, generated %q", err, config.Privacy.CloakKey)
+	}
+
+	for _, key := range []string{"short", "change-this-to-a-long-random-secret"} {
+		config := DefaultConfig()
+		config.Privacy.CloakKey = key
+		if err := config.Validate(); err == nil {
+			t.Errorf("cloak key %q accepted", key)
+		}
+	}
+
+	// The shipped example config must not carry a usable key
+	config, err := LoadConfig("configs/config.json")
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.Privacy.CloakKey != "" {
+		t.Errorf("example config sets cloak_key %q", config.Privacy.CloakKey)
+	}
+}
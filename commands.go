@@ -48,6 +48,7 @@ const (
 	ERR_NOORIGIN          = 409
 	ERR_NORECIPIENT       = 411
 	ERR_NOTEXTTOSEND      = 412
+	ERR_INPUTTOOLONG      = 417
 	ERR_UNKNOWNCOMMAND    = 421
 	ERR_NOMOTD            = 422
 	ERR_NONICKNAMEGIVEN   = 431
@@ -87,19 +88,13 @@ const (
 	RPL_SNOMASK           = 8
 	RPL_GLOBALNOTICE      = 710
 	RPL_OPERWALL          = 711
+	RPL_PRIVS             = 270
+	RPL_WHOISCERTFP       = 276
 )
 
 // handleNick handles NICK command
-func (c *Client) handleNick(parts []string) {
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "NICK :Not enough parameters")
-		return
-	}
-
-	newNick := parts[1]
-	if len(newNick) > 0 && newNick[0] == ':' {
-		newNick = newNick[1:]
-	}
+func (c *Client) handleNick(msg *Message) {
+	newNick := msg.Params[0]
 
 	// Validate nickname
 	if !isValidNickname(newNick) {
@@ -107,50 +102,57 @@ func (c *Client) handleNick(parts []string) {
 		return
 	}
 
-	// Check if nick is already in use
-	if existing := c.server.GetClient(newNick); existing != nil && existing != c {
+	// Check if nick is already in use (service nicks are always reserved)
+	if existing := c.server.GetClient(newNick); (existing != nil && existing != c) ||
+		(c.server.services != nil && c.server.services.IsServiceNick(newNick)) {
 		c.SendNumeric(ERR_NICKNAMEINUSE, newNick+" :Nickname is already in use")
 		return
 	}
 
+	if !c.IsRegistered() {
+		c.SetNick(newNick)
+		c.checkRegistration()
+		return
+	}
+
+	if newNick != c.Nick() {
+		c.changeNick(newNick)
+	}
+}
+
+// changeNick renames a registered client, telling it and everyone sharing a channel
+func (c *Client) changeNick(newNick string) {
 	oldNick := c.Nick()
+	message := fmt.Sprintf(":%s NICK :%s", c.Prefix(), newNick)
 	c.SetNick(newNick)
 
-	// If already registered, notify channels
-	if c.IsRegistered() && oldNick != "" {
-		message := fmt.Sprintf(":%s NICK :%s", c.Prefix(), newNick)
-		for _, channel := range c.GetChannels() {
-			channel.Broadcast(message, nil)
-		}
-
-		// Send snomask notification for nick change
-		if c.server != nil && oldNick != newNick {
-			c.server.sendSnomask('n', fmt.Sprintf("Nick change: %s -> %s (%s@%s)",
-				oldNick, newNick, c.User(), c.Host()))
-		}
+	c.SendMessage(message)
+	for _, peer := range c.commonChannelPeers() {
+		peer.SendMessage(message)
 	}
 
-	c.checkRegistration()
-}
+	// Send snomask notification for nick change
+	c.server.sendSnomask('n', fmt.Sprintf("Nick change: %s -> %s (%s@%s)",
+		oldNick, newNick, c.User(), c.Host()))
+	c.server.propagateNick(c)
+	c.server.spyEvent(c, oldNick, "changed nick from "+oldNick)
+	c.server.presenceNick(c, oldNick)
 
-// handleUser handles USER command
-func (c *Client) handleUser(parts []string) {
-	if len(parts) < 5 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "USER :Not enough parameters")
-		return
+	if c.server.services != nil {
+		c.server.services.CheckNick(c)
 	}
+}
 
+// handleUser handles USER command
+func (c *Client) handleUser(msg *Message) {
 	if c.IsRegistered() {
 		c.SendNumeric(ERR_ALREADYREGISTRED, ":You may not reregister")
 		return
 	}
 
-	c.SetUser(parts[1])
-	// parts[2] and parts[3] are ignored (mode and unused)
-	realname := strings.Join(parts[4:], " ")
-	if len(realname) > 0 && realname[0] == ':' {
-		realname = realname[1:]
-	}
+	c.SetUser(msg.Params[0])
+	// msg.Params[1] and msg.Params[2] are ignored (mode and unused)
+	realname := msg.Params[3]
 	c.SetRealname(realname)
 
 	c.checkRegistration()
@@ -158,9 +160,13 @@ func (c *Client) handleUser(parts []string) {
 
 // checkRegistration checks if client is ready to be registered
 func (c *Client) checkRegistration() {
-	if !c.IsRegistered() && c.Nick() != "" && c.User() != "" {
+	if !c.IsRegistered() && c.Nick() != "" && c.User() != "" && !c.IsCapNegotiating() {
+		if !c.checkBans() || !c.assignClass() {
+			return
+		}
 		c.SetRegistered(true)
 		c.sendWelcome()
+		c.server.presenceOnline(c)
 	}
 }
 
@@ -173,34 +179,68 @@ func (c *Client) sendWelcome() {
 		return
 	}
 
-	c.SendNumeric(RPL_WELCOME, fmt.Sprintf("Welcome to %s, %s", c.server.config.Server.Network, c.Prefix()))
-	c.SendNumeric(RPL_YOURHOST, fmt.Sprintf("Your host is %s, running version %s", c.server.config.Server.Name, c.server.config.Server.Version))
-	c.SendNumeric(RPL_CREATED, "This server was created recently")
+	// Hosts are cloaked from the start when they are hidden from users
+	if c.server.config.Privacy.HideHostsFromUsers {
+		c.SetMode('x', true)
+	}
+
+	c.SendNumeric(RPL_WELCOME, fmt.Sprintf(":Welcome to %s, %s", c.server.config.Server.Network, c.Prefix()))
+	c.SendNumeric(RPL_YOURHOST, fmt.Sprintf(":Your host is %s, running version %s", c.server.config.Server.Name, c.server.config.Server.Version))
+	c.SendNumeric(RPL_CREATED, ":This server was created recently")
 	c.SendNumeric(RPL_MYINFO, fmt.Sprintf("%s %s o o", c.server.config.Server.Name, c.server.config.Server.Version))
+	c.sendISupport()
 
 	// Send MOTD
 	if len(c.server.config.MOTD) > 0 {
-		c.SendNumeric(RPL_MOTDSTART, fmt.Sprintf("- %s Message of the Day -", c.server.config.Server.Name))
+		c.SendNumeric(RPL_MOTDSTART, fmt.Sprintf(":- %s Message of the Day -", c.server.config.Server.Name))
 		for _, line := range c.server.config.MOTD {
-			c.SendNumeric(RPL_MOTD, fmt.Sprintf("- %s", line))
+			c.SendNumeric(RPL_MOTD, fmt.Sprintf(":- %s", line))
 		}
-		c.SendNumeric(RPL_ENDOFMOTD, "End of /MOTD command")
+		c.SendNumeric(RPL_ENDOFMOTD, ":End of /MOTD command")
 	}
 
 	// Send snomask notification for new client connection
 	if c.server != nil {
 		c.server.sendSnomask('c', fmt.Sprintf("Client connect: %s (%s@%s)",
 			c.Nick(), c.User(), c.Host()))
+		c.server.spyEvent(c, "", "connected")
+	}
+
+	// Introduce the client to the rest of the network
+	c.server.introduceClient(c)
+
+	// Protect registered nicknames
+	if c.server.services != nil {
+		c.server.services.CheckNick(c)
+	}
+}
+
+// sendISupport sends RPL_ISUPPORT with the features clients can rely on
+func (c *Client) sendISupport() {
+	config := c.server.config
+	tokens := []string{
+		"NETWORK=" + config.Server.Network,
+		"CHANTYPES=#&!+",
+		"PREFIX=(qohv)~@%+",
+		fmt.Sprintf("MONITOR=%d", config.Limits.MaxMonitor),
+		fmt.Sprintf("WATCH=%d", config.Limits.MaxMonitor),
 	}
+	if config.Features.CaseMapping != "" {
+		tokens = append(tokens, "CASEMAPPING="+config.Features.CaseMapping)
+	}
+	if c.server.history != nil {
+		tokens = append(tokens, fmt.Sprintf("CHATHISTORY=%d", config.History.QueryLimit), "MSGREFTYPES=timestamp,msgid")
+	}
+	c.SendNumeric(RPL_ISUPPORT, strings.Join(tokens, " ")+" :are supported by this server")
 }
 
 // handlePing handles PING command
-func (c *Client) handlePing(parts []string) {
-	if len(parts) < 2 {
+func (c *Client) handlePing(msg *Message) {
+	if len(msg.Params) < 1 {
 		return
 	}
 
-	token := parts[1]
+	token := msg.Params[0]
 	if len(token) > 0 && token[0] == ':' {
 		token = token[1:]
 	}
@@ -230,7 +270,7 @@ func (c *Client) handlePing(parts []string) {
 }
 
 // handlePong handles PONG command
-func (c *Client) handlePong(parts []string) {
+func (c *Client) handlePong(msg *Message) {
 	// Update the last pong time for ping timeout tracking
 	// This is used by the client Handler's ping timeout mechanism
 	c.mu.Lock()
@@ -243,23 +283,13 @@ func (c *Client) handlePong(parts []string) {
 }
 
 // handleJoin handles JOIN command
-func (c *Client) handleJoin(parts []string) {
-	log.Printf("JOIN command from %s (registered: %v): %v", c.Nick(), c.IsRegistered(), parts)
+func (c *Client) handleJoin(msg *Message) {
+	log.Printf("JOIN command from %s (registered: %v): %v", c.Nick(), c.IsRegistered(), msg.Params)
 	
-	if !c.IsRegistered() {
-		c.SendNumeric(ERR_NOTREGISTERED, ":You have not registered")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "JOIN :Not enough parameters")
-		return
-	}
-
-	channelNames := strings.Split(parts[1], ",")
+	channelNames := strings.Split(msg.Params[0], ",")
 	keys := []string{}
-	if len(parts) > 2 {
-		keys = strings.Split(parts[2], ",")
+	if len(msg.Params) > 1 {
+		keys = strings.Split(msg.Params[1], ",")
 	}
 
 	for i, channelName := range channelNames {
@@ -278,9 +308,13 @@ func (c *Client) handleJoin(parts []string) {
 
 		channel := c.server.GetOrCreateChannel(channelName)
 
-		// Check if already in channel
+		// Check if already in channel; a ghost joining for real becomes visible
 		if c.IsInChannel(channelName) {
-			continue
+			if !channel.IsGhost(c) {
+				continue
+			}
+			channel.RemoveClient(c)
+			c.RemoveChannel(channelName)
 		}
 
 		// Check channel modes and limits (God Mode can bypass all restrictions)
@@ -295,7 +329,7 @@ func (c *Client) handleJoin(parts []string) {
 				continue
 			}
 
-			if channel.HasMode('l') && channel.UserCount() >= channel.Limit() {
+			if channel.HasMode('l') && channel.VisibleCount() >= channel.Limit() {
 				c.SendNumeric(ERR_CHANNELISFULL, channelName+" :Cannot join channel (+l)")
 				continue
 			}
@@ -314,14 +348,21 @@ func (c *Client) handleJoin(parts []string) {
 		} else {
 			// God Mode user joining - notify operators
 			c.sendSnomask('o', fmt.Sprintf("GOD MODE: %s bypassed restrictions to join %s", c.Nick(), channelName))
+			c.audit("GODMODE", channelName, "ok", "joined bypassing channel restrictions")
 		}
 
 		// Join the channel
 		channel.AddClient(c)
 		c.AddChannel(channel)
 
-		message := fmt.Sprintf(":%s JOIN :%s", c.Prefix(), channelName)
-		channel.Broadcast(message, nil)
+		channel.broadcastJoin(c, nil)
+		c.server.propagateJoin(c, channel)
+		c.server.spyEvent(c, "", "joined "+channelName)
+		c.server.spyFollow(c, channel)
+
+		if c.server.services != nil {
+			c.server.services.ChannelJoin(c, channel)
+		}
 
 		// Send topic if exists
 		if channel.Topic() != "" {
@@ -335,24 +376,11 @@ func (c *Client) handleJoin(parts []string) {
 }
 
 // handlePart handles PART command
-func (c *Client) handlePart(parts []string) {
-	if !c.IsRegistered() {
-		c.SendNumeric(ERR_NOTREGISTERED, ":You have not registered")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "PART :Not enough parameters")
-		return
-	}
-
-	channelNames := strings.Split(parts[1], ",")
+func (c *Client) handlePart(msg *Message) {
+	channelNames := strings.Split(msg.Params[0], ",")
 	reason := "Leaving"
-	if len(parts) > 2 {
-		reason = strings.Join(parts[2:], " ")
-		if len(reason) > 0 && reason[0] == ':' {
-			reason = reason[1:]
-		}
+	if len(msg.Params) > 1 {
+		reason = msg.Params[1]
 	}
 
 	for _, channelName := range channelNames {
@@ -371,8 +399,15 @@ func (c *Client) handlePartChannel(channelName, reason string) {
 		return
 	}
 
-	message := fmt.Sprintf(":%s PART %s :%s", c.Prefix(), channelName, reason)
-	channel.Broadcast(message, nil)
+	message := c.taggedMessage("PART", channelName, reason)
+	if channel.IsGhost(c) {
+		// Nobody else knew the ghost was there
+		c.Send(message)
+	} else {
+		channel.BroadcastMessage(message, nil)
+		c.server.propagatePart(c, channel, reason)
+		c.server.spyEvent(c, "", fmt.Sprintf("left %s (%s)", channelName, reason))
+	}
 
 	channel.RemoveClient(c)
 	c.RemoveChannel(channelName)
@@ -384,27 +419,19 @@ func (c *Client) handlePartChannel(channelName, reason string) {
 }
 
 // handlePrivmsg handles PRIVMSG command
-func (c *Client) handlePrivmsg(parts []string) {
-	if !c.IsRegistered() {
-		c.SendNumeric(ERR_NOTREGISTERED, ":You have not registered")
-		return
-	}
-
-	if len(parts) < 2 {
+func (c *Client) handlePrivmsg(msg *Message) {
+	if len(msg.Params) < 1 {
 		c.SendNumeric(ERR_NORECIPIENT, ":No recipient given (PRIVMSG)")
 		return
 	}
 
-	if len(parts) < 3 {
+	if len(msg.Params) < 2 {
 		c.SendNumeric(ERR_NOTEXTTOSEND, ":No text to send")
 		return
 	}
 
-	target := parts[1]
-	message := strings.Join(parts[2:], " ")
-	if len(message) > 0 && message[0] == ':' {
-		message = message[1:]
-	}
+	target := msg.Params[0]
+	message := msg.Params[1]
 
 	if isChannelName(target) {
 		// Channel message
@@ -425,9 +452,19 @@ func (c *Client) handlePrivmsg(parts []string) {
 			return
 		}
 
-		msg := fmt.Sprintf(":%s PRIVMSG %s :%s", c.Prefix(), target, message)
-		channel.Broadcast(msg, c)
+		item := c.historyItem("PRIVMSG", channel.Name(), message)
+		relay := relayMessage(item, c.clientTags(msg))
+		channel.BroadcastMessage(relay, c)
+		c.echo(relay)
+		channel.MarkSpoke(c)
+		c.server.propagateMessage(c, relay)
+		c.server.recordHistory(c, item)
 	} else {
+		// Messages to services are handled internally
+		if c.server.services != nil && c.server.services.HandleMessage(c, target, message) {
+			return
+		}
+
 		// Private message
 		targetClient := c.server.GetClient(target)
 		if targetClient == nil {
@@ -439,26 +476,26 @@ func (c *Client) handlePrivmsg(parts []string) {
 			c.SendNumeric(RPL_AWAY, fmt.Sprintf("%s :%s", target, targetClient.Away()))
 		}
 
-		msg := fmt.Sprintf(":%s PRIVMSG %s :%s", c.Prefix(), target, message)
-		targetClient.SendMessage(msg)
+		item := c.historyItem("PRIVMSG", targetClient.Nick(), message)
+		relay := relayMessage(item, c.clientTags(msg))
+		c.server.recordHistory(c, item)
+		if targetClient.IsRemote() {
+			c.server.propagateMessage(c, relay)
+		} else {
+			targetClient.Send(relay)
+		}
+		c.echo(relay)
 	}
 }
 
 // handleNotice handles NOTICE command
-func (c *Client) handleNotice(parts []string) {
-	if !c.IsRegistered() {
-		return // NOTICE should not generate error responses
-	}
-
-	if len(parts) < 3 {
+func (c *Client) handleNotice(msg *Message) {
+	if len(msg.Params) < 2 {
 		return
 	}
 
-	target := parts[1]
-	message := strings.Join(parts[2:], " ")
-	if len(message) > 0 && message[0] == ':' {
-		message = message[1:]
-	}
+	target := msg.Params[0]
+	message := msg.Params[1]
 
 	if isChannelName(target) {
 		// Channel notice
@@ -467,8 +504,13 @@ func (c *Client) handleNotice(parts []string) {
 			return
 		}
 
-		msg := fmt.Sprintf(":%s NOTICE %s :%s", c.Prefix(), target, message)
-		channel.Broadcast(msg, c)
+		item := c.historyItem("NOTICE", channel.Name(), message)
+		relay := relayMessage(item, c.clientTags(msg))
+		channel.BroadcastMessage(relay, c)
+		c.echo(relay)
+		channel.MarkSpoke(c)
+		c.server.propagateMessage(c, relay)
+		c.server.recordHistory(c, item)
 	} else {
 		// Private notice
 		targetClient := c.server.GetClient(target)
@@ -476,24 +518,21 @@ func (c *Client) handleNotice(parts []string) {
 			return
 		}
 
-		msg := fmt.Sprintf(":%s NOTICE %s :%s", c.Prefix(), target, message)
-		targetClient.SendMessage(msg)
+		item := c.historyItem("NOTICE", targetClient.Nick(), message)
+		relay := relayMessage(item, c.clientTags(msg))
+		c.server.recordHistory(c, item)
+		if targetClient.IsRemote() {
+			c.server.propagateMessage(c, relay)
+		} else {
+			targetClient.Send(relay)
+		}
+		c.echo(relay)
 	}
 }
 
 // handleWho handles WHO command
-func (c *Client) handleWho(parts []string) {
-	if !c.IsRegistered() {
-		c.SendNumeric(ERR_NOTREGISTERED, ":You have not registered")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "WHO :Not enough parameters")
-		return
-	}
-
-	target := parts[1]
+func (c *Client) handleWho(msg *Message) {
+	target := msg.Params[0]
 
 	if isChannelName(target) {
 		channel := c.server.GetChannel(target)
@@ -507,6 +546,10 @@ func (c *Client) handleWho(parts []string) {
 			if !client.IsVisibleTo(c) {
 				continue
 			}
+			member, ok := channel.Member(client)
+			if !ok || (member.Ghost && client != c) {
+				continue
+			}
 			
 			flags := ""
 			if client.IsOper() {
@@ -517,14 +560,10 @@ func (c *Client) handleWho(parts []string) {
 			} else {
 				flags += "H"
 			}
-			if channel.IsOperator(client) {
-				flags += "@"
-			} else if channel.IsVoice(client) {
-				flags += "+"
-			}
+			flags += member.HighestPrefix()
 
 			c.SendNumeric(352, fmt.Sprintf("%s %s %s %s %s %s :0 %s",
-				target, client.User(), client.HostForUser(c), c.server.config.Server.Name,
+				target, client.User(), client.HostForUser(c), client.ServerName(),
 				client.Nick(), flags, client.Realname()))
 		}
 	}
@@ -533,18 +572,8 @@ func (c *Client) handleWho(parts []string) {
 }
 
 // handleWhois handles WHOIS command
-func (c *Client) handleWhois(parts []string) {
-	if !c.IsRegistered() {
-		c.SendNumeric(ERR_NOTREGISTERED, ":You have not registered")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "WHOIS :Not enough parameters")
-		return
-	}
-
-	nick := parts[1]
+func (c *Client) handleWhois(msg *Message) {
+	nick := msg.Params[0]
 	target := c.server.GetClient(nick)
 	if target == nil {
 		c.SendNumeric(ERR_NOSUCHNICK, nick+" :No such nick")
@@ -566,8 +595,11 @@ func (c *Client) handleWhois(parts []string) {
 	}
 
 	// Server information
-	c.SendNumeric(RPL_WHOISSERVER, fmt.Sprintf("%s %s :%s",
-		target.Nick(), c.server.config.Server.Name, c.server.config.Server.Description))
+	serverDesc := c.server.config.Server.Description
+	if target.IsRemote() {
+		serverDesc = target.remote.Description
+	}
+	c.SendNumeric(RPL_WHOISSERVER, fmt.Sprintf("%s %s :%s", target.Nick(), target.ServerName(), serverDesc))
 
 	// Operator status
 	if target.IsOper() {
@@ -577,18 +609,13 @@ func (c *Client) handleWhois(parts []string) {
 		if c.canSeeWhoisInfo(target, "oper_class") {
 			operClass := target.OperClass()
 			if operClass != "" {
-				// Load operator config to get class description and rank name
-				operConfig, err := LoadOperConfig(c.server.config.OperConfig.ConfigFile)
-				if err == nil && c.server.config.OperConfig.Enable {
-					class := operConfig.GetOperClass(operClass)
-					if class != nil {
-						rankName := operConfig.GetRankName(class.Rank)
-						c.SendMessage(fmt.Sprintf(":%s 313 %s %s :is an IRC operator (%s - %s) [%s]", 
-							c.server.config.Server.Name, c.Nick(), target.Nick(), class.Name, class.Description, rankName))
-					} else {
-						c.SendMessage(fmt.Sprintf(":%s 313 %s %s :is an IRC operator (class: %s)", 
-							c.server.config.Server.Name, c.Nick(), target.Nick(), operClass))
-					}
+				// Use the operator config for the class description and rank name
+				operConfig := c.server.OperConfig()
+				class := operConfig.GetOperClass(operClass)
+				if class != nil {
+					rankName := operConfig.GetRankName(class.Rank)
+					c.SendMessage(fmt.Sprintf(":%s 313 %s %s :is an IRC operator (%s - %s) [%s]", 
+						c.server.config.Server.Name, c.Nick(), target.Nick(), class.Name, class.Description, rankName))
 				} else {
 					c.SendMessage(fmt.Sprintf(":%s 313 %s %s :is an IRC operator (class: %s)", 
 						c.server.config.Server.Name, c.Nick(), target.Nick(), operClass))
@@ -616,6 +643,9 @@ func (c *Client) handleWhois(parts []string) {
 		c.SendMessage(fmt.Sprintf(":%s 671 %s %s :is using a secure connection",
 			c.server.config.Server.Name, c.Nick(), target.Nick()))
 	}
+	if certfp := target.CertFP(); certfp != "" && c.canSeeWhoisInfo(target, "certfp") {
+		c.SendNumeric(RPL_WHOISCERTFP, fmt.Sprintf("%s :has client certificate fingerprint %s", target.Nick(), certfp))
+	}
 
 	// Channels
 	if c.canSeeChannels(target) {
@@ -623,6 +653,9 @@ func (c *Client) handleWhois(parts []string) {
 		config := c.server.config.WhoisFeatures.ShowChannels
 		
 		for _, channel := range target.GetChannels() {
+			if target != c && channel.IsGhost(target) {
+				continue
+			}
 			// Skip secret/private channels based on config
 			if config.HideSecret && channel.HasMode('s') && !channel.HasClient(c) {
 				continue
@@ -633,10 +666,8 @@ func (c *Client) handleWhois(parts []string) {
 			
 			channelName := channel.Name()
 			if config.ShowMembership {
-				if channel.IsOperator(target) {
-					channelName = "@" + channelName
-				} else if channel.IsVoice(target) {
-					channelName = "+" + channelName
+				if member, ok := channel.Member(target); ok {
+					channelName = member.HighestPrefix() + channelName
 				}
 			}
 			channels = append(channels, channelName)
@@ -677,13 +708,8 @@ func (c *Client) handleWhois(parts []string) {
 }
 
 // handleNames handles NAMES command
-func (c *Client) handleNames(parts []string) {
-	if !c.IsRegistered() {
-		c.SendNumeric(ERR_NOTREGISTERED, ":You have not registered")
-		return
-	}
-
-	if len(parts) < 2 {
+func (c *Client) handleNames(msg *Message) {
+	if len(msg.Params) < 1 {
 		// Send names for all channels
 		for _, channel := range c.server.GetChannels() {
 			if c.IsInChannel(channel.Name()) {
@@ -693,7 +719,7 @@ func (c *Client) handleNames(parts []string) {
 		return
 	}
 
-	channelNames := strings.Split(parts[1], ",")
+	channelNames := strings.Split(msg.Params[0], ",")
 	for _, channelName := range channelNames {
 		channel := c.server.GetChannel(channelName)
 		if channel != nil && c.IsInChannel(channelName) {
@@ -710,17 +736,11 @@ func (c *Client) sendNames(channel *Channel) {
 			continue
 		}
 		
-		name := client.Nick()
-		if channel.IsOwner(client) {
-			name = "~" + name
-		} else if channel.IsOperator(client) {
-			name = "@" + name
-		} else if channel.IsHalfop(client) {
-			name = "%" + name
-		} else if channel.IsVoice(client) {
-			name = "+" + name
+		member, ok := channel.Member(client)
+		if !ok || (member.Ghost && client != c) {
+			continue
 		}
-		names = append(names, name)
+		names = append(names, member.HighestPrefix()+client.Nick())
 	}
 
 	symbol := "="
@@ -735,26 +755,18 @@ func (c *Client) sendNames(channel *Channel) {
 }
 
 // handleQuit handles QUIT command
-func (c *Client) handleQuit(parts []string) {
+func (c *Client) handleQuit(msg *Message) {
 	reason := "Client quit"
-	if len(parts) > 1 {
-		reason = strings.Join(parts[1:], " ")
-		if len(reason) > 0 && reason[0] == ':' {
-			reason = reason[1:]
-		}
+	if len(msg.Params) > 0 {
+		reason = msg.Params[0]
 	}
 
-	c.server.RemoveClient(c)
+	c.Quit("Quit: " + reason)
 }
 
 // handleMode handles MODE command
-func (c *Client) handleMode(parts []string) {
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "MODE :Not enough parameters")
-		return
-	}
-
-	target := parts[1]
+func (c *Client) handleMode(msg *Message) {
+	target := msg.Params[0]
 
 	// Handle user mode requests
 	if !isChannelName(target) {
@@ -764,7 +776,7 @@ func (c *Client) handleMode(parts []string) {
 		}
 
 		// If no mode changes specified, return current user modes
-		if len(parts) == 2 {
+		if len(msg.Params) == 1 {
 			modes := c.GetModes()
 			if modes == "" {
 				modes = "+"
@@ -774,7 +786,7 @@ func (c *Client) handleMode(parts []string) {
 		}
 
 		// Parse user mode changes
-		modeString := parts[2]
+		modeString := msg.Params[1]
 		adding := true
 		var appliedModes []string
 
@@ -818,17 +830,18 @@ func (c *Client) handleMode(parts []string) {
 					appliedModes = append(appliedModes, "-o")
 					// Clear snomasks when de-opering
 					c.snomasks = make(map[rune]bool)
+					c.server.spyStop(c)
 					c.sendSnomask('o', fmt.Sprintf("%s is no longer an IRC operator", c.Nick()))
 				}
 			case 'r': // registered (cannot be set manually, services only)
 				c.SendNumeric(ERR_UMODEUNKNOWNFLAG, ":Unknown MODE flag")
 			case 'x': // host masking (TechIRCd special)
-				c.SetMode('x', adding)
-				if adding {
-					appliedModes = append(appliedModes, "+x")
-					// TODO: Implement host masking
-				} else {
-					appliedModes = append(appliedModes, "-x")
+				if c.setCloaked(adding) {
+					if adding {
+						appliedModes = append(appliedModes, "+x")
+					} else {
+						appliedModes = append(appliedModes, "-x")
+					}
 				}
 			case 'z': // SSL/TLS (automatic, cannot be manually set)
 				if c.IsSSL() {
@@ -857,11 +870,13 @@ func (c *Client) handleMode(parts []string) {
 					c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** GOD MODE enabled - You have ultimate power!", 
 						c.server.config.Server.Name, c.Nick()))
 					c.sendSnomask('o', fmt.Sprintf("%s has enabled GOD MODE - Ultimate channel override powers active", c.Nick()))
+					c.audit("UMODE", c.Nick(), "ok", "+G")
 				} else {
 					appliedModes = append(appliedModes, "-G")
 					c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** GOD MODE disabled", 
 						c.server.config.Server.Name, c.Nick()))
 					c.sendSnomask('o', fmt.Sprintf("%s has disabled GOD MODE", c.Nick()))
+					c.audit("UMODE", c.Nick(), "ok", "-G")
 				}
 			case 'S': // Stealth Mode (requires oper and stealth_mode permission)
 				if !c.IsOper() {
@@ -893,6 +908,7 @@ func (c *Client) handleMode(parts []string) {
 		if len(appliedModes) > 0 {
 			modeStr := strings.Join(appliedModes, "")
 			c.SendMessage(fmt.Sprintf(":%s MODE %s :%s", c.Nick(), c.Nick(), modeStr))
+			c.server.propagateUserMode(c, modeStr)
 		}
 		return
 	}
@@ -910,7 +926,7 @@ func (c *Client) handleMode(parts []string) {
 	}
 
 	// If no mode changes specified, return current channel modes
-	if len(parts) == 2 {
+	if len(msg.Params) == 1 {
 		modes := channel.GetModes()
 		if modes == "" {
 			modes = "+"
@@ -920,20 +936,20 @@ func (c *Client) handleMode(parts []string) {
 	}
 
 	// Parse mode changes
-	modeString := parts[2]
-	args := parts[3:]
+	modeString := msg.Params[1]
+	args := msg.Params[2:]
 	argIndex := 0
 
 	// Check if user has operator privileges (required for most mode changes)
-	// God Mode users can bypass operator requirement
-	if !c.HasGodMode() && !channel.IsOwner(c) && !channel.IsOperator(c) && !channel.IsHalfop(c) {
-		c.SendNumeric(ERR_CHANOPRIVSNEEDED, target+" :You're not channel operator")
-		return
-	}
-	
-	// If using God Mode to set modes, notify operators
-	if c.HasGodMode() && !channel.IsOwner(c) && !channel.IsOperator(c) && !channel.IsHalfop(c) {
-		c.sendSnomask('o', fmt.Sprintf("GOD MODE: %s set modes on %s without operator privileges", c.Nick(), target))
+	// God Mode users and opers with mode_channel can bypass operator requirement
+	if !channel.IsChanop(c) {
+		if c.HasGodMode() {
+			c.sendSnomask('o', fmt.Sprintf("GOD MODE: %s set modes on %s without operator privileges", c.Nick(), target))
+			c.audit("GODMODE", target, "ok", "set modes without channel status")
+		} else if !c.operOverride("mode_channel", target, fmt.Sprintf("set modes on %s", target)) {
+			c.SendNumeric(ERR_CHANOPRIVSNEEDED, target+" :You're not channel operator")
+			return
+		}
 	}
 
 	adding := true
@@ -941,6 +957,17 @@ func (c *Client) handleMode(parts []string) {
 	var appliedArgs []string
 
 	for _, char := range modeString {
+		// Registered channels may lock modes through ChanServ
+		if char != '+' && char != '-' && c.server.services != nil && !c.HasGodMode() {
+			if mlock, locked := c.server.services.ModeLocked(target, char, adding); locked {
+				c.SendNumeric(ERR_MLOCKRESTRICTED, fmt.Sprintf("%s %c %s :MODE cannot be set due to channel having an active MLOCK restriction policy", target, char, mlock))
+				if adding && (char == 'k' || char == 'l') {
+					argIndex++
+				}
+				continue
+			}
+		}
+
 		switch char {
 		case '+':
 			adding = true
@@ -1232,17 +1259,17 @@ func (c *Client) handleMode(parts []string) {
 		for _, client := range channel.GetClients() {
 			client.SendFrom(c.Prefix(), modeChangeMsg)
 		}
+		c.server.propagateChannelMode(c, channel, strings.Join(appliedModes, ""), appliedArgs)
+
+		if c.server.services != nil && strings.ContainsRune(modeString, 'b') {
+			c.server.services.ChannelBansChanged(channel)
+		}
 	}
 }
 
 // handleTopic handles TOPIC command
-func (c *Client) handleTopic(parts []string) {
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "TOPIC :Not enough parameters")
-		return
-	}
-
-	channelName := parts[1]
+func (c *Client) handleTopic(msg *Message) {
+	channelName := msg.Params[0]
 	if !isChannelName(channelName) {
 		c.SendNumeric(ERR_NOSUCHCHANNEL, channelName+" :No such channel")
 		return
@@ -1260,7 +1287,7 @@ func (c *Client) handleTopic(parts []string) {
 	}
 
 	// If no topic provided, return current topic
-	if len(parts) == 2 {
+	if len(msg.Params) == 1 {
 		topic := channel.Topic()
 		if topic == "" {
 			c.SendNumeric(RPL_NOTOPIC, channelName+" :No topic is set")
@@ -1270,47 +1297,57 @@ func (c *Client) handleTopic(parts []string) {
 		return
 	}
 
-	// Check if user can set topic (for now, anyone in channel can)
-	// TODO: Add proper +t mode checking
-	newTopic := strings.Join(parts[2:], " ")
-	if len(newTopic) > 0 && newTopic[0] == ':' {
-		newTopic = newTopic[1:]
+	// With +t only halfops and above, or opers with the topic permission, can set it
+	if channel.HasMode('t') && !channel.IsChanop(c) && !c.HasGodMode() &&
+		!c.operOverride("topic", channelName, fmt.Sprintf("changed the topic of %s", channelName)) {
+		c.SendNumeric(ERR_CHANOPRIVSNEEDED, channelName+" :You're not channel operator")
+		return
 	}
+	newTopic := msg.Params[1]
 
 	channel.SetTopic(newTopic, c.Nick())
+	if c.server.services != nil {
+		c.server.services.ChannelTopicChanged(channel)
+	}
 
 	// Broadcast topic change to all channel members
 	for _, client := range channel.GetClients() {
 		client.SendFrom(c.Prefix(), fmt.Sprintf("TOPIC %s :%s", channelName, newTopic))
 	}
+	c.server.propagateTopic(c, channel)
 }
 
 // handleAway handles AWAY command
-func (c *Client) handleAway(parts []string) {
-	if len(parts) == 1 {
+func (c *Client) handleAway(msg *Message) {
+	if len(msg.Params) == 0 {
 		// Remove away status
 		c.SetAway("")
 		c.SendNumeric(RPL_UNAWAY, ":You are no longer marked as being away")
+		c.notifyAway()
+		c.server.propagateAway(c)
 		return
 	}
 
 	// Set away message
-	awayMsg := strings.Join(parts[1:], " ")
-	if len(awayMsg) > 0 && awayMsg[0] == ':' {
-		awayMsg = awayMsg[1:]
-	}
+	awayMsg := msg.Params[0]
 
 	c.SetAway(awayMsg)
 	c.SendNumeric(RPL_NOWAWAY, ":You have been marked as being away")
+	c.notifyAway()
+	c.server.propagateAway(c)
 }
 
 // handleList handles LIST command
-func (c *Client) handleList(parts []string) {
+func (c *Client) handleList(msg *Message) {
 	c.SendNumeric(RPL_LISTSTART, "Channel :Users  Name")
 
 	for _, channel := range c.server.GetChannels() {
 		// For now, show all channels (TODO: Add proper mode checking for secret channels)
-		userCount := len(channel.GetClients())
+		userCount := channel.VisibleCount()
+		if userCount == 0 {
+			// Only ghosts are left
+			continue
+		}
 		topic := channel.Topic()
 		if topic == "" {
 			topic = ""
@@ -1322,14 +1359,9 @@ func (c *Client) handleList(parts []string) {
 }
 
 // handleInvite handles INVITE command
-func (c *Client) handleInvite(parts []string) {
-	if len(parts) < 3 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "INVITE :Not enough parameters")
-		return
-	}
-
-	nick := parts[1]
-	channelName := parts[2]
+func (c *Client) handleInvite(msg *Message) {
+	nick := msg.Params[0]
+	channelName := msg.Params[1]
 
 	target := c.server.GetClient(nick)
 	if target == nil {
@@ -1363,23 +1395,16 @@ func (c *Client) handleInvite(parts []string) {
 	// Send invite to target
 	target.SendFrom(c.Prefix(), fmt.Sprintf("INVITE %s %s", target.Nick(), channelName))
 	c.SendNumeric(RPL_INVITING, fmt.Sprintf("%s %s", target.Nick(), channelName))
+	channel.notifyInvite(c, target)
 }
 
 // handleKick handles KICK command
-func (c *Client) handleKick(parts []string) {
-	if len(parts) < 3 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "KICK :Not enough parameters")
-		return
-	}
-
-	channelName := parts[1]
-	nick := parts[2]
+func (c *Client) handleKick(msg *Message) {
+	channelName := msg.Params[0]
+	nick := msg.Params[1]
 	reason := "No reason given"
-	if len(parts) > 3 {
-		reason = strings.Join(parts[3:], " ")
-		if len(reason) > 0 && reason[0] == ':' {
-			reason = reason[1:]
-		}
+	if len(msg.Params) > 2 {
+		reason = msg.Params[2]
 	}
 
 	if !isChannelName(channelName) {
@@ -1404,7 +1429,7 @@ func (c *Client) handleKick(parts []string) {
 		return
 	}
 
-	if !target.IsInChannel(channelName) {
+	if !target.IsInChannel(channelName) || channel.IsGhost(target) {
 		c.SendNumeric(ERR_USERNOTINCHANNEL, fmt.Sprintf("%s %s :They aren't on that channel", nick, channelName))
 		return
 	}
@@ -1416,14 +1441,23 @@ func (c *Client) handleKick(parts []string) {
 		return
 	}
 
-	// TODO: Check if user has operator privileges
-	// For now, allow anyone to kick (will fix with proper channel modes)
+	// Halfops and above can kick; opers with the kick permission can override
+	if !channel.IsChanop(c) && !c.HasGodMode() &&
+		!c.operOverride("kick", channelName, fmt.Sprintf("kicked %s from %s", target.Nick(), channelName)) {
+		c.SendNumeric(ERR_CHANOPRIVSNEEDED, channelName+" :You're not channel operator")
+		return
+	}
+	if target.IsOper() && c.IsOper() && !channel.IsChanop(c) && !c.CanOperateOn(target) {
+		c.SendNumeric(ERR_NOPRIVILEGES, fmt.Sprintf(":Permission Denied - %s has an equal or higher rank", target.Nick()))
+		return
+	}
 
 	// Broadcast kick to all channel members
 	kickMsg := fmt.Sprintf("KICK %s %s :%s", channelName, target.Nick(), reason)
 	for _, client := range channel.GetClients() {
 		client.SendFrom(c.Prefix(), kickMsg)
 	}
+	c.server.propagateKick(c, channel, target, reason)
 
 	// Remove target from channel
 	channel.RemoveClient(target)
@@ -1431,24 +1465,11 @@ func (c *Client) handleKick(parts []string) {
 }
 
 // handleKill handles KILL command (operator only)
-func (c *Client) handleKill(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "KILL :Not enough parameters")
-		return
-	}
-
-	nick := parts[1]
+func (c *Client) handleKill(msg *Message) {
+	nick := msg.Params[0]
 	reason := "Killed by operator"
-	if len(parts) > 2 {
-		reason = strings.Join(parts[2:], " ")
-		if len(reason) > 0 && reason[0] == ':' {
-			reason = reason[1:]
-		}
+	if len(msg.Params) > 1 {
+		reason = msg.Params[1]
 	}
 
 	target := c.server.GetClient(nick)
@@ -1457,14 +1478,15 @@ func (c *Client) handleKill(parts []string) {
 		return
 	}
 
-	// Can't kill other operators
-	if target.IsOper() {
-		c.SendNumeric(ERR_CANTKILLSERVER, ":You can't kill other operators")
+	// Operators can only be killed by a higher rank
+	if !c.CanOperateOn(target) {
+		c.SendNumeric(ERR_NOPRIVILEGES, fmt.Sprintf(":Permission Denied - %s has an equal or higher rank", target.Nick()))
+		c.audit("KILL", target.Nick(), "denied", "equal or higher rank")
 		return
 	}
+	c.audit("KILL", target.Nick(), "ok", reason)
 
-	// Send kill message to target and disconnect
-	target.SendMessage(fmt.Sprintf("ERROR :Killed (%s (%s))", c.Nick(), reason))
+	killReason := fmt.Sprintf("Killed (%s (%s))", c.Nick(), reason)
 
 	// Broadcast to other operators
 	for _, client := range c.server.GetClients() {
@@ -1474,24 +1496,42 @@ func (c *Client) handleKill(parts []string) {
 		}
 	}
 
+	// Users on other servers are removed network-wide; our own disconnect
+	// and their QUIT reaches the network
+	if target.IsRemote() {
+		c.server.propagateKill(c, target, reason)
+		c.server.removeRemoteClient(target, killReason)
+		return
+	}
+
 	// Disconnect the target
-	target.conn.Close()
+	target.Quit(killReason)
 }
 
 // handleOper handles OPER command
-func (c *Client) handleOper(parts []string) {
-	if len(parts) < 3 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "OPER :Not enough parameters")
-		return
-	}
-
+func (c *Client) handleOper(msg *Message) {
 	if c.server == nil || c.server.config == nil {
 		c.SendNumeric(ERR_NOOPERHOST, ":No O-lines for your host")
 		return
 	}
 
-	name := parts[1]
-	password := parts[2]
+	// OPER name [password [code]]; the password may be left out when a client
+	// certificate identifies the oper, and OPER <code> alone completes a
+	// login waiting for its two-factor code
+	name := msg.Params[0]
+	password, code := "", ""
+	if len(msg.Params) > 1 {
+		password = msg.Params[1]
+	}
+	if len(msg.Params) > 2 {
+		code = msg.Params[2]
+	}
+	matchedOper := c.takePendingOper()
+	if matchedOper != nil && len(msg.Params) == 1 {
+		name, code = matchedOper.Name, msg.Params[0]
+	} else {
+		matchedOper = nil
+	}
 
 	// Check if opers are enabled
 	if !c.server.config.Features.EnableOper {
@@ -1499,52 +1539,44 @@ func (c *Client) handleOper(parts []string) {
 		return
 	}
 
-	var matchedOper *Oper
-	var operConfig *OperConfig
-	
-	// Try to load advanced oper configuration first
-	if c.server.config.OperConfig.Enable {
-		var err error
-		operConfig, err = LoadOperConfig(c.server.config.OperConfig.ConfigFile)
-		if err == nil {
-			oper := operConfig.GetOper(name)
-			if oper != nil && oper.Password == password {
-				// TODO: Implement proper host matching
-				if oper.Host == "*@localhost" || oper.Host == "*@*" {
-					matchedOper = oper
-				}
-			}
-		}
+	operConfig := c.server.OperConfig()
+	if left := c.server.operLockout.Locked(name, c.Host(), time.Now()); left > 0 {
+		c.SendNumeric(ERR_NOOPERHOST, fmt.Sprintf(":Too many failed attempts, try again in %s", formatDuration(left)))
+		return
 	}
-	
-	// Fallback to legacy configuration
+	if operConfig.Settings.RequireSSL && !c.IsSSL() {
+		c.SendNumeric(ERR_NOOPERHOST, ":You must be connected with SSL/TLS to oper")
+		return
+	}
+
 	if matchedOper == nil {
-		for _, oper := range c.server.config.Opers {
-			if oper.Name == name && oper.Password == password {
-				// Check host mask (simplified - just check if it matches *@localhost for now)
-				if oper.Host == "*@localhost" || oper.Host == "*@*" {
-					// Convert legacy oper to new format for consistency
-					matchedOper = &Oper{
-						Name:     oper.Name,
-						Password: oper.Password,
-						Host:     oper.Host,
-						Class:    oper.Class,
-						Flags:    oper.Flags,
-					}
-					break
-				}
+		var reason string
+		matchedOper, reason = c.findOper(name, password)
+		if matchedOper == nil {
+			c.operFailed(name, reason)
+			switch reason {
+			case operFailHost:
+				c.SendNumeric(ERR_NOOPERHOST, ":No O-lines for your host")
+			case operFailCertFP:
+				c.SendNumeric(ERR_NOOPERHOST, ":This oper block requires a matching client certificate")
+			case operFailExpired:
+				c.SendNumeric(ERR_NOOPERHOST, ":Your oper block has expired")
+			default:
+				c.SendNumeric(ERR_PASSWDMISMATCH, ":Password incorrect")
 			}
+			return
 		}
 	}
-	
-	if matchedOper == nil {
-		c.SendNumeric(ERR_PASSWDMISMATCH, ":Password incorrect")
+	if !c.verifyOperTOTP(matchedOper, code) {
 		return
 	}
+	c.server.operLockout.Succeed(name, c.Host())
+	c.server.touchOper(matchedOper.Name)
 
 	// Set operator status
 	c.SetOper(true)
 	c.SetOperClass(matchedOper.Class)
+	c.SetOperName(matchedOper.Name)
 
 	// Set operator user mode
 	c.SetMode('o', true)
@@ -1558,18 +1590,17 @@ func (c *Client) handleOper(parts []string) {
 
 	// Get operator class information for display
 	var className string
-	if operConfig != nil {
-		class := operConfig.GetOperClass(matchedOper.Class)
-		if class != nil {
-			className = fmt.Sprintf(" (%s)", class.Description)
-		}
+	if class := operConfig.GetOperClass(matchedOper.Class); class != nil {
+		className = fmt.Sprintf(" (%s)", class.Description)
 	}
 
 	c.SendNumeric(RPL_YOUREOPER, ":You are now an IRC operator"+className)
+	c.audit("OPER", matchedOper.Name, "ok", "")
 	c.SendNumeric(RPL_SNOMASK, fmt.Sprintf("%s :Server notice mask", c.GetSnomasks()))
 
 	// Send mode change notification
 	c.SendMessage(fmt.Sprintf(":%s MODE %s :+osw", c.Nick(), c.Nick()))
+	c.server.propagateUserMode(c, "+osw")
 
 	// Send snomask to other operators
 	operSymbol := c.GetOperSymbol()
@@ -1577,14 +1608,37 @@ func (c *Client) handleOper(parts []string) {
 		operSymbol, c.Nick(), c.User(), c.Host(), className))
 }
 
-// handleSnomask handles SNOMASK command (server notice masks for operators)
-func (c *Client) handleSnomask(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
+// handlePrivs handles PRIVS and OPERINFO, listing the caller's oper class
+// and effective permissions
+func (c *Client) handlePrivs(msg *Message) {
+	operConfig := c.server.OperConfig()
+	name := c.OperName()
+
+	rank := "no class"
+	if class := operConfig.GetOperClass(c.OperClass()); class != nil {
+		rank = fmt.Sprintf("%s, rank %d", operConfig.GetRankName(class.Rank), class.Rank)
+	}
+	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Opered as %s, class %s (%s)",
+		c.server.config.Server.Name, c.Nick(), name, c.OperClass(), rank))
+
+	permissions := operConfig.GetOperPermissions(name)
+	if len(permissions) == 0 {
+		c.SendNumeric(RPL_PRIVS, c.Nick()+" :(none)")
 		return
 	}
+	for len(permissions) > 0 {
+		n := len(permissions)
+		if n > 15 {
+			n = 15
+		}
+		c.SendNumeric(RPL_PRIVS, fmt.Sprintf("%s :%s", c.Nick(), strings.Join(permissions[:n], " ")))
+		permissions = permissions[n:]
+	}
+}
 
-	if len(parts) < 2 {
+// handleSnomask handles SNOMASK command (server notice masks for operators)
+func (c *Client) handleSnomask(msg *Message) {
+	if len(msg.Params) < 1 {
 		// Show current snomasks
 		current := c.GetSnomasks()
 		if current == "" {
@@ -1594,7 +1648,7 @@ func (c *Client) handleSnomask(parts []string) {
 		return
 	}
 
-	modeString := parts[1]
+	modeString := msg.Params[0]
 	adding := true
 	changed := false
 
@@ -1641,21 +1695,8 @@ func (c *Client) handleSnomask(parts []string) {
 }
 
 // handleGlobalNotice handles GLOBALNOTICE command (TechIRCd special oper command)
-func (c *Client) handleGlobalNotice(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "GLOBALNOTICE :Not enough parameters")
-		return
-	}
-
-	message := strings.Join(parts[1:], " ")
-	if len(message) > 0 && message[0] == ':' {
-		message = message[1:]
-	}
+func (c *Client) handleGlobalNotice(msg *Message) {
+	message := msg.Params[0]
 
 	// Send global notice to all users
 	for _, client := range c.server.GetClients() {
@@ -1668,21 +1709,8 @@ func (c *Client) handleGlobalNotice(parts []string) {
 }
 
 // handleWallops handles WALLOPS command (send to users with +w mode)
-func (c *Client) handleWallops(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "WALLOPS :Not enough parameters")
-		return
-	}
-
-	message := strings.Join(parts[1:], " ")
-	if len(message) > 0 && message[0] == ':' {
-		message = message[1:]
-	}
+func (c *Client) handleWallops(msg *Message) {
+	message := msg.Params[0]
 
 	// Send to all users with +w mode
 	for _, client := range c.server.GetClients() {
@@ -1693,21 +1721,8 @@ func (c *Client) handleWallops(parts []string) {
 }
 
 // handleOperWall handles OPERWALL command (message to all operators)
-func (c *Client) handleOperWall(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendNumeric(ERR_NEEDMOREPARAMS, "OPERWALL :Not enough parameters")
-		return
-	}
-
-	message := strings.Join(parts[1:], " ")
-	if len(message) > 0 && message[0] == ':' {
-		message = message[1:]
-	}
+func (c *Client) handleOperWall(msg *Message) {
+	message := msg.Params[0]
 
 	// Send to all operators
 	for _, client := range c.server.GetClients() {
@@ -1718,12 +1733,7 @@ func (c *Client) handleOperWall(parts []string) {
 }
 
 // handleRehash handles REHASH command (reload configuration)
-func (c *Client) handleRehash(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
-		return
-	}
-
+func (c *Client) handleRehash(msg *Message) {
 	// Reload configuration
 	if c.server != nil {
 		err := c.server.ReloadConfig()
@@ -1731,318 +1741,75 @@ func (c *Client) handleRehash(parts []string) {
 			c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** REHASH failed: %s",
 				c.server.config.Server.Name, c.Nick(), err.Error()))
 			c.sendSnomask('s', fmt.Sprintf("REHASH failed by %s: %s", c.Nick(), err.Error()))
+			c.audit("REHASH", "", "failed", err.Error())
 		} else {
 			c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Configuration reloaded successfully",
 				c.server.config.Server.Name, c.Nick()))
 			c.sendSnomask('s', fmt.Sprintf("Configuration reloaded by %s", c.Nick()))
+			c.audit("REHASH", "", "ok", "")
 		}
 	}
 }
 
-// handleTrace handles TRACE command (show server connection tree)
-func (c *Client) handleTrace(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
-		return
-	}
-
-	// Show basic server info (simplified implementation)
-	c.SendMessage(fmt.Sprintf(":%s 200 %s Link %s %s %s",
-		c.server.config.Server.Name, c.Nick(),
-		c.server.config.Server.Version,
-		c.server.config.Server.Name,
-		"TechIRCd"))
-
-	clientCount := len(c.server.GetClients())
-	c.SendMessage(fmt.Sprintf(":%s 262 %s %s :End of TRACE with %d clients",
-		c.server.config.Server.Name, c.Nick(),
-		c.server.config.Server.Name, clientCount))
-}
-
-// handleSpy handles SPY command - covert surveillance and stealth operations
-func (c *Client) handleSpy(parts []string) {
-	if !c.IsOper() {
-		c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
-		return
-	}
-
-	if len(parts) < 2 {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** SPY Usage: SPY <hide|watch|track|listen|cloak|ghost|shadow>",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	command := strings.ToLower(parts[1])
-
-	switch command {
-	case "hide":
-		c.handleSpyHide(parts[2:])
-	case "watch":
-		c.handleSpyWatch(parts[2:])
-	case "track":
-		c.handleSpyTrack(parts[2:])
-	case "listen":
-		c.handleSpyListen(parts[2:])
-	case "cloak":
-		c.handleSpyCloak(parts[2:])
-	case "ghost":
-		c.handleSpyGhost(parts[2:])
-	case "shadow":
-		c.handleSpyShadow(parts[2:])
-	case "status":
-		c.handleSpyStatus()
-	default:
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Unknown SPY command: %s",
-			c.server.config.Server.Name, c.Nick(), command))
-	}
-}
-
-// handleSpyHide - become invisible to most commands and lists
-func (c *Client) handleSpyHide(args []string) {
-	if len(args) == 0 || strings.ToLower(args[0]) == "on" {
-		c.SetMode('H', true) // Hidden mode
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** You are now HIDDEN from WHO, WHOIS, and NAMES",
-			c.server.config.Server.Name, c.Nick()))
-		c.sendSnomask('d', fmt.Sprintf("Operator %s has entered STEALTH mode", c.Nick()))
-	} else if strings.ToLower(args[0]) == "off" {
-		c.SetMode('H', false)
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** You are now VISIBLE again",
-			c.server.config.Server.Name, c.Nick()))
-		c.sendSnomask('d', fmt.Sprintf("Operator %s has left STEALTH mode", c.Nick()))
-	}
-}
-
-// handleSpyWatch - monitor a specific user's activities
-func (c *Client) handleSpyWatch(args []string) {
-	if len(args) < 1 {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Usage: SPY WATCH <nickname|off>",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	target := args[0]
-	if strings.ToLower(target) == "off" {
-		// TODO: Remove from watch list
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Surveillance disabled",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	targetClient := c.server.GetClient(target)
-	if targetClient == nil {
-		c.SendNumeric(ERR_NOSUCHNICK, target+" :No such nick/channel")
-		return
-	}
-
-	// TODO: Add to watch list
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Now watching %s (%s@%s)",
-		c.server.config.Server.Name, c.Nick(), target, targetClient.User(), targetClient.Host()))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Target is in channels: %s",
-		c.server.config.Server.Name, c.Nick(), c.getChannelList(targetClient)))
-}
-
-// handleSpyTrack - get real-time location and movement tracking
-func (c *Client) handleSpyTrack(args []string) {
-	if len(args) < 1 {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Usage: SPY TRACK <nickname>",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	target := args[0]
-	targetClient := c.server.GetClient(target)
-	if targetClient == nil {
-		c.SendNumeric(ERR_NOSUCHNICK, target+" :No such nick/channel")
-		return
-	}
-
-	// Show detailed tracking info
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** TRACKING %s",
-		c.server.config.Server.Name, c.Nick(), target))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Location: %s@%s",
-		c.server.config.Server.Name, c.Nick(), targetClient.User(), targetClient.Host()))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Status: %s",
-		c.server.config.Server.Name, c.Nick(), c.getUserStatus(targetClient)))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Channels: %s",
-		c.server.config.Server.Name, c.Nick(), c.getChannelList(targetClient)))
-
-	if targetClient.Away() != "" {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Away: %s",
-			c.server.config.Server.Name, c.Nick(), targetClient.Away()))
-	}
-}
-
-// handleSpyListen - tap into channel conversations invisibly
-func (c *Client) handleSpyListen(args []string) {
-	if len(args) < 1 {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Usage: SPY LISTEN <#channel|off>",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	target := args[0]
-	if strings.ToLower(target) == "off" {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Wiretaps disabled",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	if !isChannelName(target) {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Invalid channel name",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	channel := c.server.GetChannel(target)
-	if channel == nil {
-		c.SendNumeric(ERR_NOSUCHCHANNEL, target+" :No such channel")
-		return
-	}
-
-	// TODO: Add to wiretap list
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Now listening to %s (%d users)",
-		c.server.config.Server.Name, c.Nick(), target, channel.UserCount()))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Wiretap established - you will receive covert copies of all messages",
-		c.server.config.Server.Name, c.Nick()))
-}
-
-// handleSpyCloak - disguise your identity
-func (c *Client) handleSpyCloak(args []string) {
-	if len(args) < 1 {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Usage: SPY CLOAK <identity|off>",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	identity := args[0]
-	if strings.ToLower(identity) == "off" {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Identity cloak removed",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	// TODO: Implement identity cloaking
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Identity cloaked as: %s",
-		c.server.config.Server.Name, c.Nick(), identity))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Your true identity is hidden from WHOIS and other commands",
-		c.server.config.Server.Name, c.Nick()))
-}
-
-// handleSpyGhost - become completely invisible in a channel
-func (c *Client) handleSpyGhost(args []string) {
-	if len(args) < 1 {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Usage: SPY GHOST <#channel|off>",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	target := args[0]
-	if strings.ToLower(target) == "off" {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Ghost mode disabled",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	if !isChannelName(target) {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Invalid channel name",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	channel := c.server.GetChannel(target)
-	if channel == nil {
-		c.SendNumeric(ERR_NOSUCHCHANNEL, target+" :No such channel")
-		return
-	}
-
-	// Join channel invisibly
-	if !c.IsInChannel(target) {
-		channel.AddClient(c)
-	}
-
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** You are now a GHOST in %s",
-		c.server.config.Server.Name, c.Nick(), target))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** You can see everything but are invisible to users",
-		c.server.config.Server.Name, c.Nick()))
-}
-
-// handleSpyShadow - follow a user invisibly across channels
-func (c *Client) handleSpyShadow(args []string) {
-	if len(args) < 1 {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Usage: SPY SHADOW <nickname|off>",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	target := args[0]
-	if strings.ToLower(target) == "off" {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Shadow mode disabled",
-			c.server.config.Server.Name, c.Nick()))
-		return
-	}
-
-	targetClient := c.server.GetClient(target)
-	if targetClient == nil {
-		c.SendNumeric(ERR_NOSUCHNICK, target+" :No such nick/channel")
-		return
+// handleTrace handles TRACE [server|nick], listing this server's
+// connections or following the path to a remote target
+func (c *Client) handleTrace(msg *Message) {
+	s := c.server
+	if len(msg.Params) > 0 && !strings.EqualFold(msg.Params[0], s.config.Server.Name) {
+		target := msg.Params[0]
+		next := s.traceNextHop(target)
+		if next == nil {
+			if local := s.GetClient(target); local == nil {
+				c.SendNumeric(ERR_NOSUCHSERVER, target+" :No such server")
+				return
+			}
+		} else {
+			c.SendNumeric(RPL_TRACELINK, fmt.Sprintf("Link %s %s %s", s.config.Server.Version, target, next.peer.Name))
+			if rs := s.findServer(target); rs != nil {
+				target = rs.Name
+			} else if client := s.GetClient(target); client != nil {
+				target = client.remote.Name
+			}
+			next.send(":%s TRACE %s", c.UID(), target)
+			return
+		}
 	}
 
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Now shadowing %s",
-		c.server.config.Server.Name, c.Nick(), target))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** You will automatically follow them to any channel they join",
-		c.server.config.Server.Name, c.Nick()))
-}
-
-// handleSpyStatus - show current spy operations
-func (c *Client) handleSpyStatus() {
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** === SPY STATUS ===",
-		c.server.config.Server.Name, c.Nick()))
-
-	if c.HasMode('H') {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** STEALTH: Active (Hidden from WHO/WHOIS/NAMES)",
-			c.server.config.Server.Name, c.Nick()))
-	} else {
-		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** STEALTH: Inactive",
-			c.server.config.Server.Name, c.Nick()))
+	for _, line := range s.traceLines() {
+		c.SendNumeric(line.code, line.text)
 	}
-
-	// TODO: Show other active spy operations
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** WATCH: None active",
-		c.server.config.Server.Name, c.Nick()))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** WIRETAPS: None active",
-		c.server.config.Server.Name, c.Nick()))
-	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** SHADOWS: None active",
-		c.server.config.Server.Name, c.Nick()))
 }
 
-// Helper functions for spy operations
-func (c *Client) getChannelList(target *Client) string {
-	channels := target.GetChannels()
-	var channelNames []string
-	for _, channel := range channels {
-		channelNames = append(channelNames, channel.Name())
-	}
-	if len(channelNames) == 0 {
-		return "None"
+// handleStats handles STATS <letter>
+func (c *Client) handleStats(msg *Message) {
+	query := msg.Params[0]
+	switch query {
+	case "k", "K", "g", "G", "z", "Z", "d", "D":
+		banType := strings.ToUpper(query)
+		if banType == "D" {
+			banType = ZLine
+		}
+		permission := strings.ToLower(banType) + "line"
+		if !c.HasOperPermission(permission) {
+			c.SendNumeric(ERR_NOPRIVILEGES, fmt.Sprintf(":Permission Denied - You need %s permission", permission))
+			return
+		}
+		c.sendBanStats(banType)
+	case "i", "I", "y", "Y":
+		if !c.HasOperPermission("stats") {
+			c.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied - You need stats permission")
+			return
+		}
+		c.sendClassStats(strings.ToUpper(query))
+	case "m", "M":
+		c.sendCommandStats()
+	case "u", "U":
+		uptime := time.Since(c.server.healthMonitor.startTime)
+		c.SendNumeric(RPL_STATSUPTIME, fmt.Sprintf(":Server Up %d days %d:%02d:%02d",
+			int(uptime.Hours())/24, int(uptime.Hours())%24, int(uptime.Minutes())%60, int(uptime.Seconds())%60))
 	}
-	return strings.Join(channelNames, " ")
-}
 
-func (c *Client) getUserStatus(target *Client) string {
-	status := "Online"
-	if target.Away() != "" {
-		status = "Away"
-	}
-	if target.IsOper() {
-		status += " (Operator)"
-	}
-	if target.HasMode('i') {
-		status += " (Invisible)"
-	}
-	if target.HasMode('B') {
-		status += " (Bot)"
-	}
-	return status
+	c.SendNumeric(RPL_ENDOFSTATS, query+" :End of /STATS report")
 }
 
 // isValidNickname checks if a nickname is valid
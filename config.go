@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	Server struct {
 		Name        string `json:"name"`
+		SID         string `json:"sid"` // TS6 server ID, unique on the network
 		Network     string `json:"network"`
 		Description string `json:"description"`
 		Version     string `json:"version"`
@@ -36,10 +38,12 @@ type Config struct {
 		MaxTopicLength      int `json:"max_topic_length"`
 		MaxKickLength       int `json:"max_kick_length"`
 		MaxAwayLength       int `json:"max_away_length"`
-		PingTimeout         int `json:"ping_timeout"`
+		PingTimeout         int `json:"ping_timeout"`   // Seconds to wait for a PONG before disconnecting
+		PingFrequency       int `json:"ping_frequency"` // Seconds of silence before a connection is PINGed
 		RegistrationTimeout int `json:"registration_timeout"`
 		FloodLines          int `json:"flood_lines"`
 		FloodSeconds        int `json:"flood_seconds"`
+		MaxMonitor          int `json:"max_monitor"` // Nicks a client may have on its MONITOR or WATCH list
 	} `json:"limits"`
 
 	Features struct {
@@ -55,6 +59,7 @@ type Config struct {
 		HideHostsFromUsers bool `json:"hide_hosts_from_users"`
 		OperBypassHostHide bool `json:"oper_bypass_host_hide"`
 		MaskedHostSuffix   string `json:"masked_host_suffix"`
+		CloakKey           string `json:"cloak_key"` // Secret for +x cloaks; must match across linked servers
 	} `json:"privacy"`
 
 	WhoisFeatures struct {
@@ -71,6 +76,12 @@ type Config struct {
 			ToSelf     bool `json:"to_self"`
 		} `json:"show_ssl_status"`
 		
+		ShowCertFP struct {
+			ToEveryone bool `json:"to_everyone"`
+			ToOpers    bool `json:"to_opers"`
+			ToSelf     bool `json:"to_self"`
+		} `json:"show_certfp"`
+		
 		ShowIdleTime struct {
 			ToEveryone bool `json:"to_everyone"`
 			ToOpers    bool `json:"to_opers"`
@@ -160,6 +171,36 @@ type Config struct {
 		Enable     bool   `json:"enable"`
 	} `json:"oper_config"`
 
+	Classes []ConnectionClass `json:"classes"`
+
+	Links []LinkBlock `json:"links"`
+
+	Bans struct {
+		DatabaseFile string `json:"database_file"` // Where K/G/Z-lines are persisted
+	} `json:"bans"`
+
+	History struct {
+		Enabled         bool            `json:"enabled"`
+		MaxMessages     int             `json:"max_messages"`     // Messages kept per channel or conversation
+		MaxAgeDays      int             `json:"max_age_days"`     // 0 keeps messages until they are pushed out
+		PrivateMessages bool            `json:"private_messages"` // Keep private messages of users logged in to an account
+		QueryLimit      int             `json:"query_limit"`      // Most messages one CHATHISTORY request returns
+		DatabaseFile    string          `json:"database_file"`    // Optional on-disk store; empty keeps history in memory
+		Channels        []HistoryPolicy `json:"channels"`         // Per-channel retention, first matching mask wins
+	} `json:"history"`
+
+	Audit struct {
+		File       string `json:"file"`        // Oper audit log, written when opers.conf sets log_oper_actions
+		MaxSize    int    `json:"max_size"`    // Megabytes before the log is rotated
+		MaxBackups *int   `json:"max_backups"` // Rotated files kept; 0 keeps none, unset keeps 5
+	} `json:"audit"`
+
+	Services struct {
+		DatabaseFile string `json:"database_file"`
+		EnforceDelay int    `json:"enforce_delay"` // Seconds to identify before a registered nick is changed
+		GuestPrefix  string `json:"guest_prefix"`
+	} `json:"services"`
+
 	MOTD []string `json:"motd"`
 
 	Logging struct {
@@ -171,6 +212,48 @@ type Config struct {
 	} `json:"logging"`
 }
 
+// ConnectionClass holds the limits applied to a group of client connections.
+// A client is placed in the first class, in config order, whose criteria all
+// match when it registers.
+type ConnectionClass struct {
+	Name string `json:"name"`
+
+	// Criteria; those left empty match every connection
+	Hosts    []string `json:"hosts"`    // IP addresses, CIDR blocks or hostname masks
+	TLS      bool     `json:"tls"`      // Only connections made over TLS
+	Accounts []string `json:"accounts"` // Account masks; the client must log in with SASL
+	Ports    []int    `json:"ports"`    // Ports the client connected to
+	Password string   `json:"password"` // Must be sent with PASS; may be a bcrypt or argon2id hash
+
+	// Limits; zero means no limit, or the global limits block for the ping and flood settings
+	MaxClients    int `json:"max_clients"`    // Clients in the class
+	MaxPerIP      int `json:"max_per_ip"`     // Clients in the class from one address
+	SendQ         int `json:"sendq"`          // Bytes that may be queued for a client before it is disconnected
+	RecvQ         int `json:"recvq"`          // Bytes a client may send per flood window
+	PingFrequency int `json:"ping_frequency"` // Seconds of silence before a client is PINGed
+	FloodLines    int `json:"flood_lines"`
+	FloodSeconds  int `json:"flood_seconds"`
+}
+
+// HistoryPolicy overrides the history retention for channels matching a mask
+type HistoryPolicy struct {
+	Mask        string `json:"mask"`
+	Disabled    bool   `json:"disabled"`     // Keep no history for these channels
+	MaxMessages int    `json:"max_messages"` // 0 uses history.max_messages
+	MaxAgeDays  int    `json:"max_age_days"` // 0 uses history.max_age_days
+}
+
+// LinkBlock describes a server this server may link with
+type LinkBlock struct {
+	Name           string `json:"name"` // Server name of the peer
+	Host           string `json:"host"` // Address to connect to; incoming links must come from it
+	Port           int    `json:"port"`
+	SSL            bool   `json:"ssl"`
+	SendPassword   string `json:"send_password"`
+	AcceptPassword string `json:"accept_password"`
+	AutoConnect    bool   `json:"auto_connect"`
+}
+
 func LoadConfig(filename string) (*Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -185,18 +268,59 @@ func LoadConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
+// AuditMaxBackups returns how many rotated audit logs to keep. An unset
+// max_backups keeps 5; 0 keeps none.
+func (c *Config) AuditMaxBackups() int {
+	if c.Audit.MaxBackups == nil {
+		return 5
+	}
+	return *c.Audit.MaxBackups
+}
+
 func (c *Config) PingTimeoutDuration() time.Duration {
 	return time.Duration(c.Limits.PingTimeout) * time.Second
 }
 
+func (c *Config) PingFrequencyDuration() time.Duration {
+	return time.Duration(c.Limits.PingFrequency) * time.Second
+}
+
 func (c *Config) RegistrationTimeoutDuration() time.Duration {
 	return time.Duration(c.Limits.RegistrationTimeout) * time.Second
 }
 
+// LinkBlock returns the link block for a server name, or nil
+func (c *Config) LinkBlock(name string) *LinkBlock {
+	for i := range c.Links {
+		if strings.EqualFold(c.Links[i].Name, name) {
+			return &c.Links[i]
+		}
+	}
+	return nil
+}
+
+// Class returns the named connection class, falling back to the default class
+func (c *Config) Class(name string) *ConnectionClass {
+	var fallback *ConnectionClass
+	for i := range c.Classes {
+		if c.Classes[i].Name == name {
+			return &c.Classes[i]
+		}
+		if c.Classes[i].Name == "default" {
+			fallback = &c.Classes[i]
+		}
+	}
+	if fallback == nil {
+		fallback = &ConnectionClass{Name: "default", SendQ: 1048576}
+	}
+	return fallback
+}
+
 func DefaultConfig() *Config {
 	return &Config{
 		Server: struct {
 			Name        string `json:"name"`
+			SID         string `json:"sid"` // TS6 server ID, unique on the network
 			Network     string `json:"network"`
 			Description string `json:"description"`
 			Version     string `json:"version"`
@@ -249,9 +373,11 @@ func DefaultConfig() *Config {
 			MaxKickLength       int `json:"max_kick_length"`
 			MaxAwayLength       int `json:"max_away_length"`
 			PingTimeout         int `json:"ping_timeout"`
+			PingFrequency       int `json:"ping_frequency"`
 			RegistrationTimeout int `json:"registration_timeout"`
 			FloodLines          int `json:"flood_lines"`
 			FloodSeconds        int `json:"flood_seconds"`
+			MaxMonitor          int `json:"max_monitor"`
 		}{
 			MaxClients:          1000,
 			MaxChannels:         100,
@@ -262,9 +388,11 @@ func DefaultConfig() *Config {
 			MaxKickLength:       307,
 			MaxAwayLength:       307,
 			PingTimeout:         300,
+			PingFrequency:       120,
 			RegistrationTimeout: 60,
 			FloodLines:          20,
 			FloodSeconds:        10,
+			MaxMonitor:          100,
 		},
 		Features: struct {
 			EnableOper     bool   `json:"enable_oper"`
@@ -1,3 +1,7 @@
 module github.com/ComputerTech312/TechIRCd
 
 go 1.21
+
+require golang.org/x/crypto v0.26.0
+
+require golang.org/x/sys v0.23.0 // indirect
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTimeFormat is the IRCv3 server-time format, always UTC with milliseconds
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// historyCompactLines is the smallest database, in lines, that is compacted
+// while running
+const historyCompactLines = 10000
+
+// newMsgID returns a unique message ID
+func newMsgID() string {
+	var b [15]byte
+	rand.Read(b[:])
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b[:]))
+}
+
+// HistoryItem is one stored PRIVMSG or NOTICE
+type HistoryItem struct {
+	MsgID   string    `json:"msgid"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`            // nick!user@host of the sender
+	Account string    `json:"account,omitempty"` // Sender's account, if logged in
+	Command string    `json:"command"`
+	Target  string    `json:"target"` // Channel or nick the message was sent to
+	Text    string    `json:"text"`
+}
+
+// historyBuffer is a ring of the newest items for one channel or conversation
+type historyBuffer struct {
+	name  string // Channel or correspondent, as shown by CHATHISTORY TARGETS
+	items []HistoryItem
+	start int
+	count int
+}
+
+func newHistoryBuffer(name string, size int) *historyBuffer {
+	return &historyBuffer{name: name, items: make([]HistoryItem, size)}
+}
+
+// add stores an item, pushing out the oldest one when the ring is full
+func (b *historyBuffer) add(item HistoryItem) {
+	if len(b.items) == 0 {
+		return
+	}
+	idx := (b.start + b.count) % len(b.items)
+	b.items[idx] = item
+	if b.count < len(b.items) {
+		b.count++
+	} else {
+		b.start = (b.start + 1) % len(b.items)
+	}
+}
+
+// since returns the stored items no older than a cutoff, oldest first
+func (b *historyBuffer) since(cutoff time.Time) []HistoryItem {
+	items := make([]HistoryItem, 0, b.count)
+	for i := 0; i < b.count; i++ {
+		item := b.items[(b.start+i)%len(b.items)]
+		if !item.Time.Before(cutoff) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// resize changes the ring size, keeping the newest items
+func (b *historyBuffer) resize(size int) {
+	items := b.since(time.Time{})
+	b.items, b.start, b.count = make([]HistoryItem, size), 0, 0
+	for _, item := range items {
+		b.add(item)
+	}
+}
+
+// historyRecord is one line of the on-disk history store
+type historyRecord struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	HistoryItem
+}
+
+// HistoryStore keeps recent channel messages, and private messages of users
+// logged in to an account, in a ring per channel or conversation. With a
+// database file every message is also appended to disk and reloaded on start.
+// The file is rewritten with only what the rings hold on start and whenever
+// it reaches twice that, so it stays in proportion to the history kept.
+type HistoryStore struct {
+	buffers   map[string]*historyBuffer
+	filename  string
+	file      *os.File
+	lines     int // Lines in the file
+	compactAt int // Line count that triggers the next compaction
+	mu        sync.Mutex
+}
+
+// channelHistoryKey and privateHistoryKey name the buffers; private messages
+// are kept per account, under the nick of the other party
+func channelHistoryKey(channel string) string {
+	return strings.ToLower(channel)
+}
+
+func privateHistoryKey(account, peer string) string {
+	return strings.ToLower(account) + " " + strings.ToLower(peer)
+}
+
+// OpenHistoryStore creates a history store, loading and compacting the
+// database file if one is given
+func OpenHistoryStore(filename string, policy func(key string) (int, time.Duration)) (*HistoryStore, error) {
+	h := &HistoryStore{buffers: make(map[string]*historyBuffer)}
+	if filename == "" {
+		return h, nil
+	}
+
+	if err := h.load(filename, policy); err != nil {
+		return nil, err
+	}
+
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create history directory: %v", err)
+		}
+	}
+	h.filename = filename
+	if err := h.compactLocked(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// compactLocked rewrites the database file with only what the rings hold and
+// reopens it for appending; the caller must hold h.mu
+func (h *HistoryStore) compactLocked() error {
+	tmp := h.filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	lines := 0
+	w := bufio.NewWriter(file)
+	for key, b := range h.buffers {
+		for _, item := range b.since(time.Time{}) {
+			data, _ := json.Marshal(historyRecord{Key: key, Name: b.name, HistoryItem: item})
+			w.Write(append(data, '\n'))
+			lines++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	file.Close()
+	if err := os.Rename(tmp, h.filename); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file, err = os.OpenFile(h.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %v", err)
+	}
+	h.lines = lines
+	h.compactAt = 2 * lines
+	if h.compactAt < historyCompactLines {
+		h.compactAt = historyCompactLines
+	}
+	return nil
+}
+
+// load reads the database file into the buffers, applying the current
+// retention policy
+func (h *HistoryStore) load(filename string, policy func(key string) (int, time.Duration)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read history: %v", err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue // A line cut short by a crash
+		}
+		size, maxAge := policy(record.Key)
+		if size == 0 || (maxAge > 0 && now.Sub(record.Time) > maxAge) {
+			continue
+		}
+		b := h.buffers[record.Key]
+		if b == nil {
+			b = newHistoryBuffer(record.Name, size)
+			h.buffers[record.Key] = b
+		}
+		b.add(record.HistoryItem)
+	}
+	return scanner.Err()
+}
+
+// Add stores an item under a key, in a ring of the given size
+func (h *HistoryStore) Add(key, name string, size int, item HistoryItem) {
+	if size <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b := h.buffers[key]
+	if b == nil {
+		b = newHistoryBuffer(name, size)
+		h.buffers[key] = b
+	} else if len(b.items) != size {
+		b.resize(size)
+	}
+	b.name = name
+	b.add(item)
+
+	if h.file != nil {
+		data, _ := json.Marshal(historyRecord{Key: key, Name: name, HistoryItem: item})
+		if _, err := h.file.Write(append(data, '\n')); err != nil {
+			log.Printf("History: failed to write: %v", err)
+		}
+		h.lines++
+		if h.lines >= h.compactAt {
+			if err := h.compactLocked(); err != nil {
+				log.Printf("History: failed to compact: %v", err)
+				h.compactAt = h.lines + historyCompactLines
+			}
+		}
+	}
+}
+
+// Items returns the items stored under a key no older than maxAge (0 for
+// any age), oldest first
+func (h *HistoryStore) Items(key string, maxAge time.Duration) []HistoryItem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b := h.buffers[key]
+	if b == nil {
+		return nil
+	}
+	var cutoff time.Time
+	if maxAge > 0 {
+		cutoff = time.Now().Add(-maxAge)
+	}
+	return b.since(cutoff)
+}
+
+// Latest returns the name and newest message time of every buffer whose key
+// passes the filter
+func (h *HistoryStore) Latest(filter func(key string) bool) map[string]time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	latest := make(map[string]time.Time)
+	for key, b := range h.buffers {
+		if b.count == 0 || !filter(key) {
+			continue
+		}
+		latest[b.name] = b.items[(b.start+b.count-1)%len(b.items)].Time
+	}
+	return latest
+}
+
+// Close closes the database file
+func (h *HistoryStore) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// historyPolicy returns the ring size and maximum age for a buffer key. A
+// size of 0 means nothing is kept.
+func (s *Server) historyPolicy(key string) (int, time.Duration) {
+	config := s.config.History
+	size, days := config.MaxMessages, config.MaxAgeDays
+	if !config.Enabled {
+		return 0, 0
+	}
+
+	if isChannelName(key) {
+		for _, policy := range config.Channels {
+			if !matchWildcard(strings.ToLower(policy.Mask), key) {
+				continue
+			}
+			if policy.Disabled {
+				return 0, 0
+			}
+			if policy.MaxMessages > 0 {
+				size = policy.MaxMessages
+			}
+			if policy.MaxAgeDays > 0 {
+				days = policy.MaxAgeDays
+			}
+			break
+		}
+	} else if !config.PrivateMessages {
+		return 0, 0
+	}
+	return size, time.Duration(days) * 24 * time.Hour
+}
+
+// recordHistory stores a PRIVMSG or NOTICE delivered to a channel or to a
+// local user. Private messages are kept for each local party that is
+// logged in to an account.
+func (s *Server) recordHistory(sender *Client, item HistoryItem) {
+	if s.history == nil {
+		return
+	}
+
+	if isChannelName(item.Target) {
+		key := channelHistoryKey(item.Target)
+		size, _ := s.historyPolicy(key)
+		s.history.Add(key, item.Target, size, item)
+		return
+	}
+
+	recipient := s.GetClient(item.Target)
+	if sender != nil && !sender.IsRemote() && sender.Account() != "" {
+		key := privateHistoryKey(sender.Account(), item.Target)
+		size, _ := s.historyPolicy(key)
+		s.history.Add(key, item.Target, size, item)
+	}
+	if recipient != nil && recipient != sender && !recipient.IsRemote() && recipient.Account() != "" {
+		peer := strings.SplitN(item.Source, "!", 2)[0]
+		key := privateHistoryKey(recipient.Account(), peer)
+		size, _ := s.historyPolicy(key)
+		s.history.Add(key, peer, size, item)
+	}
+}
+
+// historyItem builds the history entry for a message sent by a local client
+func (c *Client) historyItem(command, target, text string) HistoryItem {
+	return HistoryItem{
+		MsgID:   newMsgID(),
+		Time:    time.Now().UTC(),
+		Source:  c.Prefix(),
+		Account: c.Account(),
+		Command: command,
+		Target:  target,
+		Text:    text,
+	}
+}
+
+// remoteHistoryItem builds the history entry for a message from the network;
+// sender is nil when a server sent it
+func remoteHistoryItem(sender *Client, source, command, target, text string) HistoryItem {
+	item := HistoryItem{
+		MsgID:   newMsgID(),
+		Time:    time.Now().UTC(),
+		Source:  source,
+		Command: command,
+		Target:  target,
+		Text:    text,
+	}
+	if sender != nil {
+		item.Account = sender.Account()
+	}
+	return item
+}
+
+// historyRef is a CHATHISTORY message reference: a msgid or a timestamp
+type historyRef struct {
+	msgid string
+	time  time.Time
+}
+
+func parseHistoryRef(ref string) (historyRef, bool) {
+	switch {
+	case strings.HasPrefix(ref, "msgid="):
+		return historyRef{msgid: ref[len("msgid="):]}, len(ref) > len("msgid=")
+	case strings.HasPrefix(ref, "timestamp="):
+		t, err := time.Parse(time.RFC3339Nano, ref[len("timestamp="):])
+		return historyRef{time: t}, err == nil
+	}
+	return historyRef{}, false
+}
+
+// position locates a reference in items: items[:lo] are before it and
+// items[hi:] after it. A msgid that is not stored is not found.
+func (r historyRef) position(items []HistoryItem) (lo, hi int, ok bool) {
+	if r.msgid != "" {
+		for i := range items {
+			if items[i].MsgID == r.msgid {
+				return i, i + 1, true
+			}
+		}
+		return 0, 0, false
+	}
+	lo = sort.Search(len(items), func(i int) bool { return !items[i].Time.Before(r.time) })
+	hi = sort.Search(len(items), func(i int) bool { return items[i].Time.After(r.time) })
+	return lo, hi, true
+}
+
+// firstItems and lastItems cut a result down to a limit
+func firstItems(items []HistoryItem, limit int) []HistoryItem {
+	if len(items) > limit {
+		return items[:limit]
+	}
+	return items
+}
+
+func lastItems(items []HistoryItem, limit int) []HistoryItem {
+	if len(items) > limit {
+		return items[len(items)-limit:]
+	}
+	return items
+}
+
+// selectHistory answers a CHATHISTORY subcommand from a buffer's items,
+// oldest first
+func selectHistory(items []HistoryItem, subcommand string, refs []historyRef, limit int) []HistoryItem {
+	switch subcommand {
+	case "LATEST":
+		if len(refs) == 0 {
+			return lastItems(items, limit)
+		}
+		_, hi, ok := refs[0].position(items)
+		if !ok {
+			return nil
+		}
+		return lastItems(items[hi:], limit)
+	case "BEFORE":
+		lo, _, ok := refs[0].position(items)
+		if !ok {
+			return nil
+		}
+		return lastItems(items[:lo], limit)
+	case "AFTER":
+		_, hi, ok := refs[0].position(items)
+		if !ok {
+			return nil
+		}
+		return firstItems(items[hi:], limit)
+	case "AROUND":
+		lo, _, ok := refs[0].position(items)
+		if !ok {
+			return nil
+		}
+		before, after := items[:lo], items[lo:]
+		nBefore := limit / 2
+		if nBefore > len(before) {
+			nBefore = len(before)
+		}
+		nAfter := limit - nBefore
+		if nAfter > len(after) {
+			nAfter = len(after)
+		}
+		if nBefore+nAfter < limit {
+			nBefore = limit - nAfter
+			if nBefore > len(before) {
+				nBefore = len(before)
+			}
+		}
+		return append(append([]HistoryItem(nil), before[len(before)-nBefore:]...), after[:nAfter]...)
+	case "BETWEEN":
+		loA, hiA, okA := refs[0].position(items)
+		loB, hiB, okB := refs[1].position(items)
+		if !okA || !okB {
+			return nil
+		}
+		if hiA <= loB {
+			return firstItems(items[hiA:loB], limit)
+		}
+		if hiB <= loA {
+			return lastItems(items[hiB:loA], limit)
+		}
+	}
+	return nil
+}
+
+// handleChatHistory handles CHATHISTORY <LATEST|BEFORE|AFTER|AROUND> <target> <ref> <limit>,
+// CHATHISTORY BETWEEN <target> <ref> <ref> <limit> and CHATHISTORY TARGETS <ts> <ts> <limit>
+func (c *Client) handleChatHistory(msg *Message) {
+	s := c.server
+	subcommand := strings.ToUpper(msg.Params[0])
+
+	var wantParams int
+	switch subcommand {
+	case "LATEST", "BEFORE", "AFTER", "AROUND", "TARGETS":
+		wantParams = 4
+	case "BETWEEN":
+		wantParams = 5
+	default:
+		c.sendFail("CHATHISTORY", "INVALID_PARAMS", subcommand, "Unknown subcommand")
+		return
+	}
+	if len(msg.Params) < wantParams {
+		c.sendFail("CHATHISTORY", "NEED_MORE_PARAMS", subcommand, "Missing parameters")
+		return
+	}
+
+	limit, err := strconv.Atoi(msg.Params[wantParams-1])
+	if err != nil || limit < 1 {
+		c.sendFail("CHATHISTORY", "INVALID_PARAMS", subcommand, "Invalid limit")
+		return
+	}
+	if limit > s.config.History.QueryLimit {
+		limit = s.config.History.QueryLimit
+	}
+
+	if subcommand == "TARGETS" {
+		c.sendHistoryTargets(msg.Params[1], msg.Params[2], limit)
+		return
+	}
+
+	target := msg.Params[1]
+	var refs []historyRef
+	for _, raw := range msg.Params[2 : wantParams-1] {
+		if subcommand == "LATEST" && raw == "*" {
+			continue
+		}
+		ref, ok := parseHistoryRef(raw)
+		if !ok {
+			c.sendFail("CHATHISTORY", "INVALID_PARAMS", subcommand, raw, "Invalid message reference")
+			return
+		}
+		refs = append(refs, ref)
+	}
+
+	var key string
+	if isChannelName(target) {
+		// Only members can read a channel's history
+		channel := s.GetChannel(target)
+		if channel == nil || !c.IsInChannel(target) {
+			c.sendFail("CHATHISTORY", "INVALID_TARGET", subcommand, target, "You are not on that channel")
+			return
+		}
+		target = channel.Name()
+		key = channelHistoryKey(target)
+	} else {
+		if c.Account() == "" {
+			c.sendFail("CHATHISTORY", "INVALID_TARGET", subcommand, target, "Private message history requires an account")
+			return
+		}
+		key = privateHistoryKey(c.Account(), target)
+	}
+
+	var items []HistoryItem
+	if size, maxAge := s.historyPolicy(key); size > 0 && s.history != nil {
+		items = selectHistory(s.history.Items(key, maxAge), subcommand, refs, limit)
+	}
+
+	ref := c.startBatch("chathistory", target)
+	for _, item := range items {
+		c.Send(inBatch(relayMessage(item, nil), ref))
+	}
+	c.endBatch(ref)
+}
+
+// sendHistoryTargets answers CHATHISTORY TARGETS: the channels the client is
+// on and the users it has talked to with messages between two timestamps
+func (c *Client) sendHistoryTargets(from, to string, limit int) {
+	s := c.server
+	refA, okA := parseHistoryRef(from)
+	refB, okB := parseHistoryRef(to)
+	if !okA || !okB || refA.msgid != "" || refB.msgid != "" {
+		c.sendFail("CHATHISTORY", "INVALID_PARAMS", "TARGETS", "Targets must be given as timestamps")
+		return
+	}
+	start, end := refA.time, refB.time
+	if end.Before(start) {
+		start, end = end, start
+	}
+
+	channels := make(map[string]bool)
+	for _, channel := range c.GetChannels() {
+		channels[channelHistoryKey(channel.Name())] = true
+	}
+	prefix := ""
+	if c.Account() != "" {
+		prefix = privateHistoryKey(c.Account(), "")
+	}
+
+	type target struct {
+		name   string
+		latest time.Time
+	}
+	var targets []target
+	if s.history != nil {
+		latest := s.history.Latest(func(key string) bool {
+			return channels[key] || (prefix != "" && strings.HasPrefix(key, prefix))
+		})
+		for name, t := range latest {
+			if t.After(start) && t.Before(end) {
+				targets = append(targets, target{name, t})
+			}
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].latest.Before(targets[j].latest) })
+	if len(targets) > limit {
+		targets = targets[:limit]
+	}
+
+	ref := c.startBatch("draft/chathistory-targets")
+	for _, t := range targets {
+		c.Send(inBatch(NewMessage(s.config.Server.Name, "CHATHISTORY", "TARGETS", t.name, t.latest.UTC().Format(serverTimeFormat)), ref))
+	}
+	c.endBatch(ref)
+}
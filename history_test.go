@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyItems returns n items one second apart with msgids m0, m1, ...
+func historyItems(n int) []HistoryItem {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	items := make([]HistoryItem, n)
+	for i := range items {
+		items[i] = HistoryItem{MsgID: fmt.Sprintf("m%d", i), Time: base.Add(time.Duration(i) * time.Second), Text: fmt.Sprint(i)}
+	}
+	return items
+}
+
+func msgids(items []HistoryItem) string {
+	s := ""
+	for _, item := range items {
+		if s != "" {
+			s += ","
+		}
+		s += item.MsgID
+	}
+	return s
+}
+
+func TestHistoryBufferRing(t *testing.T) {
+	b := newHistoryBuffer("#test", 3)
+	for _, item := range historyItems(5) {
+		b.add(item)
+	}
+	if got := msgids(b.since(time.Time{})); got != "m2,m3,m4" {
+		t.Errorf("ring kept %s, want m2,m3,m4", got)
+	}
+
+	b.resize(2)
+	if got := msgids(b.since(time.Time{})); got != "m3,m4" {
+		t.Errorf("after resize kept %s, want m3,m4", got)
+	}
+}
+
+func TestSelectHistory(t *testing.T) {
+	items := historyItems(10)
+	msgid := func(id string) historyRef { return historyRef{msgid: id} }
+	at := func(i int) historyRef { return historyRef{time: items[i].Time} }
+
+	tests := []struct {
+		subcommand string
+		refs       []historyRef
+		limit      int
+		want       string
+	}{
+		{"LATEST", nil, 3, "m7,m8,m9"},
+		{"LATEST", []historyRef{msgid("m6")}, 10, "m7,m8,m9"},
+		{"BEFORE", []historyRef{msgid("m5")}, 2, "m3,m4"},
+		{"BEFORE", []historyRef{at(1)}, 5, "m0"},
+		{"AFTER", []historyRef{msgid("m5")}, 2, "m6,m7"},
+		{"AFTER", []historyRef{msgid("missing")}, 2, ""},
+		{"AROUND", []historyRef{msgid("m5")}, 4, "m3,m4,m5,m6"},
+		{"AROUND", []historyRef{msgid("m0")}, 3, "m0,m1,m2"},
+		{"BETWEEN", []historyRef{msgid("m2"), msgid("m6")}, 10, "m3,m4,m5"},
+		{"BETWEEN", []historyRef{msgid("m6"), msgid("m2")}, 2, "m4,m5"},
+	}
+	for _, tt := range tests {
+		if got := msgids(selectHistory(items, tt.subcommand, tt.refs, tt.limit)); got != tt.want {
+			t.Errorf("%s %v limit %d = %s, want %s", tt.subcommand, tt.refs, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestParseHistoryRef(t *testing.T) {
+	if ref, ok := parseHistoryRef("msgid=abc"); !ok || ref.msgid != "abc" {
+		t.Errorf("msgid=abc parsed as %+v, %v", ref, ok)
+	}
+	if ref, ok := parseHistoryRef("timestamp=2024-01-01T00:00:05.000Z"); !ok || ref.time.Second() != 5 {
+		t.Errorf("timestamp parsed as %+v, %v", ref, ok)
+	}
+	for _, bad := range []string{"msgid=", "timestamp=yesterday", "abc", "*"} {
+		if _, ok := parseHistoryRef(bad); ok {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestHistoryStorePersistence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history.jsonl")
+	policy := func(key string) (int, time.Duration) {
+		if key == "#secret" {
+			return 0, 0
+		}
+		return 2, 0
+	}
+
+	h, err := OpenHistoryStore(filename, policy)
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	for _, item := range historyItems(3) {
+		h.Add("#test", "#Test", 5, item)
+		h.Add("#secret", "#secret", 5, item)
+	}
+	h.Close()
+
+	// On reload the smaller ring and the disabled channel apply
+	h, err = OpenHistoryStore(filename, policy)
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	defer h.Close()
+	if got := msgids(h.Items("#test", 0)); got != "m1,m2" {
+		t.Errorf("reloaded #test = %s, want m1,m2", got)
+	}
+	if got := h.Items("#secret", 0); len(got) != 0 {
+		t.Errorf("reloaded #secret = %s, want nothing", msgids(got))
+	}
+	if latest := h.Latest(func(string) bool { return true }); len(latest) != 1 || latest["#Test"].IsZero() {
+		t.Errorf("Latest = %v, want only #Test", latest)
+	}
+}
+
+func TestHistoryStoreCompactsWhileRunning(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history.jsonl")
+	h, err := OpenHistoryStore(filename, func(string) (int, time.Duration) { return 10, 0 })
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	defer h.Close()
+
+	// Far more messages than the ring keeps: the file stays bounded
+	items := historyItems(3 * historyCompactLines)
+	for _, item := range items {
+		h.Add("#busy", "#busy", 10, item)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > historyCompactLines {
+		t.Errorf("history file has %d lines for 10 kept messages", lines)
+	}
+
+	// Nothing kept is lost by compacting
+	h.Close()
+	h, err = OpenHistoryStore(filename, func(string) (int, time.Duration) { return 10, 0 })
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer h.Close()
+	if got, want := msgids(h.Items("#busy", 0)), msgids(items[len(items)-10:]); got != want {
+		t.Errorf("after compaction #busy = %s, want %s", got, want)
+	}
+}
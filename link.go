@@ -0,0 +1,1739 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Server linking numerics
+const (
+	RPL_MAP            = 15
+	RPL_MAPEND         = 17
+	RPL_TRACELINK      = 200
+	RPL_TRACEOPERATOR  = 204
+	RPL_TRACEUSER      = 205
+	RPL_TRACESERVER    = 206
+	RPL_TRACEUNKNOWN   = 201
+	RPL_TRACEEND       = 262
+	RPL_LINKS          = 364
+	RPL_ENDOFLINKS     = 365
+	linkConnectTimeout = 15 * time.Second
+	linkDNSTimeout     = 5 * time.Second
+	linkRetryInterval  = 60 * time.Second
+	maxBurstLineLength = 450
+)
+
+// uidChars are the characters used in the client part of a UID
+const uidChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// RemoteServer is another server on the network
+type RemoteServer struct {
+	Name        string
+	SID         string
+	Description string
+	Hops        int    // Distance from this server
+	Uplink      string // SID of the server it is connected to
+	link        *Link  // Direct link it is reached through
+}
+
+// Link is a direct connection to a peer server
+type Link struct {
+	server    *Server
+	client    *Client // The underlying connection
+	block     *LinkBlock
+	peer      *RemoteServer
+	outgoing  bool
+	bursting  bool        // Until the peer answers the PING that ends our burst
+	netjoin   *batchGroup // Batches the JOINs of users arriving in the burst
+	connected time.Time
+}
+
+// isValidSID checks the TS6 SID format: a digit followed by two letters or digits
+func isValidSID(sid string) bool {
+	if len(sid) != 3 || sid[0] < '0' || sid[0] > '9' {
+		return false
+	}
+	for i := 1; i < 3; i++ {
+		if !strings.ContainsRune(uidChars, rune(sid[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultSID derives a SID from the server name for configs that do not set one
+func defaultSID(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(name)))
+	sum := h.Sum32()
+	return fmt.Sprintf("%d%c%c", sum%10, uidChars[(sum/10)%36], uidChars[(sum/360)%36])
+}
+
+// nextUID returns a new UID: the server SID followed by six characters, the
+// first of which is a letter
+func (s *Server) nextUID() string {
+	n := atomic.AddUint64(&s.uidSeq, 1) - 1
+	id := make([]byte, 6)
+	for i := 5; i > 0; i-- {
+		id[i] = uidChars[n%36]
+		n /= 36
+	}
+	id[0] = uidChars[n%26]
+	return s.sid + string(id)
+}
+
+// send writes a line to the peer
+func (l *Link) send(format string, args ...interface{}) {
+	l.client.writeLine(fmt.Sprintf(format, args...))
+}
+
+// forward sends a line to every linked server except one
+func (s *Server) forward(except *Link, line string) {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	s.forwardLocked(except, line)
+}
+
+// forwardLocked is forward for callers holding linkMu
+func (s *Server) forwardLocked(except *Link, line string) {
+	for _, link := range s.links {
+		if link != except {
+			link.client.writeLine(line)
+		}
+	}
+}
+
+// GetLinks returns the directly connected servers
+func (s *Server) GetLinks() []*Link {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+
+	links := make([]*Link, 0, len(s.links))
+	for _, link := range s.links {
+		links = append(links, link)
+	}
+	return links
+}
+
+// GetServers returns every known remote server, nearest first
+func (s *Server) GetServers() []*RemoteServer {
+	s.mu.RLock()
+	servers := make([]*RemoteServer, 0, len(s.servers))
+	for _, rs := range s.servers {
+		servers = append(servers, rs)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Hops != servers[j].Hops {
+			return servers[i].Hops < servers[j].Hops
+		}
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
+// findServer looks a remote server up by SID or name
+func (s *Server) findServer(id string) *RemoteServer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if rs, exists := s.servers[id]; exists {
+		return rs
+	}
+	for _, rs := range s.servers {
+		if strings.EqualFold(rs.Name, id) {
+			return rs
+		}
+	}
+	return nil
+}
+
+// serverName returns the name of a server by SID, including our own
+func (s *Server) serverName(sid string) string {
+	if sid == s.sid {
+		return s.config.Server.Name
+	}
+	if rs := s.findServer(sid); rs != nil {
+		return rs.Name
+	}
+	return sid
+}
+
+// GetRemoteClients returns the users on other servers
+func (s *Server) GetRemoteClients() []*Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(s.remoteClients))
+	for _, client := range s.remoteClients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// sourceName returns how a message source is shown to local users: a
+// nick!user@host for clients and the name for servers
+func (s *Server) sourceName(source string) string {
+	if client := s.GetClientByID(source); client != nil {
+		return client.Prefix()
+	}
+	return s.serverName(source)
+}
+
+// sourceNick returns the nick or server name of a message source
+func (s *Server) sourceNick(source string) string {
+	if client := s.GetClientByID(source); client != nil {
+		return client.Nick()
+	}
+	return s.serverName(source)
+}
+
+// findTarget resolves a UID or nick
+func (s *Server) findTarget(target string) *Client {
+	if client := s.GetClientByID(target); client != nil {
+		return client
+	}
+	return s.GetClient(target)
+}
+
+// uidLine introduces a user to another server
+func (s *Server) uidLine(c *Client) string {
+	sid, hops := s.sid, 1
+	if c.remote != nil {
+		sid, hops = c.remote.SID, c.remote.Hops+1
+	}
+	return fmt.Sprintf(":%s UID %s %d %d +%s %s %s %s %s :%s", sid, c.Nick(), hops, c.NickTS(),
+		strings.TrimPrefix(c.GetModes(), "+"), c.User(), c.DisplayHost(), c.Host(), c.UID(), c.Realname())
+}
+
+// handlePass handles PASS. Servers send "PASS <password> TS 6 :<SID>" to
+// start a link.
+func (c *Client) handlePass(msg *Message) {
+	if c.IsRegistered() {
+		c.SendNumeric(ERR_ALREADYREGISTRED, ":You may not reregister")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.password = msg.Params[0]
+	if len(msg.Params) >= 4 && strings.EqualFold(msg.Params[1], "TS") {
+		c.passSID = strings.ToUpper(msg.Params[3])
+	}
+}
+
+// handleServer handles SERVER from a connection that wants to become a link
+func (c *Client) handleServer(msg *Message) {
+	if c.IsRegistered() {
+		c.SendNumeric(ERR_ALREADYREGISTRED, ":You may not reregister")
+		return
+	}
+	if len(msg.Params) < 3 {
+		c.Quit("Invalid SERVER message")
+		return
+	}
+
+	s := c.server
+	name, description := msg.Params[0], msg.Params[len(msg.Params)-1]
+
+	c.mu.RLock()
+	password, sid, block := c.password, c.passSID, c.linkBlock
+	c.mu.RUnlock()
+
+	outgoing := block != nil
+	if !outgoing {
+		block = s.config.LinkBlock(name)
+	}
+
+	reason := ""
+	switch {
+	case block == nil || !strings.EqualFold(block.Name, name):
+		reason = "No link block for " + name
+	case subtle.ConstantTimeCompare([]byte(password), []byte(block.AcceptPassword)) != 1:
+		reason = "Invalid password"
+	case !outgoing && !linkHostMatches(block.Host, c.Host()):
+		reason = "Host mismatch"
+	case !isValidSID(sid):
+		reason = "Link requires TS6 (no valid SID in PASS)"
+	}
+	if reason != "" {
+		s.sendSnomask('s', fmt.Sprintf("Link with %s[%s] rejected: %s", name, c.Host(), reason))
+		c.Quit(reason)
+		return
+	}
+
+	if !outgoing {
+		s.sendHandshake(c, block)
+	}
+	s.establishLink(c, block, name, sid, description, outgoing)
+}
+
+// linkHostMatches checks that an incoming link comes from the configured
+// host; a hostname is resolved with a timeout, so a slow resolver cannot
+// hold the handshake open
+func linkHostMatches(configured, addr string) bool {
+	if configured == addr {
+		return true
+	}
+	if ip := net.ParseIP(configured); ip != nil {
+		return ip.Equal(net.ParseIP(addr))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkDNSTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, configured)
+	if err != nil {
+		return false
+	}
+	for _, resolved := range addrs {
+		if net.ParseIP(resolved).Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendHandshake sends our side of the link registration
+func (s *Server) sendHandshake(c *Client, block *LinkBlock) {
+	c.writeLine(fmt.Sprintf("PASS %s TS 6 :%s", block.SendPassword, s.sid))
+	c.writeLine("CAPAB :QS ENCAP")
+	c.writeLine(fmt.Sprintf("SERVER %s 1 :%s", s.config.Server.Name, s.config.Server.Description))
+	c.writeLine(fmt.Sprintf("SVINFO 6 6 0 :%d", time.Now().Unix()))
+}
+
+// establishLink turns a negotiated connection into a server link and sends our burst
+func (s *Server) establishLink(c *Client, block *LinkBlock, name, sid, description string, outgoing bool) {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+
+	s.mu.Lock()
+	_, sidExists := s.servers[sid]
+	nameExists := strings.EqualFold(name, s.config.Server.Name)
+	for _, rs := range s.servers {
+		if strings.EqualFold(rs.Name, name) {
+			nameExists = true
+		}
+	}
+	if sidExists || nameExists || sid == s.sid {
+		s.mu.Unlock()
+		s.sendSnomask('s', fmt.Sprintf("Link with %s[%s] rejected: server already exists", name, c.Host()))
+		c.Quit("Server already exists")
+		return
+	}
+
+	peer := &RemoteServer{Name: name, SID: sid, Description: description, Hops: 1, Uplink: s.sid}
+	link := &Link{
+		server:    s,
+		client:    c,
+		block:     block,
+		peer:      peer,
+		outgoing:  outgoing,
+		bursting:  true,
+		netjoin:   newBatchGroup("netjoin", s.config.Server.Name, name),
+		connected: time.Now(),
+	}
+	peer.link = link
+	s.servers[sid] = peer
+	delete(s.clients, c.clientID)
+	s.mu.Unlock()
+
+	s.links[sid] = link
+
+	c.mu.Lock()
+	c.link = link
+	c.registered = true
+	c.mu.Unlock()
+
+	s.sendBurst(link)
+	s.forwardLocked(link, fmt.Sprintf(":%s SID %s 2 %s :%s", s.sid, name, sid, description))
+
+	log.Printf("Link established with %s (%s)", name, sid)
+	s.sendSnomask('s', fmt.Sprintf("Link with %s[%s] established", name, c.Host()))
+}
+
+// sendBurst tells a new peer about every server, user and channel we know
+func (s *Server) sendBurst(l *Link) {
+	// Servers, nearest first so every uplink is introduced before its leaves
+	for _, rs := range s.GetServers() {
+		if rs.link == l {
+			continue
+		}
+		l.send(":%s SID %s %d %s :%s", rs.Uplink, rs.Name, rs.Hops+1, rs.SID, rs.Description)
+	}
+
+	for _, client := range s.GetClients() {
+		if client.IsRegistered() {
+			l.send("%s", s.uidLine(client))
+		}
+	}
+	for _, client := range s.GetRemoteClients() {
+		if client.remote.link != l {
+			l.send("%s", s.uidLine(client))
+		}
+	}
+
+	for _, channel := range s.GetChannels() {
+		s.burstChannel(l, channel)
+	}
+
+	for _, ban := range s.bans.List(GLine) {
+		l.send("%s", s.glineLine(&ban))
+	}
+
+	// The answer to this PING marks the end of the burst
+	l.send("PING :%s", s.config.Server.Name)
+}
+
+// burstChannel sends a channel's members, modes, topic and bans to a peer
+func (s *Server) burstChannel(l *Link, channel *Channel) {
+	name, ts := channel.Name(), channel.TS()
+	modes, params := channel.ModeParams()
+	header := fmt.Sprintf(":%s SJOIN %d %s %s", s.sid, ts, name, strings.Join(append([]string{modes}, params...), " "))
+
+	var members []string
+	length := len(header)
+	flush := func() {
+		if len(members) > 0 {
+			l.send("%s :%s", header, strings.Join(members, " "))
+			members, length = nil, len(header)
+		}
+	}
+	for _, client := range channel.GetClients() {
+		if (client.remote != nil && client.remote.link == l) || channel.IsGhost(client) {
+			continue
+		}
+		member := channel.StatusPrefixes(client) + client.UID()
+		if length+len(member)+1 > maxBurstLineLength {
+			flush()
+		}
+		members = append(members, member)
+		length += len(member) + 1
+	}
+	flush()
+
+	if topic := channel.Topic(); topic != "" {
+		l.send(":%s TB %s %d %s :%s", s.sid, name, channel.TopicTime().Unix(), channel.TopicBy(), topic)
+	}
+
+	bans := channel.GetBans()
+	for len(bans) > 0 {
+		n, length := 0, 0
+		for n < len(bans) && length+len(bans[n])+1 < maxBurstLineLength-len(name)-40 {
+			length += len(bans[n]) + 1
+			n++
+		}
+		if n == 0 {
+			n = 1
+		}
+		l.send(":%s BMASK %d %s b :%s", s.sid, ts, name, strings.Join(bans[:n], " "))
+		bans = bans[n:]
+	}
+}
+
+// linkClosed handles the loss of a link: everything behind it splits off
+func (s *Server) linkClosed(l *Link, reason string) {
+	s.linkMu.Lock()
+	if s.links[l.peer.SID] != l {
+		s.linkMu.Unlock()
+		return
+	}
+	delete(s.links, l.peer.SID)
+	s.linkMu.Unlock()
+	l.netjoin.end()
+
+	lost := s.splitServer(l.peer)
+	s.forward(nil, fmt.Sprintf(":%s SQUIT %s :%s", s.sid, l.peer.SID, reason))
+
+	log.Printf("Link with %s closed: %s", l.peer.Name, reason)
+	s.sendSnomask('s', fmt.Sprintf("Lost link to %s (%s), %d users split", l.peer.Name, reason, lost))
+}
+
+// splitServer removes a server and every server behind it, quitting their
+// users with the usual "uplink server" netsplit reason in a netsplit batch.
+// It returns the number of users lost.
+func (s *Server) splitServer(rs *RemoteServer) int {
+	netsplit := newBatchGroup("netsplit", s.serverName(rs.Uplink), rs.Name)
+
+	s.mu.Lock()
+	gone := map[string]*RemoteServer{rs.SID: rs}
+	for changed := true; changed; {
+		changed = false
+		for sid, other := range s.servers {
+			if _, known := gone[sid]; known {
+				continue
+			}
+			if _, parentGone := gone[other.Uplink]; parentGone {
+				gone[sid] = other
+				changed = true
+			}
+		}
+	}
+
+	reasons := make(map[*Client]string)
+	for _, client := range s.remoteClients {
+		if _, lost := gone[client.remote.SID]; lost {
+			uplink := s.config.Server.Name
+			if parent, exists := s.servers[client.remote.Uplink]; exists {
+				uplink = parent.Name
+			}
+			reasons[client] = uplink + " " + client.remote.Name
+		}
+	}
+	for sid := range gone {
+		delete(s.servers, sid)
+	}
+	s.mu.Unlock()
+
+	for client, reason := range reasons {
+		s.removeRemoteClientBatched(client, reason, netsplit)
+	}
+	netsplit.end()
+	return len(reasons)
+}
+
+// addRemoteClient creates a user introduced by another server
+func (s *Server) addRemoteClient(rs *RemoteServer, uid, nick, user, host, realname, modes string, ts int64) *Client {
+	client := &Client{
+		clientID:     uid,
+		nick:         nick,
+		nickTS:       ts,
+		user:         user,
+		host:         host,
+		cloak:        cloakHost(s.config.Privacy.CloakKey, s.config.Privacy.MaskedHostSuffix, host),
+		realname:     realname,
+		server:       s,
+		remote:       rs,
+		registered:   true,
+		channels:     make(map[string]*Channel),
+		modes:        make(map[rune]bool),
+		capabilities: make(map[string]bool),
+		snomasks:     make(map[rune]bool),
+		connectTime:  time.Unix(ts, 0),
+		lastActivity: time.Now(),
+	}
+	for _, mode := range strings.TrimPrefix(modes, "+") {
+		client.modes[mode] = true
+	}
+	client.oper = client.modes['o']
+
+	s.mu.Lock()
+	s.remoteClients[uid] = client
+	s.mu.Unlock()
+	return client
+}
+
+// removeRemoteClient removes a user on another server, telling local users
+// sharing a channel with it
+func (s *Server) removeRemoteClient(c *Client, reason string) {
+	s.removeRemoteClientBatched(c, reason, nil)
+}
+
+// removeRemoteClientBatched removes a remote user, sending its QUIT to local
+// users inside a batch such as a netsplit
+func (s *Server) removeRemoteClientBatched(c *Client, reason string, batch *batchGroup) {
+	s.mu.Lock()
+	if s.remoteClients[c.clientID] != c {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.remoteClients, c.clientID)
+	s.mu.Unlock()
+	s.presenceOffline(c, c.Nick())
+
+	quitMsg := c.taggedMessage("QUIT", reason)
+	for _, peer := range c.commonChannelPeers() {
+		batch.send(peer, quitMsg)
+	}
+	for _, channel := range c.GetChannels() {
+		channel.RemoveClient(c)
+		if channel.UserCount() == 0 {
+			s.RemoveChannel(channel.Name())
+		}
+	}
+}
+
+// resolveCollision settles a nick claimed by both an existing user and one
+// introduced (or renamed) by a peer. The older nick wins; on a tie both
+// lose. It returns whether the incoming user survives.
+func (s *Server) resolveCollision(l *Link, existing *Client, uid string, ts int64) bool {
+	existingTS := existing.NickTS()
+	killExisting := ts <= existingTS
+	keepIncoming := ts < existingTS
+
+	reason := fmt.Sprintf("%s (Nick collision)", s.config.Server.Name)
+	s.sendSnomask('k', fmt.Sprintf("Nick collision on %s (%s %d <-> %s %d)", existing.Nick(), existing.UID(), existingTS, uid, ts))
+
+	if killExisting {
+		s.forward(nil, fmt.Sprintf(":%s KILL %s :%s", s.sid, existing.UID(), reason))
+		if existing.IsRemote() {
+			s.removeRemoteClient(existing, "Nick collision")
+		} else {
+			existing.Quit("Nick collision")
+		}
+	}
+	if !keepIncoming {
+		l.send(":%s KILL %s :%s", s.sid, uid, reason)
+	}
+	return keepIncoming
+}
+
+// getOrCreateLinkedChannel finds a channel named in a link message, creating
+// it with the sender's timestamp if it does not exist
+func (s *Server) getOrCreateLinkedChannel(name string) (*Channel, bool) {
+	if channel := s.GetChannel(name); channel != nil {
+		return channel, false
+	}
+	return s.GetOrCreateChannel(name), true
+}
+
+// reconcileChannelTS applies the TS rules for a channel a peer sent with a
+// timestamp. The older channel wins: if the peer's is older ours loses its
+// modes and statuses. It returns whether the peer's modes and statuses are
+// accepted.
+func (s *Server) reconcileChannelTS(channel *Channel, ts int64, created bool) bool {
+	ours := channel.TS()
+	switch {
+	case created:
+		channel.SetTS(ts)
+		channel.mu.Lock()
+		channel.modes = make(map[rune]bool)
+		channel.mu.Unlock()
+		return true
+	case ts < ours:
+		channel.SetTS(ts)
+		s.resetChannel(channel)
+		return true
+	case ts == ours:
+		return true
+	default:
+		return false
+	}
+}
+
+// resetChannel clears a channel's modes and member statuses after it lost a
+// timestamp comparison, telling the local members
+func (s *Server) resetChannel(channel *Channel) {
+	modes, _ := channel.ModeParams()
+	channel.mu.Lock()
+	channel.modes = make(map[rune]bool)
+	channel.key = ""
+	channel.limit = 0
+	channel.mu.Unlock()
+
+	name := channel.Name()
+	if modes != "+" {
+		channel.Broadcast(fmt.Sprintf(":%s MODE %s -%s", s.config.Server.Name, name, modes[1:]), nil)
+	}
+
+	for _, client := range channel.GetClients() {
+		prefixes := channel.StatusPrefixes(client)
+		if prefixes == "" {
+			continue
+		}
+		var removed string
+		var nicks []string
+		for _, prefix := range prefixes {
+			mode := statusModeForPrefix(prefix)
+			setChannelStatus(channel, client, mode, false)
+			removed += string(mode)
+			nicks = append(nicks, client.Nick())
+		}
+		channel.Broadcast(fmt.Sprintf(":%s MODE %s -%s %s", s.config.Server.Name, name, removed, strings.Join(nicks, " ")), nil)
+	}
+}
+
+// statusModeForPrefix maps a NAMES prefix to its channel mode
+func statusModeForPrefix(prefix rune) rune {
+	switch prefix {
+	case '~':
+		return 'q'
+	case '@':
+		return 'o'
+	case '%':
+		return 'h'
+	case '+':
+		return 'v'
+	}
+	return 0
+}
+
+// setChannelStatus sets or clears a status mode on a channel member
+func setChannelStatus(channel *Channel, client *Client, mode rune, set bool) {
+	switch mode {
+	case 'q':
+		channel.SetOwner(client, set)
+	case 'o':
+		channel.SetOperator(client, set)
+	case 'h':
+		channel.SetHalfop(client, set)
+	case 'v':
+		channel.SetVoice(client, set)
+	}
+}
+
+// applyLinkedModes applies channel modes received from a peer and shows them
+// to the local members. Status mode parameters are UIDs.
+func (s *Server) applyLinkedModes(channel *Channel, source, modes string, params []string) {
+	adding := true
+	var applied string
+	var args []string
+	lastSign := ' '
+	sign := func() {
+		want := '-'
+		if adding {
+			want = '+'
+		}
+		if want != lastSign {
+			applied += string(want)
+			lastSign = want
+		}
+	}
+	next := func() (string, bool) {
+		if len(params) == 0 {
+			return "", false
+		}
+		param := params[0]
+		params = params[1:]
+		return param, true
+	}
+
+	for _, mode := range modes {
+		switch mode {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'q', 'o', 'h', 'v':
+			param, ok := next()
+			if !ok {
+				continue
+			}
+			target := s.findTarget(param)
+			if target == nil || !channel.HasClient(target) {
+				continue
+			}
+			setChannelStatus(channel, target, mode, adding)
+			sign()
+			applied += string(mode)
+			args = append(args, target.Nick())
+		case 'b':
+			mask, ok := next()
+			if !ok {
+				continue
+			}
+			if adding {
+				channel.AddBan(mask)
+			} else {
+				channel.RemoveBan(mask)
+			}
+			sign()
+			applied += "b"
+			args = append(args, mask)
+		case 'k':
+			if adding {
+				key, ok := next()
+				if !ok {
+					continue
+				}
+				channel.SetKey(key)
+				args = append(args, key)
+			} else {
+				next() // A key parameter may accompany -k
+				channel.SetKey("")
+			}
+			channel.SetMode('k', adding)
+			sign()
+			applied += "k"
+		case 'l':
+			if adding {
+				param, ok := next()
+				if !ok {
+					continue
+				}
+				limit, err := strconv.Atoi(param)
+				if err != nil || limit <= 0 {
+					continue
+				}
+				channel.SetLimit(limit)
+				args = append(args, param)
+			} else {
+				channel.SetLimit(0)
+			}
+			channel.SetMode('l', adding)
+			sign()
+			applied += "l"
+		default:
+			channel.SetMode(mode, adding)
+			sign()
+			applied += string(mode)
+		}
+	}
+
+	if applied == "" {
+		return
+	}
+	line := fmt.Sprintf(":%s MODE %s %s", source, channel.Name(), applied)
+	if len(args) > 0 {
+		line += " " + strings.Join(args, " ")
+	}
+	channel.Broadcast(line, nil)
+}
+
+// handleLine processes a line received from the peer
+func (l *Link) handleLine(line string) {
+	msg, err := ParseMessage(line)
+	if err != nil {
+		return
+	}
+	s := l.server
+
+	// Every line must come from a server or user reached through this link
+	if msg.Source != "" {
+		known, behind := l.sourceBehind(msg.Source)
+		if !known {
+			return // E.g. a user we have just killed
+		}
+		if !behind {
+			l.fakeDirection(msg)
+			return
+		}
+	}
+
+	switch msg.Command {
+	case "PING":
+		l.send(":%s PONG %s :%s", s.sid, s.config.Server.Name, msg.Param(len(msg.Params)-1))
+	case "PONG":
+		if l.bursting {
+			l.bursting = false
+			l.netjoin.end()
+			s.sendSnomask('s', fmt.Sprintf("End of burst from %s (%d seconds)", l.peer.Name, int(time.Since(l.connected).Seconds())))
+		}
+	case "ERROR":
+		log.Printf("Link %s sent ERROR: %s", l.peer.Name, msg.Param(0))
+		s.sendSnomask('s', fmt.Sprintf("Link %s sent ERROR: %s", l.peer.Name, msg.Param(0)))
+	case "SID":
+		l.handleSID(msg)
+	case "UID":
+		l.handleUID(msg)
+	case "NICK":
+		l.handleNick(msg)
+	case "QUIT":
+		if client := s.GetClientByID(msg.Source); client != nil && client.IsRemote() {
+			s.removeRemoteClient(client, msg.Param(0))
+			s.forward(l, msg.String())
+		}
+	case "KILL":
+		l.handleKill(msg)
+	case "SJOIN":
+		l.handleSJoin(msg)
+	case "JOIN":
+		l.handleJoin(msg)
+	case "PART":
+		l.handlePart(msg)
+	case "KICK":
+		l.handleKick(msg)
+	case "TMODE":
+		l.handleTMode(msg)
+	case "MODE":
+		l.handleMode(msg)
+	case "TOPIC", "TB":
+		l.handleTopic(msg)
+	case "BMASK":
+		l.handleBMask(msg)
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		l.handleMessage(msg)
+	case "AWAY":
+		if client := s.GetClientByID(msg.Source); client != nil && client.IsRemote() {
+			client.SetAway(msg.Param(0))
+			client.notifyAway()
+			s.forward(l, msg.String())
+		}
+	case "SETNAME":
+		if client := s.GetClientByID(msg.Source); client != nil && client.IsRemote() && len(msg.Params) > 0 {
+			client.setRealname(msg.Params[0])
+			s.forward(l, msg.String())
+		}
+	case "CHGHOST":
+		l.handleChghost(msg)
+	case "SQUIT":
+		l.handleSquit(msg)
+	case "TRACE":
+		l.handleTrace(msg)
+	case "GLINE":
+		l.handleGLine(msg)
+	case "UNGLINE":
+		l.handleUnGLine(msg)
+	default:
+		if len(msg.Command) == 3 && msg.Command[0] >= '0' && msg.Command[0] <= '9' {
+			l.relayNumeric(msg)
+		}
+	}
+}
+
+// sourceBehind looks up the source of a line, a SID, server name or UID,
+// and reports whether it is known and whether it is reached through the link
+func (l *Link) sourceBehind(source string) (known, behind bool) {
+	s := l.server
+	if source == s.sid || strings.EqualFold(source, s.config.Server.Name) {
+		return true, false
+	}
+	if rs := s.findServer(source); rs != nil {
+		return true, rs.link == l
+	}
+	if client := s.GetClientByID(source); client != nil {
+		return true, client.IsRemote() && client.remote.link == l
+	}
+	return false, false
+}
+
+// fakeDirection drops a link that sent a line from a source reached through
+// another link, or from this server or its users. The peer is either broken
+// or speaking for users it does not carry; closing the link sends it an
+// ERROR and splits it off with a SQUIT.
+func (l *Link) fakeDirection(msg *Message) {
+	l.server.sendSnomask('s', fmt.Sprintf("Fake direction from %s: %s from %s, closing link", l.peer.Name, msg.Command, msg.Source))
+	l.client.Quit("Fake direction")
+}
+
+// handleSID - :<uplink> SID <name> <hops> <sid> :<description>
+func (l *Link) handleSID(msg *Message) {
+	if len(msg.Params) < 4 {
+		return
+	}
+	s := l.server
+	name, sid, description := msg.Params[0], strings.ToUpper(msg.Params[2]), msg.Params[3]
+
+	uplink := s.findServer(msg.Source)
+	if uplink == nil || uplink.link != l {
+		return
+	}
+	if sid == s.sid || s.findServer(sid) != nil || s.findServer(name) != nil || strings.EqualFold(name, s.config.Server.Name) {
+		// A server we already know would create a loop; drop the link
+		s.sendSnomask('s', fmt.Sprintf("Link %s introduced existing server %s (%s), closing link", l.peer.Name, name, sid))
+		l.client.Quit("Server " + name + " already exists")
+		return
+	}
+
+	rs := &RemoteServer{Name: name, SID: sid, Description: description, Hops: uplink.Hops + 1, Uplink: uplink.SID, link: l}
+	s.mu.Lock()
+	s.servers[sid] = rs
+	s.mu.Unlock()
+
+	s.forward(l, fmt.Sprintf(":%s SID %s %d %s :%s", uplink.SID, name, rs.Hops+1, sid, description))
+	s.sendSnomask('s', fmt.Sprintf("Server %s introduced by %s", name, uplink.Name))
+}
+
+// handleUID - :<sid> UID <nick> <hops> <ts> <umodes> <user> <host> <ip> <uid> :<realname>
+func (l *Link) handleUID(msg *Message) {
+	if len(msg.Params) < 9 {
+		return
+	}
+	s := l.server
+	rs := s.findServer(msg.Source)
+	if rs == nil || rs.link != l {
+		return
+	}
+
+	p := msg.Params
+	// Only the real host is kept; the cloak is derived from it with the shared key
+	nick, modes, user, host, uid, realname := p[0], p[3], p[4], p[6], p[7], p[8]
+	ts, _ := strconv.ParseInt(p[2], 10, 64)
+	if s.GetClientByID(uid) != nil {
+		return
+	}
+
+	if existing := s.GetClient(nick); existing != nil {
+		if !s.resolveCollision(l, existing, uid, ts) {
+			return
+		}
+	}
+
+	client := s.addRemoteClient(rs, uid, nick, user, host, realname, modes, ts)
+	s.presenceOnline(client)
+	s.forward(l, msg.String())
+}
+
+// handleNick - :<uid> NICK <newnick> :<ts>
+func (l *Link) handleNick(msg *Message) {
+	s := l.server
+	client := s.GetClientByID(msg.Source)
+	if client == nil || !client.IsRemote() || len(msg.Params) < 1 {
+		return
+	}
+	newNick := msg.Params[0]
+	ts, _ := strconv.ParseInt(msg.Param(1), 10, 64)
+
+	if existing := s.GetClient(newNick); existing != nil && existing != client {
+		if !s.resolveCollision(l, existing, client.UID(), ts) {
+			s.forward(l, fmt.Sprintf(":%s KILL %s :%s (Nick collision)", s.sid, client.UID(), s.config.Server.Name))
+			s.removeRemoteClient(client, "Nick collision")
+			return
+		}
+	}
+
+	message := fmt.Sprintf(":%s NICK :%s", client.Prefix(), newNick)
+	oldNick := client.Nick()
+	client.mu.Lock()
+	client.nick = newNick
+	client.nickTS = ts
+	client.mu.Unlock()
+	for _, peer := range client.commonChannelPeers() {
+		peer.SendMessage(message)
+	}
+	s.presenceNick(client, oldNick)
+
+	s.forward(l, msg.String())
+}
+
+// handleKill - :<source> KILL <uid> :<reason>
+func (l *Link) handleKill(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 1 {
+		return
+	}
+	target := s.findTarget(msg.Params[0])
+	if target == nil {
+		return
+	}
+
+	reason := fmt.Sprintf("Killed (%s (%s))", s.sourceNick(msg.Source), msg.Param(1))
+	s.sendSnomask('k', fmt.Sprintf("Received KILL message for %s from %s (%s)", target.Nick(), s.sourceNick(msg.Source), msg.Param(1)))
+
+	if target.IsRemote() {
+		s.removeRemoteClient(target, reason)
+		s.forward(l, msg.String())
+		return
+	}
+
+	// Our own user: its QUIT reaches the rest of the network as it disconnects
+	target.Quit(reason)
+}
+
+// handleSJoin - :<sid> SJOIN <ts> <channel> <modes> [params] :<members>
+func (l *Link) handleSJoin(msg *Message) {
+	if len(msg.Params) < 4 {
+		return
+	}
+	s := l.server
+	p := msg.Params
+	ts, err := strconv.ParseInt(p[0], 10, 64)
+	if err != nil || !isChannelName(p[1]) {
+		return
+	}
+
+	channel, created := s.getOrCreateLinkedChannel(p[1])
+	accept := s.reconcileChannelTS(channel, ts, created)
+	source := s.serverName(msg.Source)
+	if accept {
+		s.applyLinkedModes(channel, source, p[2], p[3:len(p)-1])
+	}
+
+	for _, member := range strings.Fields(p[len(p)-1]) {
+		uid := strings.TrimLeft(member, "~@%+")
+		prefixes := member[:len(member)-len(uid)]
+
+		client := s.GetClientByID(uid)
+		if client == nil || !client.IsRemote() {
+			continue
+		}
+		if !channel.HasClient(client) {
+			channel.AddMember(client)
+			var netjoin *batchGroup
+			if l.bursting {
+				netjoin = l.netjoin
+			}
+			channel.broadcastJoin(client, netjoin)
+		}
+		if accept && prefixes != "" {
+			var modes string
+			var nicks []string
+			for _, prefix := range prefixes {
+				mode := statusModeForPrefix(prefix)
+				setChannelStatus(channel, client, mode, true)
+				modes += string(mode)
+				nicks = append(nicks, client.Nick())
+			}
+			channel.Broadcast(fmt.Sprintf(":%s MODE %s +%s %s", source, channel.Name(), modes, strings.Join(nicks, " ")), nil)
+		}
+	}
+
+	s.forward(l, msg.String())
+}
+
+// handleJoin - :<uid> JOIN <ts> <channel> +
+func (l *Link) handleJoin(msg *Message) {
+	s := l.server
+	client := s.GetClientByID(msg.Source)
+	if client == nil || !client.IsRemote() || len(msg.Params) < 2 || !isChannelName(msg.Params[1]) {
+		return
+	}
+	ts, _ := strconv.ParseInt(msg.Params[0], 10, 64)
+
+	channel, created := s.getOrCreateLinkedChannel(msg.Params[1])
+	s.reconcileChannelTS(channel, ts, created)
+	if !channel.HasClient(client) {
+		channel.AddMember(client)
+		channel.broadcastJoin(client, nil)
+	}
+
+	s.forward(l, msg.String())
+}
+
+// handlePart - :<uid> PART <channel> :<reason>
+func (l *Link) handlePart(msg *Message) {
+	s := l.server
+	client := s.GetClientByID(msg.Source)
+	if client == nil || !client.IsRemote() || len(msg.Params) < 1 {
+		return
+	}
+
+	for _, name := range strings.Split(msg.Params[0], ",") {
+		channel := s.GetChannel(name)
+		if channel == nil || !channel.HasClient(client) {
+			continue
+		}
+		channel.BroadcastMessage(client.taggedMessage("PART", channel.Name(), msg.Param(1)), nil)
+		channel.RemoveClient(client)
+		if channel.UserCount() == 0 {
+			s.RemoveChannel(channel.Name())
+		}
+	}
+
+	s.forward(l, msg.String())
+}
+
+// handleKick - :<source> KICK <channel> <uid> :<reason>
+func (l *Link) handleKick(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 2 {
+		return
+	}
+	channel := s.GetChannel(msg.Params[0])
+	target := s.findTarget(msg.Params[1])
+	if channel == nil || target == nil || !channel.HasClient(target) {
+		return
+	}
+
+	channel.Broadcast(fmt.Sprintf(":%s KICK %s %s :%s", s.sourceName(msg.Source), channel.Name(), target.Nick(), msg.Param(2)), nil)
+	channel.RemoveClient(target)
+	if channel.UserCount() == 0 {
+		s.RemoveChannel(channel.Name())
+	}
+
+	s.forward(l, msg.String())
+}
+
+// handleTMode - :<source> TMODE <ts> <channel> <modes> [params]
+func (l *Link) handleTMode(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 3 {
+		return
+	}
+	ts, _ := strconv.ParseInt(msg.Params[0], 10, 64)
+	channel := s.GetChannel(msg.Params[1])
+	if channel == nil || ts > channel.TS() {
+		return
+	}
+
+	s.applyLinkedModes(channel, s.sourceName(msg.Source), msg.Params[2], msg.Params[3:])
+	s.forward(l, msg.String())
+}
+
+// handleMode - :<uid> MODE <uid> :<umodes>
+func (l *Link) handleMode(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 2 {
+		return
+	}
+	target := s.GetClientByID(msg.Params[0])
+	if target == nil || !target.IsRemote() {
+		return
+	}
+
+	adding := true
+	for _, mode := range msg.Params[1] {
+		switch mode {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'x':
+			target.setCloaked(adding)
+		default:
+			target.SetMode(mode, adding)
+			if mode == 'o' {
+				target.SetOper(adding)
+			}
+		}
+	}
+
+	s.forward(l, msg.String())
+}
+
+// handleTopic handles TOPIC (:<uid> TOPIC <channel> :<topic>) and the burst
+// form TB (:<sid> TB <channel> <ts> [setter] :<topic>)
+func (l *Link) handleTopic(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 2 {
+		return
+	}
+	channel := s.GetChannel(msg.Params[0])
+	if channel == nil {
+		return
+	}
+
+	topic := msg.Params[len(msg.Params)-1]
+	setter := s.sourceNick(msg.Source)
+	at := time.Now()
+	if msg.Command == "TB" {
+		if len(msg.Params) < 3 {
+			return
+		}
+		ts, _ := strconv.ParseInt(msg.Params[1], 10, 64)
+		// Keep our topic unless it is unset or newer
+		if channel.Topic() != "" && channel.TopicTime().Unix() <= ts {
+			return
+		}
+		at = time.Unix(ts, 0)
+		if len(msg.Params) > 3 {
+			setter = msg.Params[2]
+		}
+	}
+
+	channel.mu.Lock()
+	channel.topic, channel.topicBy, channel.topicTime = topic, setter, at
+	channel.mu.Unlock()
+	channel.Broadcast(fmt.Sprintf(":%s TOPIC %s :%s", s.sourceName(msg.Source), channel.Name(), topic), nil)
+
+	s.forward(l, msg.String())
+}
+
+// handleBMask - :<sid> BMASK <ts> <channel> b :<masks>
+func (l *Link) handleBMask(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 4 || msg.Params[2] != "b" {
+		return
+	}
+	ts, _ := strconv.ParseInt(msg.Params[0], 10, 64)
+	channel := s.GetChannel(msg.Params[1])
+	if channel == nil || ts > channel.TS() {
+		return
+	}
+
+	existing := make(map[string]bool)
+	for _, ban := range channel.GetBans() {
+		existing[ban] = true
+	}
+	var added []string
+	for _, mask := range strings.Fields(msg.Params[3]) {
+		if !existing[mask] {
+			channel.AddBan(mask)
+			added = append(added, mask)
+		}
+	}
+	if len(added) > 0 {
+		channel.Broadcast(fmt.Sprintf(":%s MODE %s +%s %s", s.serverName(msg.Source), channel.Name(),
+			strings.Repeat("b", len(added)), strings.Join(added, " ")), nil)
+	}
+
+	s.forward(l, msg.String())
+}
+
+// handleMessage routes PRIVMSG, NOTICE and TAGMSG from the network. The
+// msgid and time the origin server stamped are kept.
+func (l *Link) handleMessage(msg *Message) {
+	s := l.server
+	tagmsg := msg.Command == "TAGMSG"
+	if len(msg.Params) < 2 && !(tagmsg && len(msg.Params) == 1) {
+		return
+	}
+	source := s.sourceName(msg.Source)
+	sender := s.GetClientByID(msg.Source)
+	target, text := msg.Params[0], msg.Param(1)
+
+	if isChannelName(target) {
+		if channel := s.GetChannel(target); channel != nil {
+			item := remoteHistoryItem(sender, source, msg.Command, channel.Name(), text)
+			item.adoptServerTags(msg)
+			relay := relayMessage(item, clientOnlyTags(msg))
+			for _, client := range channel.GetClients() {
+				if client != sender && !client.IsRemote() {
+					client.Send(relay)
+				}
+			}
+			if !tagmsg {
+				if sender != nil {
+					channel.MarkSpoke(sender)
+				}
+				s.recordHistory(sender, item)
+			}
+		}
+		s.forward(l, msg.String())
+		return
+	}
+
+	client := s.findTarget(target)
+	if client == nil {
+		return
+	}
+	if client.IsRemote() {
+		if client.remote.link != l {
+			client.remote.link.send("%s", msg.String())
+		}
+		return
+	}
+	item := remoteHistoryItem(sender, source, msg.Command, client.Nick(), text)
+	item.adoptServerTags(msg)
+	client.Send(relayMessage(item, clientOnlyTags(msg)))
+	if !tagmsg {
+		s.recordHistory(sender, item)
+	}
+}
+
+// handleChghost - :<source> CHGHOST <uid> <host|->
+func (l *Link) handleChghost(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 2 {
+		return
+	}
+	target := s.GetClientByID(msg.Params[0])
+	host := msg.Params[1]
+	if target == nil || (host != "-" && !validVhost(host)) {
+		return
+	}
+	if host == "-" {
+		host = ""
+	}
+	target.setVhost(host)
+	s.forward(l, msg.String())
+}
+
+// handleSquit - :<source> SQUIT <server> :<reason>
+func (l *Link) handleSquit(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 1 {
+		return
+	}
+	target, reason := msg.Params[0], msg.Param(1)
+
+	if target == s.sid || strings.EqualFold(target, s.config.Server.Name) || target == l.peer.SID {
+		l.client.Quit(reason)
+		return
+	}
+
+	rs := s.findServer(target)
+	if rs == nil || rs.link != l {
+		return
+	}
+	lost := s.splitServer(rs)
+	s.forward(l, msg.String())
+	s.sendSnomask('s', fmt.Sprintf("Server %s split from %s (%s), %d users split", rs.Name, s.serverName(rs.Uplink), reason, lost))
+}
+
+// handleTrace - :<uid> TRACE <target>
+func (l *Link) handleTrace(msg *Message) {
+	s := l.server
+	requester := s.GetClientByID(msg.Source)
+	if requester == nil || !requester.IsRemote() || len(msg.Params) < 1 {
+		return
+	}
+
+	target := msg.Params[0]
+	if strings.EqualFold(target, s.config.Server.Name) || target == s.sid {
+		for _, line := range s.traceLines() {
+			l.send(":%s %03d %s %s", s.sid, line.code, requester.UID(), line.text)
+		}
+		return
+	}
+
+	// Pass it on towards the target
+	if next := s.traceNextHop(target); next != nil && next != l {
+		l.send(":%s %03d %s :Link %s %s %s", s.sid, RPL_TRACELINK, requester.UID(),
+			s.config.Server.Version, target, next.peer.Name)
+		next.send("%s", msg.String())
+	}
+}
+
+// relayNumeric delivers a numeric reply addressed to a UID
+func (l *Link) relayNumeric(msg *Message) {
+	s := l.server
+	if len(msg.Params) < 1 {
+		return
+	}
+	target := s.GetClientByID(msg.Params[0])
+	if target == nil {
+		return
+	}
+	if target.IsRemote() {
+		if target.remote.link != l {
+			target.remote.link.send("%s", msg.String())
+		}
+		return
+	}
+
+	reply := NewMessage(s.serverName(msg.Source), msg.Command, append([]string{target.Nick()}, msg.Params[1:]...)...)
+	reply.ForceTrailing = msg.ForceTrailing
+	target.Send(reply)
+}
+
+// traceLine is one numeric of TRACE output
+type traceLine struct {
+	code int
+	text string
+}
+
+// traceLines describes this server's connections for TRACE
+func (s *Server) traceLines() []traceLine {
+	var lines []traceLine
+	for _, client := range s.GetClients() {
+		class := "default"
+		if cl := client.Class(); cl != nil {
+			class = cl.Name
+		}
+		switch {
+		case !client.IsRegistered():
+			lines = append(lines, traceLine{RPL_TRACEUNKNOWN, fmt.Sprintf("Unknown %s %s", class, client.Host())})
+		case client.IsOper():
+			lines = append(lines, traceLine{RPL_TRACEOPERATOR, fmt.Sprintf("Oper %s %s[%s@%s] %d",
+				class, client.Nick(), client.User(), client.Host(), int(time.Since(client.LastActivity()).Seconds()))})
+		default:
+			lines = append(lines, traceLine{RPL_TRACEUSER, fmt.Sprintf("User %s %s[%s@%s] %d",
+				class, client.Nick(), client.User(), client.Host(), int(time.Since(client.LastActivity()).Seconds()))})
+		}
+	}
+
+	for _, link := range s.GetLinks() {
+		servers, users := 0, 0
+		for _, rs := range s.GetServers() {
+			if rs.link == link {
+				servers++
+			}
+		}
+		for _, client := range s.GetRemoteClients() {
+			if client.remote.link == link {
+				users++
+			}
+		}
+		lines = append(lines, traceLine{RPL_TRACESERVER, fmt.Sprintf("Serv server %dS %dC %s *!*@%s %d",
+			servers, users, link.peer.Name, s.config.Server.Name, int(time.Since(link.connected).Seconds()))})
+	}
+
+	lines = append(lines, traceLine{RPL_TRACEEND, fmt.Sprintf("%s %s :End of TRACE", s.config.Server.Name, s.config.Server.Version)})
+	return lines
+}
+
+// traceNextHop returns the link towards a server name or nick, or nil
+func (s *Server) traceNextHop(target string) *Link {
+	if rs := s.findServer(target); rs != nil {
+		return rs.link
+	}
+	if client := s.GetClient(target); client != nil && client.IsRemote() {
+		return client.remote.link
+	}
+	return nil
+}
+
+// connectLink dials the server described by a link block and starts the handshake
+func (s *Server) connectLink(block *LinkBlock) error {
+	addr := net.JoinHostPort(block.Host, strconv.Itoa(block.Port))
+	dialer := &net.Dialer{Timeout: linkConnectTimeout}
+
+	var conn net.Conn
+	var err error
+	if block.SSL {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: block.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	client := NewClient(conn, s)
+	client.linkBlock = block
+	s.sendHandshake(client, block)
+	go client.Handle()
+	return nil
+}
+
+// autoConnectRoutine keeps auto_connect links up
+func (s *Server) autoConnectRoutine() {
+	ticker := time.NewTicker(linkRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		for i := range s.config.Links {
+			block := &s.config.Links[i]
+			if !block.AutoConnect || s.findServer(block.Name) != nil {
+				continue
+			}
+			if err := s.connectLink(block); err != nil {
+				log.Printf("Auto-connect to %s failed: %v", block.Name, err)
+			}
+		}
+
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Network propagation of local events
+
+// introduceClient tells the network about a newly registered local user
+func (s *Server) introduceClient(c *Client) {
+	s.forward(nil, s.uidLine(c))
+}
+
+// propagateNick announces a local nick change
+func (s *Server) propagateNick(c *Client) {
+	s.forward(nil, fmt.Sprintf(":%s NICK %s :%d", c.UID(), c.Nick(), c.NickTS()))
+}
+
+// propagateQuit announces that a local user left
+func (s *Server) propagateQuit(c *Client, reason string) {
+	s.forward(nil, fmt.Sprintf(":%s QUIT :%s", c.UID(), reason))
+}
+
+// propagateJoin announces a local user joining a channel. A user creating
+// the channel is sent with its status in an SJOIN; SPY ghosts do not count,
+// since the network never learns of them.
+func (s *Server) propagateJoin(c *Client, channel *Channel) {
+	if channel.VisibleCount() == 1 {
+		modes, params := channel.ModeParams()
+		s.forward(nil, fmt.Sprintf(":%s SJOIN %d %s %s :%s%s", s.sid, channel.TS(), channel.Name(),
+			strings.Join(append([]string{modes}, params...), " "), channel.StatusPrefixes(c), c.UID()))
+		return
+	}
+	s.forward(nil, fmt.Sprintf(":%s JOIN %d %s +", c.UID(), channel.TS(), channel.Name()))
+}
+
+// propagatePart announces a local user leaving a channel
+func (s *Server) propagatePart(c *Client, channel *Channel, reason string) {
+	s.forward(nil, fmt.Sprintf(":%s PART %s :%s", c.UID(), channel.Name(), reason))
+}
+
+// propagateKick announces a kick by a local user
+func (s *Server) propagateKick(c *Client, channel *Channel, target *Client, reason string) {
+	s.forward(nil, fmt.Sprintf(":%s KICK %s %s :%s", c.UID(), channel.Name(), target.UID(), reason))
+}
+
+// propagateMessage routes a PRIVMSG, NOTICE or TAGMSG from a local user,
+// tags included: channel messages go to every peer, private messages
+// towards the target's server
+func (s *Server) propagateMessage(c *Client, msg *Message) {
+	line := *msg
+	line.Source = c.UID()
+	line.Params = append([]string(nil), msg.Params...)
+	target := line.Params[0]
+	if isChannelName(target) {
+		s.forward(nil, line.String())
+		return
+	}
+	if client := s.GetClient(target); client != nil && client.IsRemote() {
+		line.Params[0] = client.UID()
+		client.remote.link.send("%s", line.String())
+	}
+}
+
+// propagateChannelMode announces channel mode changes made by a local user;
+// status mode parameters are sent as UIDs
+func (s *Server) propagateChannelMode(c *Client, channel *Channel, modes string, args []string) {
+	params := make([]string, 0, len(args))
+	adding := true
+	i := 0
+	for _, mode := range modes {
+		switch mode {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+		if !modeTakesParam(mode, adding) || i >= len(args) {
+			continue
+		}
+		param := args[i]
+		i++
+		if strings.ContainsRune("qohv", mode) {
+			if target := s.GetClient(param); target != nil {
+				param = target.UID()
+			}
+		}
+		params = append(params, param)
+	}
+
+	line := fmt.Sprintf(":%s TMODE %d %s %s", c.UID(), channel.TS(), channel.Name(), modes)
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	s.forward(nil, line)
+}
+
+// modeTakesParam reports whether a channel mode change carries a parameter
+func modeTakesParam(mode rune, adding bool) bool {
+	switch mode {
+	case 'q', 'o', 'h', 'v', 'b':
+		return true
+	case 'k', 'l':
+		return adding
+	}
+	return false
+}
+
+// propagateUserMode announces user mode changes of a local user
+func (s *Server) propagateUserMode(c *Client, modes string) {
+	s.forward(nil, fmt.Sprintf(":%s MODE %s :%s", c.UID(), c.UID(), modes))
+}
+
+// propagateTopic announces a topic change by a local user
+func (s *Server) propagateTopic(c *Client, channel *Channel) {
+	s.forward(nil, fmt.Sprintf(":%s TOPIC %s :%s", c.UID(), channel.Name(), channel.Topic()))
+}
+
+// propagateKill announces a KILL issued by a local operator
+func (s *Server) propagateKill(c *Client, target *Client, reason string) {
+	s.forward(nil, fmt.Sprintf(":%s KILL %s :%s", c.UID(), target.UID(), reason))
+}
+
+// propagateChghost announces a vhost set by a local oper; - removes it
+func (s *Server) propagateChghost(c *Client, target *Client, host string) {
+	s.forward(nil, fmt.Sprintf(":%s CHGHOST %s %s", c.UID(), target.UID(), host))
+}
+
+// propagateSetname announces a local user's new realname
+func (s *Server) propagateSetname(c *Client) {
+	s.forward(nil, fmt.Sprintf(":%s SETNAME :%s", c.UID(), c.Realname()))
+}
+
+// propagateAway announces a local user's away status
+func (s *Server) propagateAway(c *Client) {
+	if away := c.Away(); away != "" {
+		s.forward(nil, fmt.Sprintf(":%s AWAY :%s", c.UID(), away))
+	} else {
+		s.forward(nil, fmt.Sprintf(":%s AWAY", c.UID()))
+	}
+}
+
+// handleConnect handles CONNECT <server> [port]
+func (c *Client) handleConnect(msg *Message) {
+	s := c.server
+	block := s.config.LinkBlock(msg.Params[0])
+	if block == nil {
+		c.SendNumeric(ERR_NOSUCHSERVER, msg.Params[0]+" :No link block for that server")
+		return
+	}
+	if s.findServer(block.Name) != nil {
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Connect: %s is already linked", s.config.Server.Name, c.Nick(), block.Name))
+		return
+	}
+
+	connectBlock := *block
+	if len(msg.Params) > 1 {
+		if port, err := strconv.Atoi(msg.Params[1]); err == nil && port > 0 && port <= 65535 {
+			connectBlock.Port = port
+		}
+	}
+
+	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Connecting to %s[%s:%d]", s.config.Server.Name, c.Nick(),
+		connectBlock.Name, connectBlock.Host, connectBlock.Port))
+	s.sendSnomask('s', fmt.Sprintf("%s is connecting to %s", c.Nick(), connectBlock.Name))
+	c.audit("CONNECT", connectBlock.Name, "ok", "")
+
+	go func() {
+		if err := s.connectLink(&connectBlock); err != nil {
+			c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Connect to %s failed: %v", s.config.Server.Name, c.Nick(), connectBlock.Name, err))
+			s.sendSnomask('s', fmt.Sprintf("Connect to %s failed: %v", connectBlock.Name, err))
+		}
+	}()
+}
+
+// handleSquit handles SQUIT <server> [:reason]
+func (c *Client) handleSquit(msg *Message) {
+	s := c.server
+	rs := s.findServer(msg.Params[0])
+	if rs == nil {
+		c.SendNumeric(ERR_NOSUCHSERVER, msg.Params[0]+" :No such server")
+		return
+	}
+	reason := c.Nick()
+	if len(msg.Params) > 1 {
+		reason = msg.Params[1]
+	}
+
+	s.sendSnomask('s', fmt.Sprintf("%s issued SQUIT for %s (%s)", c.Nick(), rs.Name, reason))
+	c.audit("SQUIT", rs.Name, "ok", reason)
+
+	// A direct peer is disconnected; a more distant server is asked to leave
+	if rs.link.peer == rs {
+		rs.link.client.Quit(reason)
+		return
+	}
+	rs.link.send(":%s SQUIT %s :%s", c.UID(), rs.SID, reason)
+	lost := s.splitServer(rs)
+	s.forward(rs.link, fmt.Sprintf(":%s SQUIT %s :%s", s.sid, rs.SID, reason))
+	s.sendSnomask('s', fmt.Sprintf("Server %s split (%s), %d users split", rs.Name, reason, lost))
+}
+
+// handleLinks handles LINKS
+func (c *Client) handleLinks(msg *Message) {
+	s := c.server
+	c.SendNumeric(RPL_LINKS, fmt.Sprintf("%s %s :0 %s", s.config.Server.Name, s.config.Server.Name, s.config.Server.Description))
+	for _, rs := range s.GetServers() {
+		c.SendNumeric(RPL_LINKS, fmt.Sprintf("%s %s :%d %s", rs.Name, s.serverName(rs.Uplink), rs.Hops, rs.Description))
+	}
+	c.SendNumeric(RPL_ENDOFLINKS, "* :End of /LINKS list")
+}
+
+// handleMap handles MAP, drawing the server tree with user counts
+func (c *Client) handleMap(msg *Message) {
+	s := c.server
+	users := map[string]int{s.sid: len(s.GetClients())}
+	for _, client := range s.GetRemoteClients() {
+		users[client.remote.SID]++
+	}
+	children := make(map[string][]*RemoteServer)
+	for _, rs := range s.GetServers() {
+		children[rs.Uplink] = append(children[rs.Uplink], rs)
+	}
+
+	var walk func(name, sid, indent string, last bool, root bool)
+	walk = func(name, sid, indent string, last bool, root bool) {
+		branch := ""
+		if !root {
+			branch = "|-"
+			if last {
+				branch = "`-"
+			}
+		}
+		c.SendNumeric(RPL_MAP, fmt.Sprintf(":%s%s%s[%s] (%d users)", indent, branch, name, sid, users[sid]))
+
+		if !root {
+			if last {
+				indent += "  "
+			} else {
+				indent += "| "
+			}
+		}
+		kids := children[sid]
+		for i, child := range kids {
+			walk(child.Name, child.SID, indent, i == len(kids)-1, false)
+		}
+	}
+	walk(s.config.Server.Name, s.sid, "", true, true)
+	c.SendNumeric(RPL_MAPEND, ":End of /MAP")
+}
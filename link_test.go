@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withLinkBlock adds a link block for a peer on loopback
+func withLinkBlock(name string) func(*Config) {
+	return func(config *Config) {
+		config.Links = append(config.Links, LinkBlock{
+			Name:           name,
+			Host:           "127.0.0.1",
+			Port:           6667,
+			SendPassword:   "linkpass",
+			AcceptPassword: "linkpass",
+		})
+	}
+}
+
+// fakePeer is a raw connection speaking the link protocol to a test server,
+// so a test can send lines a real server would not
+type fakePeer struct {
+	*testConn
+	sid string
+}
+
+// linkFakePeer connects a peer server and completes the handshake and burst
+func linkFakePeer(t *testing.T, s *Server, name, sid string) *fakePeer {
+	t.Helper()
+	tc := dialTest(t, s)
+	tc.send("PASS linkpass TS 6 :"+sid, "CAPAB :QS ENCAP", "SERVER "+name+" 1 :Test peer", "SVINFO 6 6 0 :0")
+	tc.expect("SERVER irc.test")
+	tc.expect("PING :irc.test")
+	tc.send(":" + sid + " PONG " + name + " :irc.test")
+	return &fakePeer{testConn: tc, sid: sid}
+}
+
+// eventually waits up to two seconds for a condition
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestLinkSourceDirection(t *testing.T) {
+	peers := []string{"two.test", "three.test", "four.test", "five.test"}
+	configure := []func(*Config){withLinkBlock("one.test")}
+	for _, name := range peers {
+		configure = append(configure, withLinkBlock(name))
+	}
+	s := newTestServer(t, configure...)
+	one := linkFakePeer(t, s, "one.test", "1AA")
+
+	one.send(":1AA UID alice 1 100 +i a alice.host 127.0.0.2 1AAAAAAAA :Alice")
+	one.sync()
+	if s.GetClient("alice") == nil {
+		t.Fatal("alice was not introduced")
+	}
+
+	local := registerTest(t, s, "local")
+	local.send("JOIN #dir")
+	local.expect(" 366 ")
+	one.send(":1AAAAAAAA JOIN 1 #dir +")
+	local.expect(":alice!a@")
+
+	// A line from an unknown source is dropped without closing the link
+	one.send(":1AAZZZZZZ PRIVMSG #dir :ghost")
+	one.sync()
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"user behind another link", ":1AAAAAAAA QUIT :spoofed"},
+		{"server behind another link", ":1AA SQUIT 1AA :spoofed"},
+		{"local user", ":" + s.GetClient("local").UID() + " PRIVMSG #dir :spoofed"},
+		{"this server", ":0TS KILL 1AAAAAAAA :spoofed"},
+	}
+	for i, tt := range tests {
+		sid := string(rune('2'+i)) + "BB"
+		peer := linkFakePeer(t, s, peers[i], sid)
+		peer.send(tt.line)
+		if line := peer.expect("ERROR"); !strings.Contains(line, "Fake direction") {
+			t.Errorf("%s: got %q", tt.name, line)
+		}
+		eventually(t, tt.name+" link to close", func() bool { return s.findServer(sid) == nil })
+	}
+
+	if s.GetClient("alice") == nil {
+		t.Error("alice was removed by a spoofed line")
+	}
+	if lines := local.sync(); len(containing(lines, "spoofed")) != 0 || len(containing(lines, "ghost")) != 0 {
+		t.Errorf("spoofed lines reached a local user: %q", lines)
+	}
+	if s.findServer("1AA") == nil {
+		t.Error("the honest link was closed")
+	}
+}
+
+// linkServers connects two test servers configured with link blocks for
+// each other, and waits for both ends of the link
+func linkServers(t *testing.T, from, to *Server) {
+	t.Helper()
+	block := from.config.LinkBlock(to.config.Server.Name)
+	block.Port = to.listener.Addr().(*net.TCPAddr).Port
+	if err := from.connectLink(block); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	eventually(t, "the link", func() bool {
+		return from.findServer(to.sid) != nil && to.findServer(from.sid) != nil
+	})
+}
+
+func TestLinkBurst(t *testing.T) {
+	hub := newTestServer(t, withLinkBlock("leaf.test"))
+	leaf := newTestServer(t, withLinkBlock("irc.test"), func(config *Config) {
+		config.Server.Name = "leaf.test"
+		config.Server.SID = "0LF"
+	})
+
+	alice := registerTest(t, hub, "alice")
+	alice.send("JOIN #burst", "TOPIC #burst :hub topic", "MODE #burst +b *!*@banned")
+	alice.expect("MODE #burst +b")
+	bob := registerTest(t, leaf, "bob")
+	bob.send("JOIN #burst")
+	bob.expect(" 366 ")
+	hub.GetChannel("#burst").SetTS(100)
+
+	linkServers(t, hub, leaf)
+
+	// Each side learns the other's users, with their channels and statuses
+	eventually(t, "the burst", func() bool {
+		return leaf.GetClient("alice") != nil && hub.GetClient("bob") != nil
+	})
+	remote := leaf.GetClient("alice")
+	if !remote.IsRemote() || remote.UID() != hub.GetClient("alice").UID() {
+		t.Errorf("alice on the leaf: remote %v, UID %s", remote.IsRemote(), remote.UID())
+	}
+	if line := bob.expect(" JOIN "); !strings.HasPrefix(line, ":alice!alice@") {
+		t.Errorf("bob saw %q", line)
+	}
+	eventually(t, "the channel burst", func() bool {
+		channel := leaf.GetChannel("#burst")
+		return channel.HasClient(remote) && channel.Topic() == "hub topic"
+	})
+
+	// The hub's channel is older, so its operator keeps status and the
+	// leaf's creator loses it
+	channel := leaf.GetChannel("#burst")
+	if !channel.IsOperator(remote) || channel.IsOperator(leaf.GetClient("bob")) {
+		t.Errorf("after the burst: alice op %v, bob op %v", channel.IsOperator(remote), channel.IsOperator(leaf.GetClient("bob")))
+	}
+	if bans := channel.GetBans(); len(bans) != 1 || bans[0] != "*!*@banned" {
+		t.Errorf("bans = %v", bans)
+	}
+
+	// Messages cross the link
+	alice.send("PRIVMSG #burst :hello leaf")
+	if line := bob.expect("PRIVMSG"); !strings.HasSuffix(line, "PRIVMSG #burst :hello leaf") {
+		t.Errorf("bob got %q", line)
+	}
+	bob.send("PRIVMSG alice :hello hub")
+	if line := alice.expect("PRIVMSG"); !strings.HasPrefix(line, ":bob!") || !strings.HasSuffix(line, "PRIVMSG alice :hello hub") {
+		t.Errorf("alice got %q", line)
+	}
+}
+
+func TestLinkJoinPastGhost(t *testing.T) {
+	s := newTestServer(t, withLinkBlock("one.test"))
+	alice := registerTest(t, s, "alice")
+	spy := registerTest(t, s, "spy")
+	bob := registerTest(t, s, "bob")
+	peer := linkFakePeer(t, s, "one.test", "1AA")
+	peer.sync()
+
+	// A ghost keeps the channel alive after its last visible member leaves
+	alice.send("JOIN #ghosted")
+	alice.expect(" 366 ")
+	channel := s.GetChannel("#ghosted")
+	s.GetClient("spy").ghostJoin(channel)
+	spy.expect(" 366 ")
+	alice.send("PART #ghosted")
+	alice.expect("PART #ghosted")
+	peer.readUntil("PART #ghosted")
+	if s.GetChannel("#ghosted") != channel {
+		t.Fatal("#ghosted did not outlive its last visible member")
+	}
+
+	// The first visible member is opped, and the peers are told so
+	bob.send("JOIN #ghosted")
+	bob.expect(" 366 ")
+	if !channel.IsOperator(s.GetClient("bob")) {
+		t.Fatal("first visible member was not opped")
+	}
+	line := peer.expect("#ghosted")
+	if want := " :@" + hubUID(s, "bob"); !strings.Contains(line, " SJOIN ") || !strings.HasSuffix(line, want) {
+		t.Errorf("peer got %q, want an SJOIN ending in %q", line, want)
+	}
+}
+
+func TestLinkNickCollision(t *testing.T) {
+	s := newTestServer(t, withLinkBlock("one.test"))
+	older := registerTest(t, s, "older")
+	newer := registerTest(t, s, "newer")
+	tied := registerTest(t, s, "tied")
+	peer := linkFakePeer(t, s, "one.test", "1AA")
+	peer.sync()
+
+	// An older remote nick wins: the local user is killed
+	olderUID := hubUID(s, "older")
+	peer.send(":1AA UID older 1 1 +i o h 127.0.0.2 1AAAAAAAA :Older")
+	older.expect("Nick collision")
+	peer.expect("KILL " + olderUID)
+	eventually(t, "the remote user to take the nick", func() bool {
+		client := s.GetClient("older")
+		return client != nil && client.UID() == "1AAAAAAAA"
+	})
+
+	// A newer remote nick loses: the peer is told to kill it
+	peer.send(fmt.Sprintf(":1AA UID newer 1 %d +i n h 127.0.0.2 1AAAAAAAB :Newer", time.Now().Unix()+3600))
+	peer.expect("KILL 1AAAAAAAB ")
+	if client := s.GetClient("newer"); client == nil || client.IsRemote() {
+		t.Error("local user lost against a newer nick")
+	}
+
+	// On a tie both users are killed
+	tiedUID := hubUID(s, "tied")
+	peer.send(fmt.Sprintf(":1AA UID tied 1 %d +i t h 127.0.0.2 1AAAAAAAC :Tied", s.GetClient("tied").NickTS()))
+	lines := peer.readUntil("KILL 1AAAAAAAC ")
+	if len(containing(lines, "KILL "+tiedUID)) != 1 {
+		t.Errorf("local user not killed on a tie: %q", lines)
+	}
+	tied.expect("Nick collision")
+	eventually(t, "the tied nick to be free", func() bool { return s.GetClient("tied") == nil })
+	if lines := newer.sync(); len(containing(lines, "ERROR")) != 0 {
+		t.Errorf("uninvolved user affected: %q", lines)
+	}
+}
+
+// hubUID returns the UID of a user, or "" if there is none
+func hubUID(s *Server, nick string) string {
+	if client := s.GetClient(nick); client != nil {
+		return client.UID()
+	}
+	return ""
+}
+
+func TestLinkSquit(t *testing.T) {
+	s := newTestServer(t, withLinkBlock("one.test"), withLinkBlock("two.test"))
+	one := linkFakePeer(t, s, "one.test", "1AA")
+	two := linkFakePeer(t, s, "two.test", "2BB")
+	local := registerTest(t, s, "local")
+	local.send("JOIN #split")
+	local.expect(" 366 ")
+
+	one.send(
+		":1AA SID leaf.test 2 1LF :Leaf",
+		":1LF UID carol 2 100 +i c h 127.0.0.2 1LFAAAAAA :Carol",
+		":1AA UID dave 1 100 +i d h 127.0.0.2 1AAAAAAAA :Dave",
+		":1LFAAAAAA JOIN 1 #split +",
+		":1AAAAAAAA JOIN 1 #split +",
+	)
+	local.expect(":carol!")
+	local.expect(":dave!")
+	if lines := two.readUntil("1AAAAAAAA"); len(containing(lines, "SID leaf.test")) != 1 {
+		t.Errorf("leaf not forwarded: %q", lines)
+	}
+
+	// SQUIT of the leaf removes it and its users only
+	one.send(":1AA SQUIT 1LF :leaf gone")
+	if line := local.expect("QUIT"); !strings.HasPrefix(line, ":carol!") || !strings.HasSuffix(line, "QUIT :one.test leaf.test") {
+		t.Errorf("netsplit QUIT: %q", line)
+	}
+	two.expect("SQUIT 1LF")
+	if s.findServer("1LF") != nil || s.GetClient("carol") != nil {
+		t.Error("leaf or its user survived the SQUIT")
+	}
+	if s.GetClient("dave") == nil {
+		t.Error("user on the uplink was removed")
+	}
+
+	// Losing the link splits off everything behind it
+	one.conn.Close()
+	if line := local.expect("QUIT"); !strings.HasPrefix(line, ":dave!") || !strings.HasSuffix(line, "QUIT :irc.test one.test") {
+		t.Errorf("netsplit QUIT: %q", line)
+	}
+	two.expect("SQUIT 1AA")
+	eventually(t, "the split", func() bool { return s.findServer("1AA") == nil })
+	if s.GetClient("dave") != nil {
+		t.Error("user survived the split")
+	}
+	if channel := s.GetChannel("#split"); channel == nil || channel.UserCount() != 1 {
+		t.Error("split users were not removed from the channel")
+	}
+}
+
+func TestLinkHostMatches(t *testing.T) {
+	tests := []struct {
+		configured, addr string
+		want             bool
+	}{
+		{"127.0.0.1", "127.0.0.1", true},
+		{"::1", "0:0:0:0:0:0:0:1", true},
+		{"127.0.0.1", "127.0.0.2", false},
+		{"localhost", "127.0.0.1", true},
+		{"no-such-host.invalid", "127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := linkHostMatches(tt.configured, tt.addr); got != tt.want {
+			t.Errorf("linkHostMatches(%q, %q) = %v", tt.configured, tt.addr, got)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Liveness timer wheel parameters: one slot per second covers 512 seconds
+// per revolution; later deadlines simply wait for further revolutions.
+const (
+	livenessResolution = time.Second
+	livenessSlots      = 512
+)
+
+// timerWheel is a hashed timing wheel holding one deadline per connection.
+// Scheduling, rescheduling and removal are O(1) and each tick only looks at
+// the connections due in that slot, however many are connected.
+type timerWheel struct {
+	resolution time.Duration
+	slots      []map[*Client]int64 // Connections in each slot, with the tick they are due
+	due        map[*Client]int64   // Tick each connection is due, for rescheduling
+	start      time.Time
+	tick       int64 // Last tick processed
+	mu         sync.Mutex
+}
+
+func newTimerWheel(size int, resolution time.Duration) *timerWheel {
+	w := &timerWheel{
+		resolution: resolution,
+		slots:      make([]map[*Client]int64, size),
+		due:        make(map[*Client]int64),
+		start:      time.Now(),
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[*Client]int64)
+	}
+	return w
+}
+
+// tickAt returns the tick a point in time falls in, never earlier than the
+// next tick to be processed
+func (w *timerWheel) tickAt(at time.Time) int64 {
+	tick := int64(at.Sub(w.start)/w.resolution) + 1
+	if tick <= w.tick {
+		tick = w.tick + 1
+	}
+	return tick
+}
+
+// Schedule sets when a connection is next due, replacing any earlier deadline
+func (w *timerWheel) Schedule(c *Client, at time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if old, exists := w.due[c]; exists {
+		delete(w.slots[old%int64(len(w.slots))], c)
+	}
+	tick := w.tickAt(at)
+	w.due[c] = tick
+	w.slots[tick%int64(len(w.slots))][c] = tick
+}
+
+// Remove forgets a connection
+func (w *timerWheel) Remove(c *Client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if old, exists := w.due[c]; exists {
+		delete(w.slots[old%int64(len(w.slots))], c)
+		delete(w.due, c)
+	}
+}
+
+// Advance processes every tick up to now and returns the connections that
+// became due. They are removed from the wheel until rescheduled.
+func (w *timerWheel) Advance(now time.Time) []*Client {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var expired []*Client
+	target := int64(now.Sub(w.start) / w.resolution)
+	for w.tick < target {
+		w.tick++
+		slot := w.slots[w.tick%int64(len(w.slots))]
+		for c, tick := range slot {
+			if tick <= w.tick {
+				expired = append(expired, c)
+				delete(slot, c)
+				delete(w.due, c)
+			}
+		}
+	}
+	return expired
+}
+
+// livenessRoutine drives the timer wheel
+func (s *Server) livenessRoutine() {
+	ticker := time.NewTicker(livenessResolution)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case now := <-ticker.C:
+			for _, client := range s.liveness.Advance(now) {
+				s.checkLiveness(client, now)
+			}
+		}
+	}
+}
+
+// watchLiveness starts tracking a new connection
+func (s *Server) watchLiveness(c *Client) {
+	s.liveness.Schedule(c, c.ConnectTime().Add(s.config.RegistrationTimeoutDuration()))
+}
+
+// unwatchLiveness stops tracking a connection whose handler has finished
+func (s *Server) unwatchLiveness(c *Client) {
+	c.mu.Lock()
+	c.unwatched = true
+	c.mu.Unlock()
+	s.liveness.Remove(c)
+}
+
+// rescheduleLiveness sets a connection's next deadline unless it is no
+// longer watched. The check and the schedule share c.mu with
+// unwatchLiveness, so a finished connection is never put back on the wheel.
+func (s *Server) rescheduleLiveness(c *Client, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.unwatched {
+		s.liveness.Schedule(c, at)
+	}
+}
+
+// checkLiveness is run when a connection's deadline passes. Unregistered
+// connections are dropped once the registration timeout runs out; idle
+// registered ones are sent a PING and dropped if nothing comes back within
+// the ping timeout.
+func (s *Server) checkLiveness(c *Client, now time.Time) {
+	if !c.IsRegistered() {
+		if deadline := c.ConnectTime().Add(s.config.RegistrationTimeoutDuration()); now.Before(deadline) {
+			s.rescheduleLiveness(c, deadline)
+			return
+		}
+		log.Printf("Registration timeout for client from %s", c.Host())
+		c.Quit("Registration timeout")
+		return
+	}
+
+	timeout := s.config.PingTimeoutDuration()
+	c.mu.Lock()
+	lastSeen, waiting, pingSent := c.lastPong, c.waitingForPong, c.pingSent
+	if waiting {
+		if deadline := pingSent.Add(timeout); now.Before(deadline) {
+			c.mu.Unlock()
+			s.rescheduleLiveness(c, deadline)
+			return
+		}
+		c.mu.Unlock()
+		s.pingTimeout(c, now.Sub(lastSeen))
+		return
+	}
+
+	if next := lastSeen.Add(c.pingFrequencyLocked()); now.Before(next) {
+		c.mu.Unlock()
+		s.rescheduleLiveness(c, next)
+		return
+	}
+	c.waitingForPong = true
+	c.pingSent = now
+	c.mu.Unlock()
+
+	if link := c.Link(); link != nil {
+		link.send(":%s PING %s :%s", s.sid, s.config.Server.Name, link.peer.Name)
+	} else {
+		c.SendMessage(fmt.Sprintf("PING :%s", s.config.Server.Name))
+	}
+	s.rescheduleLiveness(c, now.Add(timeout))
+}
+
+// pingTimeout disconnects a connection that stopped answering
+func (s *Server) pingTimeout(c *Client, silent time.Duration) {
+	reason := fmt.Sprintf("Ping timeout: %d seconds", int(silent.Seconds()))
+
+	name := c.Nick()
+	if link := c.Link(); link != nil {
+		name = link.peer.Name
+	}
+	log.Printf("%s for %s (%s)", reason, name, c.Host())
+	s.sendSnomask('c', fmt.Sprintf("%s for %s (%s@%s)", reason, name, c.User(), c.Host()))
+	c.Quit(reason)
+}
+
+// markAlive records that something was received from the connection, which
+// answers any outstanding PING
+func (c *Client) markAlive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPong = time.Now()
+	c.waitingForPong = false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWheel returns a wheel of eight one-second slots starting at a fixed time
+func testWheel() (*timerWheel, time.Time) {
+	w := newTimerWheel(8, time.Second)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.start = start
+	return w, start
+}
+
+func TestTimerWheelRotations(t *testing.T) {
+	w, start := testWheel()
+	near, far := &Client{}, &Client{}
+
+	// 20 seconds is two and a half turns of an eight slot wheel
+	w.Schedule(far, start.Add(20*time.Second))
+	w.Schedule(near, start.Add(4*time.Second))
+
+	for second := 1; second <= 20; second++ {
+		due := w.Advance(start.Add(time.Duration(second) * time.Second))
+		switch {
+		case second == 5:
+			if len(due) != 1 || due[0] != near {
+				t.Errorf("second %d: due %v", second, due)
+			}
+		case len(due) != 0:
+			t.Errorf("second %d: %d due early", second, len(due))
+		}
+	}
+	if due := w.Advance(start.Add(21 * time.Second)); len(due) != 1 || due[0] != far {
+		t.Errorf("after two turns: due %v", due)
+	}
+	if len(w.due) != 0 {
+		t.Errorf("%d connections left on the wheel", len(w.due))
+	}
+}
+
+func TestTimerWheelReschedule(t *testing.T) {
+	w, start := testWheel()
+	moved, removed, earlier := &Client{}, &Client{}, &Client{}
+
+	w.Schedule(moved, start.Add(2*time.Second))
+	w.Schedule(moved, start.Add(10*time.Second))
+	w.Schedule(removed, start.Add(2*time.Second))
+	w.Remove(removed)
+	w.Remove(removed)
+	w.Schedule(earlier, start.Add(30*time.Second))
+	w.Schedule(earlier, start.Add(time.Second))
+
+	if due := w.Advance(start.Add(5 * time.Second)); len(due) != 1 || due[0] != earlier {
+		t.Errorf("first five seconds: due %v", due)
+	}
+	if due := w.Advance(start.Add(11 * time.Second)); len(due) != 1 || due[0] != moved {
+		t.Errorf("after the reschedule: due %v", due)
+	}
+	if due := w.Advance(start.Add(40 * time.Second)); len(due) != 0 {
+		t.Errorf("stale entries fired: %v", due)
+	}
+}
+
+func TestTimerWheelSkippedTicks(t *testing.T) {
+	w, start := testWheel()
+	clients := []*Client{{}, {}, {}}
+	w.Schedule(clients[0], start.Add(2*time.Second))
+	w.Schedule(clients[1], start.Add(9*time.Second))
+	w.Schedule(clients[2], start.Add(100*time.Second))
+
+	// One late Advance processes every tick it skipped
+	if due := w.Advance(start.Add(30 * time.Second)); len(due) != 2 {
+		t.Errorf("late Advance: %d due", len(due))
+	}
+
+	// A deadline already in the past is due on the next tick, not lost
+	past := &Client{}
+	w.Schedule(past, start)
+	if due := w.Advance(start.Add(31 * time.Second)); len(due) != 1 || due[0] != past {
+		t.Errorf("past deadline: due %v", due)
+	}
+	if due := w.Advance(start.Add(101 * time.Second)); len(due) != 1 || due[0] != clients[2] {
+		t.Errorf("far deadline: due %v", due)
+	}
+}
+
+// livenessClient returns a client connected at start to a server with a
+// 60 second registration timeout, 90 second ping frequency and 30 second
+// ping timeout
+func livenessClient(t *testing.T, registered bool, start time.Time) (*Client, *bufio.Reader) {
+	s := &Server{config: DefaultConfig(), liveness: newTimerWheel(livenessSlots, livenessResolution)}
+	s.config.Server.Name = "irc.test"
+	s.config.Limits.RegistrationTimeout = 60
+	s.config.Limits.PingFrequency = 90
+	s.config.Limits.PingTimeout = 30
+
+	server, conn := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	c := &Client{
+		server:       s,
+		host:         "127.0.0.1",
+		nick:         "alice",
+		capabilities: make(map[string]bool),
+		sendq:        newSendQueue(server, 65536),
+		connectTime:  start,
+		lastPong:     start,
+		registered:   registered,
+	}
+	return c, bufio.NewReader(conn)
+}
+
+func TestLivenessTimeouts(t *testing.T) {
+	start := time.Now()
+
+	// An unregistered connection is dropped at the registration timeout,
+	// long before a registered one would be pinged
+	c, r := livenessClient(t, false, start)
+	c.server.checkLiveness(c, start.Add(59*time.Second))
+	if c.server.liveness.due[c] == 0 {
+		t.Error("unregistered connection not rescheduled before its timeout")
+	}
+	c.server.checkLiveness(c, start.Add(60*time.Second))
+	if line := readLines(t, r, 1)[0]; !strings.Contains(line, "(Registration timeout)") {
+		t.Errorf("registration timeout: %q", line)
+	}
+
+	// A registered connection is pinged after the ping frequency and
+	// dropped when the ping timeout runs out
+	c, r = livenessClient(t, true, start)
+	c.server.checkLiveness(c, start.Add(60*time.Second))
+	c.server.checkLiveness(c, start.Add(89*time.Second))
+	if c.QuitReason() != "Client closed connection" {
+		t.Fatalf("registered connection quit early: %s", c.QuitReason())
+	}
+	c.server.checkLiveness(c, start.Add(90*time.Second))
+	if line := readLines(t, r, 1)[0]; line != "PING :irc.test" {
+		t.Errorf("expected a PING, got %q", line)
+	}
+	c.server.checkLiveness(c, start.Add(119*time.Second))
+	if c.QuitReason() != "Client closed connection" {
+		t.Fatalf("quit before the ping timeout: %s", c.QuitReason())
+	}
+	c.server.checkLiveness(c, start.Add(120*time.Second))
+	if line := readLines(t, r, 1)[0]; !strings.Contains(line, "(Ping timeout: 120 seconds)") {
+		t.Errorf("ping timeout: %q", line)
+	}
+
+	// Answering the PING reschedules the next one from the answer
+	c, r = livenessClient(t, true, start)
+	c.server.checkLiveness(c, start.Add(90*time.Second))
+	readLines(t, r, 1)
+	c.markAlive()
+	c.server.checkLiveness(c, time.Now().Add(60*time.Second))
+	if c.QuitReason() != "Client closed connection" {
+		t.Errorf("answered PING still timed out: %s", c.QuitReason())
+	}
+	if c.waitingForPong {
+		t.Error("answered PING is still outstanding")
+	}
+}
+
+func TestLivenessSkipsFinishedConnections(t *testing.T) {
+	start := time.Now()
+	c, _ := livenessClient(t, false, start)
+	c.server.watchLiveness(c)
+	c.server.unwatchLiveness(c)
+
+	// A deadline already taken off the wheel must not put the client back
+	c.server.checkLiveness(c, start.Add(30*time.Second))
+	if _, exists := c.server.liveness.due[c]; exists {
+		t.Error("finished connection rescheduled")
+	}
+}
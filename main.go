@@ -9,6 +9,11 @@ import (
 )
 
 func main() {
+	// "techircd mkpasswd" prints an oper password hash and exits
+	if len(os.Args) > 1 && os.Args[1] == "mkpasswd" {
+		os.Exit(runMkpasswd(os.Args[2:]))
+	}
+
 	// Parse command line flags
 	configFile := flag.String("config", "config.json", "Path to configuration file")
 	flag.Parse()
@@ -32,7 +37,11 @@ func main() {
 	log.Println("Configuration validated successfully")
 
 	// Create and start the server
-	server := NewServer(config)
+	server, err := NewServer(config)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	server.SetConfigFile(*configFile)
 
 	// Handle graceful shutdown
 	c := make(chan os.Signal, 1)
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Protocol line limits
+const (
+	maxMessageLength    = 512  // RFC 1459 limit for source, command and params including CRLF
+	maxTagsLength       = 8191 // IRCv3 limit for the whole tags section including '@' and space
+	maxClientTagsLength = 4096 // IRCv3 limit for tags sent by clients
+)
+
+var (
+	errEmptyMessage = errors.New("empty message")
+	errNoCommand    = errors.New("message has no command")
+)
+
+// Message is a single IRC protocol line
+type Message struct {
+	Tags    map[string]string
+	Source  string
+	Command string
+	Params  []string
+
+	// ForceTrailing serializes the last parameter with a leading ':' even
+	// when it would not need one (used to preserve the form of relayed lines)
+	ForceTrailing bool
+}
+
+// NewMessage creates a message with the given source, command and parameters
+func NewMessage(source, command string, params ...string) *Message {
+	return &Message{
+		Source:  source,
+		Command: command,
+		Params:  params,
+	}
+}
+
+// Param returns the i-th parameter, or "" if it is not present
+func (m *Message) Param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// Tag returns the value of a tag and whether it was present
+func (m *Message) Tag(name string) (string, bool) {
+	if m.Tags == nil {
+		return "", false
+	}
+	value, ok := m.Tags[name]
+	return value, ok
+}
+
+// SetTag sets a tag on the message, allocating the tag map if needed
+func (m *Message) SetTag(name, value string) {
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	m.Tags[name] = value
+}
+
+// ParseMessage parses a raw IRC line (without CRLF) into a Message
+func ParseMessage(line string) (*Message, error) {
+	line = strings.TrimRight(line, "\r\n")
+	line = strings.TrimLeft(line, " ")
+	if line == "" {
+		return nil, errEmptyMessage
+	}
+
+	msg := &Message{}
+
+	if line[0] == '@' {
+		end := strings.IndexByte(line, ' ')
+		if end == -1 {
+			return nil, errNoCommand
+		}
+		msg.Tags = parseTags(line[1:end])
+		line = strings.TrimLeft(line[end+1:], " ")
+	}
+
+	if line != "" && line[0] == ':' {
+		end := strings.IndexByte(line, ' ')
+		if end == -1 {
+			return nil, errNoCommand
+		}
+		msg.Source = line[1:end]
+		line = strings.TrimLeft(line[end+1:], " ")
+	}
+
+	command, rest := line, ""
+	if end := strings.IndexByte(line, ' '); end != -1 {
+		command, rest = line[:end], line[end+1:]
+	}
+	if command == "" {
+		return nil, errNoCommand
+	}
+	msg.Command = strings.ToUpper(command)
+	msg.Params, msg.ForceTrailing = splitParams(rest)
+
+	return msg, nil
+}
+
+// splitParams splits the parameter section of a line, honouring the
+// trailing parameter. It reports whether a trailing parameter was present.
+func splitParams(s string) ([]string, bool) {
+	var params []string
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return params, false
+		}
+		if s[0] == ':' {
+			return append(params, s[1:]), true
+		}
+		end := strings.IndexByte(s, ' ')
+		if end == -1 {
+			return append(params, s), false
+		}
+		params = append(params, s[:end])
+		s = s[end+1:]
+	}
+}
+
+// parseTags parses the tag section of a line (without the leading '@')
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(tag, "=")
+		if name == "" {
+			continue
+		}
+		tags[name] = unescapeTagValue(value)
+	}
+	return tags
+}
+
+// escapeTagValue escapes a tag value as described by IRCv3 message-tags
+func escapeTagValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case ';':
+			b.WriteString(`\:`)
+		case ' ':
+			b.WriteString(`\s`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// unescapeTagValue reverses escapeTagValue; unknown escapes yield the
+// escaped character and a lone trailing backslash is dropped
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i >= len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// tagString serializes the tags (without '@' or trailing space), sorted by
+// name so output is deterministic
+func (m *Message) tagString() string {
+	if len(m.Tags) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(m.Tags))
+	for name := range m.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(name)
+		if value := m.Tags[name]; value != "" {
+			b.WriteByte('=')
+			b.WriteString(escapeTagValue(value))
+		}
+	}
+	return b.String()
+}
+
+// body serializes everything after the tags
+func (m *Message) body() string {
+	var b strings.Builder
+	if m.Source != "" {
+		b.WriteByte(':')
+		b.WriteString(m.Source)
+		b.WriteByte(' ')
+	}
+	b.WriteString(m.Command)
+
+	for i, param := range m.Params {
+		b.WriteByte(' ')
+		last := i == len(m.Params)-1
+		if last && (m.ForceTrailing || param == "" || param[0] == ':' || strings.IndexByte(param, ' ') != -1) {
+			b.WriteByte(':')
+		}
+		b.WriteString(param)
+	}
+	return b.String()
+}
+
+// String serializes the message without enforcing length limits
+func (m *Message) String() string {
+	if tags := m.tagString(); tags != "" {
+		return "@" + tags + " " + m.body()
+	}
+	return m.body()
+}
+
+// Line serializes the message for the wire (without CRLF). The body is
+// truncated to fit in 512 bytes and tags are dropped if they exceed their
+// own budget, so a line never exceeds the protocol limits.
+func (m *Message) Line() string {
+	body := truncateUTF8(m.body(), maxMessageLength-2)
+
+	tags := m.tagString()
+	if tags == "" || len(tags)+2 > maxTagsLength {
+		return body
+	}
+	return "@" + tags + " " + body
+}
+
+// lineTooLong reports whether a line received from a client exceeds the
+// limits for client tags or the message body
+func lineTooLong(line string) bool {
+	if line != "" && line[0] == '@' {
+		end := strings.IndexByte(line, ' ')
+		if end == -1 {
+			return false
+		}
+		if end+1 > maxClientTagsLength {
+			return true
+		}
+		line = line[end+1:]
+	}
+	return len(line) > maxMessageLength-2
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a UTF-8 sequence
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line    string
+		tags    map[string]string
+		source  string
+		command string
+		params  []string
+	}{
+		{"PRIVMSG #chan :hello  world", nil, "", "PRIVMSG", []string{"#chan", "hello  world"}},
+		{"privmsg #chan ::)", nil, "", "PRIVMSG", []string{"#chan", ":)"}},
+		{":nick!user@host NICK new", nil, "nick!user@host", "NICK", []string{"new"}},
+		{"USER guest 0 * :Real Name", nil, "", "USER", []string{"guest", "0", "*", "Real Name"}},
+		{"@+typing=active;msgid=abc TAGMSG #chan", map[string]string{"+typing": "active", "msgid": "abc"}, "", "TAGMSG", []string{"#chan"}},
+		{`@a=semi\:space\sslash\\;b PING x`, map[string]string{"a": `semi;space slash\`, "b": ""}, "", "PING", []string{"x"}},
+		{"PRIVMSG #chan :", nil, "", "PRIVMSG", []string{"#chan", ""}},
+		{"QUIT", nil, "", "QUIT", nil},
+	}
+
+	for _, tt := range tests {
+		msg, err := ParseMessage(tt.line)
+		if err != nil {
+			t.Errorf("ParseMessage(%q) returned error: %v", tt.line, err)
+			continue
+		}
+		if tt.tags != nil && !reflect.DeepEqual(msg.Tags, tt.tags) {
+			t.Errorf("ParseMessage(%q) tags = %v, want %v", tt.line, msg.Tags, tt.tags)
+		}
+		if msg.Source != tt.source || msg.Command != tt.command || !reflect.DeepEqual(msg.Params, tt.params) {
+			t.Errorf("ParseMessage(%q) = %q %q %q, want %q %q %q",
+				tt.line, msg.Source, msg.Command, msg.Params, tt.source, tt.command, tt.params)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, line := range []string{"", "   ", "@tags-only", ":source-only"} {
+		if _, err := ParseMessage(line); err == nil {
+			t.Errorf("ParseMessage(%q) expected error", line)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	lines := []string{
+		":server 001 nick :Welcome to the network",
+		":nick!user@host PRIVMSG #chan :hi",
+		"@time=2025-01-01T00:00:00.000Z :nick!user@host PRIVMSG #chan :a b",
+		`@draft/reply=x\sy :a JOIN #chan`,
+		"PONG server LAG123",
+	}
+
+	for _, line := range lines {
+		msg, err := ParseMessage(line)
+		if err != nil {
+			t.Fatalf("ParseMessage(%q) returned error: %v", line, err)
+		}
+		if got := msg.String(); got != line {
+			t.Errorf("round trip of %q produced %q", line, got)
+		}
+	}
+}
+
+func TestMessageLineTruncation(t *testing.T) {
+	msg := NewMessage("server", "NOTICE", "nick", strings.Repeat("é", 400))
+	line := msg.Line()
+	if len(line) > maxMessageLength-2 {
+		t.Errorf("line length %d exceeds limit", len(line))
+	}
+	if !strings.HasSuffix(line, "é") {
+		t.Error("truncation split a UTF-8 sequence")
+	}
+
+	msg.SetTag("huge", strings.Repeat("x", maxTagsLength))
+	if strings.HasPrefix(msg.Line(), "@") {
+		t.Error("expected oversized tags to be dropped")
+	}
+}
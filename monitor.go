@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MONITOR numerics
+const (
+	RPL_MONONLINE    = 730
+	RPL_MONOFFLINE   = 731
+	RPL_MONLIST      = 732
+	RPL_ENDOFMONLIST = 733
+	ERR_MONLISTFULL  = 734
+)
+
+// WATCH numerics
+const (
+	ERR_TOOMANYWATCH   = 512
+	RPL_LOGON          = 600
+	RPL_LOGOFF         = 601
+	RPL_WATCHOFF       = 602
+	RPL_WATCHSTAT      = 603
+	RPL_NOWON          = 604
+	RPL_NOWOFF         = 605
+	RPL_WATCHLIST      = 606
+	RPL_ENDOFWATCHLIST = 607
+)
+
+// maxNickListLength is how much of a reply line a comma or space separated
+// list of nicks may take before it is continued on another line
+const maxNickListLength = 400
+
+// watchIndex maps each watched nick to the clients watching it, and each
+// client to the nicks on its list, for MONITOR and WATCH. Nicks are compared
+// case-insensitively but listed as the client gave them.
+type watchIndex struct {
+	byNick   map[string]map[*Client]bool   // Folded nick -> watchers
+	byClient map[*Client]map[string]string // Watcher -> folded nick -> nick
+	mu       sync.Mutex
+}
+
+func newWatchIndex() *watchIndex {
+	return &watchIndex{
+		byNick:   make(map[string]map[*Client]bool),
+		byClient: make(map[*Client]map[string]string),
+	}
+}
+
+// add puts a nick on a client's list, which may hold at most limit nicks.
+// It returns false if the list is full; a nick already on it always fits.
+func (w *watchIndex) add(c *Client, nick string, limit int) bool {
+	key := strings.ToLower(nick)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	nicks := w.byClient[c]
+	if _, ok := nicks[key]; ok {
+		return true
+	}
+	if len(nicks) >= limit {
+		return false
+	}
+	if nicks == nil {
+		nicks = make(map[string]string)
+		w.byClient[c] = nicks
+	}
+	nicks[key] = nick
+	if w.byNick[key] == nil {
+		w.byNick[key] = make(map[*Client]bool)
+	}
+	w.byNick[key][c] = true
+	return true
+}
+
+// remove takes a nick off a client's list and returns whether it was on it
+func (w *watchIndex) remove(c *Client, nick string) bool {
+	key := strings.ToLower(nick)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.byClient[c][key]; !ok {
+		return false
+	}
+	w.unlink(c, key)
+	return true
+}
+
+// clear empties a client's list, e.g. when it disconnects
+func (w *watchIndex) clear(c *Client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key := range w.byClient[c] {
+		w.unlink(c, key)
+	}
+}
+
+// unlink drops one entry from both maps; w.mu must be held
+func (w *watchIndex) unlink(c *Client, key string) {
+	delete(w.byClient[c], key)
+	if len(w.byClient[c]) == 0 {
+		delete(w.byClient, c)
+	}
+	delete(w.byNick[key], c)
+	if len(w.byNick[key]) == 0 {
+		delete(w.byNick, key)
+	}
+}
+
+// list returns the nicks on a client's list in sorted order
+func (w *watchIndex) list(c *Client) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	nicks := make([]string, 0, len(w.byClient[c]))
+	for _, nick := range w.byClient[c] {
+		nicks = append(nicks, nick)
+	}
+	sort.Slice(nicks, func(i, j int) bool { return strings.ToLower(nicks[i]) < strings.ToLower(nicks[j]) })
+	return nicks
+}
+
+// watchers returns the clients with a nick on their list
+func (w *watchIndex) watchers(nick string) []*Client {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	clients := make([]*Client, 0, len(w.byNick[strings.ToLower(nick)]))
+	for c := range w.byNick[strings.ToLower(nick)] {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// splitNickList joins nicks with sep into as few lines as fit the reply
+// length
+func splitNickList(nicks []string, sep string) []string {
+	var lines []string
+	line := ""
+	for _, nick := range nicks {
+		if line != "" && len(line)+len(sep)+len(nick) > maxNickListLength {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += sep
+		}
+		line += nick
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// sendNickList sends a MONITOR numeric for a list of targets
+func (c *Client) sendNickList(numeric int, targets []string) {
+	for _, line := range splitNickList(targets, ",") {
+		c.SendNumeric(numeric, ":"+line)
+	}
+}
+
+// onlineClient returns the registered user, local or remote, using a nick
+func (s *Server) onlineClient(nick string) *Client {
+	if target := s.GetClient(nick); target != nil && target.IsRegistered() {
+		return target
+	}
+	return nil
+}
+
+// presenceOnline tells the clients monitoring or watching c's nick that it is
+// now in use, after c registers, arrives over a link or changes nick
+func (s *Server) presenceOnline(c *Client) {
+	nick := c.Nick()
+	for _, watcher := range s.monitors.watchers(nick) {
+		watcher.SendNumeric(RPL_MONONLINE, fmt.Sprintf(":%s!%s@%s", nick, c.User(), c.HostForUser(watcher)))
+	}
+	for _, watcher := range s.watches.watchers(nick) {
+		watcher.SendNumeric(RPL_LOGON, fmt.Sprintf("%s %s %s %d :logged online", nick, c.User(), c.HostForUser(watcher), c.NickTS()))
+	}
+}
+
+// presenceOffline tells the clients monitoring or watching nick that c no
+// longer uses it, after c quits or changes nick
+func (s *Server) presenceOffline(c *Client, nick string) {
+	for _, watcher := range s.monitors.watchers(nick) {
+		watcher.SendNumeric(RPL_MONOFFLINE, ":"+nick)
+	}
+	for _, watcher := range s.watches.watchers(nick) {
+		watcher.SendNumeric(RPL_LOGOFF, fmt.Sprintf("%s %s %s %d :logged offline", nick, c.User(), c.HostForUser(watcher), c.NickTS()))
+	}
+}
+
+// presenceNick tells watchers of both nicks about a nick change; a change
+// of case only is not a change of presence
+func (s *Server) presenceNick(c *Client, oldNick string) {
+	if strings.EqualFold(oldNick, c.Nick()) {
+		return
+	}
+	s.presenceOffline(c, oldNick)
+	s.presenceOnline(c)
+}
+
+// handleMonitor handles MONITOR + <targets>, - <targets>, C, L and S
+func (c *Client) handleMonitor(msg *Message) {
+	s := c.server
+	subcommand := strings.ToUpper(msg.Params[0])
+
+	switch subcommand {
+	case "+", "-":
+		if len(msg.Params) < 2 {
+			c.SendNumeric(ERR_NEEDMOREPARAMS, "MONITOR :Not enough parameters")
+			return
+		}
+		targets := strings.Split(msg.Params[1], ",")
+		if subcommand == "-" {
+			for _, target := range targets {
+				s.monitors.remove(c, target)
+			}
+			return
+		}
+
+		limit := s.config.Limits.MaxMonitor
+		var online, offline []string
+		for i, target := range targets {
+			if !isValidNickname(target) {
+				continue
+			}
+			if !s.monitors.add(c, target, limit) {
+				c.SendNumeric(ERR_MONLISTFULL, fmt.Sprintf("%d %s :Monitor list is full", limit, strings.Join(targets[i:], ",")))
+				break
+			}
+			if client := s.onlineClient(target); client != nil {
+				online = append(online, client.Nick()+"!"+client.User()+"@"+client.HostForUser(c))
+			} else {
+				offline = append(offline, target)
+			}
+		}
+		c.sendNickList(RPL_MONONLINE, online)
+		c.sendNickList(RPL_MONOFFLINE, offline)
+
+	case "C":
+		s.monitors.clear(c)
+
+	case "L":
+		c.sendNickList(RPL_MONLIST, s.monitors.list(c))
+		c.SendNumeric(RPL_ENDOFMONLIST, ":End of MONITOR list")
+
+	case "S":
+		var online, offline []string
+		for _, target := range s.monitors.list(c) {
+			if client := s.onlineClient(target); client != nil {
+				online = append(online, client.Nick()+"!"+client.User()+"@"+client.HostForUser(c))
+			} else {
+				offline = append(offline, target)
+			}
+		}
+		c.sendNickList(RPL_MONONLINE, online)
+		c.sendNickList(RPL_MONOFFLINE, offline)
+	}
+}
+
+// sendWatchState replies to WATCH with whether a nick is online; with an
+// offline numeric of 0 nothing is sent for a nick that is not
+func (c *Client) sendWatchState(nick string, online, offline int, onText, offText string) {
+	if client := c.server.onlineClient(nick); client != nil {
+		c.SendNumeric(online, fmt.Sprintf("%s %s %s %d :%s", client.Nick(), client.User(), client.HostForUser(c), client.NickTS(), onText))
+	} else if offline != 0 {
+		c.SendNumeric(offline, fmt.Sprintf("%s * * 0 :%s", nick, offText))
+	}
+}
+
+// handleWatch handles the legacy WATCH [+nick|-nick|C|S|L|l ...]; with no
+// arguments it acts as WATCH l
+func (c *Client) handleWatch(msg *Message) {
+	s := c.server
+	var entries []string
+	for _, param := range msg.Params {
+		entries = append(entries, strings.FieldsFunc(param, func(r rune) bool { return r == ',' || r == ' ' })...)
+	}
+	if len(entries) == 0 {
+		entries = []string{"l"}
+	}
+
+	limit := s.config.Limits.MaxMonitor
+	for _, entry := range entries {
+		switch {
+		case entry[0] == '+' && len(entry) > 1:
+			nick := entry[1:]
+			if !isValidNickname(nick) {
+				continue
+			}
+			if !s.watches.add(c, nick, limit) {
+				c.SendNumeric(ERR_TOOMANYWATCH, fmt.Sprintf("%s :Maximum size for WATCH-list is %d entries", nick, limit))
+				continue
+			}
+			c.sendWatchState(nick, RPL_NOWON, RPL_NOWOFF, "is online", "is offline")
+
+		case entry[0] == '-' && len(entry) > 1:
+			nick := entry[1:]
+			if s.watches.remove(c, nick) {
+				c.sendWatchState(nick, RPL_WATCHOFF, RPL_WATCHOFF, "stopped watching", "stopped watching")
+			}
+
+		case entry == "C" || entry == "c":
+			s.watches.clear(c)
+
+		case entry == "S" || entry == "s":
+			nicks := s.watches.list(c)
+			c.SendNumeric(RPL_WATCHSTAT, fmt.Sprintf(":You have %d and are on %d WATCH entries", len(nicks), len(s.watches.watchers(c.Nick()))))
+			for _, line := range splitNickList(nicks, " ") {
+				c.SendNumeric(RPL_WATCHLIST, ":"+line)
+			}
+			c.SendNumeric(RPL_ENDOFWATCHLIST, ":End of WATCH S")
+
+		case entry == "L" || entry == "l":
+			offline := 0
+			if entry == "L" {
+				offline = RPL_NOWOFF
+			}
+			for _, nick := range s.watches.list(c) {
+				c.sendWatchState(nick, RPL_NOWON, offline, "is online", "is offline")
+			}
+			c.SendNumeric(RPL_ENDOFWATCHLIST, ":End of WATCH "+entry)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWatchIndex(t *testing.T) {
+	w := newWatchIndex()
+	alice, bob := &Client{}, &Client{}
+
+	if !w.add(alice, "Carol", 2) || !w.add(alice, "dave", 2) || !w.add(bob, "carol", 2) {
+		t.Fatal("add refused a nick below the limit")
+	}
+	if !w.add(alice, "CAROL", 2) {
+		t.Error("add refused a nick already on the list")
+	}
+	if w.add(alice, "erin", 2) {
+		t.Error("add accepted a nick over the limit")
+	}
+
+	if got := w.list(alice); !reflect.DeepEqual(got, []string{"Carol", "dave"}) {
+		t.Errorf("list = %v", got)
+	}
+	if got := w.watchers("CaRoL"); len(got) != 2 {
+		t.Errorf("watchers(carol) = %d clients, want 2", len(got))
+	}
+
+	if !w.remove(alice, "carol") || w.remove(alice, "carol") {
+		t.Error("remove should succeed once")
+	}
+	if got := w.watchers("carol"); len(got) != 1 || got[0] != bob {
+		t.Errorf("watchers after remove = %v", got)
+	}
+
+	w.clear(alice)
+	w.clear(bob)
+	if len(w.byNick) != 0 || len(w.byClient) != 0 {
+		t.Errorf("clear left entries: %v %v", w.byNick, w.byClient)
+	}
+}
+
+func TestSplitNickList(t *testing.T) {
+	if got := splitNickList([]string{"a", "b", "c"}, ","); !reflect.DeepEqual(got, []string{"a,b,c"}) {
+		t.Errorf("splitNickList = %v", got)
+	}
+
+	nick := strings.Repeat("n", 30)
+	nicks := make([]string, 30)
+	for i := range nicks {
+		nicks[i] = nick
+	}
+	lines := splitNickList(nicks, " ")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+	for _, line := range lines {
+		if len(line) > maxNickListLength {
+			t.Errorf("line of %d bytes is over the limit", len(line))
+		}
+	}
+}
+
+func TestMonitorCommand(t *testing.T) {
+	s := newTestServer(t)
+	registerTest(t, s, "carol")
+	alice := registerTest(t, s, "alice")
+
+	alice.send("MONITOR + carol,Dave")
+	if line := alice.expect(" 730 "); !strings.HasSuffix(line, " 730 alice :carol!carol@127.0.0.1") {
+		t.Errorf("online reply: %q", line)
+	}
+	if line := alice.expect(" 731 "); !strings.HasSuffix(line, " 731 alice :Dave") {
+		t.Errorf("offline reply: %q", line)
+	}
+
+	alice.send("MONITOR L")
+	lines := alice.readUntil(" 733 ")
+	if list := containing(lines, " 732 "); len(list) != 1 || !strings.HasSuffix(list[0], " :carol,Dave") {
+		t.Errorf("MONITOR L: %q", lines)
+	}
+
+	alice.send("MONITOR S")
+	alice.expect(" 730 alice :carol!")
+	alice.expect(" 731 alice :Dave")
+
+	alice.send("MONITOR - dave")
+	alice.send("MONITOR L")
+	lines = alice.readUntil(" 733 ")
+	if list := containing(lines, " 732 "); len(list) != 1 || !strings.HasSuffix(list[0], " :carol") {
+		t.Errorf("MONITOR L after -: %q", lines)
+	}
+
+	alice.send("MONITOR C")
+	alice.send("MONITOR L")
+	if list := containing(alice.readUntil(" 733 "), " 732 "); len(list) != 0 {
+		t.Errorf("MONITOR L after C: %q", list)
+	}
+	if len(s.monitors.byNick) != 0 {
+		t.Errorf("MONITOR C left watchers: %v", s.monitors.byNick)
+	}
+}
+
+func TestMonitorListFull(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Limits.MaxMonitor = 2
+	})
+	alice := registerTest(t, s, "alice")
+
+	alice.send("MONITOR + a,b,c,d")
+	lines := alice.readUntil(" 734 ")
+	if line := lines[len(lines)-1]; !strings.HasSuffix(line, " 734 alice 2 c,d :Monitor list is full") {
+		t.Errorf("list full reply: %q", line)
+	}
+	if line := alice.expect(" 731 "); !strings.HasSuffix(line, " :a,b") {
+		t.Errorf("offline reply: %q", line)
+	}
+
+	// A nick already on a full list is still accepted
+	alice.send("MONITOR + A")
+	lines = alice.sync()
+	if len(containing(lines, " 734 ")) != 0 || len(containing(lines, " 731 alice :A")) != 1 {
+		t.Errorf("re-adding a listed nick: %q", lines)
+	}
+}
+
+func TestMonitorNotifications(t *testing.T) {
+	s := newTestServer(t)
+	alice := registerTest(t, s, "alice")
+	alice.send("MONITOR + carol,dave")
+	alice.expect(" 731 ")
+
+	// Registration
+	carol := registerTest(t, s, "carol")
+	if line := alice.expect(" 730 "); !strings.HasSuffix(line, " 730 alice :carol!carol@127.0.0.1") {
+		t.Errorf("online on registration: %q", line)
+	}
+
+	// A nick change is an offline and an online
+	carol.send("NICK dave")
+	alice.expect(" 731 alice :carol")
+	alice.expect(" 730 alice :dave!carol@127.0.0.1")
+
+	// A change of case only is not
+	carol.send("NICK Dave")
+	carol.expect(" NICK ")
+	if got := containing(alice.sync(), " 73"); len(got) != 0 {
+		t.Errorf("case-only nick change was announced: %q", got)
+	}
+
+	// Leaving the server, however the client goes
+	s.RemoveClient(s.GetClient("dave"))
+	alice.expect(" 731 alice :Dave")
+	bob := registerTest(t, s, "carol")
+	alice.expect(" 730 alice :carol!")
+	bob.send("QUIT :bye")
+	alice.expect(" 731 alice :carol")
+
+	// A disconnected watcher is dropped from the index
+	alice.conn.Close()
+	eventually(t, "watcher removed", func() bool {
+		return len(s.monitors.watchers("carol")) == 0
+	})
+}
+
+func TestWatchNotifications(t *testing.T) {
+	s := newTestServer(t)
+	alice := registerTest(t, s, "alice")
+
+	alice.send("WATCH +carol")
+	if line := alice.expect(" 605 "); !strings.HasSuffix(line, " 605 alice carol * * 0 :is offline") {
+		t.Errorf("WATCH +offline: %q", line)
+	}
+	carol := registerTest(t, s, "carol")
+	if line := alice.expect(" 600 "); !strings.Contains(line, " 600 alice carol carol 127.0.0.1 ") {
+		t.Errorf("logon: %q", line)
+	}
+	carol.send("QUIT")
+	if line := alice.expect(" 601 "); !strings.Contains(line, " 601 alice carol carol 127.0.0.1 ") {
+		t.Errorf("logoff: %q", line)
+	}
+
+	alice.send("WATCH -carol")
+	alice.expect(" 602 alice carol * * 0 :stopped watching")
+	alice.send("WATCH L")
+	if got := containing(alice.readUntil(" 607 "), " 60"); len(got) != 1 {
+		t.Errorf("WATCH L after -: %q", got)
+	}
+}
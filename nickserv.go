@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// handleNickServ handles commands sent to NickServ
+func (sv *Services) handleNickServ(c *Client, text string) {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		sv.reply(c, "NickServ", "Type /msg NickServ HELP for a list of commands.")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "REGISTER":
+		sv.nsRegister(c, args[1:])
+	case "IDENTIFY", "ID":
+		sv.nsIdentify(c, args[1:])
+	case "GROUP":
+		sv.nsGroup(c)
+	case "DROP":
+		sv.nsDrop(c, args[1:])
+	case "SET":
+		sv.nsSet(c, args[1:])
+	case "CERT":
+		sv.nsCert(c, args[1:])
+	case "LOGOUT":
+		sv.nsLogout(c)
+	case "HELP":
+		sv.nsHelp(c)
+	default:
+		sv.reply(c, "NickServ", "Unknown command %s. Type /msg NickServ HELP for a list of commands.", strings.ToUpper(args[0]))
+	}
+}
+
+// nsRegister - REGISTER <password> [email]
+func (sv *Services) nsRegister(c *Client, args []string) {
+	if len(args) < 1 {
+		sv.reply(c, "NickServ", "Syntax: REGISTER <password> [email]")
+		return
+	}
+
+	if c.Account() != "" {
+		sv.reply(c, "NickServ", "You are already logged in as %s.", c.Account())
+		return
+	}
+
+	email := ""
+	if len(args) > 1 {
+		email = args[1]
+	}
+
+	nick := c.Nick()
+	if err := sv.db.Register(nick, args[0], email); err != nil {
+		switch err {
+		case errAccountExists:
+			sv.reply(c, "NickServ", "%s is already registered.", nick)
+		case errPasswordTooWeak:
+			sv.reply(c, "NickServ", "Please choose a password of at least %d characters that is not your nickname.", minPasswordLength)
+		default:
+			sv.reply(c, "NickServ", "Registration failed, please try again later.")
+			sv.server.sendSnomask('d', fmt.Sprintf("NickServ: failed to register %s: %v", nick, err))
+		}
+		return
+	}
+
+	sv.reply(c, "NickServ", "%s is now registered to you. Remember your password!", nick)
+	sv.Login(c, nick)
+	sv.server.sendSnomask('n', fmt.Sprintf("NickServ: %s (%s@%s) registered account %s", nick, c.User(), c.Host(), nick))
+}
+
+// nsIdentify - IDENTIFY [account] <password>
+func (sv *Services) nsIdentify(c *Client, args []string) {
+	if len(args) < 1 {
+		sv.reply(c, "NickServ", "Syntax: IDENTIFY [account] <password>")
+		return
+	}
+
+	name, password := c.Nick(), args[0]
+	if len(args) > 1 {
+		name, password = args[0], args[1]
+	}
+
+	if c.Account() != "" {
+		sv.reply(c, "NickServ", "You are already logged in as %s.", c.Account())
+		return
+	}
+
+	account, ok, left := c.checkAccountPassword(sv.db, name, password)
+	if left > 0 {
+		sv.reply(c, "NickServ", "Too many failed attempts, try again in %s.", formatDuration(left))
+		return
+	}
+	if !ok {
+		sv.reply(c, "NickServ", "Invalid password for %s.", name)
+		sv.server.sendSnomask('n', fmt.Sprintf("NickServ: failed IDENTIFY for %s by %s (%s@%s)", name, c.Nick(), c.User(), c.Host()))
+		return
+	}
+
+	sv.reply(c, "NickServ", "You are now identified for %s.", account)
+	sv.Login(c, account)
+}
+
+// nsGroup - GROUP: add the current nickname to your account
+func (sv *Services) nsGroup(c *Client) {
+	account := c.Account()
+	if account == "" {
+		sv.reply(c, "NickServ", "You must be identified to group a nickname.")
+		return
+	}
+
+	nick := c.Nick()
+	if err := sv.db.Group(account, nick); err != nil {
+		if err == errNickRegistered {
+			sv.reply(c, "NickServ", "%s is registered to another account.", nick)
+		} else {
+			sv.reply(c, "NickServ", "Could not group %s: %v", nick, err)
+		}
+		return
+	}
+
+	sv.reply(c, "NickServ", "%s is now grouped to your account %s.", nick, account)
+}
+
+// nsDrop - DROP <password>: delete your account
+func (sv *Services) nsDrop(c *Client, args []string) {
+	account := c.Account()
+	if account == "" {
+		sv.reply(c, "NickServ", "You must be identified to drop your account.")
+		return
+	}
+	if len(args) < 1 {
+		sv.reply(c, "NickServ", "Syntax: DROP <password>")
+		return
+	}
+
+	_, ok, left := c.checkAccountPassword(sv.db, account, args[0])
+	if left > 0 {
+		sv.reply(c, "NickServ", "Too many failed attempts, try again in %s.", formatDuration(left))
+		return
+	}
+	if !ok {
+		sv.reply(c, "NickServ", "Invalid password for %s.", account)
+		return
+	}
+
+	if err := sv.db.Drop(account); err != nil {
+		sv.reply(c, "NickServ", "Could not drop %s: %v", account, err)
+		return
+	}
+
+	// Log out every client using the dropped account
+	for _, client := range sv.server.GetClients() {
+		if strings.EqualFold(client.Account(), account) {
+			client.logout()
+		}
+	}
+
+	sv.reply(c, "NickServ", "Account %s has been dropped.", account)
+	sv.server.sendSnomask('n', fmt.Sprintf("NickServ: %s (%s@%s) dropped account %s", c.Nick(), c.User(), c.Host(), account))
+}
+
+// nsSet - SET PASSWORD <new password>
+func (sv *Services) nsSet(c *Client, args []string) {
+	account := c.Account()
+	if account == "" {
+		sv.reply(c, "NickServ", "You must be identified to change settings.")
+		return
+	}
+	if len(args) < 2 || strings.ToUpper(args[0]) != "PASSWORD" {
+		sv.reply(c, "NickServ", "Syntax: SET PASSWORD <new password>")
+		return
+	}
+
+	if err := sv.db.SetPassword(account, args[1]); err != nil {
+		if err == errPasswordTooWeak {
+			sv.reply(c, "NickServ", "Please choose a password of at least %d characters that is not your account name.", minPasswordLength)
+		} else {
+			sv.reply(c, "NickServ", "Could not change password: %v", err)
+		}
+		return
+	}
+
+	sv.reply(c, "NickServ", "Password for %s changed.", account)
+}
+
+// nsCert - CERT LIST | CERT ADD [fingerprint] | CERT DEL <fingerprint>
+func (sv *Services) nsCert(c *Client, args []string) {
+	account := c.Account()
+	if account == "" {
+		sv.reply(c, "NickServ", "You must be identified to manage certificate fingerprints.")
+		return
+	}
+	if len(args) == 0 {
+		sv.reply(c, "NickServ", "Syntax: CERT LIST | CERT ADD [fingerprint] | CERT DEL <fingerprint>")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LIST":
+		info, _ := sv.db.GetAccount(account)
+		if len(info.Certfps) == 0 {
+			sv.reply(c, "NickServ", "No certificate fingerprints on %s.", account)
+			return
+		}
+		sv.reply(c, "NickServ", "Certificate fingerprints on %s:", account)
+		for _, certfp := range info.Certfps {
+			sv.reply(c, "NickServ", "  %s", certfp)
+		}
+	case "ADD":
+		certfp := c.CertFP()
+		if len(args) > 1 {
+			certfp = args[1]
+		}
+		if !validCertFP(certfp) {
+			sv.reply(c, "NickServ", "You are not using a client certificate; give a SHA-256 fingerprint.")
+			return
+		}
+		if err := sv.db.AddCertfp(account, certfp); err != nil {
+			sv.reply(c, "NickServ", "Could not add fingerprint: %v", err)
+			return
+		}
+		sv.reply(c, "NickServ", "Added %s to %s. You can now log in with SASL EXTERNAL.", normalizeCertFP(certfp), account)
+	case "DEL":
+		if len(args) < 2 {
+			sv.reply(c, "NickServ", "Syntax: CERT DEL <fingerprint>")
+			return
+		}
+		if err := sv.db.DelCertfp(account, args[1]); err != nil {
+			sv.reply(c, "NickServ", "Could not remove fingerprint: %v", err)
+			return
+		}
+		sv.reply(c, "NickServ", "Removed %s from %s.", normalizeCertFP(args[1]), account)
+	default:
+		sv.reply(c, "NickServ", "Syntax: CERT LIST | CERT ADD [fingerprint] | CERT DEL <fingerprint>")
+	}
+}
+
+// nsLogout - LOGOUT
+func (sv *Services) nsLogout(c *Client) {
+	if c.Account() == "" {
+		sv.reply(c, "NickServ", "You are not logged in.")
+		return
+	}
+	sv.reply(c, "NickServ", "You have been logged out of %s.", c.Account())
+	sv.Logout(c)
+}
+
+func (sv *Services) nsHelp(c *Client) {
+	sv.reply(c, "NickServ", "NickServ lets you register and protect your nickname.")
+	sv.reply(c, "NickServ", "  REGISTER <password> [email]  - Register your current nickname")
+	sv.reply(c, "NickServ", "  IDENTIFY [account] <password> - Log in to your account")
+	sv.reply(c, "NickServ", "  GROUP                         - Add your current nickname to your account")
+	sv.reply(c, "NickServ", "  DROP <password>               - Delete your account")
+	sv.reply(c, "NickServ", "  SET PASSWORD <password>       - Change your password")
+	sv.reply(c, "NickServ", "  CERT ADD|DEL|LIST [fp]        - Manage certificate fingerprints for SASL EXTERNAL")
+	sv.reply(c, "NickServ", "  LOGOUT                        - Log out of your account")
+}
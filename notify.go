@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+)
+
+// maxRealnameLength limits the realname set with SETNAME
+const maxRealnameLength = 150
+
+// notifyPeers sends a message to the clients sharing a channel with c that
+// negotiated a capability, and to c itself if self is set and it did too
+func (c *Client) notifyPeers(capability string, msg *Message, self bool) {
+	if self && !c.IsRemote() && c.HasCapability(capability) {
+		c.Send(msg)
+	}
+	for _, peer := range c.commonChannelPeers() {
+		if peer.HasCapability(capability) {
+			peer.Send(msg)
+		}
+	}
+}
+
+// notifyAway tells away-notify clients sharing a channel with c that it
+// went away or came back
+func (c *Client) notifyAway() {
+	if away := c.Away(); away != "" {
+		c.notifyPeers("away-notify", c.taggedMessage("AWAY", away), false)
+	} else {
+		c.notifyPeers("away-notify", c.taggedMessage("AWAY"), false)
+	}
+}
+
+// notifyAccount tells account-notify clients sharing a channel with c, and
+// c itself, that it logged in to an account or, with "", logged out
+func (c *Client) notifyAccount(account string) {
+	if !c.IsRegistered() {
+		return
+	}
+	if account == "" {
+		account = "*"
+	}
+	c.notifyPeers("account-notify", c.taggedMessage("ACCOUNT", account), true)
+}
+
+// joinMessages returns the JOIN for c joining a channel in both forms: plain,
+// and with the account and realname for extended-join clients. Both carry
+// the same msgid.
+func (c *Client) joinMessages(channel string) (join, extended *Message) {
+	join = c.taggedMessage("JOIN", channel)
+
+	account := c.Account()
+	if account == "" {
+		account = "*"
+	}
+	ext := *join
+	ext.Params = []string{channel, account, c.Realname()}
+	return join, &ext
+}
+
+// joinFor picks the form of a JOIN a recipient understands
+func joinFor(recipient *Client, join, extended *Message) *Message {
+	if recipient.HasCapability("extended-join") {
+		return extended
+	}
+	return join
+}
+
+// broadcastJoin announces c joining the channel to every member, in the
+// form each one negotiated, and tells away-notify clients if c is away.
+// During a link burst the lines go in the netjoin batch.
+func (ch *Channel) broadcastJoin(c *Client, netjoin *batchGroup) {
+	join, extended := c.joinMessages(ch.Name())
+
+	var away *Message
+	if reason := c.Away(); reason != "" {
+		away = c.taggedMessage("AWAY", reason)
+	}
+
+	for _, member := range ch.GetClients() {
+		netjoin.send(member, joinFor(member, join, extended))
+		if away != nil && member != c && member.HasCapability("away-notify") {
+			netjoin.send(member, away)
+		}
+	}
+}
+
+// notifyInvite tells the channel operators that negotiated invite-notify,
+// other than the inviter, that someone was invited
+func (ch *Channel) notifyInvite(inviter, target *Client) {
+	msg := inviter.taggedMessage("INVITE", target.Nick(), ch.Name())
+	msg.ForceTrailing = false
+	for _, member := range ch.GetClients() {
+		if member == inviter || member == target || !member.HasCapability("invite-notify") {
+			continue
+		}
+		if ch.IsChanop(member) {
+			member.Send(msg)
+		}
+	}
+}
+
+// setRealname changes the client's realname and tells setname clients
+// sharing a channel with it, and the client itself
+func (c *Client) setRealname(realname string) {
+	c.SetRealname(realname)
+	c.notifyPeers("setname", c.taggedMessage("SETNAME", realname), true)
+}
+
+// handleSetname handles SETNAME :<realname>
+func (c *Client) handleSetname(msg *Message) {
+	realname := msg.Params[0]
+	if realname == "" || len(realname) > maxRealnameLength {
+		c.sendFail("SETNAME", "INVALID_REALNAME", fmt.Sprintf("Realname must be 1 to %d characters", maxRealnameLength))
+		return
+	}
+
+	c.setRealname(realname)
+	c.server.propagateSetname(c)
+}
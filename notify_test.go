@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJoinMessages(t *testing.T) {
+	c := &Client{nick: "bob", user: "b", host: "h", realname: "Bob Smith", modes: make(map[rune]bool)}
+
+	join, extended := c.joinMessages("#chan")
+	if got := join.body(); got != ":bob!b@h JOIN :#chan" {
+		t.Errorf("join = %q", got)
+	}
+	if got := extended.body(); got != ":bob!b@h JOIN #chan * :Bob Smith" {
+		t.Errorf("extended join without account = %q", got)
+	}
+	if join.Tags["msgid"] == "" || join.Tags["msgid"] != extended.Tags["msgid"] {
+		t.Errorf("both forms should share one msgid: %v %v", join.Tags, extended.Tags)
+	}
+
+	c.account = "bobby"
+	_, extended = c.joinMessages("#chan")
+	if got := extended.body(); got != ":bob!b@h JOIN #chan bobby :Bob Smith" {
+		t.Errorf("extended join with account = %q", got)
+	}
+
+	withCap := &Client{capabilities: map[string]bool{"extended-join": true}}
+	without := &Client{capabilities: make(map[string]bool)}
+	if joinFor(withCap, join, extended) != extended || joinFor(without, join, extended) != join {
+		t.Errorf("joinFor picked the wrong form")
+	}
+}
+
+func TestNotifyCapabilityGating(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Features.EnableServices = true
+	})
+	s.services.db.Register("alice", "secret", "")
+
+	// capped and outsider negotiate every notification; plain none. All
+	// three are chanops where they share a channel, for invite-notify.
+	const caps = "away-notify account-notify setname chghost invite-notify"
+	capped := registerTest(t, s, "capped")
+	capped.send("CAP REQ :" + caps)
+	capped.expect("ACK")
+	capped.send("JOIN #room")
+	capped.expect(" 366 ")
+	outsider := registerTest(t, s, "outsider")
+	outsider.send("CAP REQ :"+caps, "JOIN #elsewhere")
+	outsider.expect(" 366 ")
+	plain := registerTest(t, s, "plain")
+	plain.send("JOIN #room")
+	plain.expect(" 366 ")
+	capped.send("MODE #room +o plain")
+	plain.expect("MODE #room +o plain")
+
+	alice := registerTest(t, s, "alice")
+	alice.send("JOIN #room")
+	alice.expect(" 366 ")
+	capped.sync()
+	plain.sync()
+	guest := registerTest(t, s, "guest")
+	oper := registerTest(t, s, "oper")
+	operTest(t, s, oper, "admin", "admin")
+
+	checks := []struct {
+		name   string
+		action func()
+		want   string
+	}{
+		{"AWAY", func() { alice.send("AWAY :gone") }, " AWAY :gone"},
+		{"ACCOUNT", func() { alice.send("PRIVMSG NickServ :IDENTIFY secret") }, " ACCOUNT :alice"},
+		{"SETNAME", func() { alice.send("SETNAME :Alice Liddell") }, " SETNAME :Alice Liddell"},
+		{"CHGHOST", func() { oper.send("CHGHOST alice alice.example.org") }, " CHGHOST alice alice.example.org"},
+		{"INVITE", func() { alice.send("INVITE guest #room") }, " INVITE guest #room"},
+	}
+	for _, check := range checks {
+		check.action()
+		if line := capped.expect(check.want); !strings.HasPrefix(line, ":alice!") {
+			t.Errorf("%s reached capped from the wrong source: %q", check.name, line)
+		}
+		alice.sync()
+		oper.sync()
+		if got := containing(plain.sync(), check.want); len(got) != 0 {
+			t.Errorf("%s reached a client without the capability: %q", check.name, got)
+		}
+		if got := containing(outsider.sync(), check.want); len(got) != 0 {
+			t.Errorf("%s reached a client sharing no channel: %q", check.name, got)
+		}
+	}
+	guest.expect("INVITE guest #room")
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2id parameters for new oper password hashes
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 2
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Reasons an OPER attempt fails, shown to other opers
+const (
+	operFailNoBlock  = "no such oper"
+	operFailHost     = "host mismatch"
+	operFailPassword = "bad password"
+	operFailCertFP   = "certificate fingerprint mismatch"
+	operFailExpired  = "oper block expired"
+	operFailTOTP     = "bad two-factor code"
+	operFailReplay   = "reused two-factor code"
+)
+
+// operTOTPTimeout is how long a client has to send the two-factor code after
+// its password was accepted
+const operTOTPTimeout = time.Minute
+
+// matchOperHost matches a client's ident and IP address against an oper
+// host mask. The mask is user@host, where host is a wildcard, an IP address
+// or a CIDR block; "localhost" matches loopback addresses. Several masks can
+// be given separated by spaces or commas.
+func matchOperHost(masks, user, ip string) bool {
+	for _, mask := range strings.FieldsFunc(masks, func(r rune) bool { return r == ' ' || r == ',' }) {
+		maskUser, maskHost := "*", mask
+		if at := strings.LastIndex(mask, "@"); at >= 0 {
+			maskUser, maskHost = mask[:at], mask[at+1:]
+		}
+		if !matchWildcard(maskUser, user) && !matchWildcard(maskUser, strings.TrimPrefix(user, "~")) {
+			continue
+		}
+		if strings.EqualFold(maskHost, "localhost") {
+			if addr := net.ParseIP(ip); addr != nil && addr.IsLoopback() {
+				return true
+			}
+			continue
+		}
+		if matchIPMask(maskHost, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPasswordHash returns true if a configured password is a bcrypt or
+// argon2id hash rather than plain text
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$") || strings.HasPrefix(stored, "$argon2id$")
+}
+
+// checkOperPassword compares a password with the configured one, which may be
+// a bcrypt hash, an argon2id hash or, for old configs, plain text
+func checkOperPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return checkArgon2(stored, password)
+	case isPasswordHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	default:
+		return stored != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+// hashArgon2 hashes a password as $argon2id$v=19$m=...,t=...,p=...$salt$key
+func hashArgon2(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkArgon2 verifies a password against an argon2id hash
+func checkArgon2(stored, password string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, computed) == 1
+}
+
+// findOper looks up the oper block a client is trying to use. It returns the
+// block, or nil and the reason the attempt failed. An expired block is
+// refused however the client authenticates. A block with a certfp matching
+// the client's certificate needs no password; one with require_certfp
+// refuses the password without it.
+func (c *Client) findOper(name, password string) (*Oper, string) {
+	candidates := []Oper{}
+	if oper := c.server.OperConfig().GetOper(name); oper != nil {
+		candidates = append(candidates, *oper)
+	}
+	// Legacy blocks in the main config with the same name are tried too
+	for _, oper := range c.server.config.Opers {
+		if oper.Name == name {
+			candidates = append(candidates, Oper{Name: oper.Name, Password: oper.Password, Host: oper.Host, Class: oper.Class, Flags: oper.Flags})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, operFailNoBlock
+	}
+
+	certfp := c.CertFP()
+	reason := operFailHost
+	for i := range candidates {
+		oper := &candidates[i]
+		if !matchOperHost(oper.Host, c.User(), c.Host()) {
+			continue
+		}
+		if oper.Expired(time.Now()) {
+			reason = operFailExpired
+			continue
+		}
+		if oper.CertFP != "" && certfp != "" && normalizeCertFP(oper.CertFP) == certfp {
+			return oper, ""
+		}
+		if oper.RequireCertFP {
+			reason = operFailCertFP
+			continue
+		}
+		if !checkOperPassword(oper.Password, password) {
+			reason = operFailPassword
+			continue
+		}
+		return oper, ""
+	}
+	return nil, reason
+}
+
+// setPendingOper remembers an oper block whose password was accepted while
+// the client is asked for its two-factor code
+func (c *Client) setPendingOper(oper *Oper) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pendingOper = oper
+	c.pendingOperAt = time.Now()
+}
+
+// takePendingOper returns and forgets the oper block waiting for a
+// two-factor code, or nil if there is none or it has timed out
+func (c *Client) takePendingOper() *Oper {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oper := c.pendingOper
+	c.pendingOper = nil
+	if oper == nil || time.Since(c.pendingOperAt) > operTOTPTimeout {
+		return nil
+	}
+	return oper
+}
+
+// verifyOperTOTP is the second OPER step. It returns true if the oper may go
+// ahead; otherwise the client has already been answered. Without a code the
+// client is asked for one with OPER <code>.
+func (c *Client) verifyOperTOTP(oper *Oper, code string) bool {
+	if oper.TOTPSecret == "" {
+		if c.server.OperConfig().Settings.RequireTwoFactor {
+			c.server.sendSnomask('o', fmt.Sprintf("OPER as %s by %s (%s@%s) refused: two-factor authentication is required but no totp_secret is set",
+				oper.Name, c.Nick(), c.User(), c.Host()))
+			c.SendNumeric(ERR_NOOPERHOST, ":Two-factor authentication is required but not set up for this oper block")
+			return false
+		}
+		return true
+	}
+
+	if code == "" {
+		c.setPendingOper(oper)
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Two-factor authentication required: send OPER <code> within %s",
+			c.server.config.Server.Name, c.Nick(), formatDuration(operTOTPTimeout)))
+		return false
+	}
+
+	step, ok := verifyTOTP(oper.TOTPSecret, code, time.Now())
+	if !ok {
+		c.operFailed(oper.Name, operFailTOTP)
+		c.SendNumeric(ERR_PASSWDMISMATCH, ":Two-factor code incorrect")
+		return false
+	}
+	if !c.server.operTOTP.Use(oper.Name, step) {
+		c.operFailed(oper.Name, operFailReplay)
+		c.SendNumeric(ERR_PASSWDMISMATCH, ":Two-factor code already used")
+		return false
+	}
+	return true
+}
+
+// operAttempts counts failed OPER attempts from one IP address or for one
+// oper name
+type operAttempts struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// operLockout tracks failed OPER attempts so that repeated guessing locks the
+// IP address and the oper name for a while. Account logins use a second one.
+type operLockout struct {
+	attempts map[string]*operAttempts
+	mu       sync.Mutex
+}
+
+func newOperLockout() *operLockout {
+	return &operLockout{attempts: make(map[string]*operAttempts)}
+}
+
+// lockoutKeys returns the keys an attempt is counted under
+func lockoutKeys(name, ip string) []string {
+	return []string{"ip:" + ip, "name:" + strings.ToLower(name)}
+}
+
+// Locked returns how long an IP address or oper name remains locked out
+func (l *operLockout) Locked(name, ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var remaining time.Duration
+	for _, key := range lockoutKeys(name, ip) {
+		if a, exists := l.attempts[key]; exists && now.Before(a.lockedUntil) {
+			if left := a.lockedUntil.Sub(now); left > remaining {
+				remaining = left
+			}
+		}
+	}
+	return remaining
+}
+
+// Fail records a failed attempt and returns true if it started a lockout.
+// Failures older than the lockout duration are forgotten.
+func (l *operLockout) Fail(name, ip string, max int, duration time.Duration, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	locked := false
+	for _, key := range lockoutKeys(name, ip) {
+		a, exists := l.attempts[key]
+		if !exists || now.Sub(a.first) > duration {
+			a = &operAttempts{first: now}
+			l.attempts[key] = a
+		}
+		a.failures++
+		if a.failures >= max && !now.Before(a.lockedUntil) {
+			a.lockedUntil = now.Add(duration)
+			a.failures = 0
+			a.first = now
+			locked = true
+		}
+	}
+
+	// Forget stale entries so guessing many names cannot grow the map forever
+	for key, a := range l.attempts {
+		if now.Sub(a.first) > duration && !now.Before(a.lockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+	return locked
+}
+
+// Succeed clears the failures of an IP address and oper name
+func (l *operLockout) Succeed(name, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range lockoutKeys(name, ip) {
+		delete(l.attempts, key)
+	}
+}
+
+// operFailed records a failed OPER attempt, announces it on the 'o' snomask
+// and locks the IP address and oper name after too many failures
+func (c *Client) operFailed(name, reason string) {
+	settings := c.server.OperConfig().Settings
+	c.server.sendSnomask('o', fmt.Sprintf("Failed OPER attempt as %s by %s (%s@%s): %s", name, c.Nick(), c.User(), c.Host(), reason))
+	c.audit("OPER", name, "failed", reason)
+
+	if settings.MaxFailedAttempts <= 0 {
+		return
+	}
+	duration := time.Duration(settings.LockoutDuration) * time.Minute
+	if duration <= 0 {
+		duration = 30 * time.Minute
+	}
+	if c.server.operLockout.Fail(name, c.Host(), settings.MaxFailedAttempts, duration, time.Now()) {
+		c.server.sendSnomask('o', fmt.Sprintf("OPER locked for %s and %s for %s after %d failed attempts",
+			name, c.Host(), formatDuration(duration), settings.MaxFailedAttempts))
+	}
+}
+
+// runMkpasswd implements "techircd mkpasswd [-argon2] [password]", printing
+// a hash for an oper block. The password is read from standard input when it
+// is not given.
+func runMkpasswd(args []string) int {
+	flags := flag.NewFlagSet("mkpasswd", flag.ContinueOnError)
+	useArgon2 := flags.Bool("argon2", false, "Hash with argon2id instead of bcrypt")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	password := flags.Arg(0)
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintf(os.Stderr, "mkpasswd: %v\n", err)
+			return 1
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "mkpasswd: empty password")
+		return 1
+	}
+
+	var hash string
+	var err error
+	if *useArgon2 {
+		hash, err = hashArgon2(password)
+	} else {
+		var raw []byte
+		raw, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hash = string(raw)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkpasswd: %v\n", err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMatchOperHost(t *testing.T) {
+	tests := []struct {
+		mask, user, ip string
+		want           bool
+	}{
+		{"*@*", "bob", "203.0.113.5", true},
+		{"*@localhost", "bob", "127.0.0.1", true},
+		{"*@localhost", "bob", "::1", true},
+		{"*@localhost", "bob", "203.0.113.5", false},
+		{"*@10.0.0.0/8", "bob", "10.1.2.3", true},
+		{"*@10.0.0.0/8", "bob", "11.1.2.3", false},
+		{"bob@203.0.113.*", "~bob", "203.0.113.5", true},
+		{"bob@203.0.113.*", "eve", "203.0.113.5", false},
+		{"*@192.0.2.1, *@2001:db8::/32", "bob", "2001:db8::7", true},
+	}
+	for _, tt := range tests {
+		if got := matchOperHost(tt.mask, tt.user, tt.ip); got != tt.want {
+			t.Errorf("matchOperHost(%q, %q, %q) = %v, want %v", tt.mask, tt.user, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOperPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := hashArgon2("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stored := range []string{"secret", string(bcryptHash), argon2Hash} {
+		if !checkOperPassword(stored, "secret") {
+			t.Errorf("correct password rejected for %q", stored)
+		}
+		if checkOperPassword(stored, "wrong") {
+			t.Errorf("wrong password accepted for %q", stored)
+		}
+	}
+	if checkOperPassword("", "") {
+		t.Error("empty password accepted")
+	}
+}
+
+func TestOperLockout(t *testing.T) {
+	l := newOperLockout()
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if l.Fail("admin", "192.0.2.1", 3, time.Minute, now) {
+			t.Fatalf("locked after %d failures", i+1)
+		}
+	}
+	if !l.Fail("admin", "192.0.2.1", 3, time.Minute, now) {
+		t.Fatal("not locked after 3 failures")
+	}
+	if l.Locked("admin", "198.51.100.1", now) == 0 {
+		t.Error("oper name not locked from another address")
+	}
+	if l.Locked("other", "192.0.2.1", now) == 0 {
+		t.Error("address not locked for another oper name")
+	}
+	if l.Locked("admin", "192.0.2.1", now.Add(2*time.Minute)) != 0 {
+		t.Error("lockout did not expire")
+	}
+
+	l.Succeed("admin", "192.0.2.1")
+	if l.Locked("admin", "192.0.2.1", now) != 0 {
+		t.Error("success did not clear the lockout")
+	}
+}
+
+func TestFindOperExpiredCertFP(t *testing.T) {
+	const fp = "40f510d23683f6273ea630dda89c2615e77d8344b293a2e7678b8ecea26f97c2"
+	s := &Server{config: &Config{}}
+	operConfig := DefaultOperConfig()
+	operConfig.Opers = []Oper{{Name: "cert", Class: "admin", Host: "*@*", CertFP: fp, Expires: "2000-01-01"}}
+	s.operConfig.Store(operConfig)
+	c := &Client{server: s, user: "user", host: "192.0.2.1", certfp: fp}
+
+	if oper, reason := c.findOper("cert", ""); oper != nil || reason != operFailExpired {
+		t.Errorf("expired block with a matching certfp: oper %v, reason %q", oper, reason)
+	}
+
+	operConfig.Opers[0].Expires = ""
+	if oper, reason := c.findOper("cert", ""); oper == nil {
+		t.Errorf("matching certfp refused: %q", reason)
+	}
+}
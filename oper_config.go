@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 // OperClass defines an operator class with specific permissions
@@ -19,15 +25,18 @@ type OperClass struct {
 
 // Oper defines an individual operator
 type Oper struct {
-	Name        string   `json:"name"`
-	Password    string   `json:"password"`
-	Host        string   `json:"host"`
-	Class       string   `json:"class"`
-	Flags       []string `json:"flags"`      // Additional per-user flags
-	MaxClients  int      `json:"max_clients"` // Max clients this oper can handle
-	Expires     string   `json:"expires"`     // Expiration date (optional)
-	Contact     string   `json:"contact"`     // Contact information
-	LastSeen    string   `json:"last_seen"`   // Last time this oper was online
+	Name          string   `json:"name"`
+	Password      string   `json:"password"`
+	Host          string   `json:"host"`
+	Class         string   `json:"class"`
+	Flags         []string `json:"flags"`                    // Additional per-user flags
+	MaxClients    int      `json:"max_clients"`              // Max clients this oper can handle
+	Expires       string   `json:"expires"`                  // Expiration date (optional)
+	Contact       string   `json:"contact"`                  // Contact information
+	LastSeen      string   `json:"last_seen"`                // Last time this oper was online
+	CertFP        string   `json:"certfp,omitempty"`         // TLS client certificate fingerprint that authenticates this oper
+	RequireCertFP bool     `json:"require_certfp,omitempty"` // Also require the certificate when a password is given
+	TOTPSecret    string   `json:"totp_secret,omitempty"`    // Base32 secret for two-factor codes (RFC 6238)
 }
 
 // RankNames defines custom names for rank levels
@@ -39,6 +48,54 @@ type RankNames struct {
 	Rank5 string `json:"rank_5"` // Default: Owner
 	// Support for custom ranks beyond 5
 	CustomRanks map[string]int `json:"custom_ranks"` // "CustomName": 6
+
+	comments map[string]json.RawMessage // custom_ranks entries starting with "_"
+}
+
+// UnmarshalJSON reads rank names, skipping custom_ranks entries whose names
+// start with an underscore; those hold comments and examples
+func (rn *RankNames) UnmarshalJSON(data []byte) error {
+	type plain RankNames
+	var raw struct {
+		plain
+		CustomRanks map[string]json.RawMessage `json:"custom_ranks"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*rn = RankNames(raw.plain)
+	rn.CustomRanks = make(map[string]int)
+	rn.comments = make(map[string]json.RawMessage)
+	for name, value := range raw.CustomRanks {
+		if strings.HasPrefix(name, "_") {
+			rn.comments[name] = value
+			continue
+		}
+		var rank int
+		if err := json.Unmarshal(value, &rank); err != nil {
+			return fmt.Errorf("custom rank %s: %v", name, err)
+		}
+		rn.CustomRanks[name] = rank
+	}
+	return nil
+}
+
+// MarshalJSON writes rank names back out, keeping the comment entries
+// UnmarshalJSON skipped
+func (rn RankNames) MarshalJSON() ([]byte, error) {
+	type plain RankNames
+	custom := make(map[string]interface{}, len(rn.CustomRanks)+len(rn.comments))
+	for name, value := range rn.comments {
+		custom[name] = value
+	}
+	for name, rank := range rn.CustomRanks {
+		custom[name] = rank
+	}
+	return json.Marshal(struct {
+		plain
+		CustomRanks map[string]interface{} `json:"custom_ranks"`
+	}{plain(rn), custom})
 }
 
 // OperConfig holds the complete operator configuration
@@ -73,20 +130,191 @@ func LoadOperConfig(filename string) (*OperConfig, error) {
 	return &config, nil
 }
 
-// SaveOperConfig saves operator configuration to file
+// SaveOperConfig saves operator configuration to file. An existing file is
+// updated in place: keys the config does not know about are kept where they
+// were, and so is the file's mode.
 func SaveOperConfig(config *OperConfig, filename string) error {
-	data, err := json.MarshalIndent(config, "", "  ")
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal oper config: %v", err)
+	}
+	updated, err := decodeOrderedJSON(data)
 	if err != nil {
 		return fmt.Errorf("failed to marshal oper config: %v", err)
 	}
 
-	if err := os.WriteFile(filename, data, 0644); err != nil {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+		if existing, err := os.ReadFile(filename); err == nil {
+			if original, err := decodeOrderedJSON(existing); err == nil {
+				updated = mergeOrderedJSON(original, updated)
+			}
+		}
+	}
+
+	data, err = json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal oper config: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
 		return fmt.Errorf("failed to write oper config file: %v", err)
 	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write oper config file: %v", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to replace oper config file: %v", err)
+	}
 
 	return nil
 }
 
+// orderedObject is a JSON object that remembers the order of its keys, so
+// a file can be rewritten without reordering it
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, exists := o.values[key]; !exists {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeOrderedJSON decodes JSON with objects as orderedObjects and numbers
+// kept as written
+func decodeOrderedJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	value, err := decodeOrderedValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the top-level value")
+	}
+	return value, nil
+}
+
+func decodeOrderedValue(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := &orderedObject{values: make(map[string]interface{})}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			object.set(key.(string), value)
+		}
+		_, err := dec.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := dec.Token()
+		return array, err
+	}
+	return token, nil
+}
+
+// mergeOrderedJSON lays an updated value over the original one. Objects keep
+// the original's keys and order, with updated values replacing theirs;
+// elements of arrays of named objects, such as classes and opers, are
+// matched by name.
+func mergeOrderedJSON(original, updated interface{}) interface{} {
+	switch updated := updated.(type) {
+	case *orderedObject:
+		original, ok := original.(*orderedObject)
+		if !ok {
+			return updated
+		}
+		merged := &orderedObject{keys: append([]string(nil), original.keys...), values: make(map[string]interface{})}
+		for key, value := range original.values {
+			merged.values[key] = value
+		}
+		for _, key := range updated.keys {
+			merged.set(key, mergeOrderedJSON(original.values[key], updated.values[key]))
+		}
+		return merged
+	case []interface{}:
+		original, ok := original.([]interface{})
+		if !ok {
+			return updated
+		}
+		named := make(map[string]interface{})
+		for _, element := range original {
+			if name := orderedName(element); name != "" {
+				named[name] = element
+			}
+		}
+		merged := make([]interface{}, len(updated))
+		for i, element := range updated {
+			if match, exists := named[orderedName(element)]; exists {
+				merged[i] = mergeOrderedJSON(match, element)
+			} else {
+				merged[i] = element
+			}
+		}
+		return merged
+	}
+	return updated
+}
+
+// orderedName returns the "name" of a JSON object, or ""
+func orderedName(value interface{}) string {
+	if object, ok := value.(*orderedObject); ok {
+		if name, ok := object.values["name"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
 // GetOperClass returns the operator class by name
 func (oc *OperConfig) GetOperClass(className string) *OperClass {
 	for i := range oc.Classes {
@@ -97,6 +325,25 @@ func (oc *OperConfig) GetOperClass(className string) *OperClass {
 	return nil
 }
 
+// ExpiresAt parses the oper's expiry, a date (2006-01-02) or an RFC 3339
+// time. It returns the zero time if the oper never expires.
+func (o *Oper) ExpiresAt() (time.Time, error) {
+	if o.Expires == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", o.Expires); err == nil {
+		// A date is valid until the end of that day
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, o.Expires)
+}
+
+// Expired returns true if the oper block is past its expiry
+func (o *Oper) Expired(now time.Time) bool {
+	expires, err := o.ExpiresAt()
+	return err == nil && !expires.IsZero() && !now.Before(expires)
+}
+
 // GetOper returns the operator by name
 func (oc *OperConfig) GetOper(operName string) *Oper {
 	for i := range oc.Opers {
@@ -107,6 +354,21 @@ func (oc *OperConfig) GetOper(operName string) *Oper {
 	return nil
 }
 
+// ClassPermissions returns the permissions of a class, including every
+// class it inherits from
+func (oc *OperConfig) ClassPermissions(className string) []string {
+	var permissions []string
+	seen := make(map[string]bool)
+	for class := oc.GetOperClass(className); class != nil && !seen[class.Name]; class = oc.GetOperClass(class.Inherits) {
+		seen[class.Name] = true
+		permissions = append(permissions, class.Permissions...)
+		if class.Inherits == "" {
+			break
+		}
+	}
+	return permissions
+}
+
 // GetOperPermissions returns all permissions for an operator (including inherited)
 func (oc *OperConfig) GetOperPermissions(operName string) []string {
 	oper := oc.GetOper(operName)
@@ -114,42 +376,217 @@ func (oc *OperConfig) GetOperPermissions(operName string) []string {
 		return nil
 	}
 
-	class := oc.GetOperClass(oper.Class)
-	if class == nil {
-		return oper.Flags
-	}
-
 	permissions := make(map[string]bool)
-	
-	// Add class permissions
-	for _, perm := range class.Permissions {
+	for _, perm := range oc.ClassPermissions(oper.Class) {
 		permissions[perm] = true
 	}
-	
-	// Add inherited permissions
-	if class.Inherits != "" {
-		inherited := oc.GetOperClass(class.Inherits)
-		if inherited != nil {
-			for _, perm := range inherited.Permissions {
-				permissions[perm] = true
-			}
-		}
-	}
-	
+
 	// Add individual flags
 	for _, flag := range oper.Flags {
 		permissions[flag] = true
 	}
-	
+
 	// Convert back to slice
 	result := make([]string, 0, len(permissions))
 	for perm := range permissions {
 		result = append(result, perm)
 	}
-	
+	sort.Strings(result)
+
 	return result
 }
 
+// Validate checks for mistakes that would make permissions ambiguous:
+// duplicate class or oper names, references to unknown classes and
+// inheritance cycles
+func (oc *OperConfig) Validate() error {
+	var problems []string
+
+	classes := make(map[string]*OperClass)
+	for i := range oc.Classes {
+		class := &oc.Classes[i]
+		if class.Name == "" {
+			problems = append(problems, "class without a name")
+			continue
+		}
+		if _, exists := classes[class.Name]; exists {
+			problems = append(problems, fmt.Sprintf("duplicate class %s", class.Name))
+			continue
+		}
+		classes[class.Name] = class
+	}
+
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		inherits := classes[name].Inherits
+		if inherits != "" && classes[inherits] == nil {
+			problems = append(problems, fmt.Sprintf("class %s inherits unknown class %s", name, inherits))
+			continue
+		}
+
+		// Only report a cycle from a class on it, so each is reported once per member
+		seen := map[string]bool{name: true}
+		for next := inherits; next != "" && classes[next] != nil; next = classes[next].Inherits {
+			if next == name {
+				problems = append(problems, fmt.Sprintf("class %s is in an inheritance cycle", name))
+				break
+			}
+			if seen[next] {
+				break
+			}
+			seen[next] = true
+		}
+	}
+
+	opers := make(map[string]bool)
+	for _, oper := range oc.Opers {
+		if oper.Name == "" {
+			problems = append(problems, "oper without a name")
+			continue
+		}
+		if opers[oper.Name] {
+			problems = append(problems, fmt.Sprintf("duplicate oper %s", oper.Name))
+		}
+		opers[oper.Name] = true
+		if classes[oper.Class] == nil {
+			problems = append(problems, fmt.Sprintf("oper %s uses unknown class %s", oper.Name, oper.Class))
+		}
+		if oper.CertFP != "" && !validCertFP(oper.CertFP) {
+			problems = append(problems, fmt.Sprintf("oper %s has an invalid certfp", oper.Name))
+		}
+		if oper.RequireCertFP && oper.CertFP == "" {
+			problems = append(problems, fmt.Sprintf("oper %s requires a certfp but has none", oper.Name))
+		}
+		if oper.Password == "" && oper.CertFP == "" {
+			problems = append(problems, fmt.Sprintf("oper %s has neither a password nor a certfp", oper.Name))
+		}
+		if oper.TOTPSecret != "" {
+			if _, err := decodeTOTPSecret(oper.TOTPSecret); err != nil {
+				problems = append(problems, fmt.Sprintf("oper %s has an invalid totp_secret", oper.Name))
+			}
+		}
+		if _, err := oper.ExpiresAt(); err != nil {
+			problems = append(problems, fmt.Sprintf("oper %s has an invalid expires date %q", oper.Name, oper.Expires))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid oper config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// loadOperConfig builds the operator configuration the server runs with:
+// opers.conf when it is enabled, otherwise the default classes, plus the opers
+// from the main config. A file that cannot be read or fails validation is an
+// error, so it never replaces a working configuration.
+func loadOperConfig(config *Config) (*OperConfig, error) {
+	var operConfig *OperConfig
+	if config.OperConfig.Enable {
+		loaded, err := LoadOperConfig(config.OperConfig.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := loaded.Validate(); err != nil {
+			return nil, err
+		}
+		operConfig = loaded
+	} else {
+		operConfig = DefaultOperConfig()
+		operConfig.Opers = nil
+	}
+
+	addConfigOpers(operConfig, config)
+	for _, oper := range operConfig.Opers {
+		if oper.Password != "" && !isPasswordHash(oper.Password) {
+			log.Printf("Warning: oper %s has a plain text password; generate a hash with 'techircd mkpasswd'", oper.Name)
+		}
+	}
+	return operConfig, nil
+}
+
+// touchOper records when an oper last opered up, both in the loaded oper
+// config and in the opers.conf file
+func (s *Server) touchOper(name string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	s.operSaveMu.Lock()
+	defer s.operSaveMu.Unlock()
+
+	// The loaded config is shared, so update a copy, and try again if a
+	// REHASH swapped it in the meantime
+	for {
+		current := s.OperConfig()
+		updated := *current
+		updated.Opers = append([]Oper(nil), current.Opers...)
+		oper := updated.GetOper(name)
+		if oper == nil {
+			break
+		}
+		oper.LastSeen = now
+		if s.operConfig.CompareAndSwap(current, &updated) {
+			break
+		}
+	}
+
+	if !s.config.OperConfig.Enable {
+		return
+	}
+	filename := s.config.OperConfig.ConfigFile
+	before, err := os.Stat(filename)
+	if err != nil {
+		log.Printf("Failed to record last_seen for oper %s: %v", name, err)
+		return
+	}
+	onDisk, err := LoadOperConfig(filename)
+	if err != nil {
+		log.Printf("Failed to record last_seen for oper %s: %v", name, err)
+		return
+	}
+	oper := onDisk.GetOper(name)
+	if oper == nil {
+		// Opers from the main config are not written to opers.conf
+		return
+	}
+	oper.LastSeen = now
+
+	// An admin editing the file meanwhile wins over a last_seen update
+	if after, err := os.Stat(filename); err != nil || !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		log.Printf("Not recording last_seen for oper %s: %s changed while it was updated", name, filename)
+		return
+	}
+	if err := SaveOperConfig(onDisk, filename); err != nil {
+		log.Printf("Failed to record last_seen for oper %s: %v", name, err)
+	}
+}
+
+// addConfigOpers adds the opers defined in the main config so their
+// permissions can be looked up by name. For an oper of the same name the
+// opers.conf block decides the permissions.
+func addConfigOpers(operConfig *OperConfig, config *Config) {
+	for _, oper := range config.Opers {
+		if operConfig.GetOper(oper.Name) != nil {
+			continue
+		}
+		operConfig.Opers = append(operConfig.Opers, Oper{
+			Name:     oper.Name,
+			Password: oper.Password,
+			Host:     oper.Host,
+			Class:    oper.Class,
+			Flags:    oper.Flags,
+		})
+	}
+}
+
+// OperConfig returns the operator configuration currently in use
+func (s *Server) OperConfig() *OperConfig {
+	return s.operConfig.Load()
+}
+
 // GetRankName returns the custom name for a rank level
 func (oc *OperConfig) GetRankName(rank int) string {
 	switch rank {
@@ -245,7 +682,18 @@ func (oc *OperConfig) CanOperateOn(oper1Name, oper2Name string) bool {
 	
 	// Higher rank can operate on lower rank
 	// Same rank cannot operate on each other (unless they have override permission)
-	return rank1 > rank2 || oc.HasPermission(oper1Name, "override_rank")
+	return rank1 > rank2 || oc.hasExplicitPermission(oper1Name, "override_rank")
+}
+
+// hasExplicitPermission checks for a permission that is listed by name; the
+// * wildcard does not grant it
+func (oc *OperConfig) hasExplicitPermission(operName, permission string) bool {
+	for _, perm := range oc.GetOperPermissions(operName) {
+		if perm == permission {
+			return true
+		}
+	}
+	return false
 }
 
 // DefaultOperConfig returns a default operator configuration
@@ -273,7 +721,7 @@ func DefaultOperConfig() *OperConfig {
 				Name:        "operator",
 				Rank:        3,
 				Description: "Operator - Server management commands",
-				Permissions: []string{"kill", "gline", "rehash", "connect", "squit", "wallops", "operwall"},
+				Permissions: []string{"kill", "kline", "gline", "zline", "rehash", "connect", "squit", "wallops", "operwall", "globalnotice", "trace", "stats"},
 				Inherits:    "moderator",
 				Color:       "red",
 				Symbol:      "*",
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOperConfigValidate(t *testing.T) {
+	if err := DefaultOperConfig().Validate(); err != nil {
+		t.Fatalf("default oper config is invalid: %v", err)
+	}
+
+	config := &OperConfig{
+		Classes: []OperClass{
+			{Name: "a", Inherits: "b"},
+			{Name: "b", Inherits: "a"},
+			{Name: "c", Inherits: "missing"},
+			{Name: "c"},
+		},
+		Opers: []Oper{
+			{Name: "x", Class: "a"},
+			{Name: "x", Class: "nope"},
+		},
+	}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("invalid oper config passed validation")
+	}
+	for _, want := range []string{
+		"duplicate class c",
+		"class a is in an inheritance cycle",
+		"class c inherits unknown class missing",
+		"duplicate oper x",
+		"oper x uses unknown class nope",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+}
+
+func TestClassPermissionsFollowInheritance(t *testing.T) {
+	config := &OperConfig{
+		Classes: []OperClass{
+			{Name: "helper", Permissions: []string{"kick"}},
+			{Name: "moderator", Permissions: []string{"ban"}, Inherits: "helper"},
+			{Name: "operator", Permissions: []string{"kill"}, Inherits: "moderator"},
+		},
+		Opers: []Oper{{Name: "op", Class: "operator"}},
+	}
+
+	for _, perm := range []string{"kill", "ban", "kick"} {
+		if !config.HasPermission("op", perm) {
+			t.Errorf("operator class should have %s", perm)
+		}
+	}
+	if config.HasPermission("op", "rehash") || config.HasPermission("nobody", "kick") {
+		t.Error("permission granted that was never configured")
+	}
+}
+
+func TestCustomRanksSkipComments(t *testing.T) {
+	config, err := LoadOperConfig("configs/opers.conf")
+	if err != nil {
+		t.Fatalf("example opers.conf does not load: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("example opers.conf is invalid: %v", err)
+	}
+	if _, ok := config.RankNames.CustomRanks["_comment"]; ok {
+		t.Error("custom_ranks comment was read as a rank")
+	}
+	if config.RankNames.CustomRanks["God Emperor"] != 15 {
+		t.Errorf("custom rank lost: %v", config.RankNames.CustomRanks)
+	}
+}
+
+func TestCanOperateOnRanks(t *testing.T) {
+	config := DefaultOperConfig()
+	config.Opers = []Oper{
+		{Name: "op", Class: "operator"},
+		{Name: "admin1", Class: "admin"},
+		{Name: "admin2", Class: "admin"},
+		{Name: "owner", Class: "owner"},
+	}
+
+	if !config.CanOperateOn("admin1", "op") || config.CanOperateOn("op", "admin1") {
+		t.Error("rank order not respected")
+	}
+	if config.CanOperateOn("admin1", "admin2") {
+		t.Error("the * wildcard should not grant override_rank")
+	}
+	if !config.CanOperateOn("owner", "owner") {
+		t.Error("an explicit override_rank should bypass rank checks")
+	}
+}
+
+func TestOperConfigValidateCertFP(t *testing.T) {
+	config := DefaultOperConfig()
+	config.Opers = []Oper{
+		{Name: "cert", Class: "admin", Host: "*@*", CertFP: "40:F5:10:D2:36:83:F6:27:3E:A6:30:DD:A8:9C:26:15:E7:7D:83:44:B2:93:A2:E7:67:8B:8E:CE:A2:6F:97:C2"},
+		{Name: "short", Class: "admin", Password: "x", CertFP: "abcd"},
+		{Name: "strict", Class: "admin", Password: "x", RequireCertFP: true},
+		{Name: "nothing", Class: "admin"},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("invalid certfp settings passed validation")
+	}
+	for _, want := range []string{
+		"oper short has an invalid certfp",
+		"oper strict requires a certfp but has none",
+		"oper nothing has neither a password nor a certfp",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "oper cert ") {
+		t.Errorf("a colon separated fingerprint was rejected: %v", err)
+	}
+}
+
+func TestOperExpiry(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		expires string
+		expired bool
+	}{
+		{"", false},
+		{"2025-06-15", false},
+		{"2025-06-14", true},
+		{"2025-06-15T11:00:00Z", true},
+		{"2025-06-15T13:00:00Z", false},
+	} {
+		oper := &Oper{Expires: tt.expires}
+		if got := oper.Expired(now); got != tt.expired {
+			t.Errorf("Expired(%q) = %v, want %v", tt.expires, got, tt.expired)
+		}
+	}
+
+	if _, err := (&Oper{Expires: "next tuesday"}).ExpiresAt(); err == nil {
+		t.Error("invalid expiry accepted")
+	}
+}
+
+func TestSaveOperConfigKeepsComments(t *testing.T) {
+	config, err := LoadOperConfig("configs/opers.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "opers.conf")
+	if err := SaveOperConfig(config, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "_comment") {
+		t.Error("custom_ranks comment was dropped on save")
+	}
+	saved, err := LoadOperConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.RankNames.CustomRanks["God Emperor"] != 15 || len(saved.Opers) != len(config.Opers) {
+		t.Error("saved oper config does not match the original")
+	}
+}
+
+func TestTouchOperPersistsLastSeen(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "opers.conf")
+	original := `{
+  "comment": "kept by hand",
+  "classes": [
+    {"name": "admin", "rank": 4, "permissions": ["*"], "note": "class note"}
+  ],
+  "opers": [
+    {"name": "admin", "class": "admin", "host": "*@*", "password": "secret", "contact": "admin@example.org"}
+  ],
+  "settings": {"log_oper_actions": false}
+}`
+	if err := os.WriteFile(filename, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, func(config *Config) {
+		config.OperConfig.Enable = true
+		config.OperConfig.ConfigFile = filename
+	})
+	s.touchOper("admin")
+
+	seen := s.OperConfig().GetOper("admin").LastSeen
+	if seen == "" {
+		t.Fatal("last_seen not updated in the loaded config")
+	}
+	saved, err := LoadOperConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.GetOper("admin").LastSeen; got != seen {
+		t.Errorf("last_seen in opers.conf = %q, want %q", got, seen)
+	}
+
+	data, _ := os.ReadFile(filename)
+	for _, key := range []string{`"comment": "kept by hand"`, `"note": "class note"`, `"contact": "admin@example.org"`} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("opers.conf lost %s:\n%s", key, data)
+		}
+	}
+	if strings.Index(string(data), `"comment"`) > strings.Index(string(data), `"classes"`) {
+		t.Errorf("opers.conf keys were reordered:\n%s", data)
+	}
+	if info, _ := os.Stat(filename); info.Mode().Perm() != 0644 {
+		t.Errorf("opers.conf mode changed to %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RPL_STATSCOMMANDS reports the usage of one command for STATS m
+const RPL_STATSCOMMANDS = 212
+
+// CommandHandler runs a command sent by a local client
+type CommandHandler func(c *Client, msg *Message)
+
+// Command describes a client command and what is required to use it. The
+// dispatcher checks the requirements before the handler runs, so handlers
+// only deal with the command itself.
+type Command struct {
+	Name            string
+	Handler         CommandHandler
+	MinParams       int    // Fewer parameters are answered with ERR_NEEDMOREPARAMS
+	PreRegistration bool   // Allowed before registration; other commands get ERR_NOTREGISTERED
+	Oper            bool   // Only IRC operators may use it
+	Permission      string // Oper permission needed, checked with HasOperPermission
+	Penalty         int    // Extra flood cost on top of the line itself
+
+	uses  uint64 // Times the command was received
+	bytes uint64 // Bytes received in those lines
+}
+
+// Uses returns how many times the command was received and how many bytes
+// those lines held
+func (cmd *Command) Uses() (count, bytes uint64) {
+	return atomic.LoadUint64(&cmd.uses), atomic.LoadUint64(&cmd.bytes)
+}
+
+// CommandRegistry holds every command the server accepts from clients
+type CommandRegistry struct {
+	commands map[string]*Command
+	mu       sync.RWMutex
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		commands: make(map[string]*Command),
+	}
+}
+
+// Get returns the named command, or nil if there is no such command
+func (r *CommandRegistry) Get(name string) *Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.commands[name]
+}
+
+// List returns all commands sorted by name
+func (r *CommandRegistry) List() []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	commands := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// RegisterCommand adds a command to the server. Command names are upper case
+// and may only be registered once.
+func (s *Server) RegisterCommand(cmd *Command) error {
+	if cmd.Name == "" || cmd.Handler == nil {
+		return fmt.Errorf("command needs a name and a handler")
+	}
+	if cmd.Name != strings.ToUpper(cmd.Name) {
+		return fmt.Errorf("command name %s must be upper case", cmd.Name)
+	}
+
+	s.commands.mu.Lock()
+	defer s.commands.mu.Unlock()
+	if _, exists := s.commands.commands[cmd.Name]; exists {
+		return fmt.Errorf("command %s is already registered", cmd.Name)
+	}
+	s.commands.commands[cmd.Name] = cmd
+	return nil
+}
+
+// dispatch checks a command's requirements and runs it
+func (s *Server) dispatch(client *Client, msg *Message, size int) {
+	cmd := s.commands.Get(msg.Command)
+	if cmd == nil {
+		client.SendNumeric(ERR_UNKNOWNCOMMAND, msg.Command+" :Unknown command")
+		return
+	}
+	atomic.AddUint64(&cmd.uses, 1)
+	atomic.AddUint64(&cmd.bytes, uint64(size))
+
+	if label, ok := msg.Tag("label"); ok && label != "" && client.HasCapability("labeled-response") {
+		client.startLabel(label)
+		defer client.endLabel()
+	}
+
+	if !cmd.PreRegistration && !client.IsRegistered() {
+		client.SendNumeric(ERR_NOTREGISTERED, ":You have not registered")
+		return
+	}
+	if cmd.Oper && !client.IsOper() {
+		client.SendNumeric(ERR_NOPRIVILEGES, ":Permission Denied- You're not an IRC operator")
+		return
+	}
+	if cmd.Permission != "" && !client.HasOperPermission(cmd.Permission) {
+		client.SendNumeric(ERR_NOPRIVILEGES, fmt.Sprintf(":Permission Denied - You need %s permission", cmd.Permission))
+		if client.IsOper() {
+			target := ""
+			if len(msg.Params) > 0 {
+				target = msg.Params[0]
+			}
+			client.audit(cmd.Name, target, "denied", "needs "+cmd.Permission)
+		}
+		return
+	}
+	if len(msg.Params) < cmd.MinParams {
+		client.SendNumeric(ERR_NEEDMOREPARAMS, msg.Command+" :Not enough parameters")
+		return
+	}
+
+	cmd.Handler(client, msg)
+	if cmd.Penalty > 0 {
+		client.addFloodPenalty(cmd.Penalty)
+	}
+}
+
+// registerBuiltinCommands registers the commands the server itself provides
+func (s *Server) registerBuiltinCommands() {
+	builtin := []*Command{
+		// Connection registration
+		{Name: "CAP", Handler: (*Client).handleCap, MinParams: 1, PreRegistration: true},
+		{Name: "AUTHENTICATE", Handler: (*Client).handleAuthenticate, MinParams: 1, PreRegistration: true, Penalty: 1},
+		{Name: "PASS", Handler: (*Client).handlePass, MinParams: 1, PreRegistration: true},
+		{Name: "NICK", Handler: (*Client).handleNick, MinParams: 1, PreRegistration: true},
+		{Name: "USER", Handler: (*Client).handleUser, MinParams: 4, PreRegistration: true},
+		{Name: "PING", Handler: (*Client).handlePing, PreRegistration: true},
+		{Name: "PONG", Handler: (*Client).handlePong, PreRegistration: true},
+		{Name: "QUIT", Handler: (*Client).handleQuit, PreRegistration: true},
+
+		// Server links
+		{Name: "SERVER", Handler: (*Client).handleServer, PreRegistration: true},
+		{Name: "CAPAB", Handler: handleLinkNegotiation, PreRegistration: true},
+		{Name: "SVINFO", Handler: handleLinkNegotiation, PreRegistration: true},
+		{Name: "CONNECT", Handler: (*Client).handleConnect, MinParams: 1, Permission: "connect"},
+		{Name: "SQUIT", Handler: (*Client).handleSquit, MinParams: 1, Permission: "squit"},
+		{Name: "LINKS", Handler: (*Client).handleLinks, Penalty: 1},
+		{Name: "MAP", Handler: (*Client).handleMap, Penalty: 1},
+
+		// Channels and messages
+		{Name: "JOIN", Handler: (*Client).handleJoin, MinParams: 1},
+		{Name: "PART", Handler: (*Client).handlePart, MinParams: 1},
+		{Name: "MODE", Handler: (*Client).handleMode, MinParams: 1},
+		{Name: "TOPIC", Handler: (*Client).handleTopic, MinParams: 1},
+		{Name: "KICK", Handler: (*Client).handleKick, MinParams: 2},
+		{Name: "INVITE", Handler: (*Client).handleInvite, MinParams: 2, Penalty: 1},
+		{Name: "NAMES", Handler: (*Client).handleNames, Penalty: 1},
+		{Name: "LIST", Handler: (*Client).handleList, Penalty: 2},
+		{Name: "PRIVMSG", Handler: (*Client).handlePrivmsg},
+		{Name: "NOTICE", Handler: (*Client).handleNotice},
+		{Name: "TAGMSG", Handler: (*Client).handleTagmsg, MinParams: 1},
+		{Name: "AWAY", Handler: (*Client).handleAway},
+		{Name: "SETNAME", Handler: (*Client).handleSetname, MinParams: 1, Penalty: 1},
+		{Name: "CHATHISTORY", Handler: (*Client).handleChatHistory, MinParams: 1, Penalty: 1},
+		{Name: "MONITOR", Handler: (*Client).handleMonitor, MinParams: 1, Penalty: 1},
+		{Name: "WATCH", Handler: (*Client).handleWatch, Penalty: 1},
+
+		// User queries
+		{Name: "WHO", Handler: (*Client).handleWho, MinParams: 1, Penalty: 1},
+		{Name: "WHOIS", Handler: (*Client).handleWhois, MinParams: 1, Penalty: 1},
+		{Name: "STATS", Handler: (*Client).handleStats, MinParams: 1, Penalty: 1},
+
+		// Services shortcuts
+		{Name: "NICKSERV", Handler: serviceAlias("NickServ")},
+		{Name: "NS", Handler: serviceAlias("NickServ")},
+		{Name: "CHANSERV", Handler: serviceAlias("ChanServ")},
+		{Name: "CS", Handler: serviceAlias("ChanServ")},
+
+		// Operator commands
+		{Name: "OPER", Handler: (*Client).handleOper, MinParams: 1},
+		{Name: "SNOMASK", Handler: (*Client).handleSnomask, Oper: true},
+		{Name: "PRIVS", Handler: (*Client).handlePrivs, Oper: true},
+		{Name: "OPERINFO", Handler: (*Client).handlePrivs, Oper: true},
+		{Name: "GLOBALNOTICE", Handler: (*Client).handleGlobalNotice, MinParams: 1, Permission: "globalnotice"},
+		{Name: "OPERWALL", Handler: (*Client).handleOperWall, MinParams: 1, Permission: "operwall"},
+		{Name: "WALLOPS", Handler: (*Client).handleWallops, MinParams: 1, Permission: "wallops"},
+		{Name: "REHASH", Handler: (*Client).handleRehash, Permission: "rehash"},
+		{Name: "TRACE", Handler: (*Client).handleTrace, Permission: "trace"},
+		{Name: "KILL", Handler: (*Client).handleKill, MinParams: 1, Permission: "kill"},
+		{Name: "SPY", Handler: (*Client).handleSpy, Permission: "spy"},
+		{Name: "CHGHOST", Handler: (*Client).handleChghost, MinParams: 2, Permission: "chghost"},
+		{Name: "AUDIT", Handler: (*Client).handleAudit, Permission: "audit"},
+	}
+
+	for name, spec := range banCommands {
+		builtin = append(builtin,
+			&Command{Name: name, Handler: (*Client).handleServerBan, MinParams: 1, Permission: spec.permission},
+			&Command{Name: "UN" + name, Handler: (*Client).handleServerUnban, MinParams: 1, Permission: spec.permission})
+	}
+
+	for _, cmd := range builtin {
+		if err := s.RegisterCommand(cmd); err != nil {
+			log.Fatalf("Failed to register built-in command: %v", err)
+		}
+	}
+}
+
+// handleLinkNegotiation accepts the link capability lines sent during a
+// server handshake; there is nothing to negotiate yet
+func handleLinkNegotiation(c *Client, msg *Message) {}
+
+// serviceAlias returns a handler passing a command such as NS to a service
+func serviceAlias(bot string) CommandHandler {
+	return func(c *Client, msg *Message) {
+		c.handleServiceAlias(bot, msg)
+	}
+}
+
+// sendCommandStats lists command usage for STATS m
+func (c *Client) sendCommandStats() {
+	for _, cmd := range c.server.commands.List() {
+		count, bytes := cmd.Uses()
+		if count == 0 {
+			continue
+		}
+		c.SendNumeric(RPL_STATSCOMMANDS, fmt.Sprintf("%s %d %d 0", cmd.Name, count, bytes))
+	}
+}
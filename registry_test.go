@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	s := newTestServer(t)
+	handler := func(c *Client, msg *Message) {}
+
+	if err := s.RegisterCommand(&Command{Name: "PRIVMSG", Handler: handler}); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Errorf("duplicate name: %v", err)
+	}
+	if err := s.RegisterCommand(&Command{Name: "Hello", Handler: handler}); err == nil || !strings.Contains(err.Error(), "upper case") {
+		t.Errorf("lower case name: %v", err)
+	}
+	if err := s.RegisterCommand(&Command{Name: "HELLO"}); err == nil {
+		t.Error("command without a handler was registered")
+	}
+	if err := s.RegisterCommand(&Command{Name: "HELLO", Handler: handler}); err != nil {
+		t.Errorf("RegisterCommand: %v", err)
+	}
+	if s.commands.Get("HELLO") == nil || s.commands.Get("Hello") != nil {
+		t.Error("registered command not found by its name")
+	}
+}
+
+func TestDispatchRequirements(t *testing.T) {
+	s := newTestServer(t)
+	operConfig := &OperConfig{
+		Classes: []OperClass{{Name: "helper", Permissions: []string{"kick"}}},
+		Opers:   []Oper{{Name: "helper", Class: "helper"}},
+	}
+	operConfig.Settings.LogOperActions = true
+	s.operConfig.Store(operConfig)
+
+	ran := make(chan string, 10)
+	for _, cmd := range []*Command{
+		{Name: "TESTANY", MinParams: 2},
+		{Name: "TESTOPER", Oper: true},
+		{Name: "TESTPERM", Permission: "rehash"},
+	} {
+		name := cmd.Name
+		cmd.Handler = func(c *Client, msg *Message) { ran <- name }
+		if err := s.RegisterCommand(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc := dialTest(t, s)
+	tc.send("TESTANY a b")
+	tc.expect(" 451 ")
+
+	tc = registerTest(t, s, "user")
+	tc.send("TESTANY a")
+	tc.expect(" 461 user TESTANY :Not enough parameters")
+	tc.send("TESTOPER", "TESTPERM")
+	tc.expect(" 481 ")
+	tc.expect(" 481 ")
+	tc.send("NOSUCHCOMMAND")
+	tc.expect(" 421 ")
+	if len(ran) != 0 {
+		t.Fatalf("handler ran without its requirements: %s", <-ran)
+	}
+
+	// An oper passes the oper gate, and a denied permission is audited
+	client := s.GetClient("user")
+	client.mu.Lock()
+	client.oper, client.operName, client.operClass = true, "helper", "helper"
+	client.mu.Unlock()
+	tc.send("TESTOPER", "TESTPERM target")
+	if line := tc.expect(" 481 "); !strings.Contains(line, "You need rehash permission") {
+		t.Errorf("permission denial: %q", line)
+	}
+	tc.send("TESTANY a b")
+	tc.sync()
+	if got := []string{<-ran, <-ran}; got[0] != "TESTOPER" || got[1] != "TESTANY" || len(ran) != 0 {
+		t.Errorf("handlers ran: %v", got)
+	}
+
+	entries, err := s.audit.Search(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Command != "TESTPERM" || entries[0].Target != "target" || entries[0].Outcome != "denied" || entries[0].Oper != "helper" {
+		t.Errorf("audit entries: %+v", entries)
+	}
+
+	// STATS m counts every use, including rejected ones
+	tc.send("STATS m")
+	lines := tc.readUntil(" 219 ")
+	for _, want := range []string{" 212 user TESTANY 3 ", " 212 user TESTOPER 2 ", " 212 user TESTPERM 2 "} {
+		if len(containing(lines, want)) != 1 {
+			t.Errorf("STATS m has no %q: %q", want, lines)
+		}
+	}
+	if len(containing(lines, "NOSUCHCOMMAND")) != 0 {
+		t.Errorf("unknown command counted: %q", lines)
+	}
+}
+
+func TestKillRanks(t *testing.T) {
+	s := newTestServer(t)
+	admin1 := registerTest(t, s, "admin1")
+	operTest(t, s, admin1, "admin1", "admin")
+	admin2 := registerTest(t, s, "admin2")
+	operTest(t, s, admin2, "admin2", "admin")
+
+	// An equal rank is refused, even with the * wildcard, and audited
+	admin1.send("KILL admin2 :bye")
+	if line := admin1.expect(" 481 "); !strings.Contains(line, "admin2 has an equal or higher rank") {
+		t.Errorf("equal rank KILL: %q", line)
+	}
+	if s.GetClient("admin2") == nil {
+		t.Fatal("an equal rank oper was killed")
+	}
+	kills := func(target string) []AuditEntry {
+		entries, _ := s.audit.Search(AuditFilter{Target: target})
+		var found []AuditEntry
+		for _, entry := range entries {
+			if entry.Command == "KILL" {
+				found = append(found, entry)
+			}
+		}
+		return found
+	}
+	entries := kills("admin2")
+	if len(entries) != 1 || entries[0].Outcome != "denied" || entries[0].Oper != "admin1" {
+		t.Errorf("audit of the refused KILL: %+v", entries)
+	}
+
+	// override_rank lets an owner kill another owner
+	owner1 := registerTest(t, s, "owner1")
+	operTest(t, s, owner1, "owner1", "owner")
+	owner2 := registerTest(t, s, "owner2")
+	operTest(t, s, owner2, "owner2", "owner")
+	owner1.send("KILL owner2 :bye")
+	owner2.expect("ERROR")
+	eventually(t, "owner2 removed", func() bool { return s.GetClient("owner2") == nil })
+	entries = kills("owner2")
+	if len(entries) != 1 || entries[0].Outcome != "ok" || entries[0].Oper != "owner1" || entries[0].Detail != "bye" {
+		t.Errorf("audit of the KILL: %+v", entries)
+	}
+}
+
+func TestPrivs(t *testing.T) {
+	s := newTestServer(t)
+	current := s.OperConfig()
+	updated := *current
+	updated.Opers = append(append([]Oper(nil), current.Opers...), Oper{Name: "op", Class: "operator", Host: "*@*", Password: "operpass", Flags: []string{"spy"}})
+	s.operConfig.Store(&updated)
+
+	tc := registerTest(t, s, "op")
+	tc.send("OPER op operpass")
+	tc.expect(" 381 ")
+	tc.send("PRIVS")
+	lines := tc.sync()
+
+	if got := containing(lines, "*** Opered as op, class operator (Operator, rank 3)"); len(got) != 1 {
+		t.Errorf("PRIVS header: %q", lines)
+	}
+	var privs []string
+	for _, line := range containing(lines, " 270 op op :") {
+		privs = append(privs, strings.Fields(line[strings.Index(line, " :")+2:])...)
+	}
+	// The class's own permissions, those inherited from moderator and
+	// helper, and the oper's flags, each once
+	want := []string{"ban", "connect", "gline", "globalnotice", "kick", "kill", "kline", "mode_channel", "mode_user", "mute", "operwall", "rehash", "spy", "squit", "stats", "topic", "trace", "unban", "wallops", "who_override", "zline"}
+	if strings.Join(privs, " ") != strings.Join(want, " ") {
+		t.Errorf("PRIVS lists %v, want %v (%q)", privs, want, lines)
+	}
+	if n := len(containing(lines, " 270 ")); n != 2 {
+		t.Errorf("PRIVS sent %d lines, want 2 of at most 15", n)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SASL numerics (IRCv3 sasl-3.1)
+const (
+	RPL_LOGGEDIN    = 900
+	RPL_LOGGEDOUT   = 901
+	RPL_SASLSUCCESS = 903
+	ERR_SASLFAIL    = 904
+	ERR_SASLTOOLONG = 905
+	ERR_SASLABORTED = 906
+	ERR_SASLALREADY = 907
+	RPL_SASLMECHS   = 908
+)
+
+const (
+	saslChunkSize    = 400  // Maximum size of a single AUTHENTICATE payload
+	saslMaxDataSize  = 8192 // Maximum size of a reassembled payload
+	saslMechanisms   = "PLAIN,EXTERNAL"
+	saslEmptyPayload = "+"
+)
+
+// Repeated failed logins lock the address and the account name, so
+// passwords cannot be guessed and every guess costs a hash comparison
+const (
+	accountMaxFailures     = 5
+	accountLockoutDuration = 5 * time.Minute
+)
+
+// AccountStore verifies credentials for SASL and services logins
+type AccountStore interface {
+	// Authenticate checks a password and returns the canonical account name
+	Authenticate(account, password string) (string, bool)
+	// AccountForCertfp returns the account a TLS certificate fingerprint belongs to
+	AccountForCertfp(fingerprint string) (string, bool)
+}
+
+// SetAccountStore installs the account store used for SASL and advertises
+// the sasl capability while one is available
+func (s *Server) SetAccountStore(store AccountStore) {
+	s.mu.Lock()
+	s.accounts = store
+	s.mu.Unlock()
+
+	if store != nil {
+		s.RegisterCapability("sasl", saslMechanisms)
+	} else {
+		s.UnregisterCapability("sasl")
+	}
+}
+
+// AccountStore returns the installed account store, or nil
+func (s *Server) AccountStore() AccountStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.accounts
+}
+
+// CertFP returns the hex SHA-256 fingerprint of the client's TLS
+// certificate, or "" if the client did not present one
+func (c *Client) CertFP() string {
+	c.mu.RLock()
+	certfp := c.certfp
+	c.mu.RUnlock()
+	if certfp != "" {
+		return certfp
+	}
+
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	certfp = hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	c.certfp = certfp
+	c.mu.Unlock()
+	return certfp
+}
+
+// normalizeCertFP puts a fingerprint in the form CertFP returns: lower case
+// hex without separators
+func normalizeCertFP(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// validCertFP returns true for a SHA-256 fingerprint in hex, with or without
+// colon separators
+func validCertFP(fingerprint string) bool {
+	decoded, err := hex.DecodeString(normalizeCertFP(fingerprint))
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// loginAs marks the client as logged in to an account and tells it so
+func (c *Client) loginAs(account string) {
+	c.SetAccount(account)
+	c.notifyAccount(account)
+	c.SendNumeric(RPL_LOGGEDIN, fmt.Sprintf("%s!%s@%s %s :You are now logged in as %s",
+		c.displayNick(), c.User(), c.DisplayHost(), account, account))
+
+	c.SetMode('r', true)
+	if c.IsRegistered() {
+		c.SendMessage(fmt.Sprintf(":%s MODE %s :+r", c.Nick(), c.Nick()))
+	}
+}
+
+// logout clears the client's account and tells it so
+func (c *Client) logout() {
+	c.SetAccount("")
+	c.notifyAccount("")
+	c.SendNumeric(RPL_LOGGEDOUT, fmt.Sprintf("%s!%s@%s :You are now logged out", c.displayNick(), c.User(), c.DisplayHost()))
+
+	if c.HasMode('r') {
+		c.SetMode('r', false)
+		c.SendMessage(fmt.Sprintf(":%s MODE %s :-r", c.Nick(), c.Nick()))
+	}
+}
+
+func (c *Client) resetSASL() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saslMech = ""
+	c.saslData = ""
+}
+
+// handleAuthenticate handles AUTHENTICATE command (SASL)
+func (c *Client) handleAuthenticate(msg *Message) {
+	store := c.server.AccountStore()
+	if store == nil || !c.HasCapability("sasl") {
+		c.SendNumeric(ERR_SASLFAIL, ":SASL authentication failed")
+		return
+	}
+
+	if c.Account() != "" {
+		c.SendNumeric(ERR_SASLALREADY, ":You have already authenticated using SASL")
+		return
+	}
+
+	param := msg.Params[0]
+	if param == "*" {
+		c.resetSASL()
+		c.SendNumeric(ERR_SASLABORTED, ":SASL authentication aborted")
+		return
+	}
+
+	c.mu.RLock()
+	mech := c.saslMech
+	c.mu.RUnlock()
+
+	// First message selects the mechanism
+	if mech == "" {
+		mech = strings.ToUpper(param)
+		if mech != "PLAIN" && mech != "EXTERNAL" {
+			c.SendNumeric(RPL_SASLMECHS, saslMechanisms+" :are available SASL mechanisms")
+			c.SendNumeric(ERR_SASLFAIL, ":SASL authentication failed")
+			return
+		}
+		c.mu.Lock()
+		c.saslMech = mech
+		c.mu.Unlock()
+		c.SendMessage("AUTHENTICATE +")
+		return
+	}
+
+	if len(param) > saslChunkSize {
+		c.resetSASL()
+		c.SendNumeric(ERR_SASLTOOLONG, ":SASL message too long")
+		return
+	}
+
+	c.mu.Lock()
+	if param != saslEmptyPayload {
+		c.saslData += param
+	}
+	data := c.saslData
+	c.mu.Unlock()
+
+	if len(data) > saslMaxDataSize {
+		c.resetSASL()
+		c.SendNumeric(ERR_SASLTOOLONG, ":SASL message too long")
+		return
+	}
+
+	// A full-size chunk means more data follows
+	if len(param) == saslChunkSize {
+		return
+	}
+
+	c.resetSASL()
+
+	payload, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		c.SendNumeric(ERR_SASLFAIL, ":SASL authentication failed")
+		return
+	}
+
+	var account string
+	var ok bool
+	switch mech {
+	case "PLAIN":
+		account, ok = c.saslPlain(store, payload)
+	case "EXTERNAL":
+		account, ok = c.saslExternal(store, payload)
+	}
+
+	if !ok {
+		c.SendNumeric(ERR_SASLFAIL, ":SASL authentication failed")
+		c.server.sendSnomask('d', fmt.Sprintf("Failed SASL %s authentication from %s", mech, c.Host()))
+		return
+	}
+
+	c.loginAs(account)
+	c.SendNumeric(RPL_SASLSUCCESS, ":SASL authentication successful")
+}
+
+// checkAccountPassword verifies an account password for SASL PLAIN and
+// NickServ. Failures are counted per address and account name as for OPER;
+// while either is locked out the password is not checked and the time left
+// is returned instead.
+func (c *Client) checkAccountPassword(store AccountStore, name, password string) (string, bool, time.Duration) {
+	lockout := c.server.authLockout
+	host, now := c.Host(), time.Now()
+	if left := lockout.Locked(name, host, now); left > 0 {
+		return "", false, left
+	}
+
+	account, ok := store.Authenticate(name, password)
+	if !ok {
+		if lockout.Fail(name, host, accountMaxFailures, accountLockoutDuration, now) {
+			c.server.sendSnomask('d', fmt.Sprintf("Logins to %s and from %s locked for %s after %d failed attempts",
+				name, host, formatDuration(accountLockoutDuration), accountMaxFailures))
+		}
+		return "", false, 0
+	}
+	lockout.Succeed(name, host)
+	return account, true, 0
+}
+
+// saslPlain verifies a PLAIN payload: authzid NUL authcid NUL password
+func (c *Client) saslPlain(store AccountStore, payload []byte) (string, bool) {
+	fields := bytes.Split(payload, []byte{0})
+	if len(fields) != 3 {
+		return "", false
+	}
+
+	authzid, authcid, password := string(fields[0]), string(fields[1]), string(fields[2])
+	if authzid != "" && !strings.EqualFold(authzid, authcid) {
+		return "", false
+	}
+
+	account, ok, left := c.checkAccountPassword(store, authcid, password)
+	if left > 0 {
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Too many failed attempts, try again in %s",
+			c.server.config.Server.Name, c.displayNick(), formatDuration(left)))
+	}
+	return account, ok
+}
+
+// saslExternal verifies the client's TLS certificate fingerprint
+func (c *Client) saslExternal(store AccountStore, payload []byte) (string, bool) {
+	certfp := c.CertFP()
+	if certfp == "" {
+		return "", false
+	}
+
+	account, ok := store.AccountForCertfp(certfp)
+	if !ok {
+		return "", false
+	}
+
+	// An optional authzid must name the certificate's own account
+	if authzid := string(payload); authzid != "" && !strings.EqualFold(authzid, account) {
+		return "", false
+	}
+	return account, true
+}
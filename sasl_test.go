@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testAccounts is an AccountStore with fixed passwords and certificates
+type testAccounts struct {
+	passwords map[string]string // Account -> password
+	certs     map[string]string // Fingerprint -> account
+}
+
+func (a testAccounts) Authenticate(account, password string) (string, bool) {
+	for name, want := range a.passwords {
+		if strings.EqualFold(name, account) && password == want {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (a testAccounts) AccountForCertfp(fingerprint string) (string, bool) {
+	account, ok := a.certs[fingerprint]
+	return account, ok
+}
+
+// saslTest returns an unregistered client that negotiated sasl against a
+// server with the given accounts
+func saslTest(t *testing.T, accounts testAccounts) (*Server, *testConn) {
+	s := newTestServer(t)
+	s.SetAccountStore(accounts)
+
+	tc := dialTest(t, s)
+	tc.send("CAP LS 302", "CAP REQ :sasl", "NICK sasl", "USER sasl 0 * :SASL")
+	tc.expect("ACK :sasl")
+	return s, tc
+}
+
+func plainPayload(authzid, authcid, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(authzid + "\x00" + authcid + "\x00" + password))
+}
+
+func TestSASLPlain(t *testing.T) {
+	_, tc := saslTest(t, testAccounts{passwords: map[string]string{"Alice": "secret"}})
+
+	tc.send("AUTHENTICATE PLAIN")
+	if line := tc.expect("AUTHENTICATE"); line != "AUTHENTICATE +" {
+		t.Errorf("mechanism accepted with %q", line)
+	}
+	tc.send("AUTHENTICATE " + plainPayload("", "alice", "secret"))
+	if line := tc.expect(" 900 "); !strings.Contains(line, " Alice :You are now logged in as Alice") {
+		t.Errorf("logged in with %q", line)
+	}
+	tc.expect(" 903 ")
+
+	tc.send("AUTHENTICATE PLAIN")
+	tc.expect(" 907 ")
+
+	// Registration still waits for CAP END
+	tc.send("CAP END")
+	tc.expect(" 001 sasl ")
+}
+
+func TestSASLPlainFailures(t *testing.T) {
+	_, tc := saslTest(t, testAccounts{passwords: map[string]string{"alice": "secret", "bob": "hunter2"}})
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"wrong password", plainPayload("", "alice", "wrong")},
+		{"authzid of another account", plainPayload("bob", "alice", "secret")},
+		{"missing field", base64.StdEncoding.EncodeToString([]byte("alice\x00secret"))},
+		{"invalid base64", "not*base64"},
+	}
+	for _, tt := range tests {
+		tc.send("AUTHENTICATE PLAIN")
+		tc.expect("AUTHENTICATE +")
+		tc.send("AUTHENTICATE " + tt.payload)
+		if lines := tc.sync(); len(containing(lines, " 904 ")) != 1 || len(containing(lines, " 900 ")) != 0 {
+			t.Errorf("%s: got %q", tt.name, lines)
+		}
+	}
+
+	// An authzid naming the same account is allowed
+	tc.send("AUTHENTICATE PLAIN", "AUTHENTICATE "+plainPayload("ALICE", "alice", "secret"))
+	tc.expect(" 903 ")
+}
+
+// countingAccounts counts the password checks made against an account store
+type countingAccounts struct {
+	testAccounts
+	checks *atomic.Int32
+}
+
+func (a countingAccounts) Authenticate(account, password string) (string, bool) {
+	a.checks.Add(1)
+	return a.testAccounts.Authenticate(account, password)
+}
+
+func TestSASLPlainLockout(t *testing.T) {
+	s := newTestServer(t)
+	accounts := countingAccounts{testAccounts{passwords: map[string]string{"alice": "secret"}}, new(atomic.Int32)}
+	s.SetAccountStore(accounts)
+	connect := func() *testConn {
+		tc := dialTest(t, s)
+		tc.send("CAP LS 302", "CAP REQ :sasl", "NICK sasl", "USER sasl 0 * :SASL")
+		tc.expect("ACK :sasl")
+		return tc
+	}
+
+	tc := connect()
+	for i := 0; i < accountMaxFailures; i++ {
+		tc.send("AUTHENTICATE PLAIN", "AUTHENTICATE "+plainPayload("", "alice", "wrong"))
+		tc.expect(" 904 ")
+	}
+
+	// Once locked, not even the right password is checked, from this
+	// connection or another one from the same address
+	for _, tc := range []*testConn{tc, connect()} {
+		tc.send("AUTHENTICATE PLAIN", "AUTHENTICATE "+plainPayload("", "alice", "secret"))
+		tc.expect("Too many failed attempts")
+		if lines := tc.sync(); len(containing(lines, " 904 ")) != 1 || len(containing(lines, " 900 ")) != 0 {
+			t.Errorf("locked out login: %q", lines)
+		}
+	}
+	if got := accounts.checks.Load(); got != accountMaxFailures {
+		t.Errorf("%d password checks, want %d", got, accountMaxFailures)
+	}
+}
+
+func TestSASLChunking(t *testing.T) {
+	// 600 bytes encode to exactly two full 400 byte chunks
+	password := strings.Repeat("p", 600-len("\x00alice\x00"))
+	_, tc := saslTest(t, testAccounts{passwords: map[string]string{"alice": password}})
+
+	payload := plainPayload("", "alice", password)
+	if len(payload) != 2*saslChunkSize {
+		t.Fatalf("payload is %d bytes", len(payload))
+	}
+
+	tc.send("AUTHENTICATE PLAIN")
+	tc.expect("AUTHENTICATE +")
+	tc.send("AUTHENTICATE "+payload[:saslChunkSize], "AUTHENTICATE "+payload[saslChunkSize:])
+	if lines := tc.sync(); len(containing(lines, " 90")) != 0 {
+		t.Fatalf("full-size chunk ended the exchange: %q", lines)
+	}
+	tc.send("AUTHENTICATE +")
+	tc.expect(" 903 ")
+}
+
+func TestSASLTooLong(t *testing.T) {
+	_, tc := saslTest(t, testAccounts{})
+
+	tc.send("AUTHENTICATE PLAIN")
+	tc.expect("AUTHENTICATE +")
+	tc.send("AUTHENTICATE " + strings.Repeat("A", saslChunkSize+1))
+	tc.expect(" 905 ")
+}
+
+func TestSASLAbortAndMechanisms(t *testing.T) {
+	_, tc := saslTest(t, testAccounts{passwords: map[string]string{"alice": "secret"}})
+
+	tc.send("AUTHENTICATE SCRAM-SHA-256")
+	if line := tc.expect(" 908 "); !strings.Contains(line, " PLAIN,EXTERNAL :") {
+		t.Errorf("mechanism list: %q", line)
+	}
+	tc.expect(" 904 ")
+
+	tc.send("AUTHENTICATE PLAIN")
+	tc.expect("AUTHENTICATE +")
+	tc.send("AUTHENTICATE *")
+	tc.expect(" 906 ")
+
+	// The aborted exchange leaves nothing behind
+	tc.send("AUTHENTICATE PLAIN", "AUTHENTICATE "+plainPayload("", "alice", "secret"))
+	tc.expect(" 903 ")
+}
+
+func TestSASLExternal(t *testing.T) {
+	certfp := strings.Repeat("ab", 32)
+	s, tc := saslTest(t, testAccounts{certs: map[string]string{certfp: "alice"}})
+
+	// No certificate
+	tc.send("AUTHENTICATE EXTERNAL")
+	tc.expect("AUTHENTICATE +")
+	tc.send("AUTHENTICATE +")
+	tc.expect(" 904 ")
+
+	client := s.GetClient("sasl")
+	client.mu.Lock()
+	client.certfp = certfp
+	client.mu.Unlock()
+
+	// An authzid must name the certificate's account
+	tc.send("AUTHENTICATE EXTERNAL", "AUTHENTICATE "+base64.StdEncoding.EncodeToString([]byte("bob")))
+	tc.expect(" 904 ")
+
+	tc.send("AUTHENTICATE EXTERNAL", "AUTHENTICATE +")
+	tc.expect(" 900 ")
+	tc.expect(" 903 ")
+	if account := client.Account(); account != "alice" {
+		t.Errorf("account = %q", account)
+	}
+}
+
+func TestSASLWithoutCapability(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAccountStore(testAccounts{})
+
+	tc := dialTest(t, s)
+	tc.send("AUTHENTICATE PLAIN")
+	tc.expect(" 904 ")
+}
+
+// testCertificate generates a self-signed certificate, writing it and its
+// key to PEM files in dir
+func testCertificate(t *testing.T, dir, name string) (tls.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestCertFPOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := testCertificate(t, dir, "server")
+	clientCert, _, _ := testCertificate(t, dir, "client")
+	sum := sha256.Sum256(clientCert.Certificate[0])
+	certfp := hex.EncodeToString(sum[:])
+
+	s := newTestServer(t, func(config *Config) {
+		config.Server.SSL.CertFile = certFile
+		config.Server.SSL.KeyFile = keyFile
+		config.WhoisFeatures.ShowCertFP.ToEveryone = false
+		config.WhoisFeatures.ShowCertFP.ToOpers = false
+		config.WhoisFeatures.ShowCertFP.ToSelf = true
+	})
+	s.SetAccountStore(testAccounts{certs: map[string]string{certfp: "alice"}})
+
+	tlsConfig, err := s.sslConfig()
+	if err != nil {
+		t.Fatalf("sslConfig: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	serveTest(t, s, listener)
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true, // The server certificate is self-signed
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	tc := &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	// SASL EXTERNAL logs in with the certificate's fingerprint
+	tc.send("CAP LS 302", "CAP REQ :sasl", "NICK secure", "USER secure 0 * :Secure")
+	tc.expect("ACK :sasl")
+	tc.send("AUTHENTICATE EXTERNAL", "AUTHENTICATE +")
+	tc.expect(" 900 ")
+	tc.expect(" 903 ")
+	tc.send("CAP END")
+	tc.expect(" 376 ")
+	if client := s.GetClient("secure"); client.CertFP() != certfp || client.Account() != "alice" {
+		t.Errorf("certfp %q, account %q", client.CertFP(), client.Account())
+	}
+
+	// WHOIS shows the fingerprint to the client itself only
+	tc.send("WHOIS secure")
+	if line := tc.expect(" 276 "); !strings.HasSuffix(line, " 276 secure secure :has client certificate fingerprint "+certfp) {
+		t.Errorf("WHOIS certfp: %q", line)
+	}
+	other := registerTest(t, s, "other")
+	other.send("WHOIS secure")
+	if lines := other.readUntil(" 318 "); len(containing(lines, " 276 ")) != 0 {
+		t.Errorf("certfp shown to another user: %q", lines)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// sendQueueWriteTimeout bounds a single write to the socket
+const sendQueueWriteTimeout = 30 * time.Second
+
+var errSendQExceeded = errors.New("send queue limit exceeded")
+
+// sendQueue buffers outgoing data for one connection and writes it from a
+// dedicated goroutine, so a slow reader never blocks the clients sending to
+// it. Everything queued since the last write goes out in a single write.
+type sendQueue struct {
+	conn    net.Conn
+	limit   int    // Maximum number of queued bytes
+	buf     []byte // Data waiting to be written
+	closing bool   // Flush what is queued, then close the connection
+	closed  bool   // No more data is accepted
+	mu      sync.Mutex
+	cond    *sync.Cond
+}
+
+func newSendQueue(conn net.Conn, limit int) *sendQueue {
+	q := &sendQueue{
+		conn:  conn,
+		limit: limit,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// Enqueue queues a line for writing. It returns errSendQExceeded the first
+// time the queue grows past its limit; the queue is then discarded and the
+// connection closed. Lines queued after Close are silently dropped.
+func (q *sendQueue) Enqueue(line string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.closing {
+		return nil
+	}
+
+	if len(q.buf)+len(line)+2 > q.limit {
+		q.buf = nil
+		q.closed = true
+		q.cond.Signal()
+		q.conn.Close()
+		return errSendQExceeded
+	}
+
+	q.buf = append(q.buf, line...)
+	q.buf = append(q.buf, '\r', '\n')
+	q.cond.Signal()
+	return nil
+}
+
+// SetLimit changes the number of bytes that may be queued
+func (q *sendQueue) SetLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = limit
+}
+
+// Limit returns the number of bytes that may be queued
+func (q *sendQueue) Limit() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit
+}
+
+// Len returns the number of bytes waiting to be written
+func (q *sendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.buf)
+}
+
+// Close flushes the queued data and then closes the connection
+func (q *sendQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closing = true
+	q.cond.Signal()
+}
+
+func (q *sendQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.buf) == 0 && !q.closing && !q.closed {
+			q.cond.Wait()
+		}
+		data := q.buf
+		q.buf = nil
+		done := q.closing || q.closed
+		q.mu.Unlock()
+
+		if len(data) > 0 {
+			q.conn.SetWriteDeadline(time.Now().Add(sendQueueWriteTimeout))
+			if _, err := q.conn.Write(data); err != nil {
+				done = true
+			}
+		}
+
+		if done {
+			q.mu.Lock()
+			q.closed = true
+			q.buf = nil
+			q.mu.Unlock()
+			q.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSendQueueDelivers(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	q := newSendQueue(server, 1024)
+	for _, line := range []string{"PING :a", "PING :b", "PING :c"} {
+		if err := q.Enqueue(line); err != nil {
+			t.Fatalf("Enqueue(%q) returned %v", line, err)
+		}
+	}
+	q.Close()
+
+	reader := bufio.NewReader(client)
+	for _, want := range []string{"PING :a", "PING :b", "PING :c"} {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading queued line: %v", err)
+		}
+		if strings.TrimRight(got, "\r\n") != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSendQueueLimit(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// Nobody reads from the pipe, so the first write blocks and the rest queue up
+	q := newSendQueue(server, 64)
+	line := strings.Repeat("x", 20)
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = q.Enqueue(line)
+	}
+	if err != errSendQExceeded {
+		t.Fatalf("expected errSendQExceeded, got %v", err)
+	}
+	if err := q.Enqueue(line); err != nil {
+		t.Errorf("Enqueue after overflow returned %v, want nil", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("queue holds %d bytes after overflow", q.Len())
+	}
+}
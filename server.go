@@ -7,11 +7,15 @@ import (
 	"net"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 type Server struct {
 	config        *Config
+	configFile    string
+	operConfig    atomic.Pointer[OperConfig]
+	operSaveMu    sync.Mutex // Serialises writes to the oper config file
+	operTOTP      *totpReplay
 	clients       map[string]*Client
 	channels      map[string]*Channel
 	listener      net.Listener
@@ -19,17 +23,118 @@ type Server struct {
 	mu            sync.RWMutex
 	shutdown      chan bool
 	healthMonitor *HealthMonitor
+	capabilities  *CapabilityRegistry
+	commands      *CommandRegistry
+	accounts      AccountStore
+	services      *Services
+	bans          *BanDB
+	audit         *AuditLog
+	history       *HistoryStore
+	monitors      *watchIndex // MONITOR lists
+	watches       *watchIndex // WATCH lists
+	spy           *spyState
+	liveness      *timerWheel
+	operLockout   *operLockout
+	authLockout   *operLockout // Failed SASL PLAIN and NickServ logins
+	classMu       sync.Mutex   // Makes class limit checks and admission atomic
+
+	// Server linking
+	sid           string
+	uidSeq        uint64
+	linkMu        sync.Mutex               // Guards links; taken before mu
+	links         map[string]*Link         // Direct peers by SID
+	servers       map[string]*RemoteServer // Every known remote server by SID
+	remoteClients map[string]*Client       // Users on other servers by UID
 }
 
-func NewServer(config *Config) *Server {
+func NewServer(config *Config) (*Server, error) {
 	server := &Server{
-		config:   config,
-		clients:  make(map[string]*Client),
-		channels: make(map[string]*Channel),
-		shutdown: make(chan bool),
+		config:        config,
+		configFile:    "config.json",
+		clients:       make(map[string]*Client),
+		channels:      make(map[string]*Channel),
+		shutdown:      make(chan bool),
+		capabilities:  NewCapabilityRegistry(),
+		commands:      NewCommandRegistry(),
+		liveness:      newTimerWheel(livenessSlots, livenessResolution),
+		operLockout:   newOperLockout(),
+		authLockout:   newOperLockout(),
+		operTOTP:      newTOTPReplay(),
+		spy:           newSpyState(),
+		monitors:      newWatchIndex(),
+		watches:       newWatchIndex(),
+		sid:           config.Server.SID,
+		links:         make(map[string]*Link),
+		servers:       make(map[string]*RemoteServer),
+		remoteClients: make(map[string]*Client),
 	}
 	server.healthMonitor = NewHealthMonitor(server)
-	return server
+	server.registerBuiltinCommands()
+
+	operConfig, err := loadOperConfig(config)
+	if err != nil {
+		// Fail closed: without a valid opers.conf no class grants anything,
+		// and what opers can still do is audited
+		log.Printf("Failed to load oper config, operators will have no permissions: %v", err)
+		operConfig = &OperConfig{}
+		operConfig.Settings.LogOperActions = true
+		addConfigOpers(operConfig, config)
+	}
+	server.operConfig.Store(operConfig)
+
+	// Starting without the bans would lift them all, and every ban set
+	// afterwards would overwrite the unreadable database
+	bans, err := LoadBanDB(config.Bans.DatabaseFile)
+	if err != nil {
+		return nil, err
+	}
+	server.bans = bans
+
+	// Oper actions are never carried out unrecorded while auditing is on
+	audit, err := OpenAuditLog(config.Audit.File, int64(config.Audit.MaxSize)*1024*1024, config.AuditMaxBackups())
+	if err != nil {
+		if operConfig.Settings.LogOperActions {
+			return nil, err
+		}
+		log.Printf("Failed to open audit log: %v", err)
+	} else {
+		server.audit = audit
+	}
+	if config.History.Enabled {
+		history, err := OpenHistoryStore(config.History.DatabaseFile, server.historyPolicy)
+		if err != nil {
+			log.Printf("Failed to load chat history, starting empty: %v", err)
+			history, _ = OpenHistoryStore("", server.historyPolicy)
+		}
+		server.history = history
+		server.RegisterCapability("draft/chathistory", "")
+	}
+	server.RegisterCapability("cap-notify", "")
+	server.RegisterCapability("chghost", "")
+	server.RegisterCapability("away-notify", "")
+	server.RegisterCapability("account-notify", "")
+	server.RegisterCapability("extended-join", "")
+	server.RegisterCapability("setname", "")
+	server.RegisterCapability("invite-notify", "")
+	server.RegisterCapability("message-tags", "")
+	server.RegisterCapability("server-time", "")
+	server.RegisterCapability("account-tag", "")
+	server.RegisterCapability("batch", "")
+	server.RegisterCapability("echo-message", "")
+	server.RegisterCapability("labeled-response", "")
+
+	// Running without services would leave registered nicks unprotected,
+	// and accounts registered afterwards would overwrite the database
+	if config.Features.EnableServices {
+		services, err := NewServices(server)
+		if err != nil {
+			return nil, err
+		}
+		server.services = services
+		server.SetAccountStore(services.db)
+	}
+
+	return server, nil
 }
 
 func (s *Server) Start() error {
@@ -60,11 +165,20 @@ func (s *Server) Start() error {
 				channel.SetMode(rune(mode), true)
 			}
 		}
+		if s.services != nil {
+			s.services.ChannelCreated(channel)
+		}
 		s.channels[strings.ToLower(channelName)] = channel
 	}
 
-	// Start ping routine
-	go s.pingRoutine()
+	// Start registration and ping timeout tracking
+	go s.livenessRoutine()
+
+	// Bring up auto-connect links
+	go s.autoConnectRoutine()
+
+	// Remove bans as they expire
+	go s.banExpiryRoutine()
 
 	// Accept connections
 	for {
@@ -76,6 +190,9 @@ func (s *Server) Start() error {
 			if err != nil {
 				continue
 			}
+			if s.connectionBanned(conn) {
+				continue
+			}
 
 			client := NewClient(conn, s)
 			s.AddClient(client)
@@ -85,16 +202,29 @@ func (s *Server) Start() error {
 	}
 }
 
-func (s *Server) startSSLListener() {
-	// Load SSL certificates
+// sslConfig loads the server certificate and returns the TLS settings for
+// client connections
+func (s *Server) sslConfig() (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(s.config.Server.SSL.CertFile, s.config.Server.SSL.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Client certificates are optional and not verified against a CA; only
+	// their fingerprint is used, for SASL EXTERNAL and oper blocks
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	}, nil
+}
+
+func (s *Server) startSSLListener() {
+	tlsConfig, err := s.sslConfig()
 	if err != nil {
 		log.Printf("Failed to load SSL certificates: %v", err)
 		return
 	}
 
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-
 	addr := fmt.Sprintf("%s:%d", s.config.Server.Listen.Host, s.config.Server.Listen.SSLPort)
 	listener, err := tls.Listen("tcp", addr, tlsConfig)
 	if err != nil {
@@ -114,6 +244,9 @@ func (s *Server) startSSLListener() {
 			if err != nil {
 				continue
 			}
+			if s.connectionBanned(conn) {
+				continue
+			}
 
 			client := NewClient(conn, s)
 			s.AddClient(client)
@@ -122,37 +255,32 @@ func (s *Server) startSSLListener() {
 	}
 }
 
-func (s *Server) pingRoutine() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.shutdown:
-			return
-		case <-ticker.C:
-			s.mu.RLock()
-			for _, client := range s.clients {
-				if client.IsRegistered() {
-					client.SendMessage(fmt.Sprintf("PING :%s", s.config.Server.Name))
-				}
-			}
-			s.mu.RUnlock()
-		}
-	}
-}
-
 func (s *Server) AddClient(client *Client) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Check client limit
 	if len(s.clients) >= s.config.Limits.MaxClients {
-		client.SendMessage("ERROR :Server full")
-		client.conn.Close()
+		client.Quit("Server full")
 		return
 	}
 
+	// Unregistered connections count towards the per-address limit too, or
+	// a host could hold any number of them open
+	ip := client.Host()
+	if limit := s.config.acceptLimit(ip, client.IsSSL(), client.port); limit > 0 {
+		fromIP := 0
+		for _, other := range s.clients {
+			if other.Host() == ip {
+				fromIP++
+			}
+		}
+		if fromIP >= limit {
+			client.Quit("Too many connections from your host")
+			return
+		}
+	}
+
 	s.clients[client.clientID] = client
 }
 
@@ -161,6 +289,16 @@ func (s *Server) RemoveClient(client *Client) {
 	delete(s.clients, client.clientID)
 	s.mu.Unlock()
 
+	if s.services != nil {
+		s.services.ClientQuit(client)
+	}
+
+	s.monitors.clear(client)
+	s.watches.clear(client)
+	if client.IsRegistered() {
+		s.presenceOffline(client, client.Nick())
+	}
+
 	// Send snomask notification for client disconnect (after releasing the lock)
 	if client.IsRegistered() {
 		s.sendSnomask('c', fmt.Sprintf("Client disconnect: %s (%s@%s)",
@@ -181,16 +319,41 @@ func (s *Server) sendSnomask(snomask rune, message string) {
 	}
 }
 
-// ReloadConfig reloads the server configuration
+// SetConfigFile sets the file REHASH reloads the configuration from
+func (s *Server) SetConfigFile(filename string) {
+	s.configFile = filename
+}
+
+// ReloadConfig reloads the main and operator configuration. Both are loaded
+// and validated before either replaces the running configuration, so a
+// broken file leaves everything as it was.
 func (s *Server) ReloadConfig() error {
-	config, err := LoadConfig("config.json")
+	config, err := LoadConfig(s.configFile)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
+	// Keep a generated cloak key, or every cloak would change
+	if config.Privacy.CloakKey == "" {
+		config.Privacy.CloakKey = s.config.Privacy.CloakKey
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	config.SanitizeConfig()
+
+	operConfig, err := loadOperConfig(config)
+	if err != nil {
+		return err
+	}
+	if operConfig.Settings.LogOperActions && s.audit == nil {
+		return fmt.Errorf("log_oper_actions is on but the audit log is not open")
+	}
+
 	s.mu.Lock()
 	s.config = config
 	s.mu.Unlock()
+	s.operConfig.Store(operConfig)
 
 	return nil
 }
@@ -204,6 +367,11 @@ func (s *Server) GetClient(nick string) *Client {
 			return client
 		}
 	}
+	for _, client := range s.remoteClients {
+		if strings.EqualFold(client.Nick(), nick) {
+			return client
+		}
+	}
 	return nil
 }
 
@@ -222,7 +390,10 @@ func (s *Server) GetClientByHost(host string) *Client {
 func (s *Server) GetClientByID(clientID string) *Client {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.clients[clientID]
+	if client, exists := s.clients[clientID]; exists {
+		return client
+	}
+	return s.remoteClients[clientID]
 }
 
 func (s *Server) GetClients() map[string]*Client {
@@ -259,6 +430,9 @@ func (s *Server) GetOrCreateChannel(name string) *Channel {
 			channel.SetMode(rune(mode), true)
 		}
 	}
+	if s.services != nil {
+		s.services.ChannelCreated(channel)
+	}
 	s.channels[channelName] = channel
 	return channel
 }
@@ -314,78 +488,21 @@ func (s *Server) IsNickInUse(nick string) bool {
 			return true
 		}
 	}
+	for _, client := range s.remoteClients {
+		if strings.EqualFold(client.Nick(), nick) {
+			return true
+		}
+	}
 	return false
 }
 
 func (s *Server) HandleMessage(client *Client, message string) {
-	parts := strings.Fields(message)
-	if len(parts) == 0 {
+	msg, err := ParseMessage(message)
+	if err != nil {
 		return
 	}
 
-	command := strings.ToUpper(parts[0])
-
-	// Log the command for debugging
-	log.Printf("Client %s: %s", client.Host(), message)
-
-	switch command {
-	case "CAP":
-		// TODO: implement CAP handling
-	case "NICK":
-		client.handleNick(parts)
-	case "USER":
-		client.handleUser(parts)
-	case "PING":
-		client.handlePing(parts)
-	case "PONG":
-		client.handlePong(parts)
-	case "JOIN":
-		client.handleJoin(parts)
-	case "PART":
-		client.handlePart(parts)
-	case "PRIVMSG":
-		client.handlePrivmsg(parts)
-	case "NOTICE":
-		client.handleNotice(parts)
-	case "WHO":
-		client.handleWho(parts)
-	case "WHOIS":
-		client.handleWhois(parts)
-	case "NAMES":
-		client.handleNames(parts)
-	case "MODE":
-		client.handleMode(parts)
-	case "OPER":
-		client.handleOper(parts)
-	case "SNOMASK":
-		client.handleSnomask(parts)
-	case "GLOBALNOTICE":
-		client.handleGlobalNotice(parts)
-	case "OPERWALL":
-		client.handleOperWall(parts)
-	case "WALLOPS":
-		client.handleWallops(parts)
-	case "REHASH":
-		client.handleRehash(parts)
-	case "TRACE":
-		client.handleTrace(parts)
-	case "TOPIC":
-		client.handleTopic(parts)
-	case "KICK":
-		client.handleKick(parts)
-	case "INVITE":
-		client.handleInvite(parts)
-	case "AWAY":
-		client.handleAway(parts)
-	case "LIST":
-		client.handleList(parts)
-	case "KILL":
-		client.handleKill(parts)
-	case "QUIT":
-		client.handleQuit(parts)
-	default:
-		client.SendNumeric(ERR_UNKNOWNCOMMAND, command+" :Unknown command")
-	}
+	s.dispatch(client, msg, len(message))
 }
 
 // Shutdown gracefully shuts down the server
@@ -415,5 +532,12 @@ func (s *Server) Shutdown() {
 		s.sslListener.Close()
 	}
 
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	if s.history != nil {
+		s.history.Close()
+	}
+
 	log.Println("Server shutdown complete")
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server with its data files in a temporary
+// directory, accepting clients on a loopback port. configure may change the
+// config before the server is created.
+func newTestServer(t *testing.T, configure ...func(*Config)) *Server {
+	t.Helper()
+	dir := t.TempDir()
+
+	config := DefaultConfig()
+	config.Server.Name = "irc.test"
+	config.Server.SID = "0TS"
+	config.Opers = nil
+	config.Bans.DatabaseFile = filepath.Join(dir, "bans.json")
+	config.Audit.File = filepath.Join(dir, "audit.log")
+	config.History.DatabaseFile = filepath.Join(dir, "history.db")
+	config.Services.DatabaseFile = filepath.Join(dir, "services.json")
+	for _, f := range configure {
+		f(config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s.listener = listener
+	serveTest(t, s, listener)
+	return s
+}
+
+// serveTest accepts clients on a listener until the test ends
+func serveTest(t *testing.T, s *Server, listener net.Listener) {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			client := NewClient(conn, s)
+			s.AddClient(client)
+			go client.Handle()
+		}
+	}()
+}
+
+// testConn is a client connection to a test server
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialTest connects to a test server without registering
+func dialTest(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// registerTest connects and registers a client, reading up to the end of
+// the MOTD
+func registerTest(t *testing.T, s *Server, nick string) *testConn {
+	t.Helper()
+	tc := dialTest(t, s)
+	tc.send("NICK "+nick, "USER "+nick+" 0 * :"+nick)
+	tc.expect(" 376 ")
+	return tc
+}
+
+// operTest adds an oper block of the given class that any host can use
+// with the password "operpass", and opers the client up with it
+func operTest(t *testing.T, s *Server, tc *testConn, name, class string) {
+	t.Helper()
+	current := s.OperConfig()
+	updated := *current
+	updated.Opers = append(append([]Oper(nil), current.Opers...), Oper{Name: name, Class: class, Host: "*@*", Password: "operpass"})
+	s.operConfig.Store(&updated)
+
+	tc.send("OPER " + name + " operpass")
+	tc.expect(" 381 ")
+}
+
+func (tc *testConn) send(lines ...string) {
+	tc.t.Helper()
+	for _, line := range lines {
+		if _, err := tc.conn.Write([]byte(line + "\r\n")); err != nil {
+			tc.t.Fatalf("write %q: %v", line, err)
+		}
+	}
+}
+
+// readUntil returns every line read up to and including the first one
+// containing want
+func (tc *testConn) readUntil(want string) []string {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var lines []string
+	for {
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			tc.t.Fatalf("waiting for %q: %v (read %q)", want, err, lines)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if strings.Contains(line, want) {
+			return lines
+		}
+	}
+}
+
+// expect returns the first line containing want, skipping others
+func (tc *testConn) expect(want string) string {
+	tc.t.Helper()
+	lines := tc.readUntil(want)
+	return lines[len(lines)-1]
+}
+
+// sync sends a PING and returns everything the client was sent before the
+// PONG, so a test can check what a command did and did not send
+func (tc *testConn) sync() []string {
+	tc.t.Helper()
+	tc.send("PING :sync")
+	lines := tc.readUntil("PONG")
+	return lines[:len(lines)-1]
+}
+
+// containing returns the lines containing s
+func containing(lines []string, s string) []string {
+	var found []string
+	for _, line := range lines {
+		if strings.Contains(line, s) {
+			found = append(found, line)
+		}
+	}
+	return found
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errAccountExists   = errors.New("account already exists")
+	errNoSuchAccount   = errors.New("no such account")
+	errNickRegistered  = errors.New("nickname is registered to another account")
+	errPasswordTooWeak = errors.New("password is too short or matches the account name")
+	errChannelExists   = errors.New("channel is already registered")
+	errNoSuchChannel   = errors.New("channel is not registered")
+	errCertfpInUse     = errors.New("fingerprint is already on an account")
+	errNoSuchCertfp    = errors.New("fingerprint is not on the account")
+)
+
+const minPasswordLength = 5
+
+// Account is a services account
+type Account struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash"`
+	Email        string    `json:"email,omitempty"`
+	Nicks        []string  `json:"nicks"`             // Grouped nicknames, including the account name
+	Certfps      []string  `json:"certfps,omitempty"` // TLS certificate fingerprints for SASL EXTERNAL
+	Registered   time.Time `json:"registered"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// ChannelAccess is an access list entry of a registered channel
+type ChannelAccess struct {
+	Account string    `json:"account"`
+	Level   string    `json:"level"` // founder, op, halfop or voice
+	AddedBy string    `json:"added_by"`
+	Added   time.Time `json:"added"`
+}
+
+// RegisteredChannel is a channel registered with ChanServ
+type RegisteredChannel struct {
+	Name       string          `json:"name"`
+	Founder    string          `json:"founder"`
+	Registered time.Time       `json:"registered"`
+	Topic      string          `json:"topic,omitempty"`
+	TopicBy    string          `json:"topic_by,omitempty"`
+	TopicTime  time.Time       `json:"topic_time,omitempty"`
+	MLockOn    string          `json:"mlock_on,omitempty"`  // Modes locked on
+	MLockOff   string          `json:"mlock_off,omitempty"` // Modes locked off
+	MLockKey   string          `json:"mlock_key,omitempty"`
+	MLockLimit int             `json:"mlock_limit,omitempty"`
+	Bans       []string        `json:"bans,omitempty"`
+	Access     []ChannelAccess `json:"access"`
+}
+
+// ServicesDB is the persistent services database
+type ServicesDB struct {
+	Accounts map[string]*Account           `json:"accounts"` // Keyed by lowercase account name
+	Channels map[string]*RegisteredChannel `json:"channels"` // Keyed by lowercase channel name
+
+	filename string
+	mu       sync.RWMutex
+}
+
+// LoadServicesDB loads the services database, starting empty if the file does not exist
+func LoadServicesDB(filename string) (*ServicesDB, error) {
+	db := &ServicesDB{
+		Accounts: make(map[string]*Account),
+		Channels: make(map[string]*RegisteredChannel),
+		filename: filename,
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, fmt.Errorf("failed to read services database: %v", err)
+	}
+
+	if err := json.Unmarshal(data, db); err != nil {
+		return nil, fmt.Errorf("failed to parse services database: %v", err)
+	}
+	if db.Accounts == nil {
+		db.Accounts = make(map[string]*Account)
+	}
+	if db.Channels == nil {
+		db.Channels = make(map[string]*RegisteredChannel)
+	}
+
+	return db, nil
+}
+
+// saveLocked writes the database to disk; the caller must hold db.mu
+func (db *ServicesDB) saveLocked() error {
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal services database: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated database
+	tmp := db.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write services database: %v", err)
+	}
+	if err := os.Rename(tmp, db.filename); err != nil {
+		return fmt.Errorf("failed to replace services database: %v", err)
+	}
+
+	return nil
+}
+
+// accountForNickLocked finds the account owning a nickname; the caller must hold db.mu
+func (db *ServicesDB) accountForNickLocked(nick string) *Account {
+	nick = strings.ToLower(nick)
+	if account, exists := db.Accounts[nick]; exists {
+		return account
+	}
+	for _, account := range db.Accounts {
+		for _, grouped := range account.Nicks {
+			if strings.ToLower(grouped) == nick {
+				return account
+			}
+		}
+	}
+	return nil
+}
+
+// AccountForNick returns the name of the account owning a nickname
+func (db *ServicesDB) AccountForNick(nick string) (string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	account := db.accountForNickLocked(nick)
+	if account == nil {
+		return "", false
+	}
+	return account.Name, true
+}
+
+// GetAccount returns a copy of an account
+func (db *ServicesDB) GetAccount(name string) (Account, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	account, exists := db.Accounts[strings.ToLower(name)]
+	if !exists {
+		return Account{}, false
+	}
+	return *account, true
+}
+
+// Register creates a new account named after a nickname
+func (db *ServicesDB) Register(name, password, email string) error {
+	if len(password) < minPasswordLength || strings.EqualFold(password, name) {
+		return errPasswordTooWeak
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.accountForNickLocked(name) != nil {
+		return errAccountExists
+	}
+
+	now := time.Now()
+	db.Accounts[strings.ToLower(name)] = &Account{
+		Name:         name,
+		PasswordHash: string(hash),
+		Email:        email,
+		Nicks:        []string{name},
+		Registered:   now,
+		LastSeen:     now,
+	}
+
+	return db.saveLocked()
+}
+
+// Authenticate checks an account (or grouped nickname) password. It
+// implements AccountStore.
+func (db *ServicesDB) Authenticate(name, password string) (string, bool) {
+	db.mu.RLock()
+	account := db.accountForNickLocked(name)
+	if account == nil {
+		db.mu.RUnlock()
+		return "", false
+	}
+	accountName, hash := account.Name, account.PasswordHash
+	db.mu.RUnlock()
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", false
+	}
+	return accountName, true
+}
+
+// AccountForCertfp returns the account a certificate fingerprint is
+// registered to. It implements AccountStore.
+func (db *ServicesDB) AccountForCertfp(fingerprint string) (string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, account := range db.Accounts {
+		for _, certfp := range account.Certfps {
+			if strings.EqualFold(certfp, normalizeCertFP(fingerprint)) {
+				return account.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// AddCertfp adds a certificate fingerprint to an account
+func (db *ServicesDB) AddCertfp(name, fingerprint string) error {
+	fingerprint = normalizeCertFP(fingerprint)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	account, exists := db.Accounts[strings.ToLower(name)]
+	if !exists {
+		return errNoSuchAccount
+	}
+	for _, other := range db.Accounts {
+		for _, certfp := range other.Certfps {
+			if strings.EqualFold(certfp, fingerprint) {
+				return errCertfpInUse
+			}
+		}
+	}
+
+	account.Certfps = append(account.Certfps, fingerprint)
+	return db.saveLocked()
+}
+
+// DelCertfp removes a certificate fingerprint from an account
+func (db *ServicesDB) DelCertfp(name, fingerprint string) error {
+	fingerprint = normalizeCertFP(fingerprint)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	account, exists := db.Accounts[strings.ToLower(name)]
+	if !exists {
+		return errNoSuchAccount
+	}
+	for i, certfp := range account.Certfps {
+		if strings.EqualFold(certfp, fingerprint) {
+			account.Certfps = append(account.Certfps[:i], account.Certfps[i+1:]...)
+			return db.saveLocked()
+		}
+	}
+	return errNoSuchCertfp
+}
+
+// Group adds a nickname to an account
+func (db *ServicesDB) Group(name, nick string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	account, exists := db.Accounts[strings.ToLower(name)]
+	if !exists {
+		return errNoSuchAccount
+	}
+	if owner := db.accountForNickLocked(nick); owner != nil {
+		if owner == account {
+			return nil
+		}
+		return errNickRegistered
+	}
+
+	account.Nicks = append(account.Nicks, nick)
+	return db.saveLocked()
+}
+
+// Drop deletes an account, the channels it founded and its channel access
+func (db *ServicesDB) Drop(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Accounts[strings.ToLower(name)]; !exists {
+		return errNoSuchAccount
+	}
+	delete(db.Accounts, strings.ToLower(name))
+
+	for key, channel := range db.Channels {
+		if strings.EqualFold(channel.Founder, name) {
+			delete(db.Channels, key)
+			continue
+		}
+		channel.removeAccess(name)
+	}
+
+	return db.saveLocked()
+}
+
+// SetPassword replaces an account's password
+func (db *ServicesDB) SetPassword(name, password string) error {
+	if len(password) < minPasswordLength || strings.EqualFold(password, name) {
+		return errPasswordTooWeak
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	account, exists := db.Accounts[strings.ToLower(name)]
+	if !exists {
+		return errNoSuchAccount
+	}
+	account.PasswordHash = string(hash)
+	return db.saveLocked()
+}
+
+// Touch records that an account was just used
+func (db *ServicesDB) Touch(name string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if account, exists := db.Accounts[strings.ToLower(name)]; exists {
+		account.LastSeen = time.Now()
+		if err := db.saveLocked(); err != nil {
+			log.Printf("Services: %v", err)
+		}
+	}
+}
+
+// GetChannel returns a copy of a registered channel
+func (db *ServicesDB) GetChannel(name string) (RegisteredChannel, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	channel, exists := db.Channels[strings.ToLower(name)]
+	if !exists {
+		return RegisteredChannel{}, false
+	}
+	copied := *channel
+	copied.Bans = append([]string(nil), channel.Bans...)
+	copied.Access = append([]ChannelAccess(nil), channel.Access...)
+	return copied, true
+}
+
+// RegisterChannel registers a channel to a founder account
+func (db *ServicesDB) RegisterChannel(channel *RegisteredChannel) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := strings.ToLower(channel.Name)
+	if _, exists := db.Channels[key]; exists {
+		return errChannelExists
+	}
+	db.Channels[key] = channel
+	return db.saveLocked()
+}
+
+// DropChannel deletes a channel registration
+func (db *ServicesDB) DropChannel(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := strings.ToLower(name)
+	if _, exists := db.Channels[key]; !exists {
+		return errNoSuchChannel
+	}
+	delete(db.Channels, key)
+	return db.saveLocked()
+}
+
+// UpdateChannel applies a change to a registered channel and saves the database
+func (db *ServicesDB) UpdateChannel(name string, update func(channel *RegisteredChannel)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	channel, exists := db.Channels[strings.ToLower(name)]
+	if !exists {
+		return errNoSuchChannel
+	}
+	update(channel)
+	return db.saveLocked()
+}
+
+// accessLevel returns the access level an account has on the channel, or ""
+func (rc *RegisteredChannel) accessLevel(account string) string {
+	if account == "" {
+		return ""
+	}
+	if strings.EqualFold(rc.Founder, account) {
+		return "founder"
+	}
+	for _, entry := range rc.Access {
+		if strings.EqualFold(entry.Account, account) {
+			return entry.Level
+		}
+	}
+	return ""
+}
+
+// setAccess adds or replaces an access list entry
+func (rc *RegisteredChannel) setAccess(entry ChannelAccess) {
+	rc.removeAccess(entry.Account)
+	rc.Access = append(rc.Access, entry)
+}
+
+// removeAccess deletes an account's access list entry, reporting whether it existed
+func (rc *RegisteredChannel) removeAccess(account string) bool {
+	for i, entry := range rc.Access {
+		if strings.EqualFold(entry.Account, account) {
+			rc.Access = append(rc.Access[:i], rc.Access[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceBot is a pseudo-client that users talk to with PRIVMSG
+type ServiceBot struct {
+	Nick    string
+	Handler func(c *Client, text string)
+}
+
+// Services is the embedded services subsystem
+type Services struct {
+	server  *Server
+	db      *ServicesDB
+	bots    map[string]*ServiceBot // Keyed by lowercase nick
+	enforce map[*Client]*time.Timer
+	mu      sync.Mutex
+}
+
+// NewServices loads the services database and creates the service bots
+func NewServices(server *Server) (*Services, error) {
+	dbFile := server.config.Services.DatabaseFile
+	if dir := filepath.Dir(dbFile); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create services directory: %v", err)
+		}
+	}
+
+	db, err := LoadServicesDB(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	services := &Services{
+		server:  server,
+		db:      db,
+		bots:    make(map[string]*ServiceBot),
+		enforce: make(map[*Client]*time.Timer),
+	}
+	services.addBot(&ServiceBot{Nick: "NickServ", Handler: services.handleNickServ})
+	services.addBot(&ServiceBot{Nick: "ChanServ", Handler: services.handleChanServ})
+
+	return services, nil
+}
+
+func (sv *Services) addBot(bot *ServiceBot) {
+	sv.bots[strings.ToLower(bot.Nick)] = bot
+}
+
+// IsServiceNick returns true if the nick belongs to a service bot
+func (sv *Services) IsServiceNick(nick string) bool {
+	_, exists := sv.bots[strings.ToLower(nick)]
+	return exists
+}
+
+// HandleMessage delivers a PRIVMSG to a service bot. It returns false if
+// the target is not a service.
+func (sv *Services) HandleMessage(c *Client, target, text string) bool {
+	bot, exists := sv.bots[strings.ToLower(target)]
+	if !exists {
+		return false
+	}
+	bot.Handler(c, text)
+	return true
+}
+
+// botPrefix returns the source prefix used by a service bot
+func (sv *Services) botPrefix(nick string) string {
+	return fmt.Sprintf("%s!services@%s", nick, sv.server.config.Server.Name)
+}
+
+// reply sends a notice from a service bot
+func (sv *Services) reply(c *Client, bot, format string, args ...interface{}) {
+	c.SendFrom(sv.botPrefix(bot), fmt.Sprintf("NOTICE %s :%s", c.Nick(), fmt.Sprintf(format, args...)))
+}
+
+// Login logs the client in to an account and cancels nick enforcement
+func (sv *Services) Login(c *Client, account string) {
+	c.loginAs(account)
+	sv.db.Touch(account)
+	sv.cancelEnforcement(c)
+}
+
+// Logout logs the client out of its account
+func (sv *Services) Logout(c *Client) {
+	c.logout()
+	sv.CheckNick(c)
+}
+
+// CheckNick starts nickname enforcement if the client is using a nick
+// registered to an account it is not logged in to
+func (sv *Services) CheckNick(c *Client) {
+	nick := c.Nick()
+	owner, registered := sv.db.AccountForNick(nick)
+	if !registered || strings.EqualFold(owner, c.Account()) {
+		sv.cancelEnforcement(c)
+		return
+	}
+
+	delay := time.Duration(sv.server.config.Services.EnforceDelay) * time.Second
+	sv.reply(c, "NickServ", "This nickname is registered. Please identify via /msg NickServ IDENTIFY <password> within %d seconds or your nickname will be changed.",
+		int(delay.Seconds()))
+
+	// Replace any earlier timer in one step, so concurrent checks cannot
+	// leave a timer running that the map no longer holds
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if timer, exists := sv.enforce[c]; exists {
+		timer.Stop()
+		delete(sv.enforce, c)
+	}
+	// A client removed in the meantime has already been through ClientQuit
+	if sv.server.GetClientByID(c.clientID) == nil {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		// Only the timer still in the map may act; a replaced one was stopped
+		// too late
+		sv.mu.Lock()
+		current := sv.enforce[c] == timer
+		if current {
+			delete(sv.enforce, c)
+		}
+		sv.mu.Unlock()
+		if current {
+			sv.enforceNick(c, nick)
+		}
+	})
+	sv.enforce[c] = timer
+}
+
+func (sv *Services) cancelEnforcement(c *Client) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if timer, exists := sv.enforce[c]; exists {
+		timer.Stop()
+		delete(sv.enforce, c)
+	}
+}
+
+// enforceNick renames a client still using a protected nick after the grace period
+func (sv *Services) enforceNick(c *Client, nick string) {
+	if sv.server.GetClientByID(c.clientID) == nil || !strings.EqualFold(c.Nick(), nick) {
+		return
+	}
+	owner, registered := sv.db.AccountForNick(nick)
+	if !registered || strings.EqualFold(owner, c.Account()) {
+		return
+	}
+
+	guest := sv.guestNick()
+	sv.reply(c, "NickServ", "You failed to identify in time for %s. Your nickname has been changed to %s.", nick, guest)
+	c.changeNick(guest)
+	sv.server.sendSnomask('n', fmt.Sprintf("NickServ renamed %s to %s (failed to identify)", nick, guest))
+}
+
+// guestNick returns an unused Guest nickname
+func (sv *Services) guestNick() string {
+	prefix := sv.server.config.Services.GuestPrefix
+	for {
+		nick := fmt.Sprintf("%s%05d", prefix, rand.Intn(100000))
+		if !sv.server.IsNickInUse(nick) {
+			return nick
+		}
+	}
+}
+
+// ClientQuit releases per-client services state
+func (sv *Services) ClientQuit(c *Client) {
+	sv.cancelEnforcement(c)
+}
+
+// handleServiceAlias handles service shortcut commands such as NS
+func (c *Client) handleServiceAlias(bot string, msg *Message) {
+	if c.server.services == nil {
+		c.SendNumeric(ERR_UNKNOWNCOMMAND, msg.Command+" :Unknown command")
+		return
+	}
+
+	c.server.services.HandleMessage(c, bot, strings.Join(msg.Params, " "))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServicesDB(t *testing.T) *ServicesDB {
+	t.Helper()
+	db, err := LoadServicesDB(filepath.Join(t.TempDir(), "services.json"))
+	if err != nil {
+		t.Fatalf("LoadServicesDB: %v", err)
+	}
+	return db
+}
+
+func TestServicesDBAccounts(t *testing.T) {
+	db := newTestServicesDB(t)
+
+	if err := db.Register("Alice", "secret", ""); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := db.Register("alice", "another", ""); err != errAccountExists {
+		t.Errorf("duplicate Register = %v", err)
+	}
+
+	account, _ := db.GetAccount("alice")
+	if account.PasswordHash == "secret" || !strings.HasPrefix(account.PasswordHash, "$2") {
+		t.Errorf("password is not stored as a bcrypt hash: %q", account.PasswordHash)
+	}
+	if name, ok := db.Authenticate("ALICE", "secret"); !ok || name != "Alice" {
+		t.Errorf("Authenticate = %q, %v", name, ok)
+	}
+	if _, ok := db.Authenticate("alice", "wrong"); ok {
+		t.Error("Authenticate accepted a wrong password")
+	}
+	if _, ok := db.Authenticate("nobody", "secret"); ok {
+		t.Error("Authenticate accepted an unknown account")
+	}
+
+	if err := db.Group("alice", "alice_away"); err != nil {
+		t.Fatalf("Group: %v", err)
+	}
+	if name, ok := db.Authenticate("alice_away", "secret"); !ok || name != "Alice" {
+		t.Errorf("Authenticate by grouped nick = %q, %v", name, ok)
+	}
+	if err := db.Register("alice_away", "secret", ""); err != errAccountExists {
+		t.Errorf("Register of a grouped nick = %v", err)
+	}
+	db.Register("bob", "hunter2", "")
+	if err := db.Group("bob", "alice_away"); err != errNickRegistered {
+		t.Errorf("Group of another account's nick = %v", err)
+	}
+
+	db.RegisterChannel(&RegisteredChannel{Name: "#alice", Founder: "Alice"})
+	db.RegisterChannel(&RegisteredChannel{Name: "#bob", Founder: "bob", Access: []ChannelAccess{{Account: "alice", Level: "op"}}})
+	if err := db.Drop("alice"); err != nil {
+		t.Fatalf("Drop: %v", err)
+	}
+	if _, ok := db.AccountForNick("alice_away"); ok {
+		t.Error("grouped nick survived Drop")
+	}
+	if _, ok := db.GetChannel("#alice"); ok {
+		t.Error("founded channel survived Drop")
+	}
+	if channel, _ := db.GetChannel("#bob"); len(channel.Access) != 0 {
+		t.Errorf("access entry survived Drop: %v", channel.Access)
+	}
+	if err := db.Drop("alice"); err != errNoSuchAccount {
+		t.Errorf("second Drop = %v", err)
+	}
+}
+
+func TestServicesDBWeakPasswords(t *testing.T) {
+	db := newTestServicesDB(t)
+
+	for _, password := range []string{"", "abcd", "Carol", "CAROL"} {
+		if err := db.Register("carol", password, ""); err != errPasswordTooWeak {
+			t.Errorf("Register with %q = %v", password, err)
+		}
+	}
+	if err := db.Register("carol", "abcde", ""); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := db.SetPassword("carol", "carol"); err != errPasswordTooWeak {
+		t.Errorf("SetPassword to the account name = %v", err)
+	}
+	if err := db.SetPassword("carol", "newpass"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	if _, ok := db.Authenticate("carol", "newpass"); !ok {
+		t.Error("new password was not accepted")
+	}
+}
+
+func TestServicesDBPersistence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "services.json")
+	db, _ := LoadServicesDB(filename)
+	db.Register("alice", "secret", "alice@example.org")
+	db.Group("alice", "ali")
+	db.AddCertfp("alice", strings.Repeat("AB:", 31)+"AB")
+	db.RegisterChannel(&RegisteredChannel{Name: "#chan", Founder: "alice", MLockOn: "nt"})
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("database not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("database mode = %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	loaded, err := LoadServicesDB(filename)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if name, ok := loaded.Authenticate("ali", "secret"); !ok || name != "alice" {
+		t.Errorf("reloaded Authenticate = %q, %v", name, ok)
+	}
+	if name, ok := loaded.AccountForCertfp(strings.Repeat("ab", 32)); !ok || name != "alice" {
+		t.Errorf("reloaded AccountForCertfp = %q, %v", name, ok)
+	}
+	if channel, ok := loaded.GetChannel("#CHAN"); !ok || channel.MLockOn != "nt" {
+		t.Errorf("reloaded channel = %+v, %v", channel, ok)
+	}
+
+	// A failed save leaves the previous database in place
+	before, _ := os.ReadFile(filename)
+	if err := os.Mkdir(filename+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Register("bob", "hunter2", ""); err == nil {
+		t.Error("Register reported success although the database could not be written")
+	}
+	if after, _ := os.ReadFile(filename); string(after) != string(before) {
+		t.Error("failed save changed the database file")
+	}
+}
+
+func TestServerRefusesToRunWithoutServices(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.Features.EnableServices = true
+	config.Bans.DatabaseFile = filepath.Join(dir, "bans.json")
+	config.Audit.File = filepath.Join(dir, "audit.log")
+	config.History.DatabaseFile = filepath.Join(dir, "history.db")
+	config.Services.DatabaseFile = filepath.Join(dir, "services.json")
+	if err := os.WriteFile(config.Services.DatabaseFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewServer(config); err == nil {
+		t.Fatal("server started without its services database")
+	}
+}
+
+func TestNickEnforcement(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Features.EnableServices = true
+		config.Services.EnforceDelay = 1
+		config.Services.GuestPrefix = "Guest"
+	})
+	if s.services == nil {
+		t.Fatal("services did not start")
+	}
+	s.services.db.Register("owner", "secret", "")
+
+	squatter := registerTest(t, s, "owner")
+	squatter.expect("This nickname is registered")
+	line := squatter.expect(" NICK ")
+	if !strings.HasPrefix(line, ":owner!") || !strings.Contains(line, " NICK :Guest") {
+		t.Errorf("enforcement rename: %q", line)
+	}
+
+	// Identifying in time keeps the nick
+	start := time.Now()
+	owner := registerTest(t, s, "owner")
+	owner.expect("This nickname is registered")
+	owner.send("PRIVMSG NickServ :IDENTIFY secret")
+	owner.expect("You are now identified for owner")
+	time.Sleep(time.Until(start.Add(1500 * time.Millisecond)))
+	if renamed := containing(owner.sync(), " NICK "); len(renamed) != 0 {
+		t.Errorf("identified client was renamed: %q", renamed)
+	}
+}
+
+func TestNickServIdentifyLockout(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Features.EnableServices = true
+	})
+	s.services.db.Register("owner", "secret", "")
+
+	guesser := registerTest(t, s, "guesser")
+	for i := 0; i < accountMaxFailures; i++ {
+		guesser.send("PRIVMSG NickServ :IDENTIFY owner wrong")
+		guesser.expect("Invalid password for owner")
+	}
+	guesser.send("PRIVMSG NickServ :IDENTIFY owner secret")
+	guesser.expect("Too many failed attempts")
+	if guesser := s.GetClient("guesser"); guesser.Account() != "" {
+		t.Errorf("logged in as %s while locked out", guesser.Account())
+	}
+}
+
+func TestNickEnforcementTimers(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Features.EnableServices = true
+	})
+	s.services.db.Register("owner", "secret", "")
+	squatter := registerTest(t, s, "owner")
+	squatter.expect("This nickname is registered")
+	client := s.GetClient("owner")
+	timers := func() int {
+		s.services.mu.Lock()
+		defer s.services.mu.Unlock()
+		return len(s.services.enforce)
+	}
+
+	// A repeated check replaces the timer rather than adding another
+	s.services.CheckNick(client)
+	if n := timers(); n != 1 {
+		t.Errorf("%d enforcement timers after a second check, want 1", n)
+	}
+
+	// A client that has gone gets no timer, even if checked afterwards
+	s.RemoveClient(client)
+	s.services.CheckNick(client)
+	if n := timers(); n != 0 {
+		t.Errorf("%d enforcement timers left for a removed client", n)
+	}
+}
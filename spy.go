@@ -0,0 +1,525 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// spyMaxWatches limits how many masks one oper can watch at once
+const spyMaxWatches = 32
+
+// spyState holds the SPY watch lists and shadows of local opers. Both are
+// dropped when the oper disconnects.
+type spyState struct {
+	watches map[*Client][]string // Oper -> nick or nick!user@host masks
+	shadows map[*Client]*Client  // Oper -> user whose joins they follow
+	mu      sync.Mutex
+}
+
+func newSpyState() *spyState {
+	return &spyState{
+		watches: make(map[*Client][]string),
+		shadows: make(map[*Client]*Client),
+	}
+}
+
+// spyMaskMatches matches a watch mask against a user. A mask without ! or @
+// is a nick mask; otherwise it is matched against nick!user@host using the
+// real host.
+func spyMaskMatches(mask, nick, user, host string) bool {
+	mask = strings.ToLower(mask)
+	if !strings.ContainsAny(mask, "!@") {
+		return matchWildcard(mask, strings.ToLower(nick))
+	}
+	return matchWildcard(mask, strings.ToLower(nick+"!"+user+"@"+host))
+}
+
+// spyWatchers returns the opers with a watch mask matching the client under
+// its current nick or, for nick changes, the nick it had before
+func (s *Server) spyWatchers(c *Client, oldNick string) []*Client {
+	nick, user, host := c.Nick(), c.User(), c.Host()
+
+	s.spy.mu.Lock()
+	defer s.spy.mu.Unlock()
+
+	var opers []*Client
+	for oper, masks := range s.spy.watches {
+		if oper == c {
+			continue
+		}
+		for _, mask := range masks {
+			if spyMaskMatches(mask, nick, user, host) || (oldNick != "" && spyMaskMatches(mask, oldNick, user, host)) {
+				opers = append(opers, oper)
+				break
+			}
+		}
+	}
+	return opers
+}
+
+// spyEvent tells every oper watching a local user what the user just did
+func (s *Server) spyEvent(c *Client, oldNick, event string) {
+	if s.spy == nil || c.IsRemote() {
+		return
+	}
+	for _, oper := range s.spyWatchers(c, oldNick) {
+		oper.spyNotice("SPY: %s (%s@%s) %s", c.Nick(), c.User(), c.Host(), event)
+	}
+}
+
+// spyFollow ghost-joins the opers shadowing a user into a channel it joined
+func (s *Server) spyFollow(c *Client, channel *Channel) {
+	if s.spy == nil {
+		return
+	}
+
+	s.spy.mu.Lock()
+	var opers []*Client
+	for oper, target := range s.spy.shadows {
+		if target == c {
+			opers = append(opers, oper)
+		}
+	}
+	s.spy.mu.Unlock()
+
+	for _, oper := range opers {
+		if oper.IsInChannel(channel.Name()) {
+			continue
+		}
+		oper.ghostJoin(channel)
+		oper.spyNotice("SPY: Followed %s into %s", c.Nick(), channel.Name())
+	}
+}
+
+// spyStop drops a client's own watches and shadow, e.g. when it de-opers
+func (s *Server) spyStop(c *Client) {
+	if s.spy == nil {
+		return
+	}
+	s.spy.mu.Lock()
+	delete(s.spy.watches, c)
+	delete(s.spy.shadows, c)
+	s.spy.mu.Unlock()
+}
+
+// spyRemove drops a disconnecting client's watches and shadow, and stops
+// anyone shadowing it
+func (s *Server) spyRemove(c *Client) {
+	if s.spy == nil {
+		return
+	}
+	s.spyStop(c)
+
+	s.spy.mu.Lock()
+	var opers []*Client
+	for oper, target := range s.spy.shadows {
+		if target == c {
+			delete(s.spy.shadows, oper)
+			opers = append(opers, oper)
+		}
+	}
+	s.spy.mu.Unlock()
+
+	for _, oper := range opers {
+		oper.spyNotice("SPY: %s disconnected, no longer shadowing", c.Nick())
+	}
+}
+
+// spyNotice sends a server notice to the client
+func (c *Client) spyNotice(format string, args ...interface{}) {
+	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** %s", c.server.config.Server.Name, c.Nick(), fmt.Sprintf(format, args...)))
+}
+
+// ghostJoin adds the client to a channel as a ghost. Only the client sees
+// the JOIN; the channel and the rest of the network are not told.
+func (c *Client) ghostJoin(channel *Channel) {
+	channel.AddGhost(c)
+
+	join, extended := c.joinMessages(channel.Name())
+	c.Send(joinFor(c, join, extended))
+	if channel.Topic() != "" {
+		c.SendNumeric(RPL_TOPIC, channel.Name()+" :"+channel.Topic())
+		c.SendNumeric(RPL_TOPICWHOTIME, fmt.Sprintf("%s %s %d", channel.Name(), channel.TopicBy(), channel.TopicTime().Unix()))
+	}
+	c.sendNames(channel)
+}
+
+// ghostChannels returns the channels the client is a ghost in
+func (c *Client) ghostChannels() []*Channel {
+	var channels []*Channel
+	for _, channel := range c.GetChannels() {
+		if channel.IsGhost(c) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// handleSpy handles SPY command - covert surveillance and stealth operations
+func (c *Client) handleSpy(msg *Message) {
+	if len(msg.Params) < 1 {
+		c.spyNotice("SPY Usage: SPY <hide|watch|track|cloak|ghost|shadow|status>")
+		return
+	}
+
+	command := strings.ToLower(msg.Params[0])
+	switch command {
+	case "hide":
+		c.handleSpyHide(msg.Params[1:])
+	case "watch":
+		c.handleSpyWatch(msg.Params[1:])
+	case "track":
+		c.handleSpyTrack(msg.Params[1:])
+	case "cloak":
+		c.handleSpyCloak(msg.Params[1:])
+	case "ghost", "listen":
+		c.handleSpyGhost(msg.Params[1:])
+	case "shadow":
+		c.handleSpyShadow(msg.Params[1:])
+	case "status":
+		c.handleSpyStatus()
+	default:
+		c.spyNotice("Unknown SPY command: %s", command)
+	}
+}
+
+// handleSpyHide - become invisible to most commands and lists
+func (c *Client) handleSpyHide(args []string) {
+	if len(args) == 0 || strings.ToLower(args[0]) == "on" {
+		c.SetMode('H', true) // Hidden mode
+		c.spyNotice("You are now HIDDEN from WHO, WHOIS, and NAMES")
+		c.sendSnomask('d', fmt.Sprintf("Operator %s has entered STEALTH mode", c.Nick()))
+		c.audit("SPY", "", "ok", "hide on")
+	} else if strings.ToLower(args[0]) == "off" {
+		c.SetMode('H', false)
+		c.spyNotice("You are now VISIBLE again")
+		c.sendSnomask('d', fmt.Sprintf("Operator %s has left STEALTH mode", c.Nick()))
+		c.audit("SPY", "", "ok", "hide off")
+	} else {
+		c.spyNotice("Usage: SPY HIDE [ON|OFF]")
+	}
+}
+
+// handleSpyWatch - be told when matching users connect, change nick, join, part or quit
+func (c *Client) handleSpyWatch(args []string) {
+	if len(args) < 1 {
+		c.spyNotice("Usage: SPY WATCH <nick|nick!user@host> | SPY WATCH OFF [mask]")
+		return
+	}
+
+	spy := c.server.spy
+	if strings.ToLower(args[0]) == "off" {
+		spy.mu.Lock()
+		masks := spy.watches[c]
+		removed := 0
+		if len(args) > 1 {
+			var kept []string
+			for _, mask := range masks {
+				if strings.EqualFold(mask, args[1]) {
+					removed++
+				} else {
+					kept = append(kept, mask)
+				}
+			}
+			masks = kept
+		} else {
+			removed = len(masks)
+			masks = nil
+		}
+		if len(masks) == 0 {
+			delete(spy.watches, c)
+		} else {
+			spy.watches[c] = masks
+		}
+		spy.mu.Unlock()
+
+		target := "*"
+		if len(args) > 1 {
+			target = args[1]
+		}
+		if removed == 0 {
+			c.spyNotice("You are not watching %s", target)
+			return
+		}
+		c.spyNotice("Surveillance disabled for %s", target)
+		c.audit("SPY", target, "ok", "watch off")
+		return
+	}
+
+	mask := args[0]
+	spy.mu.Lock()
+	masks := spy.watches[c]
+	for _, existing := range masks {
+		if strings.EqualFold(existing, mask) {
+			spy.mu.Unlock()
+			c.spyNotice("You are already watching %s", mask)
+			return
+		}
+	}
+	if len(masks) >= spyMaxWatches {
+		spy.mu.Unlock()
+		c.spyNotice("Your watch list is full (%d entries)", spyMaxWatches)
+		return
+	}
+	spy.watches[c] = append(masks, mask)
+	spy.mu.Unlock()
+
+	c.spyNotice("Now watching %s", mask)
+	for _, client := range c.server.GetClients() {
+		if client == c || !client.IsRegistered() || client.IsRemote() ||
+			!spyMaskMatches(mask, client.Nick(), client.User(), client.Host()) {
+			continue
+		}
+		c.spyNotice("Currently matches %s (%s@%s) in: %s", client.Nick(), client.User(), client.Host(), c.getChannelList(client))
+	}
+	c.audit("SPY", mask, "ok", "watch")
+}
+
+// handleSpyTrack - get real-time location and movement tracking
+func (c *Client) handleSpyTrack(args []string) {
+	if len(args) < 1 {
+		c.spyNotice("Usage: SPY TRACK <nickname>")
+		return
+	}
+
+	target := args[0]
+	targetClient := c.server.GetClient(target)
+	if targetClient == nil {
+		c.SendNumeric(ERR_NOSUCHNICK, target+" :No such nick/channel")
+		return
+	}
+
+	// Show detailed tracking info
+	c.spyNotice("TRACKING %s", target)
+	c.spyNotice("Location: %s@%s", targetClient.User(), targetClient.Host())
+	c.spyNotice("Status: %s", c.getUserStatus(targetClient))
+	c.spyNotice("Channels: %s", c.getChannelList(targetClient))
+
+	if targetClient.Away() != "" {
+		c.spyNotice("Away: %s", targetClient.Away())
+	}
+	c.audit("SPY", targetClient.Nick(), "ok", "track")
+}
+
+// handleSpyCloak - show yourself to others under a chosen host. The host is
+// set as a vhost, so clients with chghost and the rest of the network see it
+// change, and opers with oper_bypass_host_hide still see the real host.
+func (c *Client) handleSpyCloak(args []string) {
+	if len(args) < 1 {
+		c.spyNotice("Usage: SPY CLOAK <host|off>")
+		return
+	}
+
+	host := args[0]
+	if strings.ToLower(host) == "off" {
+		c.mu.RLock()
+		cloaked := c.vhost != ""
+		c.mu.RUnlock()
+		if !cloaked {
+			c.spyNotice("Your identity is not cloaked")
+			return
+		}
+		c.setVhost("")
+		c.server.propagateChghost(c, c, "-")
+		c.spyNotice("Identity cloak removed")
+		c.audit("SPY", "", "ok", "cloak off")
+		return
+	}
+
+	if !validVhost(host) {
+		c.spyNotice("Invalid host %s", host)
+		return
+	}
+	c.setVhost(host)
+	c.server.propagateChghost(c, c, host)
+	c.spyNotice("Identity cloaked as %s", c.Prefix())
+	c.audit("SPY", host, "ok", "cloak")
+}
+
+// handleSpyGhost - sit in a channel without appearing in NAMES, WHO or the member count
+func (c *Client) handleSpyGhost(args []string) {
+	if len(args) < 1 {
+		c.spyNotice("Usage: SPY GHOST <#channel> | SPY GHOST OFF [#channel]")
+		return
+	}
+
+	target := args[0]
+	if strings.ToLower(target) == "off" {
+		channels := c.ghostChannels()
+		if len(args) > 1 {
+			channel := c.server.GetChannel(args[1])
+			if channel == nil || !channel.IsGhost(c) {
+				c.spyNotice("You are not a ghost in %s", args[1])
+				return
+			}
+			channels = []*Channel{channel}
+		}
+		if len(channels) == 0 {
+			c.spyNotice("You are not a ghost in any channel")
+			return
+		}
+		for _, channel := range channels {
+			c.handlePartChannel(channel.Name(), "Leaving")
+			c.audit("SPY", channel.Name(), "ok", "ghost off")
+		}
+		c.spyNotice("Ghost mode disabled")
+		return
+	}
+
+	if !isChannelName(target) {
+		c.spyNotice("Invalid channel name")
+		return
+	}
+
+	channel := c.server.GetChannel(target)
+	if channel == nil {
+		c.SendNumeric(ERR_NOSUCHCHANNEL, target+" :No such channel")
+		return
+	}
+
+	if c.IsInChannel(target) {
+		if channel.IsGhost(c) {
+			c.spyNotice("You are already a GHOST in %s", channel.Name())
+		} else {
+			c.spyNotice("You are visibly on %s, part it first", channel.Name())
+		}
+		return
+	}
+
+	c.ghostJoin(channel)
+	c.spyNotice("You are now a GHOST in %s", channel.Name())
+	c.spyNotice("You can see everything but are invisible to users")
+	c.audit("SPY", channel.Name(), "ok", "ghost")
+}
+
+// handleSpyShadow - follow a user invisibly across channels
+func (c *Client) handleSpyShadow(args []string) {
+	if len(args) < 1 {
+		c.spyNotice("Usage: SPY SHADOW <nickname|off>")
+		return
+	}
+
+	spy := c.server.spy
+	target := args[0]
+	if strings.ToLower(target) == "off" {
+		spy.mu.Lock()
+		shadowed, exists := spy.shadows[c]
+		delete(spy.shadows, c)
+		spy.mu.Unlock()
+
+		if !exists {
+			c.spyNotice("You are not shadowing anyone")
+			return
+		}
+		c.spyNotice("Shadow mode disabled; use SPY GHOST OFF to leave the channels you followed %s into", shadowed.Nick())
+		c.audit("SPY", shadowed.Nick(), "ok", "shadow off")
+		return
+	}
+
+	targetClient := c.server.GetClient(target)
+	if targetClient == nil {
+		c.SendNumeric(ERR_NOSUCHNICK, target+" :No such nick/channel")
+		return
+	}
+	if targetClient == c {
+		c.spyNotice("You cannot shadow yourself")
+		return
+	}
+	if targetClient.IsRemote() {
+		c.spyNotice("%s is on %s; only users on this server can be shadowed", targetClient.Nick(), targetClient.ServerName())
+		return
+	}
+
+	spy.mu.Lock()
+	spy.shadows[c] = targetClient
+	spy.mu.Unlock()
+
+	c.spyNotice("Now shadowing %s", targetClient.Nick())
+	c.spyNotice("You will automatically follow them to any channel they join")
+	for _, channel := range targetClient.GetChannels() {
+		if channel.IsGhost(targetClient) || c.IsInChannel(channel.Name()) {
+			continue
+		}
+		c.ghostJoin(channel)
+	}
+	c.audit("SPY", targetClient.Nick(), "ok", "shadow")
+}
+
+// handleSpyStatus - show current spy operations
+func (c *Client) handleSpyStatus() {
+	c.spyNotice("=== SPY STATUS ===")
+
+	if c.HasMode('H') {
+		c.spyNotice("STEALTH: Active (Hidden from WHO/WHOIS/NAMES)")
+	} else {
+		c.spyNotice("STEALTH: Inactive")
+	}
+
+	c.mu.RLock()
+	vhost := c.vhost
+	c.mu.RUnlock()
+	if vhost != "" {
+		c.spyNotice("CLOAK: %s", vhost)
+	} else {
+		c.spyNotice("CLOAK: Inactive")
+	}
+
+	spy := c.server.spy
+	spy.mu.Lock()
+	masks := append([]string(nil), spy.watches[c]...)
+	shadowed := spy.shadows[c]
+	spy.mu.Unlock()
+
+	if len(masks) > 0 {
+		c.spyNotice("WATCH: %s", strings.Join(masks, " "))
+	} else {
+		c.spyNotice("WATCH: None active")
+	}
+
+	var ghosts []string
+	for _, channel := range c.ghostChannels() {
+		ghosts = append(ghosts, channel.Name())
+	}
+	if len(ghosts) > 0 {
+		c.spyNotice("GHOST: %s", strings.Join(ghosts, " "))
+	} else {
+		c.spyNotice("GHOST: None active")
+	}
+
+	if shadowed != nil {
+		c.spyNotice("SHADOW: %s", shadowed.Nick())
+	} else {
+		c.spyNotice("SHADOW: None active")
+	}
+}
+
+// Helper functions for spy operations
+func (c *Client) getChannelList(target *Client) string {
+	channels := target.GetChannels()
+	var channelNames []string
+	for _, channel := range channels {
+		channelNames = append(channelNames, channel.Name())
+	}
+	if len(channelNames) == 0 {
+		return "None"
+	}
+	return strings.Join(channelNames, " ")
+}
+
+func (c *Client) getUserStatus(target *Client) string {
+	status := "Online"
+	if target.Away() != "" {
+		status = "Away"
+	}
+	if target.IsOper() {
+		status += " (Operator)"
+	}
+	if target.HasMode('i') {
+		status += " (Invisible)"
+	}
+	if target.HasMode('B') {
+		status += " (Bot)"
+	}
+	return status
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpyMaskMatches(t *testing.T) {
+	tests := []struct {
+		mask string
+		want bool
+	}{
+		{"bob", true},
+		{"BOB", true},
+		{"bo*", true},
+		{"eve", false},
+		{"bob!*@*", true},
+		{"*!~bob@203.0.113.*", true},
+		{"*@198.51.100.*", false},
+		{"*!eve@*", false},
+	}
+	for _, tt := range tests {
+		if got := spyMaskMatches(tt.mask, "Bob", "~bob", "203.0.113.5"); got != tt.want {
+			t.Errorf("spyMaskMatches(%q) = %v, want %v", tt.mask, got, tt.want)
+		}
+	}
+}
+
+func TestChannelGhost(t *testing.T) {
+	ch := NewChannel("#test")
+	ghost := &Client{channels: make(map[string]*Channel)}
+	user := &Client{channels: make(map[string]*Channel)}
+
+	ch.AddGhost(ghost)
+	ch.AddClient(user)
+
+	if !ch.IsGhost(ghost) || ch.IsGhost(user) {
+		t.Fatal("ghost membership not tracked")
+	}
+	if got := ch.VisibleCount(); got != 1 {
+		t.Errorf("VisibleCount() = %d, want 1", got)
+	}
+	if !ch.IsOperator(user) {
+		t.Error("first visible member should be opped")
+	}
+	if ch.CanSendMessage(ghost) {
+		t.Error("a ghost should not be able to speak")
+	}
+}
+
+func TestSpyCloakAndHide(t *testing.T) {
+	s := newTestServer(t)
+	spy := registerTest(t, s, "spy")
+	bob := registerTest(t, s, "bob")
+	operTest(t, s, spy, "spy", "admin")
+
+	spy.send("SPY CLOAK staff.example")
+	spy.expect("Identity cloaked as spy!spy@staff.example")
+	bob.send("WHOIS spy")
+	if line := bob.expect(" 311 "); !strings.Contains(line, " spy spy staff.example ") {
+		t.Errorf("cloaked WHOIS: %q", line)
+	}
+	spy.send("SPY STATUS")
+	spy.expect("CLOAK: staff.example")
+
+	spy.send("SPY CLOAK off")
+	spy.expect("Identity cloak removed")
+	bob.send("WHOIS spy")
+	if line := bob.expect(" 311 "); strings.Contains(line, "staff.example") {
+		t.Errorf("cloak not removed: %q", line)
+	}
+	spy.send("SPY CLOAK off")
+	spy.expect("Your identity is not cloaked")
+	spy.send("SPY CLOAK :bad host")
+	spy.expect("Invalid host bad host")
+
+	spy.send("SPY HIDE maybe")
+	spy.expect("Usage: SPY HIDE [ON|OFF]")
+
+	entries, err := s.audit.Search(AuditFilter{Oper: "spy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details []string
+	for _, entry := range entries {
+		if entry.Command == "SPY" {
+			details = append(details, entry.Detail)
+		}
+	}
+	if strings.Join(details, ",") != "cloak,cloak off" {
+		t.Errorf("audited SPY actions: %v", details)
+	}
+}
+
+func TestSpyWatchEvents(t *testing.T) {
+	s := newTestServer(t)
+	spy := registerTest(t, s, "spy")
+	operTest(t, s, spy, "spy", "admin")
+	spy.send("SPY WATCH bob*")
+	spy.expect("Now watching bob*")
+
+	bob := registerTest(t, s, "bob")
+	registerTest(t, s, "carol")
+	bob.send("JOIN #watched", "PART #watched :bye", "NICK bobby", "QUIT :done")
+	for _, event := range []string{"connected", "joined #watched", "left #watched (bye)", "changed nick from bob", "quit (Quit: done)"} {
+		if line := spy.expect("SPY: bob"); !strings.HasSuffix(line, ") "+event) {
+			t.Errorf("expected %q, got %q", event, line)
+		}
+	}
+	if lines := spy.sync(); len(containing(lines, "carol")) != 0 {
+		t.Errorf("unwatched user reported: %q", lines)
+	}
+
+	spy.send("SPY WATCH OFF bob*")
+	spy.expect("Surveillance disabled for bob*")
+	registerTest(t, s, "bob")
+	if lines := spy.sync(); len(containing(lines, "SPY:")) != 0 {
+		t.Errorf("events after WATCH OFF: %q", lines)
+	}
+
+	entries, err := s.audit.Search(AuditFilter{Oper: "spy", Target: "bob*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Detail != "watch" || entries[1].Detail != "watch off" {
+		t.Errorf("audit entries: %+v", entries)
+	}
+}
+
+func TestSpyGhostHidden(t *testing.T) {
+	s := newTestServer(t)
+	alice := registerTest(t, s, "alice")
+	spy := registerTest(t, s, "spy")
+	operTest(t, s, spy, "spy", "admin")
+	alice.send("JOIN #room")
+	alice.expect(" 366 ")
+
+	spy.send("SPY GHOST #room")
+	spy.expect("JOIN :#room")
+	spy.expect("You are now a GHOST in #room")
+	if lines := alice.sync(); len(containing(lines, "spy")) != 0 {
+		t.Errorf("ghost join seen by a member: %q", lines)
+	}
+
+	// Members do not see the ghost, but the ghost sees them
+	bob := registerTest(t, s, "bob")
+	bob.send("JOIN #room")
+	if line := bob.expect(" 353 "); strings.Contains(line, "spy") {
+		t.Errorf("ghost in NAMES: %q", line)
+	}
+	spy.expect(":bob!")
+	bob.send("WHO #room")
+	if lines := bob.readUntil(" 315 "); len(containing(lines, " spy ")) != 0 {
+		t.Errorf("ghost in WHO: %q", lines)
+	}
+	alice.send("PRIVMSG #room :hello")
+	spy.expect("PRIVMSG #room :hello")
+	spy.send("PRIVMSG #room :boo")
+	spy.expect(" 404 ")
+
+	// A shadow follows its target into new channels, unseen
+	spy.send("SPY SHADOW bob")
+	spy.expect("Now shadowing bob")
+	bob.send("JOIN #elsewhere")
+	if line := bob.expect(" 353 "); strings.Contains(line, "spy") {
+		t.Errorf("shadow in NAMES: %q", line)
+	}
+	spy.expect("JOIN :#elsewhere")
+	spy.expect("Followed bob into #elsewhere")
+
+	spy.send("SPY GHOST OFF")
+	spy.expect("Ghost mode disabled")
+	for _, tc := range []*testConn{alice, bob} {
+		if lines := tc.sync(); len(containing(lines, "spy")) != 0 {
+			t.Errorf("ghost part seen by a member: %q", lines)
+		}
+	}
+
+	entries, err := s.audit.Search(AuditFilter{Oper: "spy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details []string
+	for _, entry := range entries {
+		if entry.Command == "SPY" {
+			details = append(details, entry.Detail+" "+entry.Target)
+		}
+	}
+	if got := strings.Join(details, ","); got != "ghost #room,shadow bob,ghost off #room,ghost off #elsewhere" &&
+		got != "ghost #room,shadow bob,ghost off #elsewhere,ghost off #room" {
+		t.Errorf("audited SPY actions: %s", got)
+	}
+}
+
+func TestSpyCleanupOnDisconnect(t *testing.T) {
+	s := newTestServer(t)
+	alice := registerTest(t, s, "alice")
+	watcher := registerTest(t, s, "watcher")
+	shadow := registerTest(t, s, "shadow")
+	operTest(t, s, watcher, "watcher", "admin")
+	operTest(t, s, shadow, "shadow", "admin")
+	watcher.send("SPY WATCH alice", "SPY SHADOW alice")
+	watcher.expect("Now shadowing alice")
+	shadow.send("SPY SHADOW alice")
+	shadow.expect("Now shadowing alice")
+
+	// A disconnecting oper's watches and shadow are dropped
+	client := s.GetClient("watcher")
+	watcher.send("QUIT")
+	eventually(t, "the watcher's SPY state to go", func() bool {
+		s.spy.mu.Lock()
+		defer s.spy.mu.Unlock()
+		_, watching := s.spy.watches[client]
+		_, shadowing := s.spy.shadows[client]
+		return !watching && !shadowing
+	})
+
+	// A disconnecting target ends the shadows on it
+	alice.send("QUIT")
+	shadow.expect("alice disconnected, no longer shadowing")
+	s.spy.mu.Lock()
+	defer s.spy.mu.Unlock()
+	if len(s.spy.watches) != 0 || len(s.spy.shadows) != 0 {
+		t.Errorf("SPY state left behind: watches %v, shadows %v", s.spy.watches, s.spy.shadows)
+	}
+}
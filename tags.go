@@ -0,0 +1,169 @@
+package main
+
+import (
+	"time"
+)
+
+// tagCapabilities names the capability a client needs to receive a tag.
+// Every other tag, including msgid and client-only tags, needs message-tags.
+var tagCapabilities = map[string]string{
+	"time":    "server-time",
+	"account": "account-tag",
+	"batch":   "batch",
+	"label":   "labeled-response",
+}
+
+// isClientOnlyTag returns true for tags clients attach for each other, e.g.
+// +typing or +draft/reply
+func isClientOnlyTag(name string) bool {
+	return len(name) > 1 && name[0] == '+'
+}
+
+// clientOnlyTags returns the client-only tags of a message. If together they
+// exceed the client tag budget none are kept, so a relayed line always has
+// room for the server's own tags.
+func clientOnlyTags(msg *Message) map[string]string {
+	var tags map[string]string
+	length := 0
+	for name, value := range msg.Tags {
+		if !isClientOnlyTag(name) {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[name] = value
+		length += len(name) + len(escapeTagValue(value)) + 2
+	}
+	if length > maxClientTagsLength-2 {
+		return nil
+	}
+	return tags
+}
+
+// clientTags returns the client-only tags the client sent with a message;
+// tags from a client that did not negotiate message-tags are ignored
+func (c *Client) clientTags(msg *Message) map[string]string {
+	if !c.HasCapability("message-tags") {
+		return nil
+	}
+	return clientOnlyTags(msg)
+}
+
+// tagsFor returns the message as the client should see it, with only the
+// tags of the capabilities it negotiated. The message itself is not changed
+// since the same one is usually sent to many clients.
+func (c *Client) tagsFor(msg *Message) *Message {
+	if len(msg.Tags) == 0 {
+		return msg
+	}
+
+	messageTags := c.HasCapability("message-tags")
+	var tags map[string]string
+	for name, value := range msg.Tags {
+		if capability, ok := tagCapabilities[name]; ok {
+			if !c.HasCapability(capability) {
+				continue
+			}
+		} else if !messageTags {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[name] = value
+	}
+	if len(tags) == len(msg.Tags) {
+		return msg
+	}
+
+	stripped := *msg
+	stripped.Tags = tags
+	return &stripped
+}
+
+// stampTags sets the server-time, msgid and account tags on a message
+func stampTags(msg *Message, t time.Time, msgid, account string) {
+	msg.SetTag("time", t.UTC().Format(serverTimeFormat))
+	msg.SetTag("msgid", msgid)
+	if account != "" {
+		msg.SetTag("account", account)
+	}
+}
+
+// taggedMessage builds a message from the client stamped with the time, a
+// new msgid and the client's account, for JOIN, PART and QUIT. The last
+// parameter is always sent as a trailing one, as these lines always were.
+func (c *Client) taggedMessage(command string, params ...string) *Message {
+	msg := NewMessage(c.Prefix(), command, params...)
+	msg.ForceTrailing = true
+	stampTags(msg, time.Now(), newMsgID(), c.Account())
+	return msg
+}
+
+// relayMessage builds the line delivered for a PRIVMSG, NOTICE or TAGMSG,
+// carrying the item's msgid and time so it matches what history replays
+func relayMessage(item HistoryItem, clientTags map[string]string) *Message {
+	params := []string{item.Target}
+	if item.Command != "TAGMSG" {
+		params = append(params, item.Text)
+	}
+	msg := NewMessage(item.Source, item.Command, params...)
+	msg.ForceTrailing = item.Command != "TAGMSG"
+	stampTags(msg, item.Time, item.MsgID, item.Account)
+	for name, value := range clientTags {
+		msg.SetTag(name, value)
+	}
+	return msg
+}
+
+// adoptServerTags keeps the msgid and time a peer server stamped a message
+// with, so the message has the same msgid across the network
+func (item *HistoryItem) adoptServerTags(msg *Message) {
+	if msgid, ok := msg.Tag("msgid"); ok && msgid != "" {
+		item.MsgID = msgid
+	}
+	if value, ok := msg.Tag("time"); ok {
+		if t, err := time.Parse(serverTimeFormat, value); err == nil {
+			item.Time = t
+		}
+	}
+}
+
+// handleTagmsg handles TAGMSG <target>, which carries only client-only tags
+// and is delivered only to clients that negotiated message-tags
+func (c *Client) handleTagmsg(msg *Message) {
+	target := msg.Params[0]
+
+	if isChannelName(target) {
+		channel := c.server.GetChannel(target)
+		if channel == nil {
+			c.SendNumeric(ERR_NOSUCHCHANNEL, target+" :No such channel")
+			return
+		}
+		if !c.IsInChannel(target) || !channel.CanSendMessage(c) {
+			c.SendNumeric(ERR_CANNOTSENDTOCHAN, target+" :Cannot send to channel")
+			return
+		}
+
+		relay := relayMessage(c.historyItem("TAGMSG", channel.Name(), ""), c.clientTags(msg))
+		channel.BroadcastMessage(relay, c)
+		c.echo(relay)
+		c.server.propagateMessage(c, relay)
+		return
+	}
+
+	targetClient := c.server.GetClient(target)
+	if targetClient == nil {
+		c.SendNumeric(ERR_NOSUCHNICK, target+" :No such nick/channel")
+		return
+	}
+
+	relay := relayMessage(c.historyItem("TAGMSG", targetClient.Nick(), ""), c.clientTags(msg))
+	if targetClient.IsRemote() {
+		c.server.propagateMessage(c, relay)
+	} else {
+		targetClient.Send(relay)
+	}
+	c.echo(relay)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagsFor(t *testing.T) {
+	msg, _ := ParseMessage("@time=2024-01-01T00:00:00.000Z;msgid=abc;account=bob;+typing=active :bob!b@h PRIVMSG #c :hi")
+
+	tests := []struct {
+		caps []string
+		want string
+	}{
+		{nil, ":bob!b@h PRIVMSG #c :hi"},
+		{[]string{"server-time"}, "@time=2024-01-01T00:00:00.000Z :bob!b@h PRIVMSG #c :hi"},
+		{[]string{"account-tag"}, "@account=bob :bob!b@h PRIVMSG #c :hi"},
+		{[]string{"message-tags"}, "@+typing=active;msgid=abc :bob!b@h PRIVMSG #c :hi"},
+		{[]string{"message-tags", "server-time", "account-tag"}, msg.String()},
+	}
+	for _, tt := range tests {
+		c := &Client{capabilities: make(map[string]bool)}
+		for _, name := range tt.caps {
+			c.capabilities[name] = true
+		}
+		if got := c.tagsFor(msg).Line(); got != tt.want {
+			t.Errorf("caps %v: got %q, want %q", tt.caps, got, tt.want)
+		}
+	}
+	if len(msg.Tags) != 4 {
+		t.Errorf("tagsFor changed the original message: %v", msg.Tags)
+	}
+}
+
+func TestClientOnlyTags(t *testing.T) {
+	msg, _ := ParseMessage("@+draft/reply=abc;+typing=active;msgid=forged;time=x PRIVMSG #c :hi")
+	tags := clientOnlyTags(msg)
+	if len(tags) != 2 || tags["+draft/reply"] != "abc" || tags["+typing"] != "active" {
+		t.Errorf("clientOnlyTags = %v", tags)
+	}
+
+	msg.SetTag("+big", strings.Repeat("x", maxClientTagsLength))
+	if tags := clientOnlyTags(msg); tags != nil {
+		t.Errorf("oversized client tags were kept: %d tags", len(tags))
+	}
+}
+
+func TestRelayMessage(t *testing.T) {
+	item := HistoryItem{
+		MsgID:   "abc",
+		Time:    time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Source:  "bob!b@h",
+		Command: "PRIVMSG",
+		Target:  "#c",
+		Text:    "hi",
+	}
+	want := "@+typing=done;msgid=abc;time=2024-01-01T12:00:00.000Z :bob!b@h PRIVMSG #c :hi"
+	if got := relayMessage(item, map[string]string{"+typing": "done"}).Line(); got != want {
+		t.Errorf("relayMessage = %q, want %q", got, want)
+	}
+
+	item.Command = "TAGMSG"
+	want = "@msgid=abc;time=2024-01-01T12:00:00.000Z :bob!b@h TAGMSG #c"
+	if got := relayMessage(item, nil).Line(); got != want {
+		t.Errorf("relayMessage = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to the six digits we use
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		step, ok := verifyTOTP(secret, tt.code, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("code %s rejected at %d", tt.code, tt.unix)
+			continue
+		}
+		if step != tt.unix/30 {
+			t.Errorf("code %s matched step %d, want %d", tt.code, step, tt.unix/30)
+		}
+	}
+
+	if _, ok := verifyTOTP(secret, "287082", time.Unix(59+120, 0)); ok {
+		t.Error("code accepted outside the allowed clock skew")
+	}
+	if _, ok := verifyTOTP(secret, "28708", time.Unix(59, 0)); ok {
+		t.Error("short code accepted")
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	r := newTOTPReplay()
+	if !r.Use("admin", 100) {
+		t.Fatal("first use rejected")
+	}
+	if r.Use("Admin", 100) || r.Use("admin", 99) {
+		t.Error("code reused")
+	}
+	if !r.Use("admin", 101) || !r.Use("other", 100) {
+		t.Error("later step or other oper rejected")
+	}
+}
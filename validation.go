@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"net"
 	"strings"
 )
 
@@ -28,6 +32,13 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid SSL port number: %d", c.Server.Listen.SSLPort)
 	}
 
+	if c.Server.SID == "" {
+		c.Server.SID = defaultSID(c.Server.Name)
+	}
+	if !isValidSID(c.Server.SID) {
+		return fmt.Errorf("invalid server SID %q: must be a digit followed by two letters or digits", c.Server.SID)
+	}
+
 	// Validate limits
 	if c.Limits.MaxClients <= 0 {
 		c.Limits.MaxClients = 1000 // Default
@@ -45,6 +56,14 @@ func (c *Config) Validate() error {
 		c.Limits.PingTimeout = 300 // Default 5 minutes
 	}
 
+	if c.Limits.PingFrequency <= 0 {
+		c.Limits.PingFrequency = 120 // Default 2 minutes
+	}
+
+	if c.Limits.RegistrationTimeout <= 0 {
+		c.Limits.RegistrationTimeout = 60 // Default 1 minute
+	}
+
 	if c.Limits.FloodLines <= 0 {
 		c.Limits.FloodLines = 10 // Default
 	}
@@ -53,6 +72,132 @@ func (c *Config) Validate() error {
 		c.Limits.FloodSeconds = 60 // Default
 	}
 
+	if c.Limits.MaxMonitor <= 0 {
+		c.Limits.MaxMonitor = 100 // Default
+	}
+
+	// Validate connection classes
+	hasDefaultClass := false
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		if class.Name == "" {
+			return fmt.Errorf("connection class %d: name cannot be empty", i)
+		}
+		if class.Name == "default" {
+			hasDefaultClass = true
+		}
+		if class.SendQ <= 0 {
+			class.SendQ = 1048576 // Default 1 MiB
+		}
+		if class.MaxClients < 0 || class.MaxPerIP < 0 || class.RecvQ < 0 || class.PingFrequency < 0 ||
+			class.FloodLines < 0 || class.FloodSeconds < 0 {
+			return fmt.Errorf("connection class %s: limits cannot be negative", class.Name)
+		}
+		if class.RecvQ > 0 && class.RecvQ < maxClientTagsLength+maxMessageLength {
+			return fmt.Errorf("connection class %s: recvq must be at least %d bytes", class.Name, maxClientTagsLength+maxMessageLength)
+		}
+		for _, mask := range class.Hosts {
+			if strings.Contains(mask, "/") && !isHostnameMask(mask) {
+				if _, _, err := net.ParseCIDR(mask); err != nil {
+					return fmt.Errorf("connection class %s: invalid CIDR block %s", class.Name, mask)
+				}
+			}
+		}
+		for _, port := range class.Ports {
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("connection class %s: invalid port number: %d", class.Name, port)
+			}
+		}
+	}
+	if !hasDefaultClass {
+		c.Classes = append(c.Classes, ConnectionClass{Name: "default", SendQ: 1048576})
+	}
+
+	// Validate link blocks
+	for i, link := range c.Links {
+		if link.Name == "" {
+			return fmt.Errorf("link %d: name cannot be empty", i)
+		}
+		if strings.EqualFold(link.Name, c.Server.Name) {
+			return fmt.Errorf("link %s: cannot link to ourselves", link.Name)
+		}
+		if link.Host == "" {
+			return fmt.Errorf("link %s: host cannot be empty", link.Name)
+		}
+		if link.Port <= 0 || link.Port > 65535 {
+			return fmt.Errorf("link %s: invalid port number: %d", link.Name, link.Port)
+		}
+		if link.SendPassword == "" || link.AcceptPassword == "" {
+			return fmt.Errorf("link %s: send_password and accept_password are required", link.Name)
+		}
+	}
+
+	// Validate privacy settings
+	if c.Privacy.MaskedHostSuffix == "" {
+		c.Privacy.MaskedHostSuffix = "users." + strings.ToLower(c.Server.Network)
+	}
+
+	if c.Privacy.CloakKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("failed to generate cloak key: %v", err)
+		}
+		c.Privacy.CloakKey = hex.EncodeToString(key)
+		log.Printf("Warning: privacy.cloak_key is not set; cloaked hosts will change on every restart")
+	} else if len(c.Privacy.CloakKey) < 16 {
+		return fmt.Errorf("privacy.cloak_key must be at least 16 characters")
+	} else if strings.HasPrefix(strings.ToLower(c.Privacy.CloakKey), "change-this") {
+		return fmt.Errorf("privacy.cloak_key is still the example value; set a long random secret")
+	}
+
+	// Validate server bans
+	if c.Bans.DatabaseFile == "" {
+		c.Bans.DatabaseFile = "data/bans.json"
+	}
+
+	// Validate chat history
+	if c.History.MaxMessages <= 0 {
+		c.History.MaxMessages = 1000
+	}
+	if c.History.MaxAgeDays < 0 {
+		c.History.MaxAgeDays = 0
+	}
+	if c.History.QueryLimit <= 0 {
+		c.History.QueryLimit = 100
+	}
+	for _, policy := range c.History.Channels {
+		if !isChannelName(policy.Mask) {
+			return fmt.Errorf("history channel policy: invalid channel mask %q", policy.Mask)
+		}
+		if policy.MaxMessages < 0 || policy.MaxAgeDays < 0 {
+			return fmt.Errorf("history channel policy %s: limits cannot be negative", policy.Mask)
+		}
+	}
+
+	// Validate the oper audit log
+	if c.Audit.File == "" {
+		c.Audit.File = "data/audit.log"
+	}
+	if c.Audit.MaxSize <= 0 {
+		c.Audit.MaxSize = 10
+	}
+	if c.Audit.MaxBackups != nil && *c.Audit.MaxBackups < 0 {
+		return fmt.Errorf("audit max_backups cannot be negative: %d", *c.Audit.MaxBackups)
+	}
+
+	// Validate services
+	if c.Services.DatabaseFile == "" {
+		c.Services.DatabaseFile = "data/services.json"
+	}
+
+	if c.Services.EnforceDelay <= 0 {
+		c.Services.EnforceDelay = 60 // Default 1 minute
+	}
+
+	if c.Services.GuestPrefix == "" {
+		c.Services.GuestPrefix = "Guest"
+	}
+
 	// Validate channels
 	for _, channelName := range c.Channels.AutoJoin {
 		if !isChannelName(channelName) {
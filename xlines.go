@@ -0,0 +1,611 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server ban (X-line) types
+const (
+	KLine = "K" // user@host ban on this server
+	GLine = "G" // user@host ban on the whole network
+	ZLine = "Z" // IP or CIDR ban, checked before registration
+)
+
+// Server ban numerics
+const (
+	RPL_STATSKLINE  = 216
+	RPL_ENDOFSTATS  = 219
+	RPL_STATSGLINE  = 223
+	RPL_STATSZLINE  = 225
+	RPL_STATSUPTIME = 242
+)
+
+// banExpiryInterval is how often expired bans are removed
+const banExpiryInterval = 30 * time.Second
+
+var (
+	errBanExists = errors.New("ban already exists")
+	errNoSuchBan = errors.New("no such ban")
+)
+
+// ServerBan is a K-, G- or Z-line
+type ServerBan struct {
+	Type    string    `json:"type"` // K, G or Z
+	Mask    string    `json:"mask"` // user@host for K/G-lines, IP or CIDR for Z-lines
+	Reason  string    `json:"reason"`
+	SetBy   string    `json:"set_by"`
+	SetAt   time.Time `json:"set_at"`
+	Expires time.Time `json:"expires,omitempty"` // Zero for permanent bans
+}
+
+// Permanent returns true if the ban never expires
+func (b *ServerBan) Permanent() bool {
+	return b.Expires.IsZero()
+}
+
+// Expired returns true if the ban has run out
+func (b *ServerBan) Expired(now time.Time) bool {
+	return !b.Permanent() && !now.Before(b.Expires)
+}
+
+// Matches checks the ban against a connection's user name and IP address
+func (b *ServerBan) Matches(user, ip string) bool {
+	if b.Type == ZLine {
+		return matchIPMask(b.Mask, ip)
+	}
+
+	maskUser, maskHost := "*", b.Mask
+	if at := strings.LastIndex(b.Mask, "@"); at >= 0 {
+		maskUser, maskHost = b.Mask[:at], b.Mask[at+1:]
+	}
+	if !matchWildcard(maskUser, user) && !matchWildcard(maskUser, strings.TrimPrefix(user, "~")) {
+		return false
+	}
+	return matchIPMask(maskHost, ip) || matchWildcard(maskHost, ip)
+}
+
+// Remaining describes how long the ban still has to run
+func (b *ServerBan) Remaining() string {
+	if b.Permanent() {
+		return "permanent"
+	}
+	return formatDuration(time.Until(b.Expires))
+}
+
+// matchIPMask matches an IP address against an address or CIDR block
+func matchIPMask(mask, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if strings.Contains(mask, "/") {
+		_, network, err := net.ParseCIDR(mask)
+		return err == nil && network.Contains(addr)
+	}
+	if maskIP := net.ParseIP(mask); maskIP != nil {
+		return maskIP.Equal(addr)
+	}
+	return matchWildcard(mask, ip)
+}
+
+// parseBanDuration parses a ban duration: a plain number of minutes or a
+// combination such as 1w2d3h4m5s. Zero means permanent.
+func parseBanDuration(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if minutes, err := strconv.Atoi(s); err == nil {
+		if minutes < 0 {
+			return 0, false
+		}
+		return time.Duration(minutes) * time.Minute, true
+	}
+
+	var total time.Duration
+	number := ""
+	for _, ch := range strings.ToLower(s) {
+		if ch >= '0' && ch <= '9' {
+			number += string(ch)
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, false
+		}
+		number = ""
+
+		switch ch {
+		case 'w':
+			total += time.Duration(n) * 7 * 24 * time.Hour
+		case 'd':
+			total += time.Duration(n) * 24 * time.Hour
+		case 'h':
+			total += time.Duration(n) * time.Hour
+		case 'm':
+			total += time.Duration(n) * time.Minute
+		case 's':
+			total += time.Duration(n) * time.Second
+		default:
+			return 0, false
+		}
+	}
+	if number != "" {
+		return 0, false
+	}
+	return total, true
+}
+
+// formatDuration renders a duration as e.g. 2d3h4m
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return "0s"
+	}
+	d = d.Round(time.Second)
+
+	var out string
+	for _, unit := range []struct {
+		size time.Duration
+		name string
+	}{{24 * time.Hour, "d"}, {time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}} {
+		if d >= unit.size {
+			out += fmt.Sprintf("%d%s", d/unit.size, unit.name)
+			d %= unit.size
+		}
+	}
+	return out
+}
+
+// BanDB is the persistent server ban database
+type BanDB struct {
+	Bans []*ServerBan `json:"bans"`
+
+	filename string
+	mu       sync.RWMutex
+}
+
+// LoadBanDB loads the ban database, starting empty if the file does not exist
+func LoadBanDB(filename string) (*BanDB, error) {
+	db := &BanDB{filename: filename}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, fmt.Errorf("failed to read ban database: %v", err)
+	}
+
+	if err := json.Unmarshal(data, db); err != nil {
+		return nil, fmt.Errorf("failed to parse ban database: %v", err)
+	}
+
+	return db, nil
+}
+
+// saveLocked writes the database to disk; the caller must hold db.mu
+func (db *BanDB) saveLocked() error {
+	if db.filename == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal ban database: %v", err)
+	}
+
+	if dir := filepath.Dir(db.filename); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create ban database directory: %v", err)
+		}
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated database
+	tmp := db.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write ban database: %v", err)
+	}
+	if err := os.Rename(tmp, db.filename); err != nil {
+		return fmt.Errorf("failed to replace ban database: %v", err)
+	}
+
+	return nil
+}
+
+// findLocked returns the index of a ban; the caller must hold db.mu
+func (db *BanDB) findLocked(banType, mask string) int {
+	for i, ban := range db.Bans {
+		if ban.Type == banType && strings.EqualFold(ban.Mask, mask) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add stores a new ban
+func (db *BanDB) Add(ban *ServerBan) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if i := db.findLocked(ban.Type, ban.Mask); i >= 0 {
+		if !db.Bans[i].Expired(time.Now()) {
+			return errBanExists
+		}
+		db.Bans = append(db.Bans[:i], db.Bans[i+1:]...)
+	}
+
+	db.Bans = append(db.Bans, ban)
+	return db.saveLocked()
+}
+
+// Remove deletes a ban and returns it
+func (db *BanDB) Remove(banType, mask string) (*ServerBan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	i := db.findLocked(banType, mask)
+	if i < 0 {
+		return nil, errNoSuchBan
+	}
+
+	ban := db.Bans[i]
+	db.Bans = append(db.Bans[:i], db.Bans[i+1:]...)
+	return ban, db.saveLocked()
+}
+
+// List returns the active bans of a type, oldest first
+func (db *BanDB) List(banType string) []ServerBan {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	var bans []ServerBan
+	for _, ban := range db.Bans {
+		if ban.Type == banType && !ban.Expired(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].SetAt.Before(bans[j].SetAt) })
+	return bans
+}
+
+// Match returns the first active ban of the given types matching a
+// connection, or nil
+func (db *BanDB) Match(user, ip string, types ...string) *ServerBan {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	for _, ban := range db.Bans {
+		if ban.Expired(now) {
+			continue
+		}
+		for _, banType := range types {
+			if ban.Type == banType && ban.Matches(user, ip) {
+				found := *ban
+				return &found
+			}
+		}
+	}
+	return nil
+}
+
+// Expire removes the bans that have run out and returns them
+func (db *BanDB) Expire() []ServerBan {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	var expired []ServerBan
+	kept := db.Bans[:0]
+	for _, ban := range db.Bans {
+		if ban.Expired(now) {
+			expired = append(expired, *ban)
+		} else {
+			kept = append(kept, ban)
+		}
+	}
+	db.Bans = kept
+
+	if len(expired) > 0 {
+		if err := db.saveLocked(); err != nil {
+			log.Printf("Failed to save ban database: %v", err)
+		}
+	}
+	return expired
+}
+
+// banExpiryRoutine removes expired bans and announces them
+func (s *Server) banExpiryRoutine() {
+	ticker := time.NewTicker(banExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			for _, ban := range s.bans.Expire() {
+				s.sendSnomask('x', fmt.Sprintf("%s-line for %s expired (set by %s: %s)", ban.Type, ban.Mask, ban.SetBy, ban.Reason))
+			}
+		}
+	}
+}
+
+// connectionBanned checks a new connection against the Z-lines before any
+// client state is created for it. A banned connection is told why and closed.
+func (s *Server) connectionBanned(conn net.Conn) bool {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	ban := s.bans.Match("", ip, ZLine)
+	if ban == nil {
+		return false
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "ERROR :Closing Link: %s (Z-lined: %s)\r\n", ip, ban.Reason)
+	conn.Close()
+	log.Printf("Rejected Z-lined connection from %s (%s)", ip, ban.Mask)
+	return true
+}
+
+// checkBans is run when a client finishes registration. It returns false
+// after disconnecting a client matched by a K- or G-line.
+func (c *Client) checkBans() bool {
+	ban := c.server.bans.Match(c.User(), c.Host(), KLine, GLine, ZLine)
+	if ban == nil {
+		return true
+	}
+
+	c.SendNumeric(ERR_YOUREBANNEDCREEP, fmt.Sprintf(":You are banned from this server- %s", ban.Reason))
+	c.Quit(fmt.Sprintf("%s-lined: %s", ban.Type, ban.Reason))
+	return false
+}
+
+// enforceBan disconnects every local client matched by a new ban
+func (s *Server) enforceBan(ban *ServerBan) int {
+	count := 0
+	for _, client := range s.GetClients() {
+		if !client.IsRegistered() || !ban.Matches(client.User(), client.Host()) {
+			continue
+		}
+		s.sendSnomask('x', fmt.Sprintf("%s-line active for %s (%s@%s)", ban.Type, client.Nick(), client.User(), client.Host()))
+		client.SendNumeric(ERR_YOUREBANNEDCREEP, fmt.Sprintf(":You are banned from this server- %s", ban.Reason))
+		client.Quit(fmt.Sprintf("%s-lined: %s", ban.Type, ban.Reason))
+		count++
+	}
+	return count
+}
+
+// addBan stores a ban, enforces it and announces it
+func (s *Server) addBan(ban *ServerBan) error {
+	if err := s.bans.Add(ban); err != nil {
+		return err
+	}
+
+	expiry := "permanent"
+	if !ban.Permanent() {
+		expiry = "expires in " + formatDuration(ban.Expires.Sub(ban.SetAt))
+	}
+	s.sendSnomask('x', fmt.Sprintf("%s added %s-line for %s (%s): %s", ban.SetBy, ban.Type, ban.Mask, expiry, ban.Reason))
+	s.enforceBan(ban)
+	return nil
+}
+
+// removeBan deletes a ban and announces it
+func (s *Server) removeBan(banType, mask, by string) (*ServerBan, error) {
+	ban, err := s.bans.Remove(banType, mask)
+	if err != nil {
+		return nil, err
+	}
+	s.sendSnomask('x', fmt.Sprintf("%s removed %s-line for %s", by, banType, ban.Mask))
+	return ban, nil
+}
+
+// banCommands maps the ban commands to the ban type and oper permission they use
+var banCommands = map[string]struct {
+	banType    string
+	permission string
+}{
+	"KLINE": {KLine, "kline"},
+	"GLINE": {GLine, "gline"},
+	"ZLINE": {ZLine, "zline"},
+	"DLINE": {ZLine, "zline"},
+}
+
+// handleServerBan handles KLINE, GLINE, ZLINE and DLINE:
+//
+//	<command> [duration] <mask> [:reason]
+//
+// The duration is a number of minutes or a value such as 1d12h; 0 or no
+// duration makes the ban permanent. KLINE and GLINE also accept a nick, which
+// bans *@host of that user.
+func (c *Client) handleServerBan(msg *Message) {
+	spec := banCommands[msg.Command]
+
+	params := msg.Params
+	var duration time.Duration
+	if len(params) > 1 {
+		if d, ok := parseBanDuration(params[0]); ok {
+			duration = d
+			params = params[1:]
+		}
+	}
+	if len(params) < 1 {
+		c.SendNumeric(ERR_NEEDMOREPARAMS, msg.Command+" :Not enough parameters")
+		return
+	}
+
+	mask, err := c.banMask(spec.banType, params[0])
+	if err != nil {
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** %s: %v", c.server.config.Server.Name, c.Nick(), msg.Command, err))
+		return
+	}
+	reason := "No reason given"
+	if len(params) > 1 && params[1] != "" {
+		reason = params[1]
+	}
+
+	now := time.Now()
+	ban := &ServerBan{Type: spec.banType, Mask: mask, Reason: reason, SetBy: c.Nick(), SetAt: now}
+	if duration > 0 {
+		ban.Expires = now.Add(duration)
+	}
+
+	if err := c.server.addBan(ban); err != nil {
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** %s-line for %s: %v", c.server.config.Server.Name, c.Nick(), ban.Type, mask, err))
+		c.audit(msg.Command, mask, "failed", err.Error())
+		return
+	}
+	c.audit(msg.Command, mask, "ok", fmt.Sprintf("%s, %s", ban.Remaining(), reason))
+	if ban.Type == GLine {
+		c.server.propagateGLine(ban)
+	}
+	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Added %s-line for %s (%s)", c.server.config.Server.Name, c.Nick(), ban.Type, mask, ban.Remaining()))
+}
+
+// banMask normalises the mask given to a ban command
+func (c *Client) banMask(banType, arg string) (string, error) {
+	if banType == ZLine {
+		if strings.Contains(arg, "@") {
+			arg = arg[strings.LastIndex(arg, "@")+1:]
+		}
+		if strings.Contains(arg, "/") {
+			_, network, err := net.ParseCIDR(arg)
+			if err != nil {
+				return "", fmt.Errorf("invalid CIDR mask %s", arg)
+			}
+			if ones, _ := network.Mask.Size(); ones == 0 {
+				return "", fmt.Errorf("mask %s is too wide", arg)
+			}
+			return network.String(), nil
+		}
+		if net.ParseIP(arg) != nil {
+			return arg, nil
+		}
+		// A wildcard mask may only contain address characters, and must
+		// contain more than wildcards and separators
+		if strings.Trim(strings.ToLower(arg), "0123456789abcdef.:*?") != "" || !strings.ContainsAny(arg, "*?") {
+			return "", fmt.Errorf("%s is not an IP address or CIDR mask", arg)
+		}
+		if strings.Trim(arg, "*?.:") == "" {
+			return "", fmt.Errorf("mask %s is too wide", arg)
+		}
+		return arg, nil
+	}
+
+	if !strings.Contains(arg, "@") {
+		target := c.server.GetClient(arg)
+		if target == nil {
+			return "", fmt.Errorf("no such nick %s; use a user@host mask", arg)
+		}
+		return "*@" + target.Host(), nil
+	}
+	if strings.Trim(arg, "*?@.") == "" {
+		return "", fmt.Errorf("mask %s is too wide", arg)
+	}
+	return arg, nil
+}
+
+// handleServerUnban handles UNKLINE, UNGLINE, UNZLINE and UNDLINE
+func (c *Client) handleServerUnban(msg *Message) {
+	command := strings.TrimPrefix(msg.Command, "UN")
+	spec := banCommands[command]
+
+	mask := msg.Params[0]
+	if spec.banType == ZLine && strings.Contains(mask, "/") {
+		if _, network, err := net.ParseCIDR(mask); err == nil {
+			mask = network.String()
+		}
+	}
+
+	if _, err := c.server.removeBan(spec.banType, mask, c.Nick()); err != nil {
+		c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** No %s-line for %s", c.server.config.Server.Name, c.Nick(), spec.banType, mask))
+		c.audit(msg.Command, mask, "failed", "no such ban")
+		return
+	}
+	c.audit(msg.Command, mask, "ok", "")
+	if spec.banType == GLine {
+		c.server.forward(nil, fmt.Sprintf(":%s UNGLINE %s", c.server.sid, mask))
+	}
+	c.SendMessage(fmt.Sprintf(":%s NOTICE %s :*** Removed %s-line for %s", c.server.config.Server.Name, c.Nick(), spec.banType, mask))
+}
+
+// sendBanStats lists the bans of a type for STATS
+func (c *Client) sendBanStats(banType string) {
+	for _, ban := range c.server.bans.List(banType) {
+		switch banType {
+		case KLine:
+			user, host := "*", ban.Mask
+			if at := strings.LastIndex(ban.Mask, "@"); at >= 0 {
+				user, host = ban.Mask[:at], ban.Mask[at+1:]
+			}
+			c.SendNumeric(RPL_STATSKLINE, fmt.Sprintf("K %s * %s :%s (%s, set by %s)", host, user, ban.Reason, ban.Remaining(), ban.SetBy))
+		case GLine:
+			c.SendNumeric(RPL_STATSGLINE, fmt.Sprintf("G %s %s %s :%s (%s)", ban.Mask, ban.Remaining(), ban.SetBy, ban.Reason, ban.SetAt.Format(time.RFC3339)))
+		case ZLine:
+			c.SendNumeric(RPL_STATSZLINE, fmt.Sprintf("Z %s :%s (%s, set by %s)", ban.Mask, ban.Reason, ban.Remaining(), ban.SetBy))
+		}
+	}
+}
+
+// propagateGLine sends a G-line to the rest of the network
+func (s *Server) propagateGLine(ban *ServerBan) {
+	s.forward(nil, s.glineLine(ban))
+}
+
+// glineLine encodes a G-line for a server link. The duration is sent as the
+// seconds left, so linked servers need not agree on the time.
+func (s *Server) glineLine(ban *ServerBan) string {
+	remaining := int64(0)
+	if !ban.Permanent() {
+		remaining = int64(time.Until(ban.Expires).Seconds())
+		if remaining < 1 {
+			remaining = 1
+		}
+	}
+	return fmt.Sprintf(":%s GLINE %s %d %s :%s", s.sid, ban.Mask, remaining, ban.SetBy, ban.Reason)
+}
+
+// handleGLine - :<source> GLINE <mask> <seconds> <setter> :<reason>
+func (l *Link) handleGLine(msg *Message) {
+	if len(msg.Params) < 4 {
+		return
+	}
+	s := l.server
+	seconds, err := strconv.ParseInt(msg.Params[1], 10, 64)
+	if err != nil || seconds < 0 {
+		return
+	}
+
+	now := time.Now()
+	ban := &ServerBan{Type: GLine, Mask: msg.Params[0], Reason: msg.Params[3], SetBy: msg.Params[2], SetAt: now}
+	if seconds > 0 {
+		ban.Expires = now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	// A G-line we already have has already been forwarded
+	if s.addBan(ban) == nil {
+		s.forward(l, msg.String())
+	}
+}
+
+// handleUnGLine - :<source> UNGLINE <mask>
+func (l *Link) handleUnGLine(msg *Message) {
+	if len(msg.Params) < 1 {
+		return
+	}
+	s := l.server
+	if _, err := s.removeBan(GLine, msg.Params[0], s.sourceNick(msg.Source)); err == nil {
+		s.forward(l, msg.String())
+	}
+}
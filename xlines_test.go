@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBanDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"30", 30 * time.Minute, true},
+		{"1w2d3h4m5s", 9*24*time.Hour + 3*time.Hour + 4*time.Minute + 5*time.Second, true},
+		{"2H", 2 * time.Hour, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"1x", 0, false},
+		{"1h30", 0, false},
+		{"h", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseBanDuration(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseBanDuration(%q) = %v, %v", tt.in, got, ok)
+		}
+	}
+}
+
+func TestServerBanMatches(t *testing.T) {
+	tests := []struct {
+		banType, mask, user, ip string
+		want                    bool
+	}{
+		{KLine, "*@192.0.2.1", "alice", "192.0.2.1", true},
+		{KLine, "bob@192.0.2.*", "~bob", "192.0.2.7", true},
+		{KLine, "bob@192.0.2.*", "alice", "192.0.2.7", false},
+		{GLine, "*@192.0.2.0/24", "alice", "192.0.2.200", true},
+		{GLine, "*@192.0.2.0/24", "alice", "192.0.3.1", false},
+		{ZLine, "192.0.2.1", "", "192.0.2.1", true},
+		{ZLine, "192.0.2.0/24", "", "192.0.2.99", true},
+		{ZLine, "192.0.2.0/24", "", "198.51.100.1", false},
+		{ZLine, "2001:db8::/32", "", "2001:db8:1::1", true},
+		{ZLine, "2001:db8::1", "", "2001:0db8:0:0:0:0:0:1", true},
+		{ZLine, "2001:db8::/32", "", "2001:db9::1", false},
+		{ZLine, "10.*", "", "10.1.2.3", true},
+	}
+	for _, tt := range tests {
+		ban := &ServerBan{Type: tt.banType, Mask: tt.mask}
+		if got := ban.Matches(tt.user, tt.ip); got != tt.want {
+			t.Errorf("%s-line %s matching %s@%s = %v", tt.banType, tt.mask, tt.user, tt.ip, got)
+		}
+	}
+}
+
+func TestBanMaskZLine(t *testing.T) {
+	c := &Client{}
+	accepted := map[string]string{
+		"192.0.2.1":         "192.0.2.1",
+		"*@192.0.2.1":       "192.0.2.1",
+		"192.0.2.77/24":     "192.0.2.0/24",
+		"2001:db8::1/32":    "2001:db8::/32",
+		"192.0.2.*":         "192.0.2.*",
+		"2001:db8:*":        "2001:db8:*",
+		"10.0.0.1/8":        "10.0.0.0/8",
+		"*@2001:db8::1/128": "2001:db8::1/128",
+	}
+	for in, want := range accepted {
+		if got, err := c.banMask(ZLine, in); err != nil || got != want {
+			t.Errorf("banMask(Z, %q) = %q, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"*", "*.*.*.*", "?", "::*", "0.0.0.0/0", "::/0", "host.example", "*.example", "192.0.2", "10.0.0.0/33"} {
+		if got, err := c.banMask(ZLine, in); err == nil {
+			t.Errorf("banMask(Z, %q) accepted as %q", in, got)
+		}
+	}
+}
+
+func TestBanDBExpiry(t *testing.T) {
+	db, _ := LoadBanDB(filepath.Join(t.TempDir(), "bans.json"))
+	now := time.Now()
+	db.Add(&ServerBan{Type: KLine, Mask: "*@192.0.2.1", SetAt: now})
+	db.Add(&ServerBan{Type: KLine, Mask: "*@192.0.2.2", SetAt: now, Expires: now.Add(-time.Second)})
+	db.Add(&ServerBan{Type: ZLine, Mask: "192.0.2.3", SetAt: now, Expires: now.Add(time.Hour)})
+
+	if ban := db.Match("alice", "192.0.2.2", KLine); ban != nil {
+		t.Errorf("expired ban matched: %+v", ban)
+	}
+	if ban := db.Match("alice", "192.0.2.3", KLine); ban != nil {
+		t.Errorf("Z-line matched as a K-line: %+v", ban)
+	}
+	if ban := db.Match("alice", "192.0.2.3", KLine, ZLine); ban == nil || ban.Type != ZLine {
+		t.Errorf("Match = %+v", ban)
+	}
+	if bans := db.List(KLine); len(bans) != 1 || bans[0].Mask != "*@192.0.2.1" {
+		t.Errorf("List = %+v", bans)
+	}
+
+	// An expired ban can be replaced, an active one cannot
+	if err := db.Add(&ServerBan{Type: ZLine, Mask: "192.0.2.3"}); err != errBanExists {
+		t.Errorf("duplicate Add = %v", err)
+	}
+	expired := db.Expire()
+	if len(expired) != 1 || expired[0].Mask != "*@192.0.2.2" {
+		t.Errorf("Expire = %+v", expired)
+	}
+	if len(db.Expire()) != 0 {
+		t.Error("ban expired twice")
+	}
+}
+
+func TestBanDBPersistence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data", "bans.json")
+	db, err := LoadBanDB(filename)
+	if err != nil {
+		t.Fatalf("LoadBanDB: %v", err)
+	}
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	db.Add(&ServerBan{Type: GLine, Mask: "*@198.51.100.*", Reason: "spam", SetBy: "oper", Expires: expires})
+	db.Add(&ServerBan{Type: ZLine, Mask: "2001:db8::/32", Reason: "abuse", SetBy: "oper"})
+	db.Remove(ZLine, "2001:db8::/32")
+	db.Add(&ServerBan{Type: ZLine, Mask: "203.0.113.0/24", Reason: "abuse", SetBy: "oper"})
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("database not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("database mode = %v", info.Mode().Perm())
+	}
+
+	loaded, err := LoadBanDB(filename)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	glines := loaded.List(GLine)
+	if len(glines) != 1 || glines[0].Reason != "spam" || glines[0].SetBy != "oper" || !glines[0].Expires.Equal(expires) {
+		t.Errorf("reloaded G-lines = %+v", glines)
+	}
+	if zlines := loaded.List(ZLine); len(zlines) != 1 || zlines[0].Mask != "203.0.113.0/24" || !zlines[0].Permanent() {
+		t.Errorf("reloaded Z-lines = %+v", zlines)
+	}
+
+	// A database that cannot be read stops the server from starting
+	// rather than lifting every ban
+	if err := os.WriteFile(filename, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBanDB(filename); err == nil {
+		t.Error("corrupt database loaded")
+	}
+	config := DefaultConfig()
+	config.Bans.DatabaseFile = filename
+	if _, err := NewServer(config); err == nil {
+		t.Error("server started with a corrupt ban database")
+	}
+}